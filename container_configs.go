@@ -1,11 +1,14 @@
 package netrun
 
 import (
+	"fmt"
+	"github.com/ingenierias-lentas/netrun/server"
 	"github.com/opencontainers/runc/libcontainer/configs"
 	_ "github.com/opencontainers/runc/libcontainer/nsenter"
 	unix "golang.org/x/sys/unix"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"net/smtp"
 )
 
 var defaultMountFlags = unix.MS_NOEXEC | unix.MS_NOSUID | unix.MS_NODEV
@@ -203,3 +206,243 @@ func LoadConciergeConfig(filename string) map[interface{}]interface{} {
 	err = yaml.Unmarshal([]byte(string(fileData)), &m)
 	return m
 }
+
+// The TLS settings in the Tls section of a concierge config, e.g.
+//
+//	Tls:
+//	  CertFile: /etc/netrun/node.crt
+//	  KeyFile: /etc/netrun/node.key
+//	  ClientCaFile: /etc/netrun/ca.crt
+//	  RequireClientCert: false
+//	  MapCommonName: false
+//	  ClientCertUsers:
+//	    "CN=node1,O=netrun": node1
+//
+// ok is false when there is no Tls section.
+func ConciergeTlsConfig(config map[interface{}]interface{}) (tlsConfig server.TlsConfig, ok bool) {
+	configTls, ok := config["Tls"].(map[interface{}]interface{})
+	if !ok {
+		return tlsConfig, false
+	}
+	tlsConfig.CertFile, _ = configTls["CertFile"].(string)
+	tlsConfig.KeyFile, _ = configTls["KeyFile"].(string)
+	tlsConfig.ClientCaFile, _ = configTls["ClientCaFile"].(string)
+	tlsConfig.RequireClientCert, _ = configTls["RequireClientCert"].(bool)
+	tlsConfig.MapCommonName, _ = configTls["MapCommonName"].(bool)
+	if users, ok := configTls["ClientCertUsers"].(map[interface{}]interface{}); ok {
+		tlsConfig.ClientCertUsers = map[string]string{}
+		for subject, username := range users {
+			subjectStr, subjectOk := subject.(string)
+			usernameStr, usernameOk := username.(string)
+			if subjectOk && usernameOk {
+				tlsConfig.ClientCertUsers[subjectStr] = usernameStr
+			}
+		}
+	}
+	return tlsConfig, true
+}
+
+// The policy files in the Authorization section of a concierge config, e.g.
+//
+//	Authorization:
+//	  Engine: cel
+//	  Policies:
+//	    - /etc/netrun/policies
+//	    - /etc/netrun/backups.yaml
+//
+// ok is false unless the engine is cel. Other engines, or none, leave the rwx
+// grants to decide.
+func ConciergePolicyPaths(config map[interface{}]interface{}) (paths []string, ok bool) {
+	configAuthz, ok := config["Authorization"].(map[interface{}]interface{})
+	if !ok {
+		return nil, false
+	}
+	if engine, _ := configAuthz["Engine"].(string); engine != "cel" {
+		return nil, false
+	}
+	policies, _ := configAuthz["Policies"].([]interface{})
+	for _, policy := range policies {
+		if path, ok := policy.(string); ok {
+			paths = append(paths, path)
+		}
+	}
+	return paths, true
+}
+
+// The container settings in the Containers section of a concierge config,
+// e.g.
+//
+//	Containers:
+//	  Root: /var/lib/container
+//	  Rootfs: /var/lib/netrun/rootfs
+//
+// Runs get a copy of DefaultContainerConfig with the configured rootfs.
+func ConciergeContainerConfig(config map[interface{}]interface{}) (root string, containerConfig *configs.Config) {
+	root = "/var/lib/container"
+	base := *DefaultContainerConfig
+	if configContainers, ok := config["Containers"].(map[interface{}]interface{}); ok {
+		if configRoot, ok := configContainers["Root"].(string); ok {
+			root = configRoot
+		}
+		if rootfs, ok := configContainers["Rootfs"].(string); ok {
+			base.Rootfs = rootfs
+		}
+	}
+	return root, &base
+}
+
+// The OIDC sign in settings in the Oidc section of a concierge config, e.g.
+//
+//	Oidc:
+//	  Issuer: https://idp.example.com
+//	  ClientId: netrun
+//	  ClientSecret: secret
+//	  RedirectUrl: https://netrun.example.com/access/oidc/callback
+//	  Scopes: [email, profile, groups]
+//	  MatchBy: email
+//	  JitProvisioning: true
+//	  RoleMappings:
+//	    - Claim: groups
+//	      Value: netrun-admins
+//	      Group: site
+//	      Role: admin
+//
+// ok is false when there is no Oidc section.
+func ConciergeOidcConfig(config map[interface{}]interface{}) (oidcConfig server.OidcConfig, ok bool) {
+	configOidc, ok := config["Oidc"].(map[interface{}]interface{})
+	if !ok {
+		return oidcConfig, false
+	}
+	oidcConfig.Issuer, _ = configOidc["Issuer"].(string)
+	oidcConfig.ClientId, _ = configOidc["ClientId"].(string)
+	oidcConfig.ClientSecret, _ = configOidc["ClientSecret"].(string)
+	oidcConfig.RedirectUrl, _ = configOidc["RedirectUrl"].(string)
+	oidcConfig.MatchBy, _ = configOidc["MatchBy"].(string)
+	oidcConfig.JitProvisioning, _ = configOidc["JitProvisioning"].(bool)
+	scopes, _ := configOidc["Scopes"].([]interface{})
+	for _, scope := range scopes {
+		if scopeStr, ok := scope.(string); ok {
+			oidcConfig.Scopes = append(oidcConfig.Scopes, scopeStr)
+		}
+	}
+	roleMappings, _ := configOidc["RoleMappings"].([]interface{})
+	for _, roleMapping := range roleMappings {
+		configMapping, ok := roleMapping.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		var mapping server.OidcRoleMapping
+		mapping.Claim, _ = configMapping["Claim"].(string)
+		mapping.Value, _ = configMapping["Value"].(string)
+		mapping.Group, _ = configMapping["Group"].(string)
+		mapping.Role, _ = configMapping["Role"].(string)
+		oidcConfig.RoleMappings = append(oidcConfig.RoleMappings, mapping)
+	}
+	return oidcConfig, true
+}
+
+type TwoFactorConfig struct {
+	// Empty keeps the default, netrun
+	Issuer           string
+	RequireForAdmins bool
+}
+
+// The two-factor settings in the TwoFactor section of a concierge config,
+// e.g.
+//
+//	TwoFactor:
+//	  Issuer: netrun.example.com
+//	  RequireForAdmins: true
+//
+// Issuer names the site in authenticator apps. With RequireForAdmins, users
+// holding the admin role in any group must enroll in TOTP before they get a
+// session. ok is false when there is no TwoFactor section.
+func ConciergeTwoFactorConfig(config map[interface{}]interface{}) (twoFactorConfig TwoFactorConfig, ok bool) {
+	configTwoFactor, ok := config["TwoFactor"].(map[interface{}]interface{})
+	if !ok {
+		return twoFactorConfig, false
+	}
+	twoFactorConfig.Issuer, _ = configTwoFactor["Issuer"].(string)
+	twoFactorConfig.RequireForAdmins, _ = configTwoFactor["RequireForAdmins"].(bool)
+	return twoFactorConfig, true
+}
+
+type DispatchConfig struct {
+	// Empty keeps the hostname
+	NodeName string
+	// Zero keeps the defaults
+	NodeRunLimit  int
+	GroupRunLimit int
+}
+
+// The dispatcher settings in the Dispatch section of a concierge config, e.g.
+//
+//	Dispatch:
+//	  NodeName: node1
+//	  NodeRunLimit: 8
+//	  GroupRunLimit: 2
+//
+// Every member sharing a database needs its own NodeName, or members start
+// each other's runs. ok is false when there is no Dispatch section.
+func ConciergeDispatchConfig(config map[interface{}]interface{}) (dispatchConfig DispatchConfig, ok bool) {
+	configDispatch, ok := config["Dispatch"].(map[interface{}]interface{})
+	if !ok {
+		return dispatchConfig, false
+	}
+	dispatchConfig.NodeName, _ = configDispatch["NodeName"].(string)
+	dispatchConfig.NodeRunLimit, _ = configDispatch["NodeRunLimit"].(int)
+	dispatchConfig.GroupRunLimit, _ = configDispatch["GroupRunLimit"].(int)
+	return dispatchConfig, true
+}
+
+type MailConfig struct {
+	// Nil leaves mail to the default, which logs who it was for and sends
+	// nothing
+	Mailer               server.Mailer
+	VerificationUrl      string
+	PasswordResetUrl     string
+	RequireVerifiedEmail bool
+}
+
+// The mail settings in the Mail section of a concierge config, e.g.
+//
+//	Mail:
+//	  RequireVerifiedEmail: true
+//	  VerificationUrl: https://netrun.example.com/verify-email
+//	  PasswordResetUrl: https://netrun.example.com/reset-password
+//	  Smtp:
+//	    Host: smtp.example.com
+//	    Port: 587
+//	    From: netrun@example.com
+//	    User: netrun
+//	    Password: secret
+//
+// Without Smtp, LogBodies: true logs whole mails instead, tokens included.
+// It is meant for development only. ok is false when there is no Mail section.
+func ConciergeMailConfig(config map[interface{}]interface{}) (mailConfig MailConfig, ok bool) {
+	configMail, ok := config["Mail"].(map[interface{}]interface{})
+	if !ok {
+		return mailConfig, false
+	}
+	mailConfig.RequireVerifiedEmail, _ = configMail["RequireVerifiedEmail"].(bool)
+	mailConfig.VerificationUrl, _ = configMail["VerificationUrl"].(string)
+	mailConfig.PasswordResetUrl, _ = configMail["PasswordResetUrl"].(string)
+	if configSmtp, ok := configMail["Smtp"].(map[interface{}]interface{}); ok {
+		host, _ := configSmtp["Host"].(string)
+		port, _ := configSmtp["Port"].(int)
+		from, _ := configSmtp["From"].(string)
+		user, _ := configSmtp["User"].(string)
+		password, _ := configSmtp["Password"].(string)
+		smtpMailer := &server.SmtpMailer{
+			Addr: fmt.Sprintf("%s:%d", host, port),
+			From: from,
+		}
+		if user != "" {
+			smtpMailer.Auth = smtp.PlainAuth("", user, password, host)
+		}
+		mailConfig.Mailer = smtpMailer
+	} else if logBodies, _ := configMail["LogBodies"].(bool); logBodies {
+		mailConfig.Mailer = &server.LogMailer{LogBodies: true}
+	}
+	return mailConfig, true
+}
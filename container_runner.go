@@ -0,0 +1,186 @@
+package netrun
+
+import (
+	"fmt"
+	"github.com/ingenierias-lentas/netrun/server"
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	unix "golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Secret files are staged here, on the host's shared memory tmpfs, so they
+// never reach a disk
+const secretsStageRoot = "/dev/shm/netrun-secrets"
+
+const cpuPeriodUs = 100000
+
+// A run in its own container
+type containerRun struct {
+	container  libcontainer.Container
+	process    *libcontainer.Process
+	pid        int
+	secretsDir string
+	done       chan struct{}
+	err        error
+}
+
+func (r *containerRun) Pid() int {
+	return r.pid
+}
+
+func (r *containerRun) Wait() error {
+	<-r.done
+	return r.err
+}
+
+func (r *containerRun) Kill() error {
+	return r.process.Signal(unix.SIGKILL)
+}
+
+// Waits for the run's process, then removes its container and secrets
+func (r *containerRun) reap() {
+	state, err := r.process.Wait()
+	if err == nil && !state.Success() {
+		err = fmt.Errorf("Run exited with %s", state)
+	}
+	r.err = err
+	r.container.Destroy()
+	if r.secretsDir != "" {
+		os.RemoveAll(r.secretsDir)
+	}
+	close(r.done)
+}
+
+// The host id a container id maps to
+func hostId(idMaps []configs.IDMap, containerId int) int {
+	for _, idMap := range idMaps {
+		if containerId >= idMap.ContainerID && containerId < idMap.ContainerID+idMap.Size {
+			return idMap.HostID + containerId - idMap.ContainerID
+		}
+	}
+	return containerId
+}
+
+// Writes a run's secret files to a directory only the run's user can read
+func stageSecretFiles(containerId string, files []server.SecretFile, config *configs.Config) (string, error) {
+	dir := filepath.Join(secretsStageRoot, containerId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	uid := hostId(config.UidMappings, 0)
+	gid := hostId(config.GidMappings, 0)
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name)
+		if err := ioutil.WriteFile(path, file.Data, 0400); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// The base config with a run's own cgroup, limits and secrets. The storage
+// limit is not enforced, the rootfs is shared by every run.
+func runContainerConfig(
+	base *configs.Config,
+	containerId string,
+	runRequest server.RunRequest,
+	secretsDir string,
+) *configs.Config {
+	config := *base
+	cgroup := *base.Cgroups
+	resources := *base.Cgroups.Resources
+	cgroup.Name = containerId
+	cgroup.Resources = &resources
+	config.Cgroups = &cgroup
+	if runRequest.MemoryLimitMb > 0 {
+		resources.Memory = int64(runRequest.MemoryLimitMb) * 1024 * 1024
+	}
+	if runRequest.CpuLimitMillicores > 0 {
+		resources.CpuPeriod = cpuPeriodUs
+		resources.CpuQuota = int64(runRequest.CpuLimitMillicores) * cpuPeriodUs / 1000
+	}
+
+	config.Mounts = append([]*configs.Mount{}, base.Mounts...)
+	if secretsDir != "" {
+		config.Mounts = append(config.Mounts, &configs.Mount{
+			Source:      secretsDir,
+			Destination: server.SecretsMountPath,
+			Device:      "bind",
+			Flags:       unix.MS_BIND | unix.MS_RDONLY | defaultMountFlags,
+		})
+	}
+	return &config
+}
+
+// A process runner that starts every run in a new container made from base
+func NewContainerRunner(factory libcontainer.Factory, base *configs.Config) server.ProcessRunner {
+	return func(runRequest server.RunRequest) (server.RunHandle, error) {
+		var secretsDir string
+		var err error
+
+		containerId := fmt.Sprintf("netrun-%d-%d", runRequest.Rpid, time.Now().UnixNano())
+		if len(runRequest.SecretFiles) > 0 {
+			secretsDir, err = stageSecretFiles(containerId, runRequest.SecretFiles, base)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cleanup := func() {
+			if secretsDir != "" {
+				os.RemoveAll(secretsDir)
+			}
+		}
+
+		config := runContainerConfig(base, containerId, runRequest, secretsDir)
+		container, err := factory.Create(containerId, config)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+
+		process := &libcontainer.Process{
+			Args:   runRequest.Argv,
+			Env:    append([]string{"PATH=/usr/local/bin:/usr/bin:/bin"}, runRequest.Env...),
+			User:   "0:0",
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+			Init:   true,
+		}
+		if err = container.Run(process); err != nil {
+			container.Destroy()
+			cleanup()
+			return nil, err
+		}
+		pid, err := process.Pid()
+		if err != nil {
+			process.Signal(unix.SIGKILL)
+			process.Wait()
+			container.Destroy()
+			cleanup()
+			return nil, err
+		}
+
+		run := &containerRun{
+			container:  container,
+			process:    process,
+			pid:        pid,
+			secretsDir: secretsDir,
+			done:       make(chan struct{}),
+		}
+		go run.reap()
+		return run, nil
+	}
+}
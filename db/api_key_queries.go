@@ -0,0 +1,85 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+)
+
+func GetUserApiKeys(uid int, db *sql.DB, errorChan chan error, apiKeys *[]DbApiKey) {
+	queryStr := `
+		SELECT ak.name, ak.prefix, ak.groups, ak.commands, ak.permissions, ak.revoked,
+		  ak.date_created, ak.date_expires, ak.date_last_used
+		FROM ` +
+		ConciergeTables.ApiKeys + ` ak
+		WHERE ak.uid = $1
+		ORDER BY ak.date_created
+	`
+	res, err := db.Query(queryStr, uid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var apiKey DbApiKey
+		var dateLastUsed sql.NullTime
+		err = res.Scan(
+			&apiKey.Name,
+			&apiKey.Prefix,
+			pq.Array(&apiKey.Groups),
+			pq.Array(&apiKey.Commands),
+			&apiKey.Permissions,
+			&apiKey.Revoked,
+			&apiKey.DateCreated,
+			&apiKey.DateExpires,
+			&dateLastUsed,
+		)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		if dateLastUsed.Valid {
+			apiKey.DateLastUsed = &dateLastUsed.Time
+		}
+		*apiKeys = append(*apiKeys, apiKey)
+	}
+
+	errorChan <- res.Err()
+}
+
+// The owner and scope of a usable key, that is not revoked or expired. Marks
+// the key as used.
+func UseApiKey(
+	keyHash string,
+	db *sql.DB,
+	errorChan chan error,
+	username *string,
+	apiKey *DbApiKey,
+) {
+	queryStr := `
+		UPDATE ` +
+		ConciergeTables.ApiKeys + ` ak
+		SET date_last_used = now()
+		FROM ` + ConciergeTables.Users + ` u
+		WHERE u.uid = ak.uid AND ak.key_hash = $1
+		  AND NOT ak.revoked AND ak.date_expires > now()
+		RETURNING u.username, ak.name, ak.prefix, ak.groups, ak.commands, ak.permissions,
+		  ak.date_created, ak.date_expires
+	`
+	err := db.QueryRow(queryStr, keyHash).Scan(
+		username,
+		&apiKey.Name,
+		&apiKey.Prefix,
+		pq.Array(&apiKey.Groups),
+		pq.Array(&apiKey.Commands),
+		&apiKey.Permissions,
+		&apiKey.DateCreated,
+		&apiKey.DateExpires,
+	)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
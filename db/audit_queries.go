@@ -0,0 +1,96 @@
+package db
+
+import (
+	"database/sql"
+)
+
+const auditColumns = `
+		  al.aid, al.actor, al.action, al.target, al.groupname, al.ip,
+		  al.request_id, al.outcome, al.date_created, al.prev_hash, al.hash`
+
+func scanAuditEntries(res *sql.Rows, entries *[]DbAuditEntry) error {
+	defer res.Close()
+
+	*entries = []DbAuditEntry{}
+	for res.Next() {
+		var entry DbAuditEntry
+		err := res.Scan(
+			&entry.Aid,
+			&entry.Actor,
+			&entry.Action,
+			&entry.Target,
+			&entry.Group,
+			&entry.Ip,
+			&entry.RequestId,
+			&entry.Outcome,
+			&entry.DateCreated,
+			&entry.PrevHash,
+			&entry.Hash,
+		)
+		if err != nil {
+			return err
+		}
+		entry.DateCreated = entry.DateCreated.UTC()
+		*entries = append(*entries, entry)
+	}
+	return res.Err()
+}
+
+// Audit entries matching a filter, newest first
+func GetAuditEntries(filter DbAuditFilter, db *sql.DB, errorChan chan error, entries *[]DbAuditEntry) {
+	queryStr := `
+		SELECT ` + auditColumns + `
+		FROM ` +
+		ConciergeTables.AuditLog + ` al
+		WHERE ($1 = '' OR al.actor = $1)
+		  AND ($2 = '' OR al.action = $2)
+		  AND ($3 = '' OR al.target = $3)
+		  AND ($4 = '' OR al.groupname = $4)
+		  AND ($5 = '' OR al.outcome = $5)
+		  AND ($6 = '' OR al.request_id = $6)
+		  AND ($7::timestamptz IS NULL OR al.date_created >= $7)
+		  AND ($8::timestamptz IS NULL OR al.date_created < $8)
+		  AND ($9 = 0 OR al.aid < $9)
+		ORDER BY al.aid DESC
+		LIMIT $10
+	`
+	res, err := db.Query(
+		queryStr,
+		filter.Actor,
+		filter.Action,
+		filter.Target,
+		filter.Group,
+		filter.Outcome,
+		filter.RequestId,
+		filter.Since,
+		filter.Until,
+		filter.Before,
+		filter.Limit,
+	)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	errorChan <- scanAuditEntries(res, entries)
+}
+
+// Up to limit audit entries after an aid, oldest first, for walking the hash
+// chain
+func GetAuditChain(afterAid int64, limit int, db *sql.DB, errorChan chan error, entries *[]DbAuditEntry) {
+	queryStr := `
+		SELECT ` + auditColumns + `
+		FROM ` +
+		ConciergeTables.AuditLog + ` al
+		WHERE al.aid > $1
+		ORDER BY al.aid
+		LIMIT $2
+	`
+	res, err := db.Query(queryStr, afterAid, limit)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	errorChan <- scanAuditEntries(res, entries)
+}
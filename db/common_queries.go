@@ -247,87 +247,48 @@ func IsRole(
 	errorChan <- nil
 }
 
+// Whether a user has a permission on a process within a group. Grants to the
+// group and every group above it count for the roles the user holds in the
+// group, and their bits are merged, so holding any role with the permission
+// is enough unless a deny grant on the way takes it away. Unknown users,
+// groups and processes have none.
 func HasPermission(
 	username string,
 	groupname string,
-	rolename string,
 	processname string,
 	permissionname string,
 	db *sql.DB,
 	errorChan chan error,
 	hasPermission *bool,
 ) {
-	var gid, rid, rpid int
-	var isRole bool
 	var rwx string
 
-	roleErrorChan := make(chan error)
-	rpidErrorChan := make(chan error)
-	gidErrorChan := make(chan error)
-	ridErrorChan := make(chan error)
-	defer func() {
-		close(roleErrorChan)
-		close(rpidErrorChan)
-		close(gidErrorChan)
-		close(ridErrorChan)
-	}()
-
-	go IsRole(username, groupname, rolename, db, roleErrorChan, &isRole)
-	roleErr := <-roleErrorChan
-	if roleErr != nil {
-		errorChan <- roleErr
-		return
-	}
-
-	go GetGid(groupname, db, gidErrorChan, &gid)
-	go GetRid(rolename, db, ridErrorChan, &rid)
-	go GetRpid(processname, db, rpidErrorChan, &rpid)
-	gidErr, ridErr, rpidErr := <-gidErrorChan, <-ridErrorChan, <-rpidErrorChan
-	if gidErr != nil {
-		errorChan <- gidErr
-		return
-	}
-	if ridErr != nil {
-		errorChan <- ridErr
-		return
-	}
-	if rpidErr != nil {
-		errorChan <- rpidErr
+	*hasPermission = false
+	permissionRegexp, ok := ConciergePermissions[permissionname]
+	if !ok {
+		errorChan <- fmt.Errorf("Unknown permission %s", permissionname)
 		return
 	}
 
 	queryStr := `
-		SELECT rp.rwx
-		FROM ` +
-		ConciergeTables.RegisteredProcesses + ` rp
-		WHERE rp.gid = $1 AND rp.rid = $2 and rp.rpid = $3
+		WITH RECURSIVE ` + GroupAncestorsCte("g.name = $2") + `
+		SELECT ` + effectiveRwx + `
+		FROM ancestors a
+		INNER JOIN ` + ConciergeTables.RegisteredProcessPermissions + ` rpp ON rpp.gid = a.gid
+		INNER JOIN ` + ConciergeTables.RegisteredProcesses + ` rp ON rp.rpid = rpp.rpid
+		INNER JOIN ` + ConciergeTables.Groups + ` g ON g.name = $2
+		INNER JOIN ` + ConciergeTables.GroupUserRoles + ` gur
+		  ON gur.gid = g.gid AND gur.rid = rpp.rid
+		INNER JOIN ` + ConciergeTables.GroupUsers + ` gu
+		  ON gu.gid = gur.gid AND gu.uid = gur.uid
+		INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		WHERE u.username = $1 AND rp.name = $3
 	`
-	res, err := db.Query(queryStr, gid, rid, rpid)
-	if err != nil {
-		*hasPermission = false
+	if err := db.QueryRow(queryStr, username, groupname, processname).Scan(&rwx); err != nil {
 		errorChan <- err
 		return
-	} else if res.Next() {
-		if err = res.Scan(&rwx); err != nil {
-			errorChan <- err
-			return
-		}
-		*hasPermission = MatchPermission(ConciergePermissions[permissionname], rwx)
-		if !(*hasPermission) {
-			permissionErrString := fmt.Sprintf(
-				"User %s with role %s does not have permission %s for process %s in group %s",
-				username, rolename, permissionname, processname, groupname)
-			errorChan <- errors.New(permissionErrString)
-			return
-		}
-	} else {
-		*hasPermission = false
-		errString := fmt.Sprintf(
-			"User %s with role %s does not have permission %s for process %s in group %s",
-			username, rolename, permissionname, processname, groupname)
-		errorChan <- errors.New(errString)
-		return
 	}
 
+	*hasPermission = MatchPermission(permissionRegexp, rwx)
 	errorChan <- nil
 }
@@ -47,6 +47,150 @@ func SetupDb(
 
 	// Drop current db tables
 	var DbWaitGroup sync.WaitGroup
+	DbWaitGroup.Add(1)
+	go DropOidcRoleGrantsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropOidcStatesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropUserIdentitiesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropAuditLogTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropLoginFailuresTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropApiKeysTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropTotpRecoveryCodesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropUserTotpTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropPasswordResetsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropRefreshTokensTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropRevokedTokensTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropSigningKeysTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropRegisteredProcessSecretsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropSecretsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropSchedulesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropRunQueueTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropGroupQuotasTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go DropRegisteredProcessParametersTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
 	DbWaitGroup.Add(1)
 
 	go DropGroupUserRolesTable(ConciergeDb, &DbWaitGroup, errorChan)
@@ -148,6 +292,150 @@ func SetupDb(
 		return nil, err
 	}
 
+	DbWaitGroup.Add(1)
+	go CreateSchedulesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateRunQueueTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateGroupQuotasTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateRegisteredProcessParametersTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateSecretsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateRegisteredProcessSecretsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateSigningKeysTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateRevokedTokensTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateRefreshTokensTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreatePasswordResetsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateUserTotpTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateTotpRecoveryCodesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateApiKeysTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateLoginFailuresTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateAuditLogTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateUserIdentitiesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateOidcStatesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go CreateOidcRoleGrantsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
 	// Insert initial data
 	DbWaitGroup.Add(3)
 	go SeedUsersTable(ConciergeDb, &DbWaitGroup, errorChan)
@@ -201,5 +489,179 @@ func SetupDb(
 		return nil, err
 	}
 
+	DbWaitGroup.Add(1)
+	go SeedSchedulesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedRunQueueTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedGroupQuotasTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedRegisteredProcessParametersTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedSecretsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedRegisteredProcessSecretsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedSigningKeysTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedRevokedTokensTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedRefreshTokensTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedPasswordResetsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedUserTotpTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedTotpRecoveryCodesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedApiKeysTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedLoginFailuresTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedAuditLogTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedUserIdentitiesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedOidcStatesTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	DbWaitGroup.Add(1)
+	go SeedOidcRoleGrantsTable(ConciergeDb, &DbWaitGroup, errorChan)
+	DbWaitGroup.Wait()
+	err = <-errorChan
+	if err != nil {
+		return nil, err
+	}
+
+	return ConciergeDb, nil
+}
+
+// Connects to a database SetupDb already created, leaving its tables and
+// rows as they are
+func OpenDb(
+	user string,
+	host string,
+	name string,
+	password string,
+	port int,
+) (*sql.DB, error) {
+	connStr := fmt.Sprintf("user=%s host=%s dbname=%s password=%s port=%d sslmode=%s",
+		user,
+		host,
+		name,
+		password,
+		port,
+		"disable",
+	)
+
+	conciergeDb, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err = conciergeDb.Ping(); err != nil {
+		conciergeDb.Close()
+		return nil, err
+	}
+	ConciergeDb = conciergeDb
 	return ConciergeDb, nil
 }
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"strconv"
+)
+
+// How many groups deep a hierarchy may go, counting the top group as one
+const MaxGroupDepth = 16
+
+// A recursive CTE named ancestors, with columns gid, parent_gid and depth, of
+// the groups matching cond on groups g and every group above them. The group
+// itself has depth 0. Use it after WITH RECURSIVE.
+func GroupAncestorsCte(cond string) string {
+	return `
+		ancestors (gid, parent_gid, depth) AS (
+		  SELECT g.gid, g.parent_gid, 0
+		  FROM ` + ConciergeTables.Groups + ` g
+		  WHERE ` + cond + `
+		  UNION ALL
+		  SELECT g.gid, g.parent_gid, a.depth + 1
+		  FROM ` + ConciergeTables.Groups + ` g
+		  INNER JOIN ancestors a ON g.gid = a.parent_gid
+		  WHERE a.depth < ` + strconv.Itoa(MaxGroupDepth) + `
+		)`
+}
+
+// A recursive CTE named descendants, with columns gid and depth, of the
+// groups matching cond on groups g and every group below them
+func GroupDescendantsCte(cond string) string {
+	return `
+		descendants (gid, depth) AS (
+		  SELECT g.gid, 0
+		  FROM ` + ConciergeTables.Groups + ` g
+		  WHERE ` + cond + `
+		  UNION ALL
+		  SELECT g.gid, d.depth + 1
+		  FROM ` + ConciergeTables.Groups + ` g
+		  INNER JOIN descendants d ON g.parent_gid = d.gid
+		  WHERE d.depth < ` + strconv.Itoa(MaxGroupDepth) + `
+		)`
+}
+
+// Whether the user holds the role in the group or any group above it
+func IsInheritedRole(
+	username string,
+	groupname string,
+	rolename string,
+	db *sql.DB,
+	errorChan chan error,
+	isRole *bool,
+) {
+	queryStr := `
+		WITH RECURSIVE ` + GroupAncestorsCte("g.name = $2") + `
+		SELECT EXISTS (
+		  SELECT 1
+		  FROM ancestors a
+		  INNER JOIN ` + ConciergeTables.GroupUserRoles + ` gur ON gur.gid = a.gid
+		  INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		  INNER JOIN ` + ConciergeTables.Roles + ` r ON r.rid = gur.rid
+		  WHERE u.username = $1 AND r.name = $3
+		)
+	`
+	if err := db.QueryRow(queryStr, username, groupname, rolename).Scan(isRole); err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+// Members of a group with their roles in it, ordered by username
+func GetGroupMembers(gid int, db *sql.DB, errorChan chan error, members *[]DbGroupMember) {
+	queryStr := `
+		SELECT u.username,
+		       COALESCE(g.owner_uid = u.uid, false),
+		       COALESCE(
+		         array_agg(r.name ORDER BY r.name) FILTER (WHERE r.name IS NOT NULL),
+		         '{}'
+		       )
+		FROM ` +
+		ConciergeTables.GroupUsers + ` gu
+		INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gu.uid
+		INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = gu.gid
+		LEFT JOIN ` + ConciergeTables.GroupUserRoles + ` gur
+		  ON gur.uid = gu.uid AND gur.gid = gu.gid
+		LEFT JOIN ` + ConciergeTables.Roles + ` r ON r.rid = gur.rid
+		WHERE gu.gid = $1
+		GROUP BY u.username, u.uid, g.owner_uid
+		ORDER BY u.username
+	`
+	res, err := db.Query(queryStr, gid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	*members = []DbGroupMember{}
+	for res.Next() {
+		var member DbGroupMember
+		if err = res.Scan(&member.Username, &member.Owner, pq.Array(&member.Roles)); err != nil {
+			errorChan <- err
+			return
+		}
+		*members = append(*members, member)
+	}
+
+	errorChan <- res.Err()
+}
+
+// Counts what still refers to a group besides its members, roles and quota,
+// including its child groups.
+// Finished and failed runs are history and do not count.
+func GetGroupDependencies(gid int, db *sql.DB, errorChan chan error, deps *DbGroupDependencies) {
+	queryStr := `
+		SELECT
+		  (SELECT COUNT(*) FROM ` + ConciergeTables.RegisteredProcessPermissions + ` WHERE gid = $1),
+		  (SELECT COUNT(*) FROM ` + ConciergeTables.Schedules + ` WHERE gid = $1),
+		  (SELECT COUNT(*) FROM ` + ConciergeTables.RunningProcesses + ` WHERE gid = $1),
+		  (SELECT COUNT(*) FROM ` + ConciergeTables.RunQueue + ` WHERE gid = $1 AND status IN ($2, $3)),
+		  (SELECT COUNT(*) FROM ` + ConciergeTables.Secrets + ` WHERE gid = $1),
+		  (SELECT COUNT(*) FROM ` + ConciergeTables.Groups + ` WHERE parent_gid = $1)
+	`
+	err := db.QueryRow(
+		queryStr,
+		gid,
+		ConciergeRunStatuses.Queued,
+		ConciergeRunStatuses.Running,
+	).Scan(
+		&deps.Permissions,
+		&deps.Schedules,
+		&deps.RunningProcesses,
+		&deps.ActiveRuns,
+		&deps.Secrets,
+		&deps.Children,
+	)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+// Signing keys that are not retired, newest first
+func GetSigningKeys(db *sql.DB, errorChan chan error, signingKeys *[]DbSigningKey) {
+	queryStr := `
+		SELECT sk.kid, sk.alg, sk.ciphertext, sk.status, sk.date_created, sk.date_retire
+		FROM ` +
+		ConciergeTables.SigningKeys + ` sk
+		WHERE sk.status <> $1
+		ORDER BY sk.date_created DESC
+	`
+	res, err := db.Query(queryStr, ConciergeKeyStatuses.Retired)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var signingKey DbSigningKey
+		var dateRetire sql.NullTime
+		err = res.Scan(
+			&signingKey.Kid,
+			&signingKey.Alg,
+			&signingKey.Ciphertext,
+			&signingKey.Status,
+			&signingKey.DateCreated,
+			&dateRetire,
+		)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		if dateRetire.Valid {
+			signingKey.DateRetire = &dateRetire.Time
+		}
+		*signingKeys = append(*signingKeys, signingKey)
+	}
+
+	errorChan <- res.Err()
+}
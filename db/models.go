@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"time"
 )
 
 type InitDbGroups struct {
@@ -30,6 +31,210 @@ type DbUser struct {
 
 type DbUsers []DbUser
 
+type DbSchedule struct {
+	Sid           int
+	Name          string
+	CronExpr      string
+	Timezone      string
+	Rpid          int
+	RunnerUid     int
+	Gid           int
+	Enabled       bool
+	MisfirePolicy string
+	LastRun       *time.Time
+	NextRun       time.Time
+	Args          map[string]string
+}
+
+type DbQueuedRun struct {
+	Qid       int
+	Name      string
+	Rpid      int
+	RunnerUid int
+	Gid       int
+	Priority  int
+	Status    string
+	Node      string
+	Args      map[string]string
+}
+
+// A named argument of a registered process. Parameters without a default
+// are required.
+type DbProcessParameter struct {
+	Name    string
+	Type    string
+	Default *string
+	Pattern string
+}
+
+// Resources asked for by a run or held by a group
+type DbResources struct {
+	Containers    int
+	MemoryMb      int
+	CpuMillicores int
+	StorageMb     int
+}
+
+// Nil quota fields are unlimited
+type DbGroupQuota struct {
+	MaxContainers    *int
+	MaxMemoryMb      *int
+	MaxCpuMillicores *int
+	MaxStorageMb     *int
+}
+
+// Bits a role in a group has on a process, and the members holding the role
+type DbPermissionGrant struct {
+	Group string
+	Role  string
+	Rwx   string
+	// The bits are taken away rather than given
+	Deny  bool
+	Users []string
+}
+
+// What a permission check on a process in a group sees for a user
+type DbPermissionExplanation struct {
+	UserFound    bool
+	GroupFound   bool
+	ProcessFound bool
+	Member       bool
+	// Roles the user holds in the group
+	Roles []string
+	// Grants on the process to any role in the group or its ancestors, nearest
+	// group first
+	Grants []DbExplainedGrant
+}
+
+// A grant on a process to a role in the group or one of its ancestors, and
+// whether the user holds the role in the group
+type DbExplainedGrant struct {
+	Group string
+	Role  string
+	Rwx   string
+	Deny  bool
+	Held  bool
+}
+
+// A role and how many group members hold it
+type DbRole struct {
+	Name        string
+	Builtin     bool
+	Assignments int
+}
+
+// A member of a group and the roles they hold in it
+type DbGroupMember struct {
+	Username string
+	Owner    bool
+	Roles    []string
+}
+
+// What still refers to a group and keeps it from being deleted
+type DbGroupDependencies struct {
+	Permissions      int
+	Schedules        int
+	RunningProcesses int
+	ActiveRuns       int
+	Secrets          int
+	Children         int
+}
+
+// Secret metadata, never the value
+type DbSecretInfo struct {
+	Name        string
+	DateCreated time.Time
+	DateUpdated time.Time
+}
+
+// A secret a registered process gets at run time, either in the env var Env
+// or in the file File of the secrets mount
+type DbSecretRef struct {
+	Secret string
+	Env    string
+	File   string
+}
+
+// A JWT signing key, encrypted with the secrets master key
+type DbSigningKey struct {
+	Kid         string
+	Alg         string
+	Ciphertext  []byte
+	Status      string
+	DateCreated time.Time
+	DateRetire  *time.Time
+}
+
+// A personal API key, without its hash. Empty groups or commands mean any.
+type DbApiKey struct {
+	Name         string
+	Prefix       string
+	Groups       []string
+	Commands     []string
+	Permissions  string
+	Revoked      bool
+	DateCreated  time.Time
+	DateExpires  time.Time
+	DateLastUsed *time.Time
+}
+
+// An audit log entry. Hash covers the entry and PrevHash, the hash of the
+// entry before it, so changing or removing one breaks the chain.
+type DbAuditEntry struct {
+	Aid         int64
+	Actor       string
+	Action      string
+	Target      string
+	Group       string
+	Ip          string
+	RequestId   string
+	Outcome     string
+	DateCreated time.Time
+	PrevHash    string
+	Hash        string
+}
+
+// Narrows down audit entries. Empty fields match anything, and Before pages
+// back from an aid.
+type DbAuditFilter struct {
+	Actor     string
+	Action    string
+	Target    string
+	Group     string
+	Outcome   string
+	RequestId string
+	Since     *time.Time
+	Until     *time.Time
+	Before    int64
+	Limit     int
+}
+
+type InitDbKeyStatuses struct {
+	Active  string
+	Verify  string
+	Retired string
+}
+
+type InitDbParameterTypes struct {
+	String string
+	Int    string
+	Float  string
+	Bool   string
+}
+
+type InitDbRunStatuses struct {
+	Queued   string
+	Running  string
+	Finished string
+	Failed   string
+	Killed   string
+}
+
+type InitDbMisfirePolicies struct {
+	FireOnce string
+	Skip     string
+}
+
 type Tables struct {
 	Users                        string
 	Roles                        string
@@ -39,6 +244,24 @@ type Tables struct {
 	RegisteredProcesses          string
 	RegisteredProcessPermissions string
 	RunningProcesses             string
+	Schedules                    string
+	RunQueue                     string
+	GroupQuotas                  string
+	RegisteredProcessParameters  string
+	Secrets                      string
+	RegisteredProcessSecrets     string
+	SigningKeys                  string
+	RevokedTokens                string
+	RefreshTokens                string
+	PasswordResets               string
+	UserTotp                     string
+	TotpRecoveryCodes            string
+	ApiKeys                      string
+	LoginFailures                string
+	AuditLog                     string
+	UserIdentities               string
+	OidcStates                   string
+	OidcRoleGrants               string
 }
 
 var InitConciergeGroups InitDbGroups
@@ -46,6 +269,10 @@ var InitConciergeRoles InitDbRoles
 var InitUsers []DbUser
 var ConciergePermissions map[string]string
 var ConciergeTables Tables
+var ConciergeMisfirePolicies InitDbMisfirePolicies
+var ConciergeRunStatuses InitDbRunStatuses
+var ConciergeParameterTypes InitDbParameterTypes
+var ConciergeKeyStatuses InitDbKeyStatuses
 
 func SetupModels(
 	env string,
@@ -59,6 +286,29 @@ func SetupModels(
 	InitConciergeRoles = InitDbRoles{
 		User:  "user",
 		Admin: "admin",
+		Pm:    "pm",
+	}
+	ConciergeMisfirePolicies = InitDbMisfirePolicies{
+		FireOnce: "fire_once",
+		Skip:     "skip",
+	}
+	ConciergeRunStatuses = InitDbRunStatuses{
+		Queued:   "queued",
+		Running:  "running",
+		Finished: "finished",
+		Failed:   "failed",
+		Killed:   "killed",
+	}
+	ConciergeParameterTypes = InitDbParameterTypes{
+		String: "string",
+		Int:    "int",
+		Float:  "float",
+		Bool:   "bool",
+	}
+	ConciergeKeyStatuses = InitDbKeyStatuses{
+		Active:  "active",
+		Verify:  "verify",
+		Retired: "retired",
 	}
 	ConciergePermissions = map[string]string{
 		"r":  `1[01]{2}`,
@@ -97,6 +347,24 @@ func SetupModels(
 			RegisteredProcesses:          "test_registered_processes",
 			RegisteredProcessPermissions: "test_registered_process_permissions",
 			RunningProcesses:             "test_running_processes",
+			Schedules:                    "test_schedules",
+			RunQueue:                     "test_run_queue",
+			GroupQuotas:                  "test_group_quotas",
+			RegisteredProcessParameters:  "test_registered_process_parameters",
+			Secrets:                      "test_secrets",
+			RegisteredProcessSecrets:     "test_registered_process_secrets",
+			SigningKeys:                  "test_signing_keys",
+			RevokedTokens:                "test_revoked_tokens",
+			RefreshTokens:                "test_refresh_tokens",
+			PasswordResets:               "test_password_resets",
+			UserTotp:                     "test_user_totp",
+			TotpRecoveryCodes:            "test_totp_recovery_codes",
+			ApiKeys:                      "test_api_keys",
+			LoginFailures:                "test_login_failures",
+			AuditLog:                     "test_audit_log",
+			UserIdentities:               "test_user_identities",
+			OidcStates:                   "test_oidc_states",
+			OidcRoleGrants:               "test_oidc_role_grants",
 		}
 
 		return nil
@@ -121,6 +389,24 @@ func SetupModels(
 			RegisteredProcesses:          "registered_processes",
 			RegisteredProcessPermissions: "registered_process_permissions",
 			RunningProcesses:             "running_processes",
+			Schedules:                    "schedules",
+			RunQueue:                     "run_queue",
+			GroupQuotas:                  "group_quotas",
+			RegisteredProcessParameters:  "registered_process_parameters",
+			Secrets:                      "secrets",
+			RegisteredProcessSecrets:     "registered_process_secrets",
+			SigningKeys:                  "signing_keys",
+			RevokedTokens:                "revoked_tokens",
+			RefreshTokens:                "refresh_tokens",
+			PasswordResets:               "password_resets",
+			UserTotp:                     "user_totp",
+			TotpRecoveryCodes:            "totp_recovery_codes",
+			ApiKeys:                      "api_keys",
+			LoginFailures:                "login_failures",
+			AuditLog:                     "audit_log",
+			UserIdentities:               "user_identities",
+			OidcStates:                   "oidc_states",
+			OidcRoleGrants:               "oidc_role_grants",
 		}
 
 		return nil
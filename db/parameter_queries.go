@@ -0,0 +1,80 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+func GetProcessParameters(
+	rpid int,
+	db *sql.DB,
+	errorChan chan error,
+	parameters *[]DbProcessParameter,
+) {
+	queryStr := `
+		SELECT rpp.name, rpp.type, rpp.default_value, rpp.pattern
+		FROM ` +
+		ConciergeTables.RegisteredProcessParameters + ` rpp
+		WHERE rpp.rpid = $1
+		ORDER BY rpp.name
+	`
+	res, err := db.Query(queryStr, rpid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var parameter DbProcessParameter
+		var defaultValue sql.NullString
+		err = res.Scan(&parameter.Name, &parameter.Type, &defaultValue, &parameter.Pattern)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		if defaultValue.Valid {
+			parameter.Default = &defaultValue.String
+		}
+		*parameters = append(*parameters, parameter)
+	}
+
+	errorChan <- res.Err()
+}
+
+// Argv and environment templates of a registered process
+func GetProcessCommand(
+	rpid int,
+	db *sql.DB,
+	errorChan chan error,
+	argv *[]string,
+	env *[]string,
+) {
+	queryStr := `
+		SELECT rp.run_argv, rp.run_env
+		FROM ` +
+		ConciergeTables.RegisteredProcesses + ` rp
+		WHERE rp.rpid = $1
+	`
+	res, err := db.Query(queryStr, rpid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	if res.Next() {
+		if err = res.Scan(pq.Array(argv), pq.Array(env)); err != nil {
+			errorChan <- err
+			return
+		}
+	} else {
+		errString := fmt.Sprintf("No registered process found for rpid %d", rpid)
+		errorChan <- errors.New(errString)
+		return
+	}
+
+	errorChan <- nil
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+)
+
+// The bits an aggregate over grants rpp leaves: everything allowed, less
+// anything denied
+const effectiveRwx = `
+		COALESCE(bit_or(rpp.rwx) FILTER (WHERE NOT rpp.deny), B'000')
+		  & ~COALESCE(bit_or(rpp.rwx) FILTER (WHERE rpp.deny), B'000')
+`
+
+// Every grant on a process, ordered by group and role
+func GetProcessAcl(rpid int, db *sql.DB, errorChan chan error, acl *[]DbPermissionGrant) {
+	queryStr := `
+		SELECT g.name, r.name, rpp.rwx, rpp.deny,
+		       COALESCE(
+		         array_agg(u.username ORDER BY u.username) FILTER (WHERE u.username IS NOT NULL),
+		         '{}'
+		       )
+		FROM ` +
+		ConciergeTables.RegisteredProcessPermissions + ` rpp
+		INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = rpp.gid
+		INNER JOIN ` + ConciergeTables.Roles + ` r ON r.rid = rpp.rid
+		LEFT JOIN ` + ConciergeTables.GroupUserRoles + ` gur
+		  ON gur.gid = rpp.gid AND gur.rid = rpp.rid
+		LEFT JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		WHERE rpp.rpid = $1
+		GROUP BY g.name, r.name, rpp.rwx, rpp.deny
+		ORDER BY g.name, r.name
+	`
+	res, err := db.Query(queryStr, rpid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	*acl = []DbPermissionGrant{}
+	for res.Next() {
+		var grant DbPermissionGrant
+		if err = res.Scan(&grant.Group, &grant.Role, &grant.Rwx, &grant.Deny, pq.Array(&grant.Users)); err != nil {
+			errorChan <- err
+			return
+		}
+		*acl = append(*acl, grant)
+	}
+
+	errorChan <- res.Err()
+}
+
+// Everything HasPermission looks at for a user, group and process, so a
+// denial can be traced to the check that failed
+func ExplainPermission(
+	username string,
+	groupname string,
+	processname string,
+	db *sql.DB,
+	errorChan chan error,
+	explanation *DbPermissionExplanation,
+) {
+	queryStr := `
+		SELECT
+		  EXISTS (SELECT 1 FROM ` + ConciergeTables.Users + ` WHERE username = $1),
+		  EXISTS (SELECT 1 FROM ` + ConciergeTables.Groups + ` WHERE name = $2),
+		  EXISTS (SELECT 1 FROM ` + ConciergeTables.RegisteredProcesses + ` WHERE name = $3),
+		  EXISTS (
+		    SELECT 1
+		    FROM ` + ConciergeTables.GroupUsers + ` gu
+		    INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gu.uid
+		    INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = gu.gid
+		    WHERE u.username = $1 AND g.name = $2
+		  ),
+		  COALESCE((
+		    SELECT array_agg(r.name ORDER BY r.name)
+		    FROM ` + ConciergeTables.GroupUserRoles + ` gur
+		    INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		    INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = gur.gid
+		    INNER JOIN ` + ConciergeTables.Roles + ` r ON r.rid = gur.rid
+		    WHERE u.username = $1 AND g.name = $2
+		  ), '{}')
+	`
+	err := db.QueryRow(queryStr, username, groupname, processname).Scan(
+		&explanation.UserFound,
+		&explanation.GroupFound,
+		&explanation.ProcessFound,
+		&explanation.Member,
+		pq.Array(&explanation.Roles),
+	)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	queryStr = `
+		WITH RECURSIVE ` + GroupAncestorsCte("g.name = $2") + `
+		SELECT ag.name, r.name, rpp.rwx, rpp.deny,
+		       EXISTS (
+		         SELECT 1
+		         FROM ` + ConciergeTables.GroupUserRoles + ` gur
+		         INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		         INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = gur.gid
+		         WHERE u.username = $1 AND g.name = $2 AND gur.rid = rpp.rid
+		       )
+		FROM ancestors a
+		INNER JOIN ` + ConciergeTables.RegisteredProcessPermissions + ` rpp ON rpp.gid = a.gid
+		INNER JOIN ` + ConciergeTables.RegisteredProcesses + ` rp ON rp.rpid = rpp.rpid
+		INNER JOIN ` + ConciergeTables.Groups + ` ag ON ag.gid = a.gid
+		INNER JOIN ` + ConciergeTables.Roles + ` r ON r.rid = rpp.rid
+		WHERE rp.name = $3
+		ORDER BY a.depth, r.name
+	`
+	res, err := db.Query(queryStr, username, groupname, processname)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	explanation.Grants = []DbExplainedGrant{}
+	for res.Next() {
+		var grant DbExplainedGrant
+		if err = res.Scan(&grant.Group, &grant.Role, &grant.Rwx, &grant.Deny, &grant.Held); err != nil {
+			errorChan <- err
+			return
+		}
+		explanation.Grants = append(explanation.Grants, grant)
+	}
+
+	errorChan <- res.Err()
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+)
+
+// Queued runs of a node, highest priority first and oldest first within a
+// priority
+func GetQueuedRuns(node string, db *sql.DB, errorChan chan error, queuedRuns *[]DbQueuedRun) {
+	queryStr := `
+		SELECT q.qid, q.name, q.rpid, q.runner_uid, q.gid, q.priority, q.status, q.node, q.args
+		FROM ` +
+		ConciergeTables.RunQueue + ` q
+		WHERE q.node = $1 AND q.status = $2
+		ORDER BY q.priority DESC, q.qid ASC
+	`
+	res, err := db.Query(queryStr, node, ConciergeRunStatuses.Queued)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var queuedRun DbQueuedRun
+		var args []byte
+		err = res.Scan(
+			&queuedRun.Qid,
+			&queuedRun.Name,
+			&queuedRun.Rpid,
+			&queuedRun.RunnerUid,
+			&queuedRun.Gid,
+			&queuedRun.Priority,
+			&queuedRun.Status,
+			&queuedRun.Node,
+			&args,
+		)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		if err = json.Unmarshal(args, &queuedRun.Args); err != nil {
+			errorChan <- err
+			return
+		}
+		*queuedRuns = append(*queuedRuns, queuedRun)
+	}
+
+	errorChan <- res.Err()
+}
+
+// Number of running runs of a node
+func GetRunningCount(node string, db *sql.DB, errorChan chan error, runningCount *int) {
+	queryStr := `
+		SELECT COUNT(*)
+		FROM ` +
+		ConciergeTables.RunQueue + ` q
+		WHERE q.node = $1 AND q.status = $2
+	`
+	res, err := db.Query(queryStr, node, ConciergeRunStatuses.Running)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	if res.Next() {
+		if err = res.Scan(runningCount); err != nil {
+			errorChan <- err
+			return
+		}
+	}
+
+	errorChan <- res.Err()
+}
+
+// Fails the runs a node recorded as running, except those named in live, and
+// frees their running process rows. Failed holds the names of the runs.
+func FailRunningRuns(
+	node string,
+	live []string,
+	reason string,
+	db *sql.DB,
+	errorChan chan error,
+	failed *[]string,
+) {
+	queryStr := `
+		WITH orphaned AS (
+		  UPDATE ` + ConciergeTables.RunQueue + `
+		  SET status = $1, error = $2
+		  WHERE node = $3 AND status = $4 AND NOT (name = ANY($5))
+		  RETURNING name
+		), freed AS (
+		  DELETE FROM ` + ConciergeTables.RunningProcesses + `
+		  WHERE name IN (SELECT name FROM orphaned)
+		)
+		SELECT name FROM orphaned
+	`
+	res, err := db.Query(
+		queryStr,
+		ConciergeRunStatuses.Failed,
+		reason,
+		node,
+		ConciergeRunStatuses.Running,
+		pq.Array(live),
+	)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var name string
+		if err = res.Scan(&name); err != nil {
+			errorChan <- err
+			return
+		}
+		*failed = append(*failed, name)
+	}
+
+	errorChan <- res.Err()
+}
+
+// Moves a queued run to running. Claims fail when the run has already left
+// the queue.
+func ClaimQueuedRun(qid int, db Querier, errorChan chan error, claimed *bool) {
+	queryStr := `
+		UPDATE ` +
+		ConciergeTables.RunQueue + `
+		SET status = $1, date_started = now()
+		WHERE qid = $2 AND status = $3
+	`
+	res, err := db.Exec(
+		queryStr,
+		ConciergeRunStatuses.Running,
+		qid,
+		ConciergeRunStatuses.Queued,
+	)
+	if err != nil {
+		*claimed = false
+		errorChan <- err
+		return
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		*claimed = false
+		errorChan <- err
+		return
+	}
+	*claimed = rows == 1
+
+	errorChan <- nil
+}
+
+// Takes a run off the queue before it starts. Cancelling fails when the run
+// has already left the queue.
+func CancelQueuedRun(qid int, reason string, db *sql.DB, errorChan chan error, cancelled *bool) {
+	queryStr := `
+		UPDATE ` +
+		ConciergeTables.RunQueue + `
+		SET status = $1, error = $2
+		WHERE qid = $3 AND status = $4
+	`
+	res, err := db.Exec(
+		queryStr,
+		ConciergeRunStatuses.Killed,
+		reason,
+		qid,
+		ConciergeRunStatuses.Queued,
+	)
+	if err != nil {
+		*cancelled = false
+		errorChan <- err
+		return
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		*cancelled = false
+		errorChan <- err
+		return
+	}
+	*cancelled = rows == 1
+
+	errorChan <- nil
+}
+
+// Looks up a run by name. Position is its 1-based place in its node's queue,
+// or 0 once the run has left the queue.
+func GetRunQueuePosition(
+	runname string,
+	db *sql.DB,
+	errorChan chan error,
+	queuedRun *DbQueuedRun,
+	position *int,
+) {
+	queryStr := `
+		SELECT q.qid, q.name, q.rpid, q.runner_uid, q.gid, q.priority, q.status, q.node,
+		       CASE WHEN q.status = $2 THEN (
+		         SELECT COUNT(*) + 1
+		         FROM ` + ConciergeTables.RunQueue + ` ahead
+		         WHERE ahead.node = q.node AND ahead.status = $2
+		           AND (ahead.priority > q.priority
+		                OR (ahead.priority = q.priority AND ahead.qid < q.qid))
+		       ) ELSE 0 END
+		FROM ` +
+		ConciergeTables.RunQueue + ` q
+		WHERE q.name = $1
+	`
+	res, err := db.Query(queryStr, runname, ConciergeRunStatuses.Queued)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	if res.Next() {
+		err = res.Scan(
+			&queuedRun.Qid,
+			&queuedRun.Name,
+			&queuedRun.Rpid,
+			&queuedRun.RunnerUid,
+			&queuedRun.Gid,
+			&queuedRun.Priority,
+			&queuedRun.Status,
+			&queuedRun.Node,
+			position,
+		)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+	} else {
+		errString := fmt.Sprintf("No queued run found with name %s", runname)
+		errorChan <- errors.New(errString)
+		return
+	}
+
+	errorChan <- nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+// Satisfied by both *sql.DB and *sql.Tx, for queries that also run inside
+// transactions
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Quota of a group. Inside a transaction forUpdate locks the group until the
+// transaction ends, whether it has a quota row or not, so quota checks and
+// run claims of a group happen one at a time across members. Groups without a
+// quota row get an all nil, unlimited quota.
+func GetGroupQuota(gid int, forUpdate bool, db Querier, errorChan chan error, quota *DbGroupQuota) {
+	queryStr := `
+		SELECT gq.max_containers, gq.max_memory_mb, gq.max_cpu_millicores, gq.max_storage_mb
+		FROM ` +
+		ConciergeTables.Groups + ` g
+		LEFT JOIN ` + ConciergeTables.GroupQuotas + ` gq ON gq.gid = g.gid
+		WHERE g.gid = $1
+	`
+	if forUpdate {
+		queryStr += " FOR NO KEY UPDATE OF g"
+	}
+	res, err := db.Query(queryStr, gid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	*quota = DbGroupQuota{}
+	if res.Next() {
+		var maxContainers, maxMemoryMb, maxCpuMillicores, maxStorageMb sql.NullInt64
+		err = res.Scan(&maxContainers, &maxMemoryMb, &maxCpuMillicores, &maxStorageMb)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+		quota.MaxContainers = nullIntPtr(maxContainers)
+		quota.MaxMemoryMb = nullIntPtr(maxMemoryMb)
+		quota.MaxCpuMillicores = nullIntPtr(maxCpuMillicores)
+		quota.MaxStorageMb = nullIntPtr(maxStorageMb)
+	}
+
+	errorChan <- res.Err()
+}
+
+// Resources held by the runs of a group across all members. Containers are
+// the running runs. Memory, cpu and storage also count queued runs, so that a
+// burst of requests cannot be accepted past the quota before any of them
+// start. Runs stop counting once they finish, fail or are killed.
+func GetGroupUsage(gid int, db Querier, errorChan chan error, usage *DbResources) {
+	queryStr := `
+		SELECT COUNT(*) FILTER (WHERE q.status = $3),
+		       COALESCE(SUM(rp.memory_limit_mb), 0),
+		       COALESCE(SUM(rp.cpu_limit_millicores), 0),
+		       COALESCE(SUM(rp.storage_limit_mb), 0)
+		FROM ` +
+		ConciergeTables.RunQueue + ` q
+		INNER JOIN ` + ConciergeTables.RegisteredProcesses + ` rp ON rp.rpid = q.rpid
+		WHERE q.gid = $1 AND q.status IN ($2, $3)
+	`
+	res, err := db.Query(
+		queryStr,
+		gid,
+		ConciergeRunStatuses.Queued,
+		ConciergeRunStatuses.Running,
+	)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	if res.Next() {
+		err = res.Scan(&usage.Containers, &usage.MemoryMb, &usage.CpuMillicores, &usage.StorageMb)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+	}
+
+	errorChan <- res.Err()
+}
+
+// Resources a single run of a registered process asks for
+func GetProcessResources(rpid int, db Querier, errorChan chan error, resources *DbResources) {
+	queryStr := `
+		SELECT rp.memory_limit_mb, rp.cpu_limit_millicores, rp.storage_limit_mb
+		FROM ` +
+		ConciergeTables.RegisteredProcesses + ` rp
+		WHERE rp.rpid = $1
+	`
+	res, err := db.Query(queryStr, rpid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	resources.Containers = 1
+	if res.Next() {
+		err = res.Scan(&resources.MemoryMb, &resources.CpuMillicores, &resources.StorageMb)
+		if err != nil {
+			errorChan <- err
+			return
+		}
+	}
+
+	errorChan <- res.Err()
+}
+
+func nullIntPtr(value sql.NullInt64) *int {
+	if !value.Valid {
+		return nil
+	}
+	intValue := int(value.Int64)
+	return &intValue
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+// A token is revoked when its jti was signed out, or when it was issued no
+// later than the last time its user signed out of all sessions. issuedAt is
+// in microseconds since the epoch.
+func IsTokenRevoked(
+	jti string,
+	username string,
+	issuedAt int64,
+	db *sql.DB,
+	errorChan chan error,
+	revoked *bool,
+) {
+	queryStr := `
+		SELECT
+		  EXISTS (
+		    SELECT 1 FROM ` + ConciergeTables.RevokedTokens + ` rt
+		    WHERE rt.jti = $1
+		  )
+		  OR COALESCE(
+		    u.sessions_revoked_at >= 'epoch'::timestamptz + $3 * interval '1 microsecond',
+		    false
+		  )
+		FROM ` +
+		ConciergeTables.Users + ` u
+		WHERE u.username = $2
+	`
+	err := db.QueryRow(queryStr, jti, username, issuedAt).Scan(revoked)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+)
+
+// Whether code depends on a role by name, so it cannot be renamed or deleted
+func IsBuiltinRole(rolename string) bool {
+	return rolename == InitConciergeRoles.Admin || rolename == InitConciergeRoles.User
+}
+
+// All roles, ordered by name
+func GetRoles(db *sql.DB, errorChan chan error, roles *[]DbRole) {
+	queryStr := `
+		SELECT r.name, COUNT(gur.uid)
+		FROM ` +
+		ConciergeTables.Roles + ` r
+		LEFT JOIN ` + ConciergeTables.GroupUserRoles + ` gur ON gur.rid = r.rid
+		GROUP BY r.rid, r.name
+		ORDER BY r.name
+	`
+	res, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	*roles = []DbRole{}
+	for res.Next() {
+		var role DbRole
+		if err = res.Scan(&role.Name, &role.Assignments); err != nil {
+			errorChan <- err
+			return
+		}
+		role.Builtin = IsBuiltinRole(role.Name)
+		*roles = append(*roles, role)
+	}
+
+	errorChan <- res.Err()
+}
+
+// The roles a member holds in a group, ordered by name. Non-members hold none.
+func GetUserRoles(username string, groupname string, db *sql.DB, errorChan chan error, roles *[]string) {
+	queryStr := `
+		SELECT COALESCE(array_agg(r.name ORDER BY r.name), '{}')
+		FROM ` +
+		ConciergeTables.GroupUserRoles + ` gur
+		INNER JOIN ` + ConciergeTables.GroupUsers + ` gu
+		  ON gu.gid = gur.gid AND gu.uid = gur.uid
+		INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = gur.gid
+		INNER JOIN ` + ConciergeTables.Roles + ` r ON r.rid = gur.rid
+		WHERE u.username = $1 AND g.name = $2
+	`
+	if err := db.QueryRow(queryStr, username, groupname).Scan(pq.Array(roles)); err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
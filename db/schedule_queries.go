@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"time"
+)
+
+const scheduleColumns = `
+		s.sid, s.name, s.cron_expr, s.timezone, s.rpid, s.runner_uid, s.gid,
+		s.enabled, s.misfire_policy, s.last_run, s.next_run, s.args
+	`
+
+func scanSchedules(res *sql.Rows, schedules *[]DbSchedule) error {
+	for res.Next() {
+		var schedule DbSchedule
+		var lastRun sql.NullTime
+		var args []byte
+		err := res.Scan(
+			&schedule.Sid,
+			&schedule.Name,
+			&schedule.CronExpr,
+			&schedule.Timezone,
+			&schedule.Rpid,
+			&schedule.RunnerUid,
+			&schedule.Gid,
+			&schedule.Enabled,
+			&schedule.MisfirePolicy,
+			&lastRun,
+			&schedule.NextRun,
+			&args,
+		)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(args, &schedule.Args); err != nil {
+			return err
+		}
+		if lastRun.Valid {
+			schedule.LastRun = &lastRun.Time
+		}
+		*schedules = append(*schedules, schedule)
+	}
+	return res.Err()
+}
+
+func GetSid(schedulename string, db *sql.DB, errorChan chan error, sid *int) {
+	queryStr := `
+		SELECT s.sid
+		FROM ` +
+		ConciergeTables.Schedules + ` s
+		WHERE s.name = $1
+	`
+	res, err := db.Query(queryStr, schedulename)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+	if res.Next() {
+		if err = res.Scan(sid); err != nil {
+			errorChan <- err
+			return
+		}
+	} else {
+		errString := fmt.Sprintf("No sid found for schedule %s", schedulename)
+		errorChan <- errors.New(errString)
+		return
+	}
+
+	errorChan <- nil
+}
+
+func GetGroupSchedules(gid int, db *sql.DB, errorChan chan error, schedules *[]DbSchedule) {
+	queryStr := `
+		SELECT ` + scheduleColumns + `
+		FROM ` +
+		ConciergeTables.Schedules + ` s
+		WHERE s.gid = $1
+		ORDER BY s.name
+	`
+	res, err := db.Query(queryStr, gid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	errorChan <- scanSchedules(res, schedules)
+}
+
+// Enabled schedules whose next run is at or before now
+func GetDueSchedules(now time.Time, db *sql.DB, errorChan chan error, schedules *[]DbSchedule) {
+	queryStr := `
+		SELECT ` + scheduleColumns + `
+		FROM ` +
+		ConciergeTables.Schedules + ` s
+		WHERE s.enabled AND s.next_run <= $1
+		ORDER BY s.next_run
+	`
+	res, err := db.Query(queryStr, now)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	errorChan <- scanSchedules(res, schedules)
+}
+
+// Moves a schedule from prevNextRun to nextRun. The update only applies while
+// next_run still holds prevNextRun, so when several schedulers share a
+// database exactly one of them claims each due run.
+func ClaimScheduleRun(
+	sid int,
+	prevNextRun time.Time,
+	nextRun time.Time,
+	fired bool,
+	db *sql.DB,
+	errorChan chan error,
+	claimed *bool,
+) {
+	queryStr := `
+		UPDATE ` +
+		ConciergeTables.Schedules + `
+		SET next_run = $1,
+		    last_run = CASE WHEN $2 THEN now() ELSE last_run END
+		WHERE sid = $3 AND next_run = $4
+	`
+	res, err := db.Exec(queryStr, nextRun, fired, sid, prevNextRun)
+	if err != nil {
+		*claimed = false
+		errorChan <- err
+		return
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		*claimed = false
+		errorChan <- err
+		return
+	}
+	*claimed = rows == 1
+
+	errorChan <- nil
+}
+
+// The names of the runner, group and process of a schedule, which
+// permissions are checked against
+func GetScheduleNames(
+	sid int,
+	db *sql.DB,
+	errorChan chan error,
+	runnername *string,
+	groupname *string,
+	processname *string,
+) {
+	queryStr := `
+		SELECT u.username, g.name, rp.name
+		FROM ` +
+		ConciergeTables.Schedules + ` s
+		INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = s.runner_uid
+		INNER JOIN ` + ConciergeTables.Groups + ` g ON g.gid = s.gid
+		INNER JOIN ` + ConciergeTables.RegisteredProcesses + ` rp ON rp.rpid = s.rpid
+		WHERE s.sid = $1
+	`
+	errorChan <- db.QueryRow(queryStr, sid).Scan(runnername, groupname, processname)
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+)
+
+func GetGroupSecrets(gid int, db *sql.DB, errorChan chan error, secrets *[]DbSecretInfo) {
+	queryStr := `
+		SELECT s.name, s.date_created, s.date_updated
+		FROM ` +
+		ConciergeTables.Secrets + ` s
+		WHERE s.gid = $1
+		ORDER BY s.name
+	`
+	res, err := db.Query(queryStr, gid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var secret DbSecretInfo
+		if err = res.Scan(&secret.Name, &secret.DateCreated, &secret.DateUpdated); err != nil {
+			errorChan <- err
+			return
+		}
+		*secrets = append(*secrets, secret)
+	}
+
+	errorChan <- res.Err()
+}
+
+func GetSecretCiphertext(
+	gid int,
+	secretname string,
+	db *sql.DB,
+	errorChan chan error,
+	ciphertext *[]byte,
+) {
+	queryStr := `
+		SELECT s.ciphertext
+		FROM ` +
+		ConciergeTables.Secrets + ` s
+		WHERE s.gid = $1 AND s.name = $2
+	`
+	res, err := db.Query(queryStr, gid, secretname)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	if res.Next() {
+		if err = res.Scan(ciphertext); err != nil {
+			errorChan <- err
+			return
+		}
+	} else {
+		errString := fmt.Sprintf("No secret %s found for gid %d", secretname, gid)
+		errorChan <- errors.New(errString)
+		return
+	}
+
+	errorChan <- nil
+}
+
+func GetProcessSecretRefs(rpid int, db *sql.DB, errorChan chan error, secretRefs *[]DbSecretRef) {
+	queryStr := `
+		SELECT rps.secret, COALESCE(rps.env, ''), COALESCE(rps.file, '')
+		FROM ` +
+		ConciergeTables.RegisteredProcessSecrets + ` rps
+		WHERE rps.rpid = $1
+	`
+	res, err := db.Query(queryStr, rpid)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer res.Close()
+
+	for res.Next() {
+		var secretRef DbSecretRef
+		if err = res.Scan(&secretRef.Secret, &secretRef.Env, &secretRef.File); err != nil {
+			errorChan <- err
+			return
+		}
+		*secretRefs = append(*secretRefs, secretRef)
+	}
+
+	errorChan <- res.Err()
+}
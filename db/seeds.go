@@ -122,22 +122,645 @@ func DropRunningProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan er
 	errorChan <- nil
 }
 
+func DropSchedulesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop schedules table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.Schedules)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropRunQueueTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop run queue table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.RunQueue)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropGroupQuotasTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop group quotas table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.GroupQuotas)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropRegisteredProcessParametersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop registered process parameters table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.RegisteredProcessParameters)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropSecretsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop secrets table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.Secrets)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropRegisteredProcessSecretsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop registered process secrets table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.RegisteredProcessSecrets)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropSigningKeysTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop signing keys table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.SigningKeys)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropRevokedTokensTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop revoked tokens table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.RevokedTokens)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropRefreshTokensTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop refresh tokens table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.RefreshTokens)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropPasswordResetsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop password resets table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.PasswordResets)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropUserTotpTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop user totp table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.UserTotp)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropTotpRecoveryCodesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop totp recovery codes table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.TotpRecoveryCodes)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropApiKeysTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop api keys table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.ApiKeys)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropLoginFailuresTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop login failures table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.LoginFailures)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropAuditLogTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop audit log table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.AuditLog)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropUserIdentitiesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop user identities table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.UserIdentities)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropOidcStatesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop oidc states table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.OidcStates)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func DropOidcRoleGrantsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("drop oidc role grants table")
+
+	queryStr := fmt.Sprintf("DROP TABLE IF EXISTS %s", ConciergeTables.OidcRoleGrants)
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
 func CreateUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create users table")
+	fmt.Println("create users table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.Users +
+		` (
+          uid SERIAL PRIMARY KEY,
+          username VARCHAR(255) UNIQUE,
+          email VARCHAR(255) UNIQUE,
+          email_verified BOOLEAN,
+          date_created TIMESTAMPTZ,
+          last_login TIMESTAMPTZ,
+          sessions_revoked_at TIMESTAMPTZ,
+          password VARCHAR(255) NOT NULL
+        )
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create roles table")
+
+	queryStr := `
+		CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.Roles +
+		` (
+		  rid SERIAL PRIMARY KEY,
+		  name VARCHAR(255) UNIQUE
+		)
+		`
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateGroupsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create groups table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.Groups +
+		` (
+          gid SERIAL PRIMARY KEY,
+          name VARCHAR(255) UNIQUE,
+          owner_uid INT,
+          parent_gid INT REFERENCES ` + ConciergeTables.Groups + ` (gid)
+        )
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateGroupUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create group users table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.GroupUsers +
+		` (
+          uid SERIAL NOT NULL,
+          gid SERIAL NOT NULL,
+          FOREIGN KEY (uid) REFERENCES ` +
+		ConciergeTables.Users +
+		` (uid),
+          FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups +
+		` (gid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateGroupUserRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create group user roles table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.GroupUserRoles +
+		` (
+        uid SERIAL NOT NULL,
+        gid SERIAL NOT NULL,
+        rid SERIAL NOT NULL,
+        FOREIGN KEY (uid) REFERENCES ` +
+		ConciergeTables.Users + ` (uid),
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid),
+        FOREIGN KEY (rid) REFERENCES ` +
+		ConciergeTables.Roles + ` (rid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRegisteredProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create registered processes table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RegisteredProcesses +
+		` (
+          rpid SERIAL PRIMARY KEY,
+          creator_uid SERIAL NOT NULL,
+          name VARCHAR(255) UNIQUE,
+          run_argv TEXT[] NOT NULL,
+          run_env TEXT[] NOT NULL DEFAULT '{}',
+          kill_argv TEXT[] NOT NULL DEFAULT '{}',
+          memory_limit_mb INT NOT NULL DEFAULT 0,
+          cpu_limit_millicores INT NOT NULL DEFAULT 0,
+          storage_limit_mb INT NOT NULL DEFAULT 0,
+          date_created TIMESTAMPTZ,
+          FOREIGN KEY (creator_uid) REFERENCES ` +
+		ConciergeTables.Users + ` (uid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRegisteredProcessPermissionsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create registered process permissions table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RegisteredProcessPermissions +
+		` (
+        rpid SERIAL NOT NULL,
+        gid SERIAL NOT NULL,
+        rid SERIAL NOT NULL,
+        rwx BIT(3),
+        deny BOOLEAN NOT NULL DEFAULT false,
+        UNIQUE (rpid, gid, rid),
+        FOREIGN KEY (rpid) REFERENCES ` +
+		ConciergeTables.RegisteredProcesses + ` (rpid),
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid),
+        FOREIGN KEY (rid) REFERENCES ` +
+		ConciergeTables.Roles + ` (rid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRunningProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create running processes table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RunningProcesses +
+		` (
+        name VARCHAR(255) UNIQUE,
+        pid BIGINT NOT NULL,
+        runner_uid SERIAL NOT NULL,
+        gid SERIAL NOT NULL,
+        rpid SERIAL NOT NULL,
+        FOREIGN KEY (runner_uid) REFERENCES ` +
+		ConciergeTables.Users + ` (uid),
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid),
+        FOREIGN KEY (rpid) REFERENCES ` +
+		ConciergeTables.RegisteredProcesses + ` (rpid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateSchedulesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create schedules table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.Schedules +
+		` (
+        sid SERIAL PRIMARY KEY,
+        name VARCHAR(255) UNIQUE,
+        cron_expr VARCHAR(255) NOT NULL,
+        timezone VARCHAR(255) NOT NULL,
+        rpid SERIAL NOT NULL,
+        runner_uid SERIAL NOT NULL,
+        gid SERIAL NOT NULL,
+        enabled BOOLEAN NOT NULL,
+        misfire_policy VARCHAR(32) NOT NULL,
+        args JSONB NOT NULL DEFAULT '{}',
+        last_run TIMESTAMPTZ,
+        next_run TIMESTAMPTZ NOT NULL,
+        date_created TIMESTAMPTZ,
+        FOREIGN KEY (rpid) REFERENCES ` +
+		ConciergeTables.RegisteredProcesses + ` (rpid),
+        FOREIGN KEY (runner_uid) REFERENCES ` +
+		ConciergeTables.Users + ` (uid),
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRunQueueTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create run queue table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RunQueue +
+		` (
+        qid SERIAL PRIMARY KEY,
+        name VARCHAR(255) UNIQUE,
+        rpid SERIAL NOT NULL,
+        runner_uid SERIAL NOT NULL,
+        gid SERIAL NOT NULL,
+        priority INT NOT NULL,
+        status VARCHAR(32) NOT NULL,
+        node VARCHAR(255) NOT NULL,
+        args JSONB NOT NULL DEFAULT '{}',
+        error TEXT,
+        date_created TIMESTAMPTZ,
+        date_started TIMESTAMPTZ,
+        FOREIGN KEY (rpid) REFERENCES ` +
+		ConciergeTables.RegisteredProcesses + ` (rpid),
+        FOREIGN KEY (runner_uid) REFERENCES ` +
+		ConciergeTables.Users + ` (uid),
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateGroupQuotasTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create group quotas table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.GroupQuotas +
+		` (
+        gid SERIAL PRIMARY KEY,
+        max_containers INT,
+        max_memory_mb INT,
+        max_cpu_millicores INT,
+        max_storage_mb INT,
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRegisteredProcessParametersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create registered process parameters table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RegisteredProcessParameters +
+		` (
+        rpid SERIAL NOT NULL,
+        name VARCHAR(255) NOT NULL,
+        type VARCHAR(32) NOT NULL,
+        default_value TEXT,
+        pattern TEXT NOT NULL DEFAULT '',
+        PRIMARY KEY (rpid, name),
+        FOREIGN KEY (rpid) REFERENCES ` +
+		ConciergeTables.RegisteredProcesses + ` (rpid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateSecretsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create secrets table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.Secrets +
+		` (
+        secid SERIAL PRIMARY KEY,
+        gid SERIAL NOT NULL,
+        name VARCHAR(255) NOT NULL,
+        ciphertext BYTEA NOT NULL,
+        date_created TIMESTAMPTZ,
+        date_updated TIMESTAMPTZ,
+        UNIQUE (gid, name),
+        FOREIGN KEY (gid) REFERENCES ` +
+		ConciergeTables.Groups + ` (gid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateRegisteredProcessSecretsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create registered process secrets table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RegisteredProcessSecrets +
+		` (
+        rpid SERIAL NOT NULL,
+        secret VARCHAR(255) NOT NULL,
+        env VARCHAR(255),
+        file VARCHAR(255),
+        FOREIGN KEY (rpid) REFERENCES ` +
+		ConciergeTables.RegisteredProcesses + ` (rpid)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateSigningKeysTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create signing keys table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.Users +
+		ConciergeTables.SigningKeys +
 		` (
-          uid SERIAL PRIMARY KEY,
-          username VARCHAR(255) UNIQUE,
-          email VARCHAR(255) UNIQUE,
-          email_verified BOOLEAN,
-          date_created TIMESTAMPTZ,
-          last_login TIMESTAMPTZ,
-          password VARCHAR(255) NOT NULL
-        )
+        kid VARCHAR(64) PRIMARY KEY,
+        alg VARCHAR(32) NOT NULL,
+        ciphertext BYTEA NOT NULL,
+        status VARCHAR(32) NOT NULL,
+        date_created TIMESTAMPTZ NOT NULL,
+        date_retire TIMESTAMPTZ,
+        date_retired TIMESTAMPTZ
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS ` +
+		ConciergeTables.SigningKeys + `_active
+        ON ` + ConciergeTables.SigningKeys + ` (status)
+        WHERE status = 'active';
         `
 	_, err := db.Query(queryStr)
 	if err != nil {
@@ -147,18 +770,20 @@ func CreateUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	errorChan <- nil
 }
 
-func CreateRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreateRevokedTokensTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create roles table")
+	fmt.Println("create revoked tokens table")
 
 	queryStr := `
-		CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.Roles +
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.RevokedTokens +
 		` (
-		  rid SERIAL PRIMARY KEY,
-		  name VARCHAR(255) UNIQUE
-		)
-		`
+        jti VARCHAR(64) PRIMARY KEY,
+        uid INT NOT NULL,
+        date_revoked TIMESTAMPTZ NOT NULL,
+        date_expires TIMESTAMPTZ NOT NULL
+        );
+        `
 	_, err := db.Query(queryStr)
 	if err != nil {
 		errorChan <- err
@@ -167,17 +792,23 @@ func CreateRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	errorChan <- nil
 }
 
-func CreateGroupsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreateRefreshTokensTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create groups table")
+	fmt.Println("create refresh tokens table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.Groups +
+		ConciergeTables.RefreshTokens +
 		` (
-          gid SERIAL PRIMARY KEY,
-          name VARCHAR(255) UNIQUE
-        )
+        rtid SERIAL PRIMARY KEY,
+        token_hash VARCHAR(64) UNIQUE NOT NULL,
+        family VARCHAR(64) NOT NULL,
+        uid INT NOT NULL,
+        used BOOLEAN NOT NULL DEFAULT false,
+        revoked BOOLEAN NOT NULL DEFAULT false,
+        date_created TIMESTAMPTZ NOT NULL,
+        date_expires TIMESTAMPTZ NOT NULL
+        );
         `
 	_, err := db.Query(queryStr)
 	if err != nil {
@@ -187,22 +818,20 @@ func CreateGroupsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	errorChan <- nil
 }
 
-func CreateGroupUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreatePasswordResetsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create group users table")
+	fmt.Println("create password resets table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.GroupUsers +
+		ConciergeTables.PasswordResets +
 		` (
-          uid SERIAL NOT NULL,
-          gid SERIAL NOT NULL,
-          FOREIGN KEY (uid) REFERENCES ` +
-		ConciergeTables.Users +
-		` (uid),
-          FOREIGN KEY (gid) REFERENCES ` +
-		ConciergeTables.Groups +
-		` (gid)
+        prid SERIAL PRIMARY KEY,
+        token_hash VARCHAR(64) UNIQUE NOT NULL,
+        uid INT NOT NULL,
+        used BOOLEAN NOT NULL DEFAULT false,
+        date_created TIMESTAMPTZ NOT NULL,
+        date_expires TIMESTAMPTZ NOT NULL
         );
         `
 	_, err := db.Query(queryStr)
@@ -213,23 +842,19 @@ func CreateGroupUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error)
 	errorChan <- nil
 }
 
-func CreateGroupUserRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreateUserTotpTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create group user roles table")
+	fmt.Println("create user totp table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.GroupUserRoles +
+		ConciergeTables.UserTotp +
 		` (
-        uid SERIAL NOT NULL,
-        gid SERIAL NOT NULL,
-        rid SERIAL NOT NULL,
-        FOREIGN KEY (uid) REFERENCES ` +
-		ConciergeTables.Users + ` (uid),
-        FOREIGN KEY (gid) REFERENCES ` +
-		ConciergeTables.Groups + ` (gid),
-        FOREIGN KEY (rid) REFERENCES ` +
-		ConciergeTables.Roles + ` (rid)
+        uid INT PRIMARY KEY,
+        ciphertext BYTEA NOT NULL,
+        enabled BOOLEAN NOT NULL DEFAULT false,
+        last_counter BIGINT NOT NULL DEFAULT 0,
+        date_created TIMESTAMPTZ NOT NULL
         );
         `
 	_, err := db.Query(queryStr)
@@ -240,22 +865,18 @@ func CreateGroupUserRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan er
 	errorChan <- nil
 }
 
-func CreateRegisteredProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreateTotpRecoveryCodesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create registered processes table")
+	fmt.Println("create totp recovery codes table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.RegisteredProcesses +
+		ConciergeTables.TotpRecoveryCodes +
 		` (
-          rpid SERIAL PRIMARY KEY,
-          creator_uid SERIAL NOT NULL,
-          name VARCHAR(255) UNIQUE,
-          run_command VARCHAR(255),
-          kill_command VARCHAR(255),
-          date_created TIMESTAMPTZ,
-          FOREIGN KEY (creator_uid) REFERENCES ` +
-		ConciergeTables.Users + ` (uid)
+        uid INT NOT NULL,
+        code_hash VARCHAR(64) NOT NULL,
+        used BOOLEAN NOT NULL DEFAULT false,
+        PRIMARY KEY (uid, code_hash)
         );
         `
 	_, err := db.Query(queryStr)
@@ -266,24 +887,27 @@ func CreateRegisteredProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan ch
 	errorChan <- nil
 }
 
-func CreateRegisteredProcessPermissionsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreateApiKeysTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create registered process permissions table")
+	fmt.Println("create api keys table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.RegisteredProcessPermissions +
+		ConciergeTables.ApiKeys +
 		` (
-        rpid SERIAL NOT NULL,
-        gid SERIAL NOT NULL,
-        rid SERIAL NOT NULL,
-        rwx BIT(3),
-        FOREIGN KEY (rpid) REFERENCES ` +
-		ConciergeTables.RegisteredProcesses + ` (rpid),
-        FOREIGN KEY (gid) REFERENCES ` +
-		ConciergeTables.Groups + ` (gid),
-        FOREIGN KEY (rid) REFERENCES ` +
-		ConciergeTables.Roles + ` (rid)
+        akid SERIAL PRIMARY KEY,
+        uid INT NOT NULL,
+        name VARCHAR(255) NOT NULL,
+        prefix VARCHAR(16) UNIQUE NOT NULL,
+        key_hash VARCHAR(64) UNIQUE NOT NULL,
+        groups TEXT[] NOT NULL DEFAULT '{}',
+        commands TEXT[] NOT NULL DEFAULT '{}',
+        permissions VARCHAR(3) NOT NULL,
+        revoked BOOLEAN NOT NULL DEFAULT false,
+        date_created TIMESTAMPTZ NOT NULL,
+        date_expires TIMESTAMPTZ NOT NULL,
+        date_last_used TIMESTAMPTZ,
+        UNIQUE (uid, name)
         );
         `
 	_, err := db.Query(queryStr)
@@ -294,25 +918,145 @@ func CreateRegisteredProcessPermissionsTable(db *sql.DB, wg *sync.WaitGroup, err
 	errorChan <- nil
 }
 
-func CreateRunningProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+func CreateLoginFailuresTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
-	fmt.Println("create running processes table")
+	fmt.Println("create login failures table")
 
 	queryStr := `
         CREATE TABLE IF NOT EXISTS ` +
-		ConciergeTables.RunningProcesses +
+		ConciergeTables.LoginFailures +
 		` (
-        name VARCHAR(255) UNIQUE,
-        pid BIGINT NOT NULL,
-        runner_uid SERIAL NOT NULL,
-        gid SERIAL NOT NULL,
-        rpid SERIAL NOT NULL,
-        FOREIGN KEY (runner_uid) REFERENCES ` +
-		ConciergeTables.Users + ` (uid),
-        FOREIGN KEY (gid) REFERENCES ` +
-		ConciergeTables.Groups + ` (gid),
-        FOREIGN KEY (rpid) REFERENCES ` +
-		ConciergeTables.RegisteredProcesses + ` (rpid)
+        kind VARCHAR(16) NOT NULL,
+        key VARCHAR(255) NOT NULL,
+        failures INT NOT NULL,
+        last_failure TIMESTAMPTZ NOT NULL,
+        locked_until TIMESTAMPTZ,
+        PRIMARY KEY (kind, key)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateAuditLogTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create audit log table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.AuditLog +
+		` (
+        aid BIGSERIAL PRIMARY KEY,
+        actor VARCHAR(255) NOT NULL,
+        action VARCHAR(64) NOT NULL,
+        target VARCHAR(255) NOT NULL,
+        groupname VARCHAR(255) NOT NULL DEFAULT '',
+        ip VARCHAR(64) NOT NULL,
+        request_id VARCHAR(64) NOT NULL DEFAULT '',
+        outcome VARCHAR(32) NOT NULL,
+        date_created TIMESTAMPTZ NOT NULL,
+        prev_hash VARCHAR(64) NOT NULL,
+        hash VARCHAR(64) NOT NULL UNIQUE
+        );
+        `
+	_, err := db.Exec(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+
+	// Entries are only ever appended. Dropping the table, as resetting the
+	// database does, still works.
+	queryStr = `
+        CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+        BEGIN
+          RAISE EXCEPTION 'audit log entries cannot be changed or removed';
+        END;
+        $$ LANGUAGE plpgsql;
+        `
+	if _, err = db.Exec(queryStr); err != nil {
+		errorChan <- err
+		return
+	}
+	for _, queryStr = range []string{
+		`DROP TRIGGER IF EXISTS audit_log_no_change ON ` + ConciergeTables.AuditLog,
+		`CREATE TRIGGER audit_log_no_change
+          BEFORE UPDATE OR DELETE ON ` + ConciergeTables.AuditLog + `
+          FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only()`,
+		`DROP TRIGGER IF EXISTS audit_log_no_truncate ON ` + ConciergeTables.AuditLog,
+		`CREATE TRIGGER audit_log_no_truncate
+          BEFORE TRUNCATE ON ` + ConciergeTables.AuditLog + `
+          FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only()`,
+	} {
+		if _, err = db.Exec(queryStr); err != nil {
+			errorChan <- err
+			return
+		}
+	}
+	errorChan <- nil
+}
+
+func CreateUserIdentitiesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create user identities table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.UserIdentities +
+		` (
+        issuer VARCHAR(512) NOT NULL,
+        subject VARCHAR(255) NOT NULL,
+        uid INT NOT NULL,
+        date_created TIMESTAMPTZ NOT NULL,
+        PRIMARY KEY (issuer, subject)
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateOidcStatesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create oidc states table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.OidcStates +
+		` (
+        state VARCHAR(64) PRIMARY KEY,
+        verifier VARCHAR(128) NOT NULL,
+        nonce VARCHAR(64) NOT NULL,
+        date_expires TIMESTAMPTZ NOT NULL
+        );
+        `
+	_, err := db.Query(queryStr)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+func CreateOidcRoleGrantsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("create oidc role grants table")
+
+	queryStr := `
+        CREATE TABLE IF NOT EXISTS ` +
+		ConciergeTables.OidcRoleGrants +
+		` (
+        uid INT NOT NULL,
+        gid INT NOT NULL,
+        rid INT NOT NULL,
+        PRIMARY KEY (uid, gid, rid)
         );
         `
 	_, err := db.Query(queryStr)
@@ -327,7 +1071,8 @@ func SeedUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 	defer wg.Done()
 	fmt.Println("seed users table")
 
-	emailVerified := false
+	// Initial users are configured by the operator, so their emails are trusted
+	emailVerified := true
 	dateCreated := pq.FormatTimestamp(time.Now())
 	lastLogin := pq.FormatTimestamp(time.Now())
 	for i := 0; i < len(InitUsers); i++ {
@@ -389,6 +1134,21 @@ func SeedRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 		errorChan <- err2
 		return
 	}
+
+	queryStr = `
+		INSERT INTO ` +
+		ConciergeTables.Roles +
+		` (name)
+		VALUES ($1)
+		`
+	_, err3 := db.Query(
+		queryStr,
+		InitConciergeRoles.Pm,
+	)
+	if err3 != nil {
+		errorChan <- err3
+		return
+	}
 	errorChan <- nil
 }
 
@@ -471,9 +1231,9 @@ func SeedGroupUsersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
 				}
 			} else {
 				errString := fmt.Sprintf(
-					"No gid found for group %s",
-					InitUsers[i].Name,
+					"No gid found for group %s of user %s",
 					InitUsers[i].Roles[j].Group,
+					InitUsers[i].Name,
 				)
 				errorChan <- errors.New(errString)
 				return
@@ -561,9 +1321,9 @@ func SeedGroupUserRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan erro
 				}
 			} else {
 				errString := fmt.Sprintf(
-					"No gid found for group %s",
-					InitUsers[i].Name,
+					"No gid found for group %s of user %s",
 					role.Group,
+					InitUsers[i].Name,
 				)
 				errorChan <- errors.New(errString)
 				return
@@ -590,9 +1350,9 @@ func SeedGroupUserRolesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan erro
 				}
 			} else {
 				errString := fmt.Sprintf(
-					"No rid found for role %s",
-					InitUsers[i].Name,
+					"No rid found for role %s of user %s",
 					role.Role,
+					InitUsers[i].Name,
 				)
 				errorChan <- errors.New(errString)
 				return
@@ -637,3 +1397,111 @@ func SeedRunningProcessesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan er
 	fmt.Println("seed running processes table")
 	errorChan <- nil
 }
+
+func SeedSchedulesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed schedules table")
+	errorChan <- nil
+}
+
+func SeedRunQueueTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed run queue table")
+	errorChan <- nil
+}
+
+func SeedGroupQuotasTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed group quotas table")
+	errorChan <- nil
+}
+
+func SeedRegisteredProcessParametersTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed registered process parameters table")
+	errorChan <- nil
+}
+
+func SeedSecretsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed secrets table")
+	errorChan <- nil
+}
+
+func SeedRegisteredProcessSecretsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed registered process secrets table")
+	errorChan <- nil
+}
+
+func SeedSigningKeysTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed signing keys table")
+	errorChan <- nil
+}
+
+func SeedRevokedTokensTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed revoked tokens table")
+	errorChan <- nil
+}
+
+func SeedRefreshTokensTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed refresh tokens table")
+	errorChan <- nil
+}
+
+func SeedPasswordResetsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed password resets table")
+	errorChan <- nil
+}
+
+func SeedUserTotpTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed user totp table")
+	errorChan <- nil
+}
+
+func SeedTotpRecoveryCodesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed totp recovery codes table")
+	errorChan <- nil
+}
+
+func SeedApiKeysTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed api keys table")
+	errorChan <- nil
+}
+
+func SeedLoginFailuresTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed login failures table")
+	errorChan <- nil
+}
+
+func SeedAuditLogTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed audit log table")
+	errorChan <- nil
+}
+
+func SeedUserIdentitiesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed user identities table")
+	errorChan <- nil
+}
+
+func SeedOidcStatesTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed oidc states table")
+	errorChan <- nil
+}
+
+func SeedOidcRoleGrantsTable(db *sql.DB, wg *sync.WaitGroup, errorChan chan error) {
+	defer wg.Done()
+	fmt.Println("seed oidc role grants table")
+	errorChan <- nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+)
+
+func GetUserEmail(
+	username string,
+	db *sql.DB,
+	errorChan chan error,
+	email *string,
+	emailVerified *bool,
+) {
+	queryStr := `
+		SELECT u.email, COALESCE(u.email_verified, false)
+		FROM ` +
+		ConciergeTables.Users + ` u
+		WHERE u.username = $1
+	`
+	err := db.QueryRow(queryStr, username).Scan(email, emailVerified)
+	if err == sql.ErrNoRows {
+		errString := fmt.Sprintf("No user found with username %s", username)
+		errorChan <- errors.New(errString)
+		return
+	} else if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+// Whether the user holds the admin role in at least one group
+func IsAdminInAnyGroup(username string, db *sql.DB, errorChan chan error, isAdmin *bool) {
+	queryStr := `
+		SELECT EXISTS (
+		  SELECT 1
+		  FROM ` +
+		ConciergeTables.GroupUserRoles + ` gur
+		  INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gur.uid
+		  INNER JOIN ` + ConciergeTables.Roles + ` r ON r.rid = gur.rid
+		  WHERE u.username = $1 AND r.name = $2
+		)
+	`
+	err := db.QueryRow(queryStr, username, InitConciergeRoles.Admin).Scan(isAdmin)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	errorChan <- nil
+}
+
+// The names of the groups the user is a member of, ordered by name
+func GetUserGroups(username string, db *sql.DB, errorChan chan error, groups *[]string) {
+	queryStr := `
+		SELECT g.name
+		FROM ` +
+		ConciergeTables.Groups + ` g
+		INNER JOIN ` + ConciergeTables.GroupUsers + ` gu ON gu.gid = g.gid
+		INNER JOIN ` + ConciergeTables.Users + ` u ON u.uid = gu.uid
+		WHERE u.username = $1
+		ORDER BY g.name
+	`
+	rows, err := db.Query(queryStr, username)
+	if err != nil {
+		errorChan <- err
+		return
+	}
+	defer rows.Close()
+	*groups = []string{}
+	for rows.Next() {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			errorChan <- err
+			return
+		}
+		*groups = append(*groups, group)
+	}
+	errorChan <- rows.Err()
+}
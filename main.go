@@ -1,13 +1,18 @@
 package netrun
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
 	"github.com/ingenierias-lentas/netrun/server"
 	"github.com/opencontainers/runc/libcontainer"
 	_ "github.com/opencontainers/runc/libcontainer/nsenter"
 	log "github.com/sirupsen/logrus"
+	"go.uber.org/zap"
 	"os"
 	"runtime"
+	"time"
 )
 
 func init() {
@@ -22,6 +27,73 @@ func init() {
 	}
 }
 
+// Connects to the database and sets up what the server and its background
+// loops need from the config. Reset recreates and seeds the database.
+func setupConcierge(config map[interface{}]interface{}) error {
+	var sqlDb *sql.DB
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	server.SetLogger(logger)
+
+	configDb := config["Db"].(map[interface{}]interface{})
+	configSiteAdmin := config["Site"].(map[interface{}]interface{})["Admin"].(map[interface{}]interface{})
+	err = conciergedb.SetupModels(
+		config["Env"].(string),
+		configSiteAdmin["User"].(string),
+		configSiteAdmin["Email"].(string),
+		configSiteAdmin["Password"].(string),
+	)
+	if err != nil {
+		return err
+	}
+
+	if reset, _ := config["Reset"].(bool); reset {
+		sqlDb, err = conciergedb.SetupDb(
+			configDb["User"].(string),
+			configDb["Host"].(string),
+			configDb["Name"].(string),
+			configDb["Password"].(string),
+			configDb["Port"].(int),
+			true,
+		)
+	} else {
+		sqlDb, err = conciergedb.OpenDb(
+			configDb["User"].(string),
+			configDb["Host"].(string),
+			configDb["Name"].(string),
+			configDb["Password"].(string),
+			configDb["Port"].(int),
+		)
+	}
+	if err != nil {
+		return err
+	}
+	server.SetDb(sqlDb)
+	server.SetJwtSecret([]byte(config["JwtSecret"].(string)))
+
+	// Secrets and signing keys are encrypted with it
+	if secretsKey, ok := config["SecretsKey"].(string); ok {
+		err = server.SetSecretsKey([]byte(secretsKey))
+	} else if secretsKeyFile, ok := config["SecretsKeyFile"].(string); ok {
+		err = server.LoadSecretsKeyFile(secretsKeyFile)
+	} else {
+		err = errors.New("SecretsKey or SecretsKeyFile is needed to encrypt secrets")
+	}
+	if err != nil {
+		return err
+	}
+
+	// HS256, RS256 or EdDSA. Keys made by later rotations use it, the active
+	// key keeps its own until it is rotated out
+	if signingAlg, ok := config["SigningAlgorithm"].(string); ok {
+		return server.SetSigningAlgorithm(signingAlg)
+	}
+	return nil
+}
+
 /* Ways to interact with a running container
 // return all the pids for all processes running inside the container
 processes, err := container.Processes()
@@ -51,7 +123,76 @@ state, err := container.State()
 func main() {
 	portString := ":8021"
 	fmt.Printf("Initializing server at port %s\n", portString)
+	// The background loops and most routes need the database
+	if _, err := os.Stat("concierge_config.yaml"); err != nil {
+		log.Fatal("concierge_config.yaml is needed to set up the server: ", err)
+	}
+	config := LoadConciergeConfig("concierge_config.yaml")
+	if err := setupConcierge(config); err != nil {
+		log.Fatal(err)
+	}
+	if tlsConfig, ok := ConciergeTlsConfig(config); ok {
+		if err := server.SetTlsConfig(tlsConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if mailConfig, ok := ConciergeMailConfig(config); ok {
+		if mailConfig.Mailer != nil {
+			server.SetMailer(mailConfig.Mailer)
+		}
+		server.SetEmailVerificationUrl(mailConfig.VerificationUrl)
+		server.SetPasswordResetUrl(mailConfig.PasswordResetUrl)
+		server.SetRequireVerifiedEmail(mailConfig.RequireVerifiedEmail)
+	}
+	if oidcConfig, ok := ConciergeOidcConfig(config); ok {
+		if err := server.SetOidcConfig(oidcConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if twoFactorConfig, ok := ConciergeTwoFactorConfig(config); ok {
+		if twoFactorConfig.Issuer != "" {
+			server.SetTotpIssuer(twoFactorConfig.Issuer)
+		}
+		server.SetRequireAdminTwoFactor(twoFactorConfig.RequireForAdmins)
+	}
+	if policyPaths, ok := ConciergePolicyPaths(config); ok {
+		policyAuthorizer, err := server.NewPolicyAuthorizer(policyPaths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.SetAuthorizer(policyAuthorizer)
+		go policyAuthorizer.RunReload(time.Minute, nil)
+	}
+	if dispatchConfig, ok := ConciergeDispatchConfig(config); ok {
+		if dispatchConfig.NodeName != "" {
+			server.SetNodeName(dispatchConfig.NodeName)
+		}
+		if dispatchConfig.NodeRunLimit > 0 {
+			server.SetNodeRunLimit(dispatchConfig.NodeRunLimit)
+		}
+		if dispatchConfig.GroupRunLimit > 0 {
+			server.SetGroupRunLimit(dispatchConfig.GroupRunLimit)
+		}
+	}
+	containerRoot, containerConfig := ConciergeContainerConfig(config)
+	factory, err := libcontainer.New(
+		containerRoot,
+		libcontainer.Cgroupfs,
+		libcontainer.InitArgs(os.Args[0], "init"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.SetProcessRunner(NewContainerRunner(factory, containerConfig))
+	if err = server.ReconcileRuns(); err != nil {
+		log.Fatal(err)
+	}
 	router := server.InitServer()
+	go server.RunScheduler(15*time.Second, nil)
+	go server.RunDispatcher(5*time.Second, nil)
+	go server.RunKeyRotation(time.Minute, 0, nil)
+	go server.RunRevocationGc(time.Hour, nil)
+	go server.RunCertReload(time.Minute, nil)
 	server.RunServer(portString, router)
 	/*
 		fmt.Printf("Running container for netrun-test\n")
@@ -2,20 +2,43 @@ package netrun
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	conciergedb "github.com/ingenierias-lentas/netrun/db"
 	"github.com/ingenierias-lentas/netrun/server"
+	"github.com/pquerna/otp/totp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"gopkg.in/square/go-jose.v2"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var srv *gin.Engine
@@ -25,6 +48,37 @@ var configDb map[interface{}]interface{}
 var configSite map[interface{}]interface{}
 var configSiteAdmin map[interface{}]interface{}
 var logger *zap.Logger
+var mailbox = &testMailer{}
+
+// Keeps sent mail so tests can follow the links in it
+type testMailer struct {
+	mu   sync.Mutex
+	sent []testMail
+}
+
+type testMail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m *testMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, testMail{to, subject, body})
+	return nil
+}
+
+func (m *testMailer) last(to string) (testMail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+	return testMail{}, false
+}
 
 func TestMain(m *testing.M) {
 	// call flag.Parse() here if TestMain uses flags
@@ -75,7 +129,30 @@ func TestMain(m *testing.M) {
 
 	server.SetLogger(logger)
 	server.SetJwtSecret([]byte(config["JwtSecret"].(string)))
+	var secretsErr error
+	if secretsKey, ok := config["SecretsKey"].(string); ok {
+		secretsErr = server.SetSecretsKey([]byte(secretsKey))
+	} else if secretsKeyFile, ok := config["SecretsKeyFile"].(string); ok {
+		secretsErr = server.LoadSecretsKeyFile(secretsKeyFile)
+	} else {
+		// Signing keys are encrypted with the secrets key, so tests always need one
+		secretsKey := make([]byte, 32)
+		if _, secretsErr = rand.Read(secretsKey); secretsErr == nil {
+			secretsErr = server.SetSecretsKey(secretsKey)
+		}
+	}
+	if secretsErr != nil {
+		logger.Error("Error setting up secrets key", zap.String("error", secretsErr.Error()))
+	}
 	server.SetDb(db)
+	server.SetMailer(mailbox)
+	server.SetRequireVerifiedEmail(true)
+	// No delays between attempts, so tests can retry right after a failure
+	server.SetLoginThrottlePolicy(server.LoginThrottlePolicy{
+		MaxUserFailures: 3,
+		MaxIpFailures:   50,
+		Lockout:         time.Minute,
+	})
 	srv = server.InitServer()
 
 	os.Exit(m.Run())
@@ -223,6 +300,72 @@ func TestCommonQueries(t *testing.T) {
 	}
 }
 
+func TestRenderCommand(t *testing.T) {
+	logger.Info("===Testing run command rendering===")
+
+	defaultCount := "3"
+	parameters := []conciergedb.DbProcessParameter{
+		{Name: "target", Type: conciergedb.ConciergeParameterTypes.String, Pattern: `[a-z0-9./-]+`},
+		{Name: "count", Type: conciergedb.ConciergeParameterTypes.Int, Default: &defaultCount},
+		{Name: "note", Type: conciergedb.ConciergeParameterTypes.String},
+	}
+	argv := []string{"/bin/backup", "--target={{target}}", "-n", "{{ count }}", "{{note}}"}
+	env := []string{"BACKUP_NOTE={{note}}"}
+
+	tests := []struct {
+		name     string
+		args     map[string]string
+		wantArgv []string
+		wantEnv  []string
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			args:     map[string]string{"target": "db1", "note": "nightly"},
+			wantArgv: []string{"/bin/backup", "--target=db1", "-n", "3", "nightly"},
+			wantEnv:  []string{"BACKUP_NOTE=nightly"},
+		},
+		{
+			name:     "shell metacharacters stay in one argument",
+			args:     map[string]string{"target": "db1", "count": "1", "note": "x; rm -rf / {{target}}"},
+			wantArgv: []string{"/bin/backup", "--target=db1", "-n", "1", "x; rm -rf / {{target}}"},
+			wantEnv:  []string{"BACKUP_NOTE=x; rm -rf / {{target}}"},
+		},
+		{name: "missing required", args: map[string]string{"target": "db1"}, wantErr: true},
+		{name: "pattern mismatch", args: map[string]string{"target": "db1 db2", "note": ""}, wantErr: true},
+		{name: "wrong type", args: map[string]string{"target": "db1", "count": "many", "note": ""}, wantErr: true},
+		{name: "unknown argument", args: map[string]string{"target": "db1", "note": "", "extra": "1"}, wantErr: true},
+	}
+
+	if err := server.ValidateCommandTemplate(argv, env, parameters); err != nil {
+		t.Fatalf("ValidateCommandTemplate() = %v ; want nil", err)
+	}
+	if err := server.ValidateCommandTemplate([]string{"{{undeclared}}"}, nil, parameters); err == nil {
+		t.Errorf("ValidateCommandTemplate() with undeclared parameter = nil ; want error")
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotArgv, gotEnv, err := server.RenderCommand(argv, env, parameters, tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("RenderCommand() = %v ; want error", gotArgv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RenderCommand() error = %v", err)
+			}
+			if !reflect.DeepEqual(gotArgv, tt.wantArgv) {
+				t.Errorf("RenderCommand() argv = %q ; want %q", gotArgv, tt.wantArgv)
+			}
+			if !reflect.DeepEqual(gotEnv, tt.wantEnv) {
+				t.Errorf("RenderCommand() env = %q ; want %q", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
 func TestPingRoute(t *testing.T) {
 	logger.Info("===Testing ping route===")
 
@@ -295,15 +438,118 @@ func TestRoutes(t *testing.T) {
 			t.Errorf("Error decoding signin response")
 		}
 
+		// The token is on its own line in the verification mail
+		mail, ok := mailbox.last(email)
+		if !ok {
+			t.Errorf("No verification mail sent to %s", email)
+		}
+		verifyToken := ""
+		for _, line := range strings.Split(mail.Body, "\n") {
+			if strings.Count(line, ".") == 2 && !strings.Contains(line, " ") {
+				verifyToken = line
+			}
+		}
+		verifyBody, err := json.Marshal(map[string]string{"token": verifyToken})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/verify-email", bytes.NewBuffer(verifyBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 {
+			logger.Error(
+				"Incorrect response from /access/verify-email",
+				zap.String("body", w.Body.String()),
+			)
+			t.Errorf("/access/verify-email response = %d ; want 200", w.Code)
+		}
+
+		// Verification tokens are not access tokens
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/signout", bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+verifyToken)
+		srv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("/access/signout with a verification token response = %d ; want 401", w.Code)
+		}
+
+		// Sign out of a second session, keeping the first for the other routes
+		var signoutRes server.SigninRes
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		err = json.Unmarshal(w.Body.Bytes(), &signoutRes)
+		if err != nil {
+			t.Errorf("Error decoding signin response")
+		}
+
+		signoutBody, err := json.Marshal(map[string]string{"user": user})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
 		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("POST", "/access/signout", nil)
+		req, _ = http.NewRequest("POST", "/access/signout", bytes.NewBuffer(signoutBody))
+		req.Header.Set("authorization", "Bearer "+signoutRes.AccessToken)
 		srv.ServeHTTP(w, req)
 		if w.Code != 200 {
 			logger.Error(
 				"Incorrect response from /access/signout",
 				zap.String("body", w.Body.String()),
 			)
-			t.Errorf("/access/signin response = %d ; want 200", w.Code)
+			t.Errorf("/access/signout response = %d ; want 200", w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/signout", bytes.NewBuffer(signoutBody))
+		req.Header.Set("authorization", "Bearer "+signoutRes.AccessToken)
+		srv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("/access/signout with a revoked token response = %d ; want 401", w.Code)
+		}
+
+		// Refresh tokens are single use, and replaying one revokes its family
+		var refreshRes server.SigninRes
+		refreshBody, err := json.Marshal(map[string]string{
+			"user":         user,
+			"refreshtoken": signinRes.RefreshToken,
+		})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/refresh", bytes.NewBuffer(refreshBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 {
+			logger.Error(
+				"Incorrect response from /access/refresh",
+				zap.String("body", w.Body.String()),
+			)
+			t.Errorf("/access/refresh response = %d ; want 200", w.Code)
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &refreshRes)
+		if err != nil {
+			t.Errorf("Error decoding refresh response")
+		}
+
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/refresh", bytes.NewBuffer(refreshBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("/access/refresh with a used token response = %d ; want 401", w.Code)
+		}
+
+		refreshBody, err = json.Marshal(map[string]string{
+			"user":         user,
+			"refreshtoken": refreshRes.RefreshToken,
+		})
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/access/refresh", bytes.NewBuffer(refreshBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("/access/refresh after reuse response = %d ; want 401", w.Code)
 		}
 	})
 
@@ -360,3 +606,3433 @@ func TestRoutes(t *testing.T) {
 		*/
 	})
 }
+
+func TestPasswordReset(t *testing.T) {
+	logger.Info("===Testing password reset===")
+	user := "resettest1"
+	email := "reset@test.com"
+	password := "onetwothreefourfive"
+	newPassword := "sixseveneightnineten"
+
+	post := func(path string, body map[string]string) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("/access/signup", map[string]string{"user": user, "email": email, "password": password})
+	if w.Code != 200 {
+		t.Errorf("/access/signup response = %d ; want 200", w.Code)
+	}
+
+	// An API key made before the reset must not outlive it
+	var keySigninRes server.SigninRes
+	var createRes server.CreateApiKeyRes
+	w = post("/access/signin", map[string]string{"user": user, "password": password})
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &keySigninRes) != nil {
+		t.Fatalf("/access/signin response = %d ; want 200", w.Code)
+	}
+	withKey := func(token string, path string, body map[string]interface{}) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+token)
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	create := map[string]interface{}{"name": "beforereset", "permissions": "r"}
+	w = withKey(keySigninRes.AccessToken, "/access/apikeys/create", create)
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &createRes) != nil {
+		t.Fatalf("/access/apikeys/create response = %d ; want 200", w.Code)
+	}
+	siteBody := map[string]interface{}{"group": conciergedb.InitConciergeGroups.Site}
+	if code := withKey(createRes.ApiKey, "/groups/usage", siteBody).Code; code != 200 {
+		t.Errorf("/groups/usage with an API key before the reset response = %d ; want 200", code)
+	}
+
+	// Unknown and known emails get the same answer
+	unknown := post("/access/forgot-password", map[string]string{"email": "nobody@test.com"})
+	known := post("/access/forgot-password", map[string]string{"email": email})
+	if unknown.Code != known.Code || unknown.Body.String() != known.Body.String() {
+		t.Errorf(
+			"/access/forgot-password responses differ: %d %q ; %d %q",
+			unknown.Code, unknown.Body.String(), known.Code, known.Body.String(),
+		)
+	}
+
+	// The reset mail goes out after the response
+	var mail testMail
+	ok := false
+	for i := 0; i < 50 && !ok; i++ {
+		if mail, ok = mailbox.last(email); !ok || mail.Subject != "Reset your password" {
+			ok = false
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !ok {
+		t.Fatalf("No password reset mail sent to %s", email)
+	}
+	resetToken := ""
+	for _, line := range strings.Split(mail.Body, "\n") {
+		if len(line) == 43 && !strings.Contains(line, " ") {
+			resetToken = line
+		}
+	}
+
+	w = post("/access/reset-password", map[string]string{"token": resetToken, "password": newPassword})
+	if w.Code != 200 {
+		logger.Error(
+			"Incorrect response from /access/reset-password",
+			zap.String("body", w.Body.String()),
+		)
+		t.Errorf("/access/reset-password response = %d ; want 200", w.Code)
+	}
+	w = post("/access/reset-password", map[string]string{"token": resetToken, "password": password})
+	if w.Code != 400 {
+		t.Errorf("/access/reset-password with a used token response = %d ; want 400", w.Code)
+	}
+	if code := withKey(createRes.ApiKey, "/groups/usage", siteBody).Code; code != 401 {
+		t.Errorf("/groups/usage with an API key after the reset response = %d ; want 401", code)
+	}
+
+	w = post("/access/signin", map[string]string{"user": user, "password": password})
+	if w.Code != 401 {
+		t.Errorf("/access/signin with the old password response = %d ; want 401", w.Code)
+	}
+	w = post("/access/signin", map[string]string{"user": user, "password": newPassword})
+	if w.Code != 200 {
+		t.Fatalf("/access/signin with the new password response = %d ; want 200", w.Code)
+	}
+
+	// The reset revoked the sessions before it, not the one signed in right
+	// after it, even within the same second
+	var signinRes server.SigninRes
+	if err := json.Unmarshal(w.Body.Bytes(), &signinRes); err != nil {
+		t.Fatalf("Error decoding signin response")
+	}
+	withToken := func(path string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(nil))
+		req.Header.Set("authorization", "Bearer "+signinRes.AccessToken)
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := withToken("/access/apikeys/list"); code != 200 {
+		t.Errorf("/access/apikeys/list right after a reset response = %d ; want 200", code)
+	}
+
+	// Signing out needs no body
+	if code := withToken("/access/signout"); code != 200 {
+		t.Errorf("/access/signout without a body response = %d ; want 200", code)
+	}
+	if code := withToken("/access/apikeys/list"); code != 401 {
+		t.Errorf("/access/apikeys/list after signing out response = %d ; want 401", code)
+	}
+}
+
+func TestTotp(t *testing.T) {
+	logger.Info("===Testing two-factor authentication===")
+	user := "totptest1"
+	password := "onetwothreefourfive"
+	var signinRes server.SigninRes
+	var enrollmentRes server.TotpEnrollmentRes
+	var recoveryRes server.TotpRecoveryCodesRes
+
+	post := func(path string, token string, body map[string]string, res interface{}) int {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+
+	signup := map[string]string{"user": user, "email": "totp@test.com", "password": password}
+	if code := post("/access/signup", "", signup, nil); code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", code)
+	}
+	signin := map[string]string{"user": user, "password": password}
+	if code := post("/access/signin", "", signin, &signinRes); code != 200 {
+		t.Fatalf("/access/signin response = %d ; want 200", code)
+	}
+
+	userBody := map[string]string{"user": user}
+	if code := post("/access/totp/enroll", signinRes.AccessToken, userBody, &enrollmentRes); code != 200 {
+		t.Fatalf("/access/totp/enroll response = %d ; want 200", code)
+	}
+	if !strings.HasPrefix(enrollmentRes.Uri, "otpauth://totp/") || enrollmentRes.QrCode == "" {
+		t.Errorf("/access/totp/enroll returned uri %q without a QR code", enrollmentRes.Uri)
+	}
+
+	now, _ := totp.GenerateCode(enrollmentRes.Secret, time.Now())
+	confirm := map[string]string{"user": user, "code": now}
+	if code := post("/access/totp/confirm", signinRes.AccessToken, confirm, &recoveryRes); code != 200 {
+		t.Fatalf("/access/totp/confirm response = %d ; want 200", code)
+	}
+	if len(recoveryRes.RecoveryCodes) == 0 {
+		t.Fatalf("/access/totp/confirm returned no recovery codes")
+	}
+
+	// The password alone now only gets a challenge
+	signinRes = server.SigninRes{}
+	if code := post("/access/signin", "", signin, &signinRes); code != 200 {
+		t.Fatalf("/access/signin response = %d ; want 200", code)
+	}
+	if signinRes.Auth || !signinRes.TwoFactorRequired || signinRes.AccessToken != "" {
+		t.Errorf("/access/signin with 2FA = %+v ; want a challenge", signinRes)
+	}
+
+	// The code used to confirm cannot be replayed, the next one works
+	challenge := map[string]string{"user": user, "challengetoken": signinRes.ChallengeToken, "code": now}
+	if code := post("/access/signin-totp", "", challenge, nil); code != 401 {
+		t.Errorf("/access/signin-totp with a replayed code response = %d ; want 401", code)
+	}
+	challenge["code"], _ = totp.GenerateCode(enrollmentRes.Secret, time.Now().Add(30*time.Second))
+	signinRes = server.SigninRes{}
+	if code := post("/access/signin-totp", "", challenge, &signinRes); code != 200 || !signinRes.Auth {
+		t.Errorf("/access/signin-totp response = %d ; want 200", code)
+	}
+
+	// Recovery codes work in place of a TOTP code, once
+	signin["code"] = recoveryRes.RecoveryCodes[0]
+	if code := post("/access/signin", "", signin, nil); code != 200 {
+		t.Errorf("/access/signin with a recovery code response = %d ; want 200", code)
+	}
+	if code := post("/access/signin", "", signin, nil); code != 401 {
+		t.Errorf("/access/signin with a used recovery code response = %d ; want 401", code)
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	logger.Info("===Testing API keys===")
+	user := "apikeytest1"
+	password := "onetwothreefourfive"
+	var signinRes server.SigninRes
+	var createRes server.CreateApiKeyRes
+	var apiKeys []conciergedb.DbApiKey
+
+	post := func(path string, token string, body interface{}, res interface{}) int {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+
+	signup := map[string]string{"user": user, "email": "apikey@test.com", "password": password}
+	if code := post("/access/signup", "", signup, nil); code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", code)
+	}
+	signin := map[string]string{"user": user, "password": password}
+	if code := post("/access/signin", "", signin, &signinRes); code != 200 {
+		t.Fatalf("/access/signin response = %d ; want 200", code)
+	}
+
+	create := map[string]interface{}{
+		"user":        user,
+		"name":        "ci",
+		"groups":      []string{"ci"},
+		"permissions": "x",
+	}
+	if code := post("/access/apikeys/create", signinRes.AccessToken, create, &createRes); code != 200 {
+		t.Fatalf("/access/apikeys/create response = %d ; want 200", code)
+	}
+	if !strings.HasPrefix(createRes.ApiKey, "nrk_"+createRes.Prefix+"_") {
+		t.Errorf("/access/apikeys/create returned key %q for prefix %q", createRes.ApiKey, createRes.Prefix)
+	}
+
+	// Keys cannot manage keys, and their scope holds
+	userBody := map[string]string{"user": user}
+	if code := post("/access/apikeys/list", createRes.ApiKey, userBody, nil); code != 401 {
+		t.Errorf("/access/apikeys/list with an API key response = %d ; want 401", code)
+	}
+	siteBody := map[string]string{"user": user, "group": conciergedb.InitConciergeGroups.Site}
+	if code := post("/groups/usage", createRes.ApiKey, siteBody, nil); code != 403 {
+		t.Errorf("/groups/usage outside the API key scope response = %d ; want 403", code)
+	}
+
+	if code := post("/access/apikeys/list", signinRes.AccessToken, userBody, &apiKeys); code != 200 {
+		t.Errorf("/access/apikeys/list response = %d ; want 200", code)
+	}
+	if len(apiKeys) != 1 || apiKeys[0].Prefix != createRes.Prefix || apiKeys[0].Permissions != "x" {
+		t.Errorf("/access/apikeys/list = %+v ; want the created key", apiKeys)
+	}
+
+	// Routes that only check the group still check the key's permission bits
+	var siteKeyRes server.CreateApiKeyRes
+	siteKey := map[string]interface{}{
+		"user":        user,
+		"name":        "site",
+		"groups":      []string{conciergedb.InitConciergeGroups.Site},
+		"permissions": "x",
+	}
+	if code := post("/access/apikeys/create", signinRes.AccessToken, siteKey, &siteKeyRes); code != 200 {
+		t.Fatalf("/access/apikeys/create response = %d ; want 200", code)
+	}
+	for _, path := range []string{"/groups/usage", "/secrets/listsecrets"} {
+		if code := post(path, siteKeyRes.ApiKey, siteBody, nil); code != 403 {
+			t.Errorf("%s with an API key without r response = %d ; want 403", path, code)
+		}
+	}
+
+	revoke := map[string]string{"user": user, "prefix": createRes.Prefix}
+	if code := post("/access/apikeys/revoke", signinRes.AccessToken, revoke, nil); code != 200 {
+		t.Errorf("/access/apikeys/revoke response = %d ; want 200", code)
+	}
+	if code := post("/groups/usage", createRes.ApiKey, siteBody, nil); code != 401 {
+		t.Errorf("/groups/usage with a revoked API key response = %d ; want 401", code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	logger.Info("===Testing sign in lockout===")
+	user := "lockouttest1"
+	password := "onetwothreefourfive"
+	var adminSigninRes server.SigninRes
+
+	post := func(path string, token string, body map[string]string, res interface{}) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w
+	}
+
+	signup := map[string]string{"user": user, "email": "lockout@test.com", "password": password}
+	if w := post("/access/signup", "", signup, nil); w.Code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", w.Code)
+	}
+
+	wrong := map[string]string{"user": user, "password": "wrong"}
+	for i := 0; i < 3; i++ {
+		if w := post("/access/signin", "", wrong, nil); w.Code != 401 {
+			t.Errorf("/access/signin with a wrong password response = %d ; want 401", w.Code)
+		}
+	}
+
+	// Locked out, even with the right password
+	right := map[string]string{"user": user, "password": password}
+	w := post("/access/signin", "", right, nil)
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("/access/signin while locked out response = %d ; want 429 with Retry-After", w.Code)
+	}
+
+	adminUser := configSiteAdmin["User"].(string)
+	adminSignin := map[string]string{"user": adminUser, "password": configSiteAdmin["Password"].(string)}
+	if w = post("/access/signin", "", adminSignin, &adminSigninRes); w.Code != 200 {
+		t.Fatalf("/access/signin as site admin response = %d ; want 200", w.Code)
+	}
+	unlock := map[string]string{"user": adminUser, "target": user}
+	if w = post("/access/unlock", adminSigninRes.AccessToken, unlock, nil); w.Code != 200 {
+		t.Errorf("/access/unlock response = %d ; want 200", w.Code)
+	}
+
+	if w = post("/access/signin", "", right, nil); w.Code != 200 {
+		t.Errorf("/access/signin after unlock response = %d ; want 200", w.Code)
+	}
+}
+
+// A minimal OIDC provider. Codes are registered by the test with the claims
+// the ID token for them should carry.
+type mockOidcProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	codes  map[string]mockOidcCode
+}
+
+type mockOidcCode struct {
+	Challenge string
+	Claims    jwt.MapClaims
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	p := &mockOidcProvider{key: key, codes: map[string]mockOidcCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.server.URL,
+			"authorization_endpoint":                p.server.URL + "/authorize",
+			"token_endpoint":                        p.server.URL + "/token",
+			"jwks_uri":                              p.server.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &p.key.PublicKey,
+			KeyID:     "mock",
+			Algorithm: "RS256",
+			Use:       "sig",
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		code, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+
+		verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != code.Challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		code.Claims["iss"] = p.server.URL
+		code.Claims["aud"] = "netrun"
+		code.Claims["iat"] = time.Now().Unix()
+		code.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, code.Claims)
+		idToken.Header["kid"] = "mock"
+		signed, err := idToken.SignedString(p.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "mock",
+			"token_type":   "Bearer",
+			"expires_in":   60,
+			"id_token":     signed,
+		})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func TestOidcLogin(t *testing.T) {
+	logger.Info("===Testing OIDC sign in===")
+	provider := newMockOidcProvider(t)
+	defer provider.server.Close()
+
+	err := server.SetOidcConfig(server.OidcConfig{
+		Issuer:          provider.server.URL,
+		ClientId:        "netrun",
+		ClientSecret:    "secret",
+		RedirectUrl:     "http://localhost/access/oidc/callback",
+		MatchBy:         server.OidcMatchEmail,
+		JitProvisioning: true,
+		RoleMappings: []server.OidcRoleMapping{{
+			Claim: "groups",
+			Value: "netrun-admins",
+			Group: conciergedb.InitConciergeGroups.Site,
+			Role:  conciergedb.InitConciergeRoles.Admin,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("SetOidcConfig = %s", err.Error())
+	}
+
+	signin := func(claims jwt.MapClaims) server.SigninRes {
+		var signinRes server.SigninRes
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/access/oidc/login", nil)
+		srv.ServeHTTP(w, req)
+		if w.Code != 302 {
+			t.Fatalf("/access/oidc/login response = %d ; want 302", w.Code)
+		}
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		query := location.Query()
+		if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+			t.Errorf("/access/oidc/login redirect has no S256 code challenge")
+		}
+
+		claims["nonce"] = query.Get("nonce")
+		provider.mu.Lock()
+		provider.codes["code-"+query.Get("state")] = mockOidcCode{query.Get("code_challenge"), claims}
+		provider.mu.Unlock()
+
+		callback := "/access/oidc/callback?" + url.Values{
+			"state": {query.Get("state")},
+			"code":  {"code-" + query.Get("state")},
+		}.Encode()
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", callback, nil)
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("/access/oidc/callback response = %d ; want 200", w.Code)
+		}
+		if err = json.Unmarshal(w.Body.Bytes(), &signinRes); err != nil {
+			t.Fatalf("Error decoding /access/oidc/callback response")
+		}
+
+		// States are single use
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", callback, nil)
+		srv.ServeHTTP(w, req)
+		if w.Code != 401 {
+			t.Errorf("/access/oidc/callback replay response = %d ; want 401", w.Code)
+		}
+		return signinRes
+	}
+
+	isSiteAdmin := func(username string) bool {
+		var count int
+		queryStr := `
+            SELECT COUNT(*)
+            FROM ` + conciergedb.ConciergeTables.GroupUserRoles + ` gur
+            JOIN ` + conciergedb.ConciergeTables.Users + ` u ON u.uid = gur.uid
+            JOIN ` + conciergedb.ConciergeTables.Groups + ` g ON g.gid = gur.gid
+            JOIN ` + conciergedb.ConciergeTables.Roles + ` r ON r.rid = gur.rid
+            WHERE u.username = $1 AND g.name = $2 AND r.name = $3
+            `
+		err := db.QueryRow(
+			queryStr,
+			username,
+			conciergedb.InitConciergeGroups.Site,
+			conciergedb.InitConciergeRoles.Admin,
+		).Scan(&count)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		return count > 0
+	}
+
+	// First sign in provisions the user, with the role its groups map to
+	signinRes := signin(jwt.MapClaims{
+		"sub":                "oidc-subject-1",
+		"email":              "oidc1@test.com",
+		"email_verified":     true,
+		"preferred_username": "oidcuser1",
+		"groups":             []string{"netrun-admins"},
+	})
+	if signinRes.User != "oidcuser1" || signinRes.AccessToken == "" {
+		t.Errorf("OIDC sign in user = %s ; want oidcuser1 with an access token", signinRes.User)
+	}
+	if !isSiteAdmin("oidcuser1") {
+		t.Errorf("OIDC user was not given the mapped role")
+	}
+
+	// Later sign ins go by subject, and drop roles the claims no longer give
+	signinRes = signin(jwt.MapClaims{
+		"sub":                "oidc-subject-1",
+		"email":              "changed@test.com",
+		"email_verified":     true,
+		"preferred_username": "someoneelse",
+	})
+	if signinRes.User != "oidcuser1" {
+		t.Errorf("OIDC sign in by subject user = %s ; want oidcuser1", signinRes.User)
+	}
+	if isSiteAdmin("oidcuser1") {
+		t.Errorf("OIDC user kept a mapped role its claims no longer give")
+	}
+	for _, action := range []string{server.AuditOidcRoleAssign, server.AuditOidcRoleUnassign} {
+		var entries int
+		queryStr := `SELECT count(*) FROM ` + conciergedb.ConciergeTables.AuditLog + `
+			WHERE actor = $1 AND action = $2 AND target = $3 AND groupname = $4`
+		err := db.QueryRow(
+			queryStr,
+			"oidcuser1",
+			action,
+			"oidcuser1="+conciergedb.InitConciergeRoles.Admin,
+			conciergedb.InitConciergeGroups.Site,
+		).Scan(&entries)
+		if err != nil {
+			t.Fatalf(err.Error())
+		} else if entries != 1 {
+			t.Errorf("OIDC role sync audit entries for %s = %d ; want 1", action, entries)
+		}
+	}
+
+	// A new subject with a verified email is linked to the existing user
+	signinRes = signin(jwt.MapClaims{
+		"sub":            "oidc-subject-2",
+		"email":          "oidc1@test.com",
+		"email_verified": true,
+	})
+	if signinRes.User != "oidcuser1" {
+		t.Errorf("OIDC sign in by email user = %s ; want oidcuser1", signinRes.User)
+	}
+
+	// The provider is only a first factor: admins who must use 2FA get an
+	// enrollment token, and users with TOTP a challenge
+	post := func(path string, token string, body map[string]string, res interface{}) int {
+		reqBody, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			json.Unmarshal(w.Body.Bytes(), res)
+		}
+		return w.Code
+	}
+	adminClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "oidc-subject-1", "groups": []string{"netrun-admins"}}
+	}
+	server.SetRequireAdminTwoFactor(true)
+	defer server.SetRequireAdminTwoFactor(false)
+	signinRes = signin(adminClaims())
+	if signinRes.Auth || !signinRes.TwoFactorEnrollment {
+		t.Fatalf("OIDC sign in of an admin without 2FA = %+v ; want an enrollment token", signinRes)
+	}
+
+	var enrollmentRes server.TotpEnrollmentRes
+	userBody := map[string]string{"user": "oidcuser1"}
+	if code := post("/access/totp/enroll", signinRes.AccessToken, userBody, &enrollmentRes); code != 200 {
+		t.Fatalf("/access/totp/enroll response = %d ; want 200", code)
+	}
+	now, _ := totp.GenerateCode(enrollmentRes.Secret, time.Now())
+	confirm := map[string]string{"user": "oidcuser1", "code": now}
+	if code := post("/access/totp/confirm", signinRes.AccessToken, confirm, nil); code != 200 {
+		t.Fatalf("/access/totp/confirm response = %d ; want 200", code)
+	}
+
+	signinRes = signin(adminClaims())
+	if signinRes.Auth || !signinRes.TwoFactorRequired || signinRes.AccessToken != "" {
+		t.Fatalf("OIDC sign in with 2FA = %+v ; want a challenge", signinRes)
+	}
+	next, _ := totp.GenerateCode(enrollmentRes.Secret, time.Now().Add(30*time.Second))
+	challenge := map[string]string{"user": "oidcuser1", "challengetoken": signinRes.ChallengeToken, "code": next}
+	signinRes = server.SigninRes{}
+	if code := post("/access/signin-totp", "", challenge, &signinRes); code != 200 || !signinRes.Auth {
+		t.Errorf("/access/signin-totp after an OIDC sign in response = %d ; want 200", code)
+	}
+}
+
+// Writes a certificate signed by parent, or self signed when parent is nil,
+// and its key as PEM files in dir
+func writeTestCert(
+	t *testing.T,
+	dir string,
+	name string,
+	template *x509.Certificate,
+	parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(path.Join(dir, name+".crt"), certPem, 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = ioutil.WriteFile(path.Join(dir, name+".key"), keyPem, 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return cert, key
+}
+
+func TestClientCertAuth(t *testing.T) {
+	logger.Info("===Testing client certificate authentication===")
+	adminUser := configSiteAdmin["User"].(string)
+
+	dir, err := ioutil.TempDir("", "netrun-tls")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "netrun test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverTemplate := func(serial int64) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	clientTemplate := func(serial int64, cn string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn, Organization: []string{"netrun"}},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+	}
+	writeTestCert(t, dir, "server", serverTemplate(2), ca, caKey)
+	writeTestCert(t, dir, "machine1", clientTemplate(3, "machine1"), ca, caKey)
+	writeTestCert(t, dir, "machine2", clientTemplate(4, "machine2"), ca, caKey)
+
+	err = server.SetTlsConfig(server.TlsConfig{
+		CertFile:        path.Join(dir, "server.crt"),
+		KeyFile:         path.Join(dir, "server.key"),
+		ClientCaFile:    path.Join(dir, "ca.crt"),
+		ClientCertUsers: map[string]string{"CN=machine1,O=netrun": adminUser},
+	})
+	if err != nil {
+		t.Fatalf("SetTlsConfig = %s", err.Error())
+	}
+
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = server.ServerTlsConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+	post := func(clientCert string, route string, body map[string]interface{}) *http.Response {
+		tlsConfig := &tls.Config{RootCAs: caPool}
+		if clientCert != "" {
+			cert, err := tls.LoadX509KeyPair(
+				path.Join(dir, clientCert+".crt"),
+				path.Join(dir, clientCert+".key"),
+			)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		reqBody, _ := json.Marshal(body)
+		res, err := client.Post(ts.URL+route, "application/json", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		res.Body.Close()
+		return res
+	}
+
+	body := map[string]interface{}{"user": adminUser, "group": conciergedb.InitConciergeGroups.Site}
+	if res := post("machine1", "/groups/usage", body); res.StatusCode != 200 {
+		t.Errorf("/groups/usage with a mapped client cert response = %d ; want 200", res.StatusCode)
+	}
+	if res := post("", "/groups/usage", body); res.StatusCode == 200 {
+		t.Errorf("/groups/usage without credentials response = 200 ; want an error")
+	}
+	if res := post("machine2", "/groups/usage", body); res.StatusCode == 200 {
+		t.Errorf("/groups/usage with an unmapped client cert response = 200 ; want an error")
+	}
+
+	// Certificates do not manage groups, even when mapped to a site admin
+	setQuota := map[string]interface{}{"group": conciergedb.InitConciergeGroups.Site, "maxcontainers": 1}
+	if res := post("machine1", "/groups/setquota", setQuota); res.StatusCode != 403 {
+		t.Errorf("/groups/setquota with a client cert response = %d ; want 403", res.StatusCode)
+	}
+	putSecret := map[string]interface{}{
+		"group":      conciergedb.InitConciergeGroups.Site,
+		"secretname": "CERT_SECRET",
+		"value":      "certvalue",
+	}
+	if res := post("machine1", "/secrets/putsecret", putSecret); res.StatusCode != 403 {
+		t.Errorf("/secrets/putsecret with a client cert response = %d ; want 403", res.StatusCode)
+	}
+
+	// A new server cert is picked up without restarting
+	writeTestCert(t, dir, "server", serverTemplate(5), ca, caKey)
+	if err = server.ReloadCertificates(); err != nil {
+		t.Fatalf("ReloadCertificates = %s", err.Error())
+	}
+	if res := post("machine1", "/groups/usage", body); res.TLS.PeerCertificates[0].SerialNumber.Int64() != 5 {
+		t.Errorf("Server cert serial after reload = %d ; want 5", res.TLS.PeerCertificates[0].SerialNumber.Int64())
+	}
+}
+
+func TestJwks(t *testing.T) {
+	logger.Info("===Testing asymmetric signing keys===")
+	adminUser := configSiteAdmin["User"].(string)
+	defer func() {
+		server.SetSigningAlgorithm("HS256")
+		server.RotateSigningKeys(time.Minute)
+	}()
+
+	signin := func() string {
+		var signinRes server.SigninRes
+		reqBody, _ := json.Marshal(map[string]string{
+			"user":     adminUser,
+			"password": configSiteAdmin["Password"].(string),
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("/access/signin response = %d ; want 200", w.Code)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &signinRes); err != nil {
+			t.Fatalf("Error decoding /access/signin response")
+		}
+		return signinRes.AccessToken
+	}
+
+	groupUsage := func(token string) int {
+		reqBody, _ := json.Marshal(map[string]string{
+			"group": conciergedb.InitConciergeGroups.Site,
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/groups/usage", bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+token)
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	jwks := func() map[string]server.Jwk {
+		var jwksRes server.JwksRes
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("/.well-known/jwks.json response = %d ; want 200", w.Code)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &jwksRes); err != nil {
+			t.Fatalf("Error decoding /.well-known/jwks.json response")
+		}
+		keys := map[string]server.Jwk{}
+		for _, jwk := range jwksRes.Keys {
+			keys[jwk.Kid] = jwk
+		}
+		return keys
+	}
+
+	// Verifies token the way another service would, with only the published key
+	verifyWithJwks := func(token string) server.Jwk {
+		unverified, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		jwk, ok := jwks()[unverified.Header["kid"].(string)]
+		if !ok {
+			t.Fatalf("Signing key missing from /.well-known/jwks.json")
+		}
+		var publicKey interface{}
+		switch jwk.Kty {
+		case "RSA":
+			n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+			publicKey = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "OKP":
+			x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+			publicKey = ed25519.PublicKey(x)
+		}
+		_, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return publicKey, nil })
+		if err != nil {
+			t.Errorf("Token does not verify with its published %s key: %s", jwk.Alg, err.Error())
+		}
+		return jwk
+	}
+
+	if err := server.SetSigningAlgorithm("RS256"); err != nil {
+		t.Fatalf("SetSigningAlgorithm = %s", err.Error())
+	}
+	if _, err := server.RotateSigningKeys(time.Minute); err != nil {
+		t.Fatalf("RotateSigningKeys = %s", err.Error())
+	}
+	rsaToken := signin()
+	if code := groupUsage(rsaToken); code != 200 {
+		t.Errorf("/groups/usage with an RS256 token response = %d ; want 200", code)
+	}
+	rsaJwk := verifyWithJwks(rsaToken)
+	if rsaJwk.Alg != "RS256" {
+		t.Errorf("Published key alg = %s ; want RS256", rsaJwk.Alg)
+	}
+
+	// The RSA public key is public, so it must not work as an HMAC secret
+	claims := jwt.MapClaims{
+		"user": adminUser,
+		"jti":  "forged",
+		"exp":  time.Now().Add(time.Minute).Unix(),
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = rsaJwk.Kid
+	n, _ := base64.RawURLEncoding.DecodeString(rsaJwk.N)
+	forgedToken, _ := forged.SignedString(n)
+	if code := groupUsage(forgedToken); code != 401 {
+		t.Errorf("/groups/usage with an HS256 token for an RS256 key response = %d ; want 401", code)
+	}
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	unsigned.Header["kid"] = rsaJwk.Kid
+	unsignedToken, _ := unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if code := groupUsage(unsignedToken); code != 401 {
+		t.Errorf("/groups/usage with an unsigned token response = %d ; want 401", code)
+	}
+
+	if err := server.SetSigningAlgorithm("EdDSA"); err != nil {
+		t.Fatalf("SetSigningAlgorithm = %s", err.Error())
+	}
+	if _, err := server.RotateSigningKeys(time.Minute); err != nil {
+		t.Fatalf("RotateSigningKeys = %s", err.Error())
+	}
+	edToken := signin()
+	if code := groupUsage(edToken); code != 200 {
+		t.Errorf("/groups/usage with an EdDSA token response = %d ; want 200", code)
+	}
+	if jwk := verifyWithJwks(edToken); jwk.Alg != "EdDSA" {
+		t.Errorf("Published key alg = %s ; want EdDSA", jwk.Alg)
+	}
+
+	// The rotated out RSA key keeps verifying until it is retired
+	if code := groupUsage(rsaToken); code != 200 {
+		t.Errorf("/groups/usage with a rotated out RS256 token response = %d ; want 200", code)
+	}
+}
+
+func TestGroupManagement(t *testing.T) {
+	logger.Info("===Testing group management===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, token string, body map[string]string, res interface{}) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		w := post("/access/signin", "", map[string]string{"user": user, "password": password}, &signinRes)
+		if w.Code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, w.Code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+	as := func(user string, path string, body map[string]string, res interface{}) int {
+		body["user"] = user
+		return post(path, tokens[user], body, res).Code
+	}
+
+	for _, user := range []string{"groupowner1", "groupmember1"} {
+		signup := map[string]string{"user": user, "email": user + "@test.com", "password": password}
+		if w := post("/access/signup", "", signup, nil); w.Code != 200 {
+			t.Fatalf("/access/signup response = %d ; want 200", w.Code)
+		}
+		signin(user, password)
+	}
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	// Only site admins create groups, here on behalf of the owner
+	create := map[string]string{"group": "team1", "owner": "groupowner1"}
+	if code := as("groupowner1", "/groups/create", create, nil); code != 403 {
+		t.Errorf("/groups/create as a non site admin response = %d ; want 403", code)
+	}
+	if code := as(adminUser, "/groups/create", create, nil); code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	if code := as(adminUser, "/groups/create", create, nil); code != 409 {
+		t.Errorf("/groups/create of an existing group response = %d ; want 409", code)
+	}
+
+	// The owner administers the group from then on
+	addUser := map[string]string{"group": "team1", "target": "groupmember1"}
+	if code := as("groupowner1", "/groups/adduser", addUser, nil); code != 200 {
+		t.Errorf("/groups/adduser response = %d ; want 200", code)
+	}
+	if code := as("groupowner1", "/groups/adduser", addUser, nil); code != 409 {
+		t.Errorf("/groups/adduser of a member response = %d ; want 409", code)
+	}
+	if code := as("groupmember1", "/groups/members", map[string]string{"group": "team1"}, nil); code != 403 {
+		t.Errorf("/groups/members as a non admin response = %d ; want 403", code)
+	}
+	var membersRes server.GroupMembersRes
+	if code := as("groupowner1", "/groups/members", map[string]string{"group": "team1"}, &membersRes); code != 200 {
+		t.Errorf("/groups/members response = %d ; want 200", code)
+	}
+	wantMembers := []conciergedb.DbGroupMember{
+		{Username: "groupmember1", Owner: false, Roles: []string{conciergedb.InitConciergeRoles.User}},
+		{Username: "groupowner1", Owner: true, Roles: []string{conciergedb.InitConciergeRoles.Admin}},
+	}
+	if !reflect.DeepEqual(membersRes.Members, wantMembers) {
+		t.Errorf("/groups/members = %v ; want %v", membersRes.Members, wantMembers)
+	}
+
+	removeOwner := map[string]string{"group": "team1", "target": "groupowner1"}
+	if code := as("groupowner1", "/groups/removeuser", removeOwner, nil); code != 409 {
+		t.Errorf("/groups/removeuser of the owner response = %d ; want 409", code)
+	}
+	transfer := map[string]string{"group": "team1", "target": "groupmember1"}
+	if code := as("groupowner1", "/groups/transferowner", transfer, nil); code != 200 {
+		t.Errorf("/groups/transferowner response = %d ; want 200", code)
+	}
+	if code := as("groupmember1", "/groups/removeuser", removeOwner, nil); code != 200 {
+		t.Errorf("/groups/removeuser of the previous owner response = %d ; want 200", code)
+	}
+	if code := as("groupowner1", "/groups/members", map[string]string{"group": "team1"}, nil); code != 403 {
+		t.Errorf("/groups/members after removal response = %d ; want 403", code)
+	}
+
+	rename := map[string]string{"group": "team1", "name": "team1b"}
+	if code := as("groupmember1", "/groups/rename", rename, nil); code != 200 {
+		t.Errorf("/groups/rename response = %d ; want 200", code)
+	}
+	site := map[string]string{"group": conciergedb.InitConciergeGroups.Site, "name": "other"}
+	if code := as(adminUser, "/groups/rename", site, nil); code != 403 {
+		t.Errorf("/groups/rename of the site group response = %d ; want 403", code)
+	}
+
+	// Groups still in use are not deleted
+	queryStr := `
+        INSERT INTO ` + conciergedb.ConciergeTables.Secrets + `
+          (gid, name, ciphertext, date_created, date_updated)
+        SELECT g.gid, 'grouptestsecret', '\x00', now(), now()
+        FROM ` + conciergedb.ConciergeTables.Groups + ` g
+        WHERE g.name = 'team1b'
+        `
+	if _, err := db.Exec(queryStr); err != nil {
+		t.Fatalf(err.Error())
+	}
+	deleteGroup := map[string]string{"group": "team1b"}
+	if code := as("groupmember1", "/groups/delete", deleteGroup, nil); code != 409 {
+		t.Errorf("/groups/delete of a group with secrets response = %d ; want 409", code)
+	}
+	queryStr = `DELETE FROM ` + conciergedb.ConciergeTables.Secrets + ` WHERE name = 'grouptestsecret'`
+	if _, err := db.Exec(queryStr); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if code := as("groupmember1", "/groups/delete", deleteGroup, nil); code != 200 {
+		t.Errorf("/groups/delete response = %d ; want 200", code)
+	}
+	if code := as(adminUser, "/groups/members", deleteGroup, nil); code != 400 {
+		t.Errorf("/groups/members of a deleted group response = %d ; want 400", code)
+	}
+}
+
+func TestRoleManagement(t *testing.T) {
+	logger.Info("===Testing role management===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, user string, body map[string]interface{}, res interface{}) int {
+		body["user"] = user
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if tokens[user] != "" {
+			req.Header.Set("authorization", "Bearer "+tokens[user])
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		code := post("/access/signin", user, map[string]interface{}{"password": password}, &signinRes)
+		if code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+
+	for _, user := range []string{"roleowner1", "rolemember1"} {
+		signup := map[string]interface{}{"email": user + "@test.com", "password": password}
+		if code := post("/access/signup", user, signup, nil); code != 200 {
+			t.Fatalf("/access/signup response = %d ; want 200", code)
+		}
+		signin(user, password)
+	}
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	operator := map[string]interface{}{"role": "operator"}
+	if code := post("/roles/create", "roleowner1", operator, nil); code != 403 {
+		t.Errorf("/roles/create as a non site admin response = %d ; want 403", code)
+	}
+	if code := post("/roles/create", adminUser, operator, nil); code != 200 {
+		t.Fatalf("/roles/create response = %d ; want 200", code)
+	}
+	if code := post("/roles/create", adminUser, operator, nil); code != 409 {
+		t.Errorf("/roles/create of an existing role response = %d ; want 409", code)
+	}
+
+	var listRes server.ListRolesRes
+	if code := post("/roles/list", "rolemember1", map[string]interface{}{}, &listRes); code != 200 {
+		t.Errorf("/roles/list response = %d ; want 200", code)
+	}
+	roleNames := []string{}
+	for _, role := range listRes.Roles {
+		roleNames = append(roleNames, role.Name)
+	}
+	if !reflect.DeepEqual(roleNames, []string{"admin", "operator", "pm", "user"}) {
+		t.Errorf("/roles/list = %v ; want admin, operator, pm and user", roleNames)
+	}
+
+	group := map[string]interface{}{"group": "roleteam1", "owner": "roleowner1"}
+	if code := post("/groups/create", adminUser, group, nil); code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	addUser := map[string]interface{}{"group": "roleteam1", "target": "rolemember1"}
+	if code := post("/groups/adduser", "roleowner1", addUser, nil); code != 200 {
+		t.Fatalf("/groups/adduser response = %d ; want 200", code)
+	}
+
+	// Group admins assign roles within their group
+	assign := map[string]interface{}{"group": "roleteam1", "target": "rolemember1", "roles": []string{"operator"}}
+	if code := post("/roles/assign", "rolemember1", assign, nil); code != 403 {
+		t.Errorf("/roles/assign as a non admin response = %d ; want 403", code)
+	}
+	if code := post("/roles/assign", "roleowner1", assign, nil); code != 200 {
+		t.Errorf("/roles/assign response = %d ; want 200", code)
+	}
+	unknown := map[string]interface{}{"group": "roleteam1", "target": "rolemember1", "roles": []string{"nosuchrole"}}
+	if code := post("/roles/assign", "roleowner1", unknown, nil); code != 400 {
+		t.Errorf("/roles/assign of an unknown role response = %d ; want 400", code)
+	}
+	var membersRes server.GroupMembersRes
+	post("/groups/members", "roleowner1", map[string]interface{}{"group": "roleteam1"}, &membersRes)
+	for _, member := range membersRes.Members {
+		if member.Username == "rolemember1" && !reflect.DeepEqual(member.Roles, []string{"operator", "user"}) {
+			t.Errorf("rolemember1 roles = %v ; want operator and user", member.Roles)
+		}
+	}
+
+	if code := post("/roles/delete", adminUser, operator, nil); code != 409 {
+		t.Errorf("/roles/delete of an assigned role response = %d ; want 409", code)
+	}
+	if code := post("/roles/unassign", "roleowner1", assign, nil); code != 200 {
+		t.Errorf("/roles/unassign response = %d ; want 200", code)
+	}
+	ownerAdmin := map[string]interface{}{"group": "roleteam1", "target": "roleowner1", "roles": []string{"admin"}}
+	if code := post("/roles/unassign", "roleowner1", ownerAdmin, nil); code != 409 {
+		t.Errorf("/roles/unassign of the owner's admin role response = %d ; want 409", code)
+	}
+
+	rename := map[string]interface{}{"role": "operator", "name": "viewer"}
+	if code := post("/roles/rename", adminUser, rename, nil); code != 200 {
+		t.Errorf("/roles/rename response = %d ; want 200", code)
+	}
+	builtin := map[string]interface{}{"role": "admin", "name": "root"}
+	if code := post("/roles/rename", adminUser, builtin, nil); code != 403 {
+		t.Errorf("/roles/rename of a built in role response = %d ; want 403", code)
+	}
+	if code := post("/roles/delete", adminUser, map[string]interface{}{"role": "viewer"}, nil); code != 200 {
+		t.Errorf("/roles/delete response = %d ; want 200", code)
+	}
+}
+
+func TestPermissionGrants(t *testing.T) {
+	logger.Info("===Testing permission grants===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, user string, body map[string]interface{}, res interface{}) int {
+		body["user"] = user
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if tokens[user] != "" {
+			req.Header.Set("authorization", "Bearer "+tokens[user])
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		code := post("/access/signin", user, map[string]interface{}{"password": password}, &signinRes)
+		if code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+
+	for _, user := range []string{"permowner1", "permmember1"} {
+		signup := map[string]interface{}{"email": user + "@test.com", "password": password}
+		if code := post("/access/signup", user, signup, nil); code != 200 {
+			t.Fatalf("/access/signup response = %d ; want 200", code)
+		}
+		queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+		if _, err := db.Exec(queryStr, user); err != nil {
+			t.Fatalf(err.Error())
+		}
+		signin(user, password)
+	}
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	group := map[string]interface{}{"group": "permteam1", "owner": "permowner1"}
+	if code := post("/groups/create", adminUser, group, nil); code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	addUser := map[string]interface{}{"group": "permteam1", "target": "permmember1"}
+	if code := post("/groups/adduser", "permowner1", addUser, nil); code != 200 {
+		t.Fatalf("/groups/adduser response = %d ; want 200", code)
+	}
+	newCommand := map[string]interface{}{
+		"group":       conciergedb.InitConciergeGroups.Site,
+		"commandname": "permcmd1",
+		"runcommand":  "echo permcmd1",
+		"killcommand": "",
+	}
+	if code := post("/command/newcommand", adminUser, newCommand, nil); code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+
+	grant := func(group string, role string, permissions string) map[string]interface{} {
+		return map[string]interface{}{
+			"process":     "permcmd1",
+			"group":       group,
+			"role":        role,
+			"permissions": permissions,
+		}
+	}
+	teamAdmin := grant("permteam1", conciergedb.InitConciergeRoles.Admin, "rw-")
+	teamUser := grant("permteam1", conciergedb.InitConciergeRoles.User, "r--")
+
+	if code := post("/command/grantpermission", "permowner1", teamAdmin, nil); code != 401 {
+		t.Errorf("/command/grantpermission without write permission response = %d ; want 401", code)
+	}
+	if code := post("/command/grantpermission", adminUser, teamAdmin, nil); code != 200 {
+		t.Errorf("/command/grantpermission response = %d ; want 200", code)
+	}
+	if code := post("/command/grantpermission", adminUser, teamAdmin, nil); code != 409 {
+		t.Errorf("/command/grantpermission of an existing grant response = %d ; want 409", code)
+	}
+	invalid := grant("permteam1", conciergedb.InitConciergeRoles.User, "rwz")
+	if code := post("/command/grantpermission", adminUser, invalid, nil); code != 400 {
+		t.Errorf("/command/grantpermission with invalid permissions response = %d ; want 400", code)
+	}
+
+	// Write permission from the grant above is enough to manage grants
+	if code := post("/command/grantpermission", "permowner1", teamUser, nil); code != 200 {
+		t.Errorf("/command/grantpermission with write permission response = %d ; want 200", code)
+	}
+	teamUser["permissions"] = "101"
+	if code := post("/command/changepermission", "permowner1", teamUser, nil); code != 200 {
+		t.Errorf("/command/changepermission response = %d ; want 200", code)
+	}
+	if code := post("/command/revokepermission", "permmember1", teamUser, nil); code != 401 {
+		t.Errorf("/command/revokepermission without write permission response = %d ; want 401", code)
+	}
+	// Write permission in permteam1 does not reach grants in other groups
+	siteUser := grant(conciergedb.InitConciergeGroups.Site, conciergedb.InitConciergeRoles.User, "rwx")
+	if code := post("/command/grantpermission", "permowner1", siteUser, nil); code != 403 {
+		t.Errorf("/command/grantpermission in another group response = %d ; want 403", code)
+	}
+	siteAdmin := grant(conciergedb.InitConciergeGroups.Site, conciergedb.InitConciergeRoles.Admin, "r--")
+	if code := post("/command/changepermission", "permowner1", siteAdmin, nil); code != 403 {
+		t.Errorf("/command/changepermission in another group response = %d ; want 403", code)
+	}
+	if code := post("/command/revokepermission", "permowner1", siteAdmin, nil); code != 403 {
+		t.Errorf("/command/revokepermission in another group response = %d ; want 403", code)
+	}
+
+	var listRes server.ListPermissionsRes
+	list := map[string]interface{}{"process": "permcmd1"}
+	if code := post("/command/listpermissions", "permmember1", list, &listRes); code != 200 {
+		t.Errorf("/command/listpermissions response = %d ; want 200", code)
+	}
+	wantGrants := []server.PermissionGrantRes{
+		{Group: "permteam1", Role: "admin", Permissions: "rw-", Users: []string{"permowner1"}},
+		{Group: "permteam1", Role: "user", Permissions: "r-x", Users: []string{"permmember1"}},
+		{Group: conciergedb.InitConciergeGroups.Site, Role: "admin", Permissions: "rwx", Users: []string{adminUser}},
+	}
+	if !reflect.DeepEqual(listRes.Grants, wantGrants) {
+		t.Errorf("/command/listpermissions = %v ; want %v", listRes.Grants, wantGrants)
+	}
+
+	if code := post("/command/revokepermission", "permowner1", teamUser, nil); code != 200 {
+		t.Errorf("/command/revokepermission response = %d ; want 200", code)
+	}
+	if code := post("/command/listpermissions", "permmember1", list, nil); code != 401 {
+		t.Errorf("/command/listpermissions after revoke response = %d ; want 401", code)
+	}
+	var denials int
+	queryStr := `SELECT count(*) FROM ` + conciergedb.ConciergeTables.AuditLog + `
+		WHERE actor = $1 AND action = $2 AND target = $3 AND outcome = $4`
+	err := db.QueryRow(
+		queryStr,
+		"permmember1",
+		server.AuditPermissionDenied,
+		"permcmd1:r",
+		server.AuditDenied,
+	).Scan(&denials)
+	if err != nil {
+		t.Fatalf(err.Error())
+	} else if denials == 0 {
+		t.Errorf("/command/listpermissions denial was not audited")
+	}
+
+	// Routes about the whole process ask the authorizer too
+	server.SetAuthorizer(permissionAuthorizer("r"))
+	defer server.SetAuthorizer(server.RbacAuthorizer{})
+	if code := post("/command/listpermissions", "permmember1", list, nil); code != 200 {
+		t.Errorf("/command/listpermissions allowed by the authorizer response = %d ; want 200", code)
+	}
+	if code := post("/command/grantpermission", "permowner1", teamUser, nil); code != 401 {
+		t.Errorf("/command/grantpermission denied by the authorizer response = %d ; want 401", code)
+	}
+}
+
+// Allows one permission on everything and denies the rest
+type permissionAuthorizer string
+
+func (p permissionAuthorizer) Authorize(req server.AuthzRequest) (bool, error) {
+	return req.Permission == string(p), nil
+}
+
+func TestHasPermission(t *testing.T) {
+	logger.Info("===Testing permission evaluation===")
+	adminUser := configSiteAdmin["User"].(string)
+
+	// The site admin holds roles a and b in the group, but not role c
+	setup := []string{
+		`INSERT INTO ` + conciergedb.ConciergeTables.RegisteredProcesses + `
+		   (creator_uid, name, run_argv, date_created)
+		 SELECT uid, 'haspermcmd', '{true}', now() FROM ` + conciergedb.ConciergeTables.Users + `
+		 WHERE username = $1`,
+		`INSERT INTO ` + conciergedb.ConciergeTables.Groups + ` (name) VALUES ('haspermgroup')`,
+		`INSERT INTO ` + conciergedb.ConciergeTables.Roles + ` (name)
+		 VALUES ('haspermrolea'), ('haspermroleb'), ('haspermrolec')`,
+		`INSERT INTO ` + conciergedb.ConciergeTables.GroupUsers + ` (uid, gid)
+		 SELECT u.uid, g.gid FROM ` + conciergedb.ConciergeTables.Users + ` u, ` +
+			conciergedb.ConciergeTables.Groups + ` g
+		 WHERE u.username = $1 AND g.name = 'haspermgroup'`,
+		`INSERT INTO ` + conciergedb.ConciergeTables.GroupUserRoles + ` (uid, gid, rid)
+		 SELECT u.uid, g.gid, r.rid FROM ` + conciergedb.ConciergeTables.Users + ` u, ` +
+			conciergedb.ConciergeTables.Groups + ` g, ` + conciergedb.ConciergeTables.Roles + ` r
+		 WHERE u.username = $1 AND g.name = 'haspermgroup' AND r.name IN ('haspermrolea', 'haspermroleb')`,
+	}
+	for _, queryStr := range setup {
+		var err error
+		if strings.Contains(queryStr, "$1") {
+			_, err = db.Exec(queryStr, adminUser)
+		} else {
+			_, err = db.Exec(queryStr)
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	grantQuery := `
+		INSERT INTO ` + conciergedb.ConciergeTables.RegisteredProcessPermissions + ` (rpid, gid, rid, rwx)
+		SELECT rp.rpid, g.gid, r.rid, $2::BIT(3)
+		FROM ` + conciergedb.ConciergeTables.RegisteredProcesses + ` rp, ` +
+		conciergedb.ConciergeTables.Groups + ` g, ` + conciergedb.ConciergeTables.Roles + ` r
+		WHERE rp.name = 'haspermcmd' AND g.name = 'haspermgroup' AND r.name = $1
+	`
+	clearQuery := `
+		DELETE FROM ` + conciergedb.ConciergeTables.RegisteredProcessPermissions + `
+		WHERE rpid = (
+		  SELECT rpid FROM ` + conciergedb.ConciergeTables.RegisteredProcesses + ` WHERE name = 'haspermcmd'
+		)
+	`
+
+	cases := []struct {
+		name    string
+		grants  map[string]string
+		allowed string
+	}{
+		{"no grants", map[string]string{}, ""},
+		{"---", map[string]string{"haspermrolea": "000"}, ""},
+		{"r--", map[string]string{"haspermrolea": "100"}, "r"},
+		{"-w-", map[string]string{"haspermrolea": "010"}, "w"},
+		{"--x", map[string]string{"haspermrolea": "001"}, "x"},
+		{"rw-", map[string]string{"haspermrolea": "110"}, "rw"},
+		{"r-x", map[string]string{"haspermrolea": "101"}, "rx"},
+		{"-wx", map[string]string{"haspermrolea": "011"}, "wx"},
+		{"rwx", map[string]string{"haspermrolea": "111"}, "rwx"},
+		{"r-- and --x merge", map[string]string{"haspermrolea": "100", "haspermroleb": "001"}, "rx"},
+		{"rw- and -wx merge", map[string]string{"haspermrolea": "110", "haspermroleb": "011"}, "rwx"},
+		{"-w- and --- merge", map[string]string{"haspermrolea": "010", "haspermroleb": "000"}, "w"},
+		{"role not held", map[string]string{"haspermrolec": "111"}, ""},
+		{"held and not held", map[string]string{"haspermrolea": "100", "haspermrolec": "011"}, "r"},
+	}
+	permissions := []string{"r", "w", "x", "rw", "rx", "wx"}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := db.Exec(clearQuery); err != nil {
+				t.Fatalf(err.Error())
+			}
+			for role, bits := range tc.grants {
+				if _, err := db.Exec(grantQuery, role, bits); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+
+			for _, permission := range permissions {
+				var hasPermission bool
+				errorChan := make(chan error)
+				go conciergedb.HasPermission(
+					adminUser,
+					"haspermgroup",
+					"haspermcmd",
+					permission,
+					db,
+					errorChan,
+					&hasPermission,
+				)
+				if err := <-errorChan; err != nil {
+					t.Fatalf("HasPermission %s = %s", permission, err.Error())
+				}
+				close(errorChan)
+
+				want := true
+				for _, flag := range permission {
+					want = want && strings.ContainsRune(tc.allowed, flag)
+				}
+				if hasPermission != want {
+					t.Errorf("HasPermission %s = %t ; want %t", permission, hasPermission, want)
+				}
+			}
+		})
+	}
+
+	// Grants to the group do not reach users outside it
+	var hasPermission bool
+	errorChan := make(chan error)
+	defer close(errorChan)
+	go conciergedb.HasPermission(
+		adminUser,
+		conciergedb.InitConciergeGroups.Site,
+		"haspermcmd",
+		"r",
+		db,
+		errorChan,
+		&hasPermission,
+	)
+	if err := <-errorChan; err != nil || hasPermission {
+		t.Errorf("HasPermission in another group = %t ; want false", hasPermission)
+	}
+}
+
+func TestPermissionExplain(t *testing.T) {
+	logger.Info("===Testing permission explain===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, user string, body map[string]interface{}, res interface{}) int {
+		body["user"] = user
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if tokens[user] != "" {
+			req.Header.Set("authorization", "Bearer "+tokens[user])
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		code := post("/access/signin", user, map[string]interface{}{"password": password}, &signinRes)
+		if code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+
+	for _, user := range []string{"explainowner1", "explainmember1", "explainoutsider1"} {
+		signup := map[string]interface{}{"email": user + "@test.com", "password": password}
+		if code := post("/access/signup", user, signup, nil); code != 200 {
+			t.Fatalf("/access/signup response = %d ; want 200", code)
+		}
+		signin(user, password)
+	}
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	group := map[string]interface{}{"group": "explainteam1", "owner": "explainowner1"}
+	if code := post("/groups/create", adminUser, group, nil); code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	addUser := map[string]interface{}{"group": "explainteam1", "target": "explainmember1"}
+	if code := post("/groups/adduser", "explainowner1", addUser, nil); code != 200 {
+		t.Fatalf("/groups/adduser response = %d ; want 200", code)
+	}
+	newCommand := map[string]interface{}{
+		"group":       conciergedb.InitConciergeGroups.Site,
+		"commandname": "explaincmd1",
+		"runcommand":  "echo explaincmd1",
+		"killcommand": "",
+	}
+	if code := post("/command/newcommand", adminUser, newCommand, nil); code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+	if _, err := db.Exec(queryStr, adminUser); err != nil {
+		t.Fatalf(err.Error())
+	}
+	grant := map[string]interface{}{
+		"process":     "explaincmd1",
+		"group":       "explainteam1",
+		"role":        conciergedb.InitConciergeRoles.User,
+		"permissions": "r--",
+	}
+	if code := post("/command/grantpermission", adminUser, grant, nil); code != 200 {
+		t.Fatalf("/command/grantpermission response = %d ; want 200", code)
+	}
+
+	cases := []struct {
+		name        string
+		caller      string
+		target      string
+		process     string
+		permission  string
+		code        int
+		allowed     bool
+		failedCheck string
+	}{
+		{"self allowed", "explainmember1", "", "explaincmd1", "r", 200, true, ""},
+		{"self missing bits", "explainmember1", "explainmember1", "explaincmd1", "x", 200, false, server.CheckBits},
+		{"self not a member", "explainoutsider1", "", "explaincmd1", "r", 200, false, server.CheckMembership},
+		{"unknown command", "explainmember1", "", "nosuchcmd", "r", 200, false, server.CheckProcessExists},
+		{"owner no grants", "explainowner1", "", "explaincmd1", "r", 200, false, server.CheckGrants},
+		{"admin on member", "explainowner1", "explainmember1", "explaincmd1", "rw", 200, false, server.CheckBits},
+		{"admin on outsider", "explainowner1", "explainoutsider1", "explaincmd1", "r", 200, false, server.CheckMembership},
+		{"admin on unknown user", "explainowner1", "nosuchuser", "explaincmd1", "r", 200, false, server.CheckUserExists},
+		{"member on another user", "explainmember1", "explainowner1", "explaincmd1", "r", 403, false, ""},
+		{"invalid permission", "explainmember1", "", "explaincmd1", "q", 400, false, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var explainRes server.ExplainPermissionRes
+			body := map[string]interface{}{
+				"target":     tc.target,
+				"group":      "explainteam1",
+				"process":    tc.process,
+				"permission": tc.permission,
+			}
+			code := post("/access/explain", tc.caller, body, &explainRes)
+			if code != tc.code {
+				t.Fatalf("/access/explain response = %d ; want %d", code, tc.code)
+			}
+			if code != 200 {
+				return
+			}
+			if explainRes.Allowed != tc.allowed {
+				t.Errorf("/access/explain allowed = %t ; want %t", explainRes.Allowed, tc.allowed)
+			}
+			if explainRes.FailedCheck != tc.failedCheck {
+				t.Errorf("/access/explain failedCheck = %s ; want %s", explainRes.FailedCheck, tc.failedCheck)
+			}
+			last := explainRes.Checks[len(explainRes.Checks)-1]
+			if tc.allowed && (last.Check != server.CheckBits || !last.Passed) {
+				t.Errorf("/access/explain last check = %+v ; want passed %s", last, server.CheckBits)
+			}
+			if tc.allowed && explainRes.Permissions != "r--" {
+				t.Errorf("/access/explain permissions = %s ; want r--", explainRes.Permissions)
+			}
+		})
+	}
+}
+
+func TestGroupHierarchy(t *testing.T) {
+	logger.Info("===Testing group hierarchy===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, user string, body map[string]interface{}, res interface{}) int {
+		body["user"] = user
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if tokens[user] != "" {
+			req.Header.Set("authorization", "Bearer "+tokens[user])
+		}
+		srv.ServeHTTP(w, req)
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		code := post("/access/signin", user, map[string]interface{}{"password": password}, &signinRes)
+		if code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+	hasPermission := func(user string, group string, permission string) bool {
+		var ok bool
+		errorChan := make(chan error)
+		defer close(errorChan)
+		go conciergedb.HasPermission(user, group, "hiercmd1", permission, db, errorChan, &ok)
+		if err := <-errorChan; err != nil {
+			t.Fatalf("HasPermission %s = %s", permission, err.Error())
+		}
+		return ok
+	}
+
+	for _, user := range []string{"hierdeptadmin1", "hierteamadmin1", "hiermember1", "hieroutsider1"} {
+		signup := map[string]interface{}{"email": user + "@test.com", "password": password}
+		if code := post("/access/signup", user, signup, nil); code != 200 {
+			t.Fatalf("/access/signup response = %d ; want 200", code)
+		}
+		signin(user, password)
+	}
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+	if _, err := db.Exec(queryStr, adminUser); err != nil {
+		t.Fatalf(err.Error())
+	}
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	// Admins of a parent create and administer groups below it
+	dept := map[string]interface{}{"group": "hierdept1", "owner": "hierdeptadmin1"}
+	if code := post("/groups/create", adminUser, dept, nil); code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	team := map[string]interface{}{"group": "hierteam1", "owner": "hierteamadmin1", "parent": "hierdept1"}
+	if code := post("/groups/create", "hieroutsider1", team, nil); code != 403 {
+		t.Errorf("/groups/create under another's group response = %d ; want 403", code)
+	}
+	if code := post("/groups/create", "hierdeptadmin1", team, nil); code != 200 {
+		t.Fatalf("/groups/create under own group response = %d ; want 200", code)
+	}
+	addUser := map[string]interface{}{"group": "hierteam1", "target": "hiermember1"}
+	if code := post("/groups/adduser", "hierdeptadmin1", addUser, nil); code != 200 {
+		t.Errorf("/groups/adduser as parent admin response = %d ; want 200", code)
+	}
+	members := map[string]interface{}{"group": "hierdept1"}
+	if code := post("/groups/members", "hierteamadmin1", members, nil); code != 403 {
+		t.Errorf("/groups/members of parent as child admin response = %d ; want 403", code)
+	}
+
+	// Hierarchies cannot loop, and only site admins move groups to the top
+	cycle := map[string]interface{}{"group": "hierdept1", "parent": "hierteam1"}
+	if code := post("/groups/setparent", "hierdeptadmin1", cycle, nil); code != 409 {
+		t.Errorf("/groups/setparent making a cycle response = %d ; want 409", code)
+	}
+	detach := map[string]interface{}{"group": "hierteam1", "parent": ""}
+	if code := post("/groups/setparent", "hierteamadmin1", detach, nil); code != 403 {
+		t.Errorf("/groups/setparent to the top as group admin response = %d ; want 403", code)
+	}
+
+	// Grants to the parent reach members of the child, less what is denied
+	newCommand := map[string]interface{}{
+		"group":       conciergedb.InitConciergeGroups.Site,
+		"commandname": "hiercmd1",
+		"runcommand":  "echo hiercmd1",
+		"killcommand": "",
+	}
+	if code := post("/command/newcommand", adminUser, newCommand, nil); code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+	grant := map[string]interface{}{
+		"process":     "hiercmd1",
+		"group":       "hierdept1",
+		"role":        conciergedb.InitConciergeRoles.User,
+		"permissions": "r-x",
+	}
+	if code := post("/command/grantpermission", adminUser, grant, nil); code != 200 {
+		t.Fatalf("/command/grantpermission response = %d ; want 200", code)
+	}
+	if !hasPermission("hiermember1", "hierteam1", "rx") {
+		t.Errorf("HasPermission rx through parent = false ; want true")
+	}
+	if hasPermission("hierteamadmin1", "hierteam1", "r") {
+		t.Errorf("HasPermission r without the granted role = true ; want false")
+	}
+
+	deny := map[string]interface{}{
+		"process":     "hiercmd1",
+		"group":       "hierteam1",
+		"role":        conciergedb.InitConciergeRoles.User,
+		"permissions": "--x",
+		"deny":        true,
+	}
+	if code := post("/command/grantpermission", adminUser, deny, nil); code != 200 {
+		t.Fatalf("/command/grantpermission deny response = %d ; want 200", code)
+	}
+	if !hasPermission("hiermember1", "hierteam1", "r") {
+		t.Errorf("HasPermission r with x denied = false ; want true")
+	}
+	if hasPermission("hiermember1", "hierteam1", "x") {
+		t.Errorf("HasPermission x with x denied = true ; want false")
+	}
+
+	var explainRes server.ExplainPermissionRes
+	explain := map[string]interface{}{"group": "hierteam1", "process": "hiercmd1", "permission": "x"}
+	if code := post("/access/explain", "hiermember1", explain, &explainRes); code != 200 {
+		t.Fatalf("/access/explain response = %d ; want 200", code)
+	}
+	if explainRes.FailedCheck != server.CheckBits || explainRes.Denied != "--x" || len(explainRes.Grants) != 2 {
+		t.Errorf("/access/explain = %+v ; want denied --x from 2 grants", explainRes)
+	}
+
+	// Parents with children are in use, and moving a group away ends what it
+	// inherits
+	if code := post("/groups/delete", "hierdeptadmin1", map[string]interface{}{"group": "hierdept1"}, nil); code != 409 {
+		t.Errorf("/groups/delete of a parent response = %d ; want 409", code)
+	}
+	if code := post("/groups/setparent", adminUser, detach, nil); code != 200 {
+		t.Fatalf("/groups/setparent to the top response = %d ; want 200", code)
+	}
+	if hasPermission("hiermember1", "hierteam1", "r") {
+		t.Errorf("HasPermission r after leaving the parent = true ; want false")
+	}
+	if code := post("/groups/members", "hierdeptadmin1", map[string]interface{}{"group": "hierteam1"}, nil); code != 403 {
+		t.Errorf("/groups/members as former parent admin response = %d ; want 403", code)
+	}
+}
+
+func TestPolicyAuthorizer(t *testing.T) {
+	logger.Info("===Testing policy authorizer===")
+	adminUser := configSiteAdmin["User"].(string)
+
+	dir, err := ioutil.TempDir("", "netrun-policies")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	policy := `
+rules:
+  - name: backups-outside-business-hours
+    effect: deny
+    condition: >
+      process.startsWith("backup-") && permission == "x" &&
+      (now.getHours("Europe/Madrid") < 9 || now.getHours("Europe/Madrid") >= 18)
+  - name: operators-run-backups
+    effect: allow
+    condition: '"operator" in roles && process.startsWith("backup-") && permission == "x"'
+  - name: grants
+    effect: allow
+    condition: rbac
+`
+	if err = ioutil.WriteFile(path.Join(dir, "backups.yaml"), []byte(policy), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	policyAuthorizer, err := server.NewPolicyAuthorizer([]string{dir})
+	if err != nil {
+		t.Fatalf("NewPolicyAuthorizer = %s", err.Error())
+	}
+
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	noon := time.Date(2024, 3, 4, 12, 0, 0, 0, madrid)
+	night := time.Date(2024, 3, 4, 22, 0, 0, 0, madrid)
+	operator := []string{"operator"}
+
+	cases := []struct {
+		name  string
+		input server.PolicyInput
+		want  server.PolicyDecision
+	}{
+		{
+			"operator runs backup in business hours",
+			server.PolicyInput{Process: "backup-db", Permission: "x", Roles: operator, Time: noon},
+			server.PolicyDecision{Allowed: true, Rule: "operators-run-backups"},
+		},
+		{
+			"operator runs backup at night",
+			server.PolicyInput{Process: "backup-db", Permission: "x", Roles: operator, Time: night},
+			server.PolicyDecision{Allowed: false, Rule: "backups-outside-business-hours"},
+		},
+		{
+			"grants do not beat the deny",
+			server.PolicyInput{Process: "backup-db", Permission: "x", Rbac: true, Time: night},
+			server.PolicyDecision{Allowed: false, Rule: "backups-outside-business-hours"},
+		},
+		{
+			"operator reads backup at night",
+			server.PolicyInput{Process: "backup-db", Permission: "r", Roles: operator, Time: night},
+			server.PolicyDecision{Allowed: false},
+		},
+		{
+			"grants allow other commands",
+			server.PolicyInput{Process: "build", Permission: "x", Rbac: true, Time: night},
+			server.PolicyDecision{Allowed: true, Rule: "grants"},
+		},
+		{
+			"nothing matches",
+			server.PolicyInput{Process: "build", Permission: "x", Roles: operator, Time: noon},
+			server.PolicyDecision{Allowed: false},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, err := policyAuthorizer.Decide(tc.input)
+			if err != nil {
+				t.Fatalf("Decide = %s", err.Error())
+			}
+			if decision != tc.want {
+				t.Errorf("Decide = %+v ; want %+v", decision, tc.want)
+			}
+		})
+	}
+
+	// Invalid policies fail to load, and failed reloads keep the old rules
+	invalid := map[string]string{
+		"syntax":   "rules:\n  - name: broken\n    effect: allow\n    condition: 'user =='\n",
+		"not bool": "rules:\n  - name: string\n    effect: allow\n    condition: user\n",
+		"effect":   "rules:\n  - name: maybe\n    effect: perhaps\n    condition: 'true'\n",
+		"unknown":  "rules:\n  - name: typo\n    efect: allow\n    condition: 'true'\n",
+	}
+	for name, policy := range invalid {
+		file := path.Join(dir, "invalid.yaml")
+		if err = ioutil.WriteFile(file, []byte(policy), 0600); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err = server.NewPolicyAuthorizer([]string{file}); err == nil {
+			t.Errorf("NewPolicyAuthorizer with %s error = nil ; want error", name)
+		}
+		if err = policyAuthorizer.Reload(); err == nil {
+			t.Errorf("Reload with %s error = nil ; want error", name)
+		}
+	}
+	decision, err := policyAuthorizer.Decide(cases[0].input)
+	if err != nil || decision != cases[0].want {
+		t.Errorf("Decide after failed reload = %+v, %v ; want %+v", decision, err, cases[0].want)
+	}
+
+	lockdown := "rules:\n  - name: lockdown\n    effect: deny\n    condition: 'true'\n"
+	if err = ioutil.WriteFile(path.Join(dir, "invalid.yaml"), []byte(lockdown), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = policyAuthorizer.Reload(); err != nil {
+		t.Fatalf("Reload = %s", err.Error())
+	}
+	decision, err = policyAuthorizer.Decide(cases[0].input)
+	if err != nil || decision.Allowed || decision.Rule != "lockdown" {
+		t.Errorf("Decide after reload = %+v, %v ; want denied by lockdown", decision, err)
+	}
+
+	// Authorize looks up roles from the database
+	roleFile := path.Join(dir, "roles.yaml")
+	rolePolicy := "rules:\n  - name: site-admins\n    effect: allow\n    condition: 'group == \"site\" && \"admin\" in roles'\n"
+	if err = ioutil.WriteFile(roleFile, []byte(rolePolicy), 0600); err != nil {
+		t.Fatalf(err.Error())
+	}
+	roleAuthorizer, err := server.NewPolicyAuthorizer([]string{roleFile})
+	if err != nil {
+		t.Fatalf("NewPolicyAuthorizer = %s", err.Error())
+	}
+	for user, want := range map[string]bool{adminUser: true, "nosuchuser": false} {
+		allowed, err := roleAuthorizer.Authorize(server.AuthzRequest{
+			User:       user,
+			Group:      conciergedb.InitConciergeGroups.Site,
+			Process:    "nosuchcmd",
+			Permission: "x",
+			Time:       time.Now(),
+		})
+		if err != nil || allowed != want {
+			t.Errorf("Authorize %s = %t, %v ; want %t", user, allowed, err, want)
+		}
+	}
+}
+
+func TestTokenIdentity(t *testing.T) {
+	logger.Info("===Testing identity from tokens===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+
+	post := func(path string, token string, body map[string]interface{}) (int, string) {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+token)
+		srv.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	signin := func(user string, password string) string {
+		var signinRes server.SigninRes
+		code, res := post("/access/signin", "", map[string]interface{}{"user": user, "password": password})
+		if code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, code)
+		}
+		if err := json.Unmarshal([]byte(res), &signinRes); err != nil {
+			t.Fatalf("Error decoding /access/signin response")
+		}
+		return signinRes.AccessToken
+	}
+
+	signup := map[string]interface{}{"user": "identuser1", "email": "identuser1@test.com", "password": password}
+	if code, _ := post("/access/signup", "", signup); code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", code)
+	}
+	userToken := signin("identuser1", password)
+	adminToken := signin(adminUser, configSiteAdmin["Password"].(string))
+	site := conciergedb.InitConciergeGroups.Site
+
+	// Bodies need only name the resource
+	if code, _ := post("/groups/usage", adminToken, map[string]interface{}{"group": site}); code != 200 {
+		t.Errorf("/groups/usage without user response = %d ; want 200", code)
+	}
+	if code, _ := post("/roles/list", userToken, map[string]interface{}{}); code != 200 {
+		t.Errorf("/roles/list with an empty body response = %d ; want 200", code)
+	}
+
+	// Bodies that name a user must name the token's
+	impersonate := map[string]interface{}{"user": adminUser, "group": site}
+	if code, _ := post("/groups/usage", userToken, impersonate); code != 401 {
+		t.Errorf("/groups/usage naming another user response = %d ; want 401", code)
+	}
+
+	// Roles come from the database, not the body
+	putSecret := map[string]interface{}{
+		"group":      site,
+		"role":       conciergedb.InitConciergeRoles.Admin,
+		"secretname": "identsecret1",
+		"value":      "hunter2",
+	}
+	if code, _ := post("/secrets/putsecret", userToken, putSecret); code != 403 {
+		t.Errorf("/secrets/putsecret claiming admin in the body response = %d ; want 403", code)
+	}
+	explain := map[string]interface{}{"target": adminUser, "group": site, "process": "nosuchcmd", "permission": "r"}
+	if code, _ := post("/access/explain", userToken, explain); code != 403 {
+		t.Errorf("/access/explain on another user as a non-admin response = %d ; want 403", code)
+	}
+
+	// Failed checks abort, so only their response is written
+	code, res := post("/groups/usage", userToken, map[string]interface{}{"group": "identnosuchgroup"})
+	var status map[string]interface{}
+	if code != 400 || json.Unmarshal([]byte(res), &status) != nil {
+		t.Errorf("/groups/usage outside the group = %d %s ; want a single 400 response", code, res)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	logger.Info("===Testing the audit log===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+
+	post := func(path string, token string, requestId string, body interface{}, res interface{}) int {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		if requestId != "" {
+			req.Header.Set(server.RequestIdHeader, requestId)
+		}
+		srv.ServeHTTP(w, req)
+		if requestId != "" && w.Header().Get(server.RequestIdHeader) != requestId {
+			t.Errorf("%s answered with request id %q ; want %q", path, w.Header().Get(server.RequestIdHeader), requestId)
+		}
+		if res != nil && w.Code == 200 {
+			if err = json.Unmarshal(w.Body.Bytes(), res); err != nil {
+				t.Errorf("Error decoding %s response", path)
+			}
+		}
+		return w.Code
+	}
+	signin := func(user string, password string, requestId string) string {
+		var signinRes server.SigninRes
+		body := map[string]string{"user": user, "password": password}
+		if code := post("/access/signin", "", requestId, body, &signinRes); code != 200 {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, code)
+		}
+		return signinRes.AccessToken
+	}
+
+	signup := map[string]string{"user": "audituser1", "email": "audituser1@test.com", "password": password}
+	if code := post("/access/signup", "", "audit-signup-1", signup, nil); code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", code)
+	}
+	userToken := signin("audituser1", password, "audit-signin-1")
+	adminToken := signin(adminUser, configSiteAdmin["Password"].(string), "")
+	wrongPassword := map[string]string{"user": "audituser1", "password": "wrong"}
+	if code := post("/access/signin", "", "audit-signin-2", wrongPassword, nil); code != 401 {
+		t.Errorf("/access/signin with a wrong password response = %d ; want 401", code)
+	}
+
+	// Only site admins read the log
+	if code := post("/audit", userToken, "", map[string]string{}, nil); code != 403 {
+		t.Errorf("/audit as a user response = %d ; want 403", code)
+	}
+
+	var auditRes server.AuditQueryRes
+	query := map[string]interface{}{"actor": "audituser1"}
+	if code := post("/audit", adminToken, "", query, &auditRes); code != 200 {
+		t.Fatalf("/audit response = %d ; want 200", code)
+	}
+	var actions []string
+	for _, entry := range auditRes.Entries {
+		actions = append(actions, entry.Action+"/"+entry.Outcome+"/"+entry.RequestId)
+	}
+	want := []string{
+		server.AuditSigninFailed + "/" + server.AuditFailure + "/audit-signin-2",
+		server.AuditSignin + "/" + server.AuditSuccess + "/audit-signin-1",
+		server.AuditSignup + "/" + server.AuditSuccess + "/audit-signup-1",
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("/audit entries of audituser1 = %v ; want %v", actions, want)
+	}
+
+	query = map[string]interface{}{"requestid": "audit-signin-1"}
+	if code := post("/audit", adminToken, "", query, &auditRes); code != 200 || len(auditRes.Entries) != 1 {
+		t.Errorf("/audit by request id = %d with %d entries ; want 200 with 1", code, len(auditRes.Entries))
+	} else if auditRes.Entries[0].Actor != "audituser1" {
+		t.Errorf("/audit by request id found actor %q ; want audituser1", auditRes.Entries[0].Actor)
+	}
+
+	// Pages go back from the newest entry without overlapping
+	var seen []int64
+	query = map[string]interface{}{"actor": "audituser1", "limit": 2}
+	for page := 0; page < 3; page++ {
+		auditRes = server.AuditQueryRes{}
+		if code := post("/audit", adminToken, "", query, &auditRes); code != 200 {
+			t.Fatalf("/audit page %d response = %d ; want 200", page, code)
+		}
+		for _, entry := range auditRes.Entries {
+			seen = append(seen, entry.Aid)
+		}
+		if auditRes.Next == 0 {
+			break
+		}
+		query["before"] = auditRes.Next
+	}
+	if len(seen) != 3 || seen[0] <= seen[1] || seen[1] <= seen[2] {
+		t.Errorf("/audit pages of audituser1 returned aids %v ; want 3 descending", seen)
+	}
+
+	// The chain holds, and entries cannot be changed
+	var verifyRes server.AuditVerifyRes
+	if code := post("/audit/verify", adminToken, "", map[string]string{}, &verifyRes); code != 200 || !verifyRes.Valid {
+		t.Fatalf("/audit/verify = %d %+v ; want a valid chain", code, verifyRes)
+	}
+	tampered := seen[1]
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.AuditLog + ` SET outcome = 'failure' WHERE aid = $1`
+	if _, err := db.Exec(queryStr, tampered); err == nil {
+		t.Errorf("Updating an audit entry succeeded ; want an error")
+	}
+	queryStr = `DELETE FROM ` + conciergedb.ConciergeTables.AuditLog + ` WHERE aid = $1`
+	if _, err := db.Exec(queryStr, tampered); err == nil {
+		t.Errorf("Deleting an audit entry succeeded ; want an error")
+	}
+
+	// Tampering that gets past the trigger breaks the chain at the entry
+	alterTrigger := func(enable string) {
+		queryStr := `ALTER TABLE ` + conciergedb.ConciergeTables.AuditLog + ` ` + enable + ` TRIGGER audit_log_no_change`
+		if _, err := db.Exec(queryStr); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	alterTrigger("DISABLE")
+	queryStr = `UPDATE ` + conciergedb.ConciergeTables.AuditLog + ` SET outcome = 'failure' WHERE aid = $1`
+	if _, err := db.Exec(queryStr, tampered); err != nil {
+		t.Fatalf(err.Error())
+	}
+	verifyRes = server.AuditVerifyRes{}
+	if code := post("/audit/verify", adminToken, "", map[string]string{}, &verifyRes); code != 200 {
+		t.Errorf("/audit/verify response = %d ; want 200", code)
+	} else if verifyRes.Valid || verifyRes.BrokenAt != tampered {
+		t.Errorf("/audit/verify after tampering = %+v ; want broken at %d", verifyRes, tampered)
+	}
+	queryStr = `UPDATE ` + conciergedb.ConciergeTables.AuditLog + ` SET outcome = 'success' WHERE aid = $1`
+	if _, err := db.Exec(queryStr, tampered); err != nil {
+		t.Fatalf(err.Error())
+	}
+	alterTrigger("ENABLE")
+
+	// Changes to groups, roles, secrets and commands are logged, failed
+	// attempts as well
+	site := conciergedb.InitConciergeGroups.Site
+	changes := []struct {
+		path    string
+		body    map[string]interface{}
+		code    int
+		action  string
+		outcome string
+	}{
+		{
+			"/groups/create",
+			map[string]interface{}{"group": "auditgroup1"},
+			200, server.AuditGroupCreate, server.AuditSuccess,
+		},
+		{
+			"/groups/adduser",
+			map[string]interface{}{"group": "auditgroup1", "target": "audituser1"},
+			200, server.AuditGroupAddUser, server.AuditSuccess,
+		},
+		{
+			"/groups/adduser",
+			map[string]interface{}{"group": "auditgroup1", "target": "audituser1"},
+			409, server.AuditGroupAddUser, server.AuditFailure,
+		},
+		{
+			"/roles/create",
+			map[string]interface{}{"role": "auditrole1"},
+			200, server.AuditRoleCreate, server.AuditSuccess,
+		},
+		{
+			"/roles/assign",
+			map[string]interface{}{"group": "auditgroup1", "target": "audituser1", "roles": []string{"auditrole1"}},
+			200, server.AuditRoleAssign, server.AuditSuccess,
+		},
+		{
+			"/secrets/putsecret",
+			map[string]interface{}{"group": "auditgroup1", "secretname": "auditsecret1", "value": "hunter2"},
+			200, server.AuditSecretPut, server.AuditSuccess,
+		},
+		{
+			"/secrets/deletesecret",
+			map[string]interface{}{"group": "auditgroup1", "secretname": "nosuchsecret"},
+			404, server.AuditSecretDelete, server.AuditFailure,
+		},
+		{
+			"/command/newcommand",
+			map[string]interface{}{"group": site, "commandname": "auditcmd1", "runcommand": "echo auditcmd1"},
+			200, server.AuditCommandRegister, server.AuditSuccess,
+		},
+		{
+			"/command/newcommand",
+			map[string]interface{}{"group": site, "commandname": "auditcmd2", "memorylimit": -1},
+			400, server.AuditCommandRegister, server.AuditFailure,
+		},
+		{
+			"/command/killcommand",
+			map[string]interface{}{"group": site, "process": "auditcmd1", "runname": "nosuchrun"},
+			404, server.AuditCommandKill, server.AuditFailure,
+		},
+	}
+	for i, change := range changes {
+		requestId := fmt.Sprintf("audit-change-%d", i)
+		if code := post(change.path, adminToken, requestId, change.body, nil); code != change.code {
+			t.Errorf("%s response = %d ; want %d", change.path, code, change.code)
+		}
+		auditRes = server.AuditQueryRes{}
+		query = map[string]interface{}{"requestid": requestId}
+		if code := post("/audit", adminToken, "", query, &auditRes); code != 200 || len(auditRes.Entries) != 1 {
+			t.Errorf("/audit of %s = %d with %d entries ; want 200 with 1", change.path, code, len(auditRes.Entries))
+			continue
+		}
+		entry := auditRes.Entries[0]
+		if entry.Action != change.action || entry.Outcome != change.outcome || entry.Actor != adminUser {
+			t.Errorf(
+				"/audit of %s = %s/%s by %s ; want %s/%s by %s",
+				change.path, entry.Action, entry.Outcome, entry.Actor,
+				change.action, change.outcome, adminUser,
+			)
+		}
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	logger.Info("===Testing schedules===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, user string, body map[string]interface{}) int {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+tokens[user])
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		reqBody, _ := json.Marshal(map[string]string{"user": user, "password": password})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &signinRes) != nil {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, w.Code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+	queuedRuns := func(schedule string) int {
+		var count int
+		queryStr := `SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name LIKE $1`
+		if err := db.QueryRow(queryStr, schedule+"-%").Scan(&count); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return count
+	}
+	makeDue := func(schedule string) {
+		queryStr := `
+			UPDATE ` + conciergedb.ConciergeTables.Schedules + `
+			SET next_run = now() - interval '5 seconds'
+			WHERE name = $1`
+		if _, err := db.Exec(queryStr, schedule); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	signup, _ := json.Marshal(map[string]string{"user": "schedowner1", "email": "schedowner1@test.com", "password": password})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/access/signup", bytes.NewBuffer(signup))
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", w.Code)
+	}
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+	if _, err := db.Exec(queryStr, "schedowner1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	signin("schedowner1", password)
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	group := map[string]interface{}{"group": "schedteam1", "owner": "schedowner1"}
+	if code := post("/groups/create", adminUser, group); code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	newCommand := map[string]interface{}{
+		"group":       conciergedb.InitConciergeGroups.Site,
+		"commandname": "schedcmd1",
+		"runcommand":  "echo schedcmd1",
+		"killcommand": "",
+	}
+	if code := post("/command/newcommand", adminUser, newCommand); code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+	grant := map[string]interface{}{
+		"process":     "schedcmd1",
+		"group":       "schedteam1",
+		"role":        conciergedb.InitConciergeRoles.Admin,
+		"permissions": "--x",
+	}
+	if code := post("/command/grantpermission", adminUser, grant); code != 200 {
+		t.Fatalf("/command/grantpermission response = %d ; want 200", code)
+	}
+
+	schedule := map[string]interface{}{
+		"group":        "schedteam1",
+		"process":      "schedcmd1",
+		"schedulename": "schedtest1",
+		"cron":         "@hourly",
+	}
+
+	// Schedules run commands, so they need a verified email like commands do
+	queryStr = `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = $1 WHERE username = $2`
+	if _, err := db.Exec(queryStr, false, "schedowner1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if code := post("/schedule/newschedule", "schedowner1", schedule); code != 403 {
+		t.Errorf("/schedule/newschedule with an unverified email response = %d ; want 403", code)
+	}
+	if _, err := db.Exec(queryStr, true, "schedowner1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if code := post("/schedule/newschedule", "schedowner1", schedule); code != 200 {
+		t.Fatalf("/schedule/newschedule response = %d ; want 200", code)
+	}
+
+	// Paused schedules do not fire, resumed ones do
+	pause := map[string]interface{}{"group": "schedteam1", "process": "schedcmd1", "schedulename": "schedtest1"}
+	if code := post("/schedule/pauseschedule", "schedowner1", pause); code != 200 {
+		t.Fatalf("/schedule/pauseschedule response = %d ; want 200", code)
+	}
+	makeDue("schedtest1")
+	server.FireDueSchedules(time.Now())
+	if n := queuedRuns("schedtest1"); n != 0 {
+		t.Errorf("Paused schedule queued %d runs ; want 0", n)
+	}
+	if code := post("/schedule/resumeschedule", "schedowner1", pause); code != 200 {
+		t.Fatalf("/schedule/resumeschedule response = %d ; want 200", code)
+	}
+	makeDue("schedtest1")
+	server.FireDueSchedules(time.Now())
+	if n := queuedRuns("schedtest1"); n != 1 {
+		t.Errorf("Due schedule queued %d runs ; want 1", n)
+	}
+
+	// Pausing names the process the schedule runs
+	wrongProcess := map[string]interface{}{"group": "schedteam1", "process": "nosuchcmd", "schedulename": "schedtest1"}
+	if code := post("/schedule/pauseschedule", "schedowner1", wrongProcess); code == 200 {
+		t.Errorf("/schedule/pauseschedule of another process response = %d ; want an error", code)
+	}
+
+	// Schedules stop firing once their runner loses execute permission
+	if code := post("/command/revokepermission", adminUser, grant); code != 200 {
+		t.Fatalf("/command/revokepermission response = %d ; want 200", code)
+	}
+	makeDue("schedtest1")
+	server.FireDueSchedules(time.Now().Add(time.Second))
+	if n := queuedRuns("schedtest1"); n != 1 {
+		t.Errorf("Schedule of a runner without execute permission queued %d runs ; want 1", n)
+	}
+}
+
+// A run of the fake runtime used to test the queue. It exits when told to or
+// when killed.
+type testRun struct {
+	request server.RunRequest
+	pid     int
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func (r *testRun) Pid() int {
+	return r.pid
+}
+
+func (r *testRun) Wait() error {
+	<-r.done
+	return r.err
+}
+
+func (r *testRun) Kill() error {
+	r.exit(fmt.Errorf("signal: killed"))
+	return nil
+}
+
+func (r *testRun) exit(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.done)
+	})
+}
+
+// Sets up the fake runtime on a node of its own. started returns the run of a
+// name once it has been started, and restore puts the previous node back.
+func useTestRunner(node string) (started func(runName string) *testRun, restore func()) {
+	var runsMutex sync.Mutex
+	runs := map[string]*testRun{}
+	server.SetProcessRunner(func(runRequest server.RunRequest) (server.RunHandle, error) {
+		runsMutex.Lock()
+		defer runsMutex.Unlock()
+		run := &testRun{request: runRequest, pid: 1000 + len(runs), done: make(chan struct{})}
+		runs[runRequest.Name] = run
+		return run, nil
+	})
+	previousNode := server.GetNodeName()
+	server.SetNodeName(node)
+
+	started = func(runName string) *testRun {
+		runsMutex.Lock()
+		defer runsMutex.Unlock()
+		return runs[runName]
+	}
+	restore = func() {
+		server.SetProcessRunner(nil)
+		server.SetNodeName(previousNode)
+		server.SetNodeRunLimit(8)
+		server.SetGroupRunLimit(2)
+	}
+	return started, restore
+}
+
+// Waits for the goroutine waiting on a run to finish it
+func waitRunStatus(t *testing.T, runName string, want string) {
+	var status string
+	queryStr := `SELECT status FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name = $1`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := db.QueryRow(queryStr, runName).Scan(&status); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if status == want || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != want {
+		t.Errorf("Status of %s = %s ; want %s", runName, status, want)
+	}
+}
+
+func TestRunQueue(t *testing.T) {
+	logger.Info("===Testing the run queue===")
+	adminUser := configSiteAdmin["User"].(string)
+	siteGroup := conciergedb.InitConciergeGroups.Site
+	var token string
+
+	started, restore := useTestRunner("queuetest-node")
+	defer restore()
+	server.SetNodeRunLimit(3)
+	server.SetGroupRunLimit(2)
+
+	post := func(path string, body map[string]interface{}) int {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+token)
+		srv.ServeHTTP(w, req)
+		return w.Code
+	}
+	runStatus := func(runName string) string {
+		var status string
+		queryStr := `SELECT status FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name = $1`
+		if err := db.QueryRow(queryStr, runName).Scan(&status); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return status
+	}
+	run := func(runName string, priority int) int {
+		return post("/command/runcommand", map[string]interface{}{
+			"group":    siteGroup,
+			"process":  "queuecmd1",
+			"runname":  runName,
+			"priority": priority,
+		})
+	}
+	kill := func(runName string) int {
+		return post("/command/killcommand", map[string]interface{}{
+			"group":   siteGroup,
+			"process": "queuecmd1",
+			"runname": runName,
+		})
+	}
+
+	var signinRes server.SigninRes
+	reqBody, _ := json.Marshal(map[string]string{"user": adminUser, "password": configSiteAdmin["Password"].(string)})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &signinRes) != nil {
+		t.Fatalf("/access/signin response = %d ; want 200", w.Code)
+	}
+	token = signinRes.AccessToken
+
+	newCommand := map[string]interface{}{
+		"group":       siteGroup,
+		"commandname": "queuecmd1",
+		"runcommand":  "echo queuecmd1",
+		"killcommand": "",
+	}
+	if code := post("/command/newcommand", newCommand); code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+
+	for _, queued := range []struct {
+		name     string
+		priority int
+	}{{"queuetest1", 0}, {"queuetest2", 0}, {"queuetest3", 5}} {
+		if code := run(queued.name, queued.priority); code != 200 {
+			t.Fatalf("/command/runcommand %s response = %d ; want 200", queued.name, code)
+		}
+	}
+	if code := run("queuetest1", 0); code != 409 {
+		t.Errorf("/command/runcommand of a taken name response = %d ; want 409", code)
+	}
+
+	// The group cap lets two runs start, highest priority first
+	server.DispatchQueuedRuns()
+	if started("queuetest3") == nil || started("queuetest1") == nil {
+		t.Fatalf("Dispatch did not start queuetest3 and queuetest1")
+	}
+	if started("queuetest2") != nil {
+		t.Errorf("Dispatch started queuetest2 past the group cap")
+	}
+	if status := runStatus("queuetest2"); status != conciergedb.ConciergeRunStatuses.Queued {
+		t.Errorf("Status of queuetest2 = %s ; want %s", status, conciergedb.ConciergeRunStatuses.Queued)
+	}
+
+	// Runs that exit free their slot
+	started("queuetest3").exit(nil)
+	waitRunStatus(t, "queuetest3", conciergedb.ConciergeRunStatuses.Finished)
+	server.DispatchQueuedRuns()
+	if started("queuetest2") == nil {
+		t.Fatalf("Dispatch did not start queuetest2 after queuetest3 finished")
+	}
+
+	// Killed runs stop and free their slot too
+	if code := kill("queuetest1"); code != 200 {
+		t.Errorf("/command/killcommand of a running run response = %d ; want 200", code)
+	}
+	waitRunStatus(t, "queuetest1", conciergedb.ConciergeRunStatuses.Killed)
+
+	// The node cap holds runs back whatever their group allows
+	server.SetNodeRunLimit(1)
+	if code := run("queuetest4", 0); code != 200 {
+		t.Fatalf("/command/runcommand queuetest4 response = %d ; want 200", code)
+	}
+	server.DispatchQueuedRuns()
+	if started("queuetest4") != nil {
+		t.Errorf("Dispatch started queuetest4 past the node cap")
+	}
+
+	// Queued runs are killed without starting
+	if code := kill("queuetest4"); code != 200 {
+		t.Errorf("/command/killcommand of a queued run response = %d ; want 200", code)
+	}
+	if status := runStatus("queuetest4"); status != conciergedb.ConciergeRunStatuses.Killed {
+		t.Errorf("Status of queuetest4 = %s ; want %s", status, conciergedb.ConciergeRunStatuses.Killed)
+	}
+	server.SetNodeRunLimit(3)
+	server.DispatchQueuedRuns()
+	if started("queuetest4") != nil {
+		t.Errorf("Dispatch started the killed queuetest4")
+	}
+	if code := kill("queuetest4"); code != 409 {
+		t.Errorf("/command/killcommand of a killed run response = %d ; want 409", code)
+	}
+	if code := kill("nosuchrun"); code != 404 {
+		t.Errorf("/command/killcommand of an unknown run response = %d ; want 404", code)
+	}
+
+	started("queuetest2").exit(fmt.Errorf("exit status 1"))
+	waitRunStatus(t, "queuetest2", conciergedb.ConciergeRunStatuses.Failed)
+
+	// Runs a previous process of this member left running are failed, runs
+	// it holds a handle for are not
+	if code := run("queuetest7", 0); code != 200 {
+		t.Fatalf("/command/runcommand queuetest7 response = %d ; want 200", code)
+	}
+	server.DispatchQueuedRuns()
+	if started("queuetest7") == nil {
+		t.Fatalf("Dispatch did not start queuetest7")
+	}
+	queryStr := `
+		INSERT INTO ` + conciergedb.ConciergeTables.RunQueue + `
+		  (name, rpid, runner_uid, gid, priority, status, node, args, date_created, date_started)
+		SELECT $1, rpid, runner_uid, gid, priority, status, node, args, now(), now()
+		FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name = $2
+		`
+	if _, err := db.Exec(queryStr, "queuetest8", "queuetest7"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	queryStr = `
+		INSERT INTO ` + conciergedb.ConciergeTables.RunningProcesses + ` (name, pid, runner_uid, gid, rpid)
+		SELECT $1, 1, runner_uid, gid, rpid
+		FROM ` + conciergedb.ConciergeTables.RunningProcesses + ` WHERE name = $2
+		`
+	if _, err := db.Exec(queryStr, "queuetest8", "queuetest7"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := server.ReconcileRuns(); err != nil {
+		t.Fatalf("ReconcileRuns = %s", err.Error())
+	}
+	if status := runStatus("queuetest8"); status != conciergedb.ConciergeRunStatuses.Failed {
+		t.Errorf("Status of the lost queuetest8 = %s ; want %s", status, conciergedb.ConciergeRunStatuses.Failed)
+	}
+	if status := runStatus("queuetest7"); status != conciergedb.ConciergeRunStatuses.Running {
+		t.Errorf("Status of the live queuetest7 = %s ; want %s", status, conciergedb.ConciergeRunStatuses.Running)
+	}
+	var runningProcesses int
+	queryStr = `SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.RunningProcesses + ` WHERE name = $1`
+	if err := db.QueryRow(queryStr, "queuetest8").Scan(&runningProcesses); err != nil || runningProcesses != 0 {
+		t.Errorf("Running processes of the lost queuetest8 = %d ; want 0", runningProcesses)
+	}
+	started("queuetest7").exit(nil)
+	waitRunStatus(t, "queuetest7", conciergedb.ConciergeRunStatuses.Finished)
+
+	// Commands with running runs are not deleted, and nothing of them is
+	deleteCommand := map[string]interface{}{
+		"group":       siteGroup,
+		"commandname": "queuecmd1",
+		"process":     "queuecmd1",
+	}
+	server.SetNodeRunLimit(1)
+	for _, runName := range []string{"queuetest5", "queuetest6"} {
+		if code := run(runName, 0); code != 200 {
+			t.Fatalf("/command/runcommand %s response = %d ; want 200", runName, code)
+		}
+	}
+	server.DispatchQueuedRuns()
+	if started("queuetest5") == nil {
+		t.Fatalf("Dispatch did not start queuetest5")
+	}
+	if code := post("/command/deletecommand", deleteCommand); code != 409 {
+		t.Errorf("/command/deletecommand with a running run response = %d ; want 409", code)
+	}
+	if status := runStatus("queuetest6"); status != conciergedb.ConciergeRunStatuses.Queued {
+		t.Errorf("Status of queuetest6 after a refused delete = %s ; want %s", status, conciergedb.ConciergeRunStatuses.Queued)
+	}
+
+	server.SetNodeRunLimit(0)
+	started("queuetest5").exit(nil)
+	waitRunStatus(t, "queuetest5", conciergedb.ConciergeRunStatuses.Finished)
+	if code := post("/command/deletecommand", deleteCommand); code != 200 {
+		t.Errorf("/command/deletecommand response = %d ; want 200", code)
+	}
+	var runs int
+	queryStr = `SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name = $1`
+	if err := db.QueryRow(queryStr, "queuetest6").Scan(&runs); err != nil || runs != 0 {
+		t.Errorf("Queued runs of a deleted command = %d ; want 0", runs)
+	}
+}
+
+func TestGroupQuotas(t *testing.T) {
+	logger.Info("===Testing group quotas===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	started, restore := useTestRunner("quotatest-node")
+	defer restore()
+
+	post := func(path string, user string, body map[string]interface{}) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+tokens[user])
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		reqBody, _ := json.Marshal(map[string]string{"user": user, "password": password})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &signinRes) != nil {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, w.Code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+	run := func(runName string) int {
+		return post("/command/runcommand", "quotaowner1", map[string]interface{}{
+			"group":   "quotateam1",
+			"process": "quotacmd1",
+			"runname": runName,
+		}).Code
+	}
+	usage := func() conciergedb.DbResources {
+		var usageRes server.GroupUsageRes
+		w := post("/groups/usage", "quotaowner1", map[string]interface{}{"group": "quotateam1"})
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &usageRes) != nil {
+			t.Fatalf("/groups/usage response = %d ; want 200", w.Code)
+		}
+		return usageRes.Usage
+	}
+
+	signup, _ := json.Marshal(map[string]string{"user": "quotaowner1", "email": "quotaowner1@test.com", "password": password})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/access/signup", bytes.NewBuffer(signup))
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", w.Code)
+	}
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+	if _, err := db.Exec(queryStr, "quotaowner1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	signin("quotaowner1", password)
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	group := map[string]interface{}{"group": "quotateam1", "owner": "quotaowner1"}
+	if code := post("/groups/create", adminUser, group).Code; code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	newCommand := map[string]interface{}{
+		"group":       conciergedb.InitConciergeGroups.Site,
+		"commandname": "quotacmd1",
+		"runcommand":  "echo quotacmd1",
+		"killcommand": "",
+		"memorylimit": 100,
+	}
+	if code := post("/command/newcommand", adminUser, newCommand).Code; code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+	grant := map[string]interface{}{
+		"process":     "quotacmd1",
+		"group":       "quotateam1",
+		"role":        conciergedb.InitConciergeRoles.Admin,
+		"permissions": "--x",
+	}
+	if code := post("/command/grantpermission", adminUser, grant).Code; code != 200 {
+		t.Fatalf("/command/grantpermission response = %d ; want 200", code)
+	}
+	quota := map[string]interface{}{"group": "quotateam1", "maxcontainers": 1, "maxmemory": 250}
+	if code := post("/groups/setquota", adminUser, quota).Code; code != 200 {
+		t.Fatalf("/groups/setquota response = %d ; want 200", code)
+	}
+
+	// Queued runs hold memory, so the third run does not fit
+	if code := run("quotatest1"); code != 200 {
+		t.Fatalf("/command/runcommand quotatest1 response = %d ; want 200", code)
+	}
+	if code := run("quotatest2"); code != 200 {
+		t.Fatalf("/command/runcommand quotatest2 response = %d ; want 200", code)
+	}
+	if code := run("quotatest3"); code != 429 {
+		t.Errorf("/command/runcommand past the memory quota response = %d ; want 429", code)
+	}
+
+	// max_containers caps the runs executing at once
+	server.DispatchQueuedRuns()
+	if started("quotatest1") == nil {
+		t.Fatalf("Dispatch did not start quotatest1")
+	}
+	if started("quotatest2") != nil {
+		t.Errorf("Dispatch started quotatest2 past max_containers")
+	}
+	if used := usage(); used.Containers != 1 || used.MemoryMb != 200 {
+		t.Errorf("Usage = %d containers, %d MB ; want 1 container, 200 MB", used.Containers, used.MemoryMb)
+	}
+
+	// Finished runs give their share back
+	started("quotatest1").exit(nil)
+	waitRunStatus(t, "quotatest1", conciergedb.ConciergeRunStatuses.Finished)
+	if used := usage(); used.Containers != 0 || used.MemoryMb != 100 {
+		t.Errorf("Usage = %d containers, %d MB ; want 0 containers, 100 MB", used.Containers, used.MemoryMb)
+	}
+	if code := run("quotatest3"); code != 200 {
+		t.Errorf("/command/runcommand after a run finished response = %d ; want 200", code)
+	}
+	server.DispatchQueuedRuns()
+	if started("quotatest2") == nil {
+		t.Errorf("Dispatch did not start quotatest2 after quotatest1 finished")
+	}
+	if started("quotatest3") != nil {
+		t.Errorf("Dispatch started quotatest3 past max_containers")
+	}
+
+	// Runs of the group on other members count against max_containers too
+	started("quotatest2").exit(nil)
+	waitRunStatus(t, "quotatest2", conciergedb.ConciergeRunStatuses.Finished)
+	queryStr = `
+		INSERT INTO ` + conciergedb.ConciergeTables.RunQueue + `
+		  (name, rpid, runner_uid, gid, priority, status, node, args, date_created, date_started)
+		SELECT $1, rpid, runner_uid, gid, priority, $2, $3, args, now(), now()
+		FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name = $4
+		`
+	_, err := db.Exec(queryStr, "quotatest4", conciergedb.ConciergeRunStatuses.Running, "quotatest-othernode", "quotatest1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	server.DispatchQueuedRuns()
+	if started("quotatest3") != nil {
+		t.Errorf("Dispatch started quotatest3 past max_containers counted across members")
+	}
+	usageRes := post("/groups/usage", "quotaowner1", map[string]interface{}{"group": "quotateam1"})
+	if !strings.Contains(usageRes.Body.String(), `"StorageEnforced":false`) {
+		t.Errorf("/groups/usage response = %s ; want StorageEnforced false", usageRes.Body.String())
+	}
+	queryStr = `UPDATE ` + conciergedb.ConciergeTables.RunQueue + ` SET status = $1 WHERE name = $2`
+	if _, err = db.Exec(queryStr, conciergedb.ConciergeRunStatuses.Finished, "quotatest4"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	server.DispatchQueuedRuns()
+	if started("quotatest3") == nil {
+		t.Fatalf("Dispatch did not start quotatest3 after the other member's run finished")
+	}
+	started("quotatest3").exit(nil)
+	waitRunStatus(t, "quotatest3", conciergedb.ConciergeRunStatuses.Finished)
+}
+
+func TestSecrets(t *testing.T) {
+	logger.Info("===Testing secrets===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	started, restore := useTestRunner("secrettest-node")
+	defer restore()
+
+	post := func(path string, user string, body map[string]interface{}) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+tokens[user])
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	signupVerified := func(user string) {
+		signup, _ := json.Marshal(map[string]string{"user": user, "email": user + "@test.com", "password": password})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signup", bytes.NewBuffer(signup))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("/access/signup %s response = %d ; want 200", user, w.Code)
+		}
+		queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+		if _, err := db.Exec(queryStr, user); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		reqBody, _ := json.Marshal(map[string]string{"user": user, "password": password})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &signinRes) != nil {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, w.Code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+	putSecret := func(user string, group string, secretname string, value string) int {
+		return post("/secrets/putsecret", user, map[string]interface{}{
+			"group":      group,
+			"secretname": secretname,
+			"value":      value,
+		}).Code
+	}
+	run := func(group string, runName string) {
+		body := map[string]interface{}{"group": group, "process": "secretcmd1", "runname": runName}
+		if code := post("/command/runcommand", "secretowner1", body).Code; code != 200 {
+			t.Fatalf("/command/runcommand %s response = %d ; want 200", runName, code)
+		}
+		server.DispatchQueuedRuns()
+	}
+	// Gives a secret of one group and name the ciphertext of another
+	copyCiphertext := func(fromGroup string, fromName string, toGroup string, toName string) {
+		queryStr := `
+			UPDATE ` + conciergedb.ConciergeTables.Secrets + ` s
+			SET ciphertext = (
+			  SELECT f.ciphertext FROM ` + conciergedb.ConciergeTables.Secrets + ` f
+			  INNER JOIN ` + conciergedb.ConciergeTables.Groups + ` fg ON fg.gid = f.gid
+			  WHERE fg.name = $1 AND f.name = $2)
+			FROM ` + conciergedb.ConciergeTables.Groups + ` g
+			WHERE g.gid = s.gid AND g.name = $3 AND s.name = $4`
+		if _, err := db.Exec(queryStr, fromGroup, fromName, toGroup, toName); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	for _, user := range []string{"secretowner1", "secretmember1", "secretoutsider1"} {
+		signupVerified(user)
+		signin(user, password)
+	}
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	for _, group := range []string{"secretteam1", "secretteam2"} {
+		body := map[string]interface{}{"group": group, "owner": "secretowner1"}
+		if code := post("/groups/create", adminUser, body).Code; code != 200 {
+			t.Fatalf("/groups/create %s response = %d ; want 200", group, code)
+		}
+	}
+	member := map[string]interface{}{"group": "secretteam1", "target": "secretmember1"}
+	if code := post("/groups/adduser", "secretowner1", member).Code; code != 200 {
+		t.Fatalf("/groups/adduser response = %d ; want 200", code)
+	}
+
+	// Only group admins store secrets, and only members list them
+	if code := putSecret("secretowner1", "secretteam1", "dbpass", "hunter2hunter2"); code != 200 {
+		t.Fatalf("/secrets/putsecret as group admin response = %d ; want 200", code)
+	}
+	if code := putSecret("secretowner1", "secretteam1", "tlskey", "tlskeydata"); code != 200 {
+		t.Fatalf("/secrets/putsecret as group admin response = %d ; want 200", code)
+	}
+	if code := putSecret("secretowner1", "secretteam2", "dbpass", "otherteampass"); code != 200 {
+		t.Fatalf("/secrets/putsecret as group admin response = %d ; want 200", code)
+	}
+	if code := putSecret("secretmember1", "secretteam1", "dbpass", "stolen"); code == 200 {
+		t.Errorf("/secrets/putsecret as a member response = %d ; want an error", code)
+	}
+	if code := putSecret("secretoutsider1", "secretteam1", "dbpass", "stolen"); code == 200 {
+		t.Errorf("/secrets/putsecret as an outsider response = %d ; want an error", code)
+	}
+	w := post("/secrets/listsecrets", "secretmember1", map[string]interface{}{"group": "secretteam1"})
+	if w.Code != 200 {
+		t.Errorf("/secrets/listsecrets as a member response = %d ; want 200", w.Code)
+	} else if strings.Contains(w.Body.String(), "hunter2hunter2") {
+		t.Errorf("/secrets/listsecrets returned a secret value")
+	}
+	w = post("/secrets/listsecrets", "secretoutsider1", map[string]interface{}{"group": "secretteam1"})
+	if w.Code == 200 {
+		t.Errorf("/secrets/listsecrets as an outsider response = %d ; want an error", w.Code)
+	}
+
+	newCommand := map[string]interface{}{
+		"group":       conciergedb.InitConciergeGroups.Site,
+		"commandname": "secretcmd1",
+		"runcommand":  "echo secretcmd1",
+		"killcommand": "",
+		"secrets": []map[string]string{
+			{"secret": "dbpass", "env": "DB_PASS"},
+			{"secret": "tlskey", "file": "tls.key"},
+		},
+	}
+	if code := post("/command/newcommand", adminUser, newCommand).Code; code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+	for _, group := range []string{"secretteam1", "secretteam2"} {
+		grant := map[string]interface{}{
+			"process":     "secretcmd1",
+			"group":       group,
+			"role":        conciergedb.InitConciergeRoles.Admin,
+			"permissions": "--x",
+		}
+		if code := post("/command/grantpermission", adminUser, grant).Code; code != 200 {
+			t.Fatalf("/command/grantpermission %s response = %d ; want 200", group, code)
+		}
+	}
+
+	// Runs get the values they were stored with
+	run("secretteam1", "secrettest1")
+	if started("secrettest1") == nil {
+		t.Fatalf("Dispatch did not start secrettest1")
+	}
+	request := started("secrettest1").request
+	foundEnv := false
+	for _, env := range request.Env {
+		foundEnv = foundEnv || env == "DB_PASS=hunter2hunter2"
+	}
+	if !foundEnv {
+		t.Errorf("Run env does not hold DB_PASS")
+	}
+	if len(request.SecretFiles) != 1 ||
+		request.SecretFiles[0].Name != "tls.key" ||
+		string(request.SecretFiles[0].Data) != "tlskeydata" {
+		t.Errorf("Run secret files = %v ; want tls.key", request.SecretFiles)
+	}
+
+	// Ciphertexts only open under the group and name they were stored with
+	copyCiphertext("secretteam1", "dbpass", "secretteam1", "tlskey")
+	run("secretteam1", "secrettest2")
+	if started("secrettest2") != nil {
+		t.Errorf("Run started with a ciphertext stored under another name")
+	}
+	waitRunStatus(t, "secrettest2", conciergedb.ConciergeRunStatuses.Failed)
+	if code := putSecret("secretowner1", "secretteam1", "tlskey", "tlskeydata"); code != 200 {
+		t.Fatalf("/secrets/putsecret as group admin response = %d ; want 200", code)
+	}
+	if code := putSecret("secretowner1", "secretteam2", "tlskey", "tlskeydata"); code != 200 {
+		t.Fatalf("/secrets/putsecret as group admin response = %d ; want 200", code)
+	}
+	copyCiphertext("secretteam1", "dbpass", "secretteam2", "dbpass")
+	run("secretteam2", "secrettest3")
+	if started("secrettest3") != nil {
+		t.Errorf("Run started with a ciphertext stored under another group")
+	}
+	waitRunStatus(t, "secrettest3", conciergedb.ConciergeRunStatuses.Failed)
+
+	// Only group admins delete secrets
+	dbpass := map[string]interface{}{"group": "secretteam1", "secretname": "dbpass"}
+	if code := post("/secrets/deletesecret", "secretmember1", dbpass).Code; code == 200 {
+		t.Errorf("/secrets/deletesecret as a member response = %d ; want an error", code)
+	}
+	if code := post("/secrets/deletesecret", "secretowner1", dbpass).Code; code != 200 {
+		t.Errorf("/secrets/deletesecret as group admin response = %d ; want 200", code)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	logger.Info("===Testing signing key rotation===")
+	adminUser := configSiteAdmin["User"].(string)
+	defer server.SetKeyRingMaxAge(30 * time.Second)
+
+	signin := func() string {
+		var signinRes server.SigninRes
+		reqBody, _ := json.Marshal(map[string]string{
+			"user":     adminUser,
+			"password": configSiteAdmin["Password"].(string),
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &signinRes) != nil {
+			t.Fatalf("/access/signin response = %d ; want 200", w.Code)
+		}
+		return signinRes.AccessToken
+	}
+	post := func(path string, token string, body map[string]interface{}) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+token)
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	groupUsage := func(token string) int {
+		return post("/groups/usage", token, map[string]interface{}{
+			"group": conciergedb.InitConciergeGroups.Site,
+		}).Code
+	}
+	tokenKid := func(token string) string {
+		unverified, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return unverified.Header["kid"].(string)
+	}
+	activeKeys := func() int {
+		var count int
+		queryStr := `SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.SigningKeys + ` WHERE status = $1`
+		if err := db.QueryRow(queryStr, conciergedb.ConciergeKeyStatuses.Active).Scan(&count); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return count
+	}
+
+	// Rotated out keys keep verifying until they are retired
+	firstToken := signin()
+	var rotateRes server.RotateKeysRes
+	w := post("/access/rotatekeys", firstToken, map[string]interface{}{"retireafter": 3600})
+	if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &rotateRes) != nil {
+		t.Fatalf("/access/rotatekeys response = %d ; want 200", w.Code)
+	}
+	secondToken := signin()
+	if kid := tokenKid(secondToken); kid != rotateRes.Kid {
+		t.Errorf("Token signed with key %s ; want the rotated in %s", kid, rotateRes.Kid)
+	}
+	if code := groupUsage(firstToken); code != 200 {
+		t.Errorf("/groups/usage with a rotated out key response = %d ; want 200", code)
+	}
+	retire := map[string]interface{}{"kid": tokenKid(firstToken)}
+	if code := post("/access/retirekey", secondToken, retire).Code; code != 200 {
+		t.Errorf("/access/retirekey response = %d ; want 200", code)
+	}
+	if code := groupUsage(firstToken); code != 401 {
+		t.Errorf("/groups/usage with a retired key response = %d ; want 401", code)
+	}
+	if code := post("/access/retirekey", secondToken, map[string]interface{}{"kid": rotateRes.Kid}).Code; code == 200 {
+		t.Errorf("/access/retirekey of the active key response = %d ; want an error", code)
+	}
+
+	// Keys retired by another member stop verifying once the key ring is
+	// read again
+	server.SetKeyRingMaxAge(time.Hour)
+	if _, err := server.RotateSigningKeys(time.Hour); err != nil {
+		t.Fatalf("RotateSigningKeys = %s", err.Error())
+	}
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.SigningKeys + ` SET status = $1 WHERE kid = $2`
+	if _, err := db.Exec(queryStr, conciergedb.ConciergeKeyStatuses.Retired, tokenKid(secondToken)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if code := groupUsage(secondToken); code != 200 {
+		t.Errorf("/groups/usage before the key ring is stale response = %d ; want 200", code)
+	}
+	server.SetKeyRingMaxAge(50 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if code := groupUsage(secondToken); code != 401 {
+		t.Errorf("/groups/usage with a key retired elsewhere response = %d ; want 401", code)
+	}
+
+	// The rotation loop retires keys whose time is up
+	thirdToken := signin()
+	if _, err := server.RotateSigningKeys(0); err != nil {
+		t.Fatalf("RotateSigningKeys = %s", err.Error())
+	}
+	quit := make(chan struct{})
+	go server.RunKeyRotation(10*time.Millisecond, 0, quit)
+	deadline := time.Now().Add(5 * time.Second)
+	for groupUsage(thirdToken) != 401 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(quit)
+	if code := groupUsage(thirdToken); code != 401 {
+		t.Errorf("/groups/usage with an expired rotated out key response = %d ; want 401", code)
+	}
+
+	// The first key is made under the rotation lock, so members starting
+	// together agree on it
+	if _, err := db.Exec(`DELETE FROM ` + conciergedb.ConciergeTables.SigningKeys); err != nil {
+		t.Fatalf(err.Error())
+	}
+	server.SetKeyRingMaxAge(0)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(context.Background(), `SELECT pg_advisory_lock($1)`, server.SigningKeyRotationLock); err != nil {
+		t.Fatalf(err.Error())
+	}
+	firstKey := make(chan error, 1)
+	go func() {
+		_, err := server.GetSigningKey()
+		firstKey <- err
+	}()
+	select {
+	case <-firstKey:
+		t.Errorf("First key made without the rotation lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, server.SigningKeyRotationLock); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = <-firstKey; err != nil {
+		t.Fatalf("GetSigningKey = %s", err.Error())
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := server.GetSigningKey(); err != nil {
+				t.Errorf("GetSigningKey = %s", err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+	if n := activeKeys(); n != 1 {
+		t.Errorf("%d active signing keys ; want 1", n)
+	}
+	if code := groupUsage(signin()); code != 200 {
+		t.Errorf("/groups/usage with the first key response = %d ; want 200", code)
+	}
+}
+
+func TestMailConfig(t *testing.T) {
+	logger.Info("===Testing mail config===")
+
+	if _, ok := ConciergeMailConfig(map[interface{}]interface{}{}); ok {
+		t.Errorf("ConciergeMailConfig without a Mail section ok = true ; want false")
+	}
+
+	config := map[interface{}]interface{}{
+		"Mail": map[interface{}]interface{}{
+			"RequireVerifiedEmail": true,
+			"VerificationUrl":      "https://netrun.test/verify-email",
+			"PasswordResetUrl":     "https://netrun.test/reset-password",
+			"Smtp": map[interface{}]interface{}{
+				"Host": "smtp.test",
+				"Port": 587,
+				"From": "netrun@test.com",
+				"User": "netrun",
+			},
+		},
+	}
+	mailConfig, ok := ConciergeMailConfig(config)
+	if !ok {
+		t.Fatalf("ConciergeMailConfig ok = false ; want true")
+	}
+	if !mailConfig.RequireVerifiedEmail || mailConfig.VerificationUrl != "https://netrun.test/verify-email" {
+		t.Errorf("ConciergeMailConfig = %+v ; want verification required at https://netrun.test/verify-email", mailConfig)
+	}
+	if mailConfig.PasswordResetUrl != "https://netrun.test/reset-password" {
+		t.Errorf("ConciergeMailConfig reset url = %s ; want https://netrun.test/reset-password", mailConfig.PasswordResetUrl)
+	}
+	smtpMailer, ok := mailConfig.Mailer.(*server.SmtpMailer)
+	if !ok || smtpMailer.Addr != "smtp.test:587" || smtpMailer.From != "netrun@test.com" || smtpMailer.Auth == nil {
+		t.Errorf("ConciergeMailConfig mailer = %+v ; want SMTP through smtp.test:587", mailConfig.Mailer)
+	}
+
+	config = map[interface{}]interface{}{"Mail": map[interface{}]interface{}{"LogBodies": true}}
+	mailConfig, _ = ConciergeMailConfig(config)
+	if logMailer, ok := mailConfig.Mailer.(*server.LogMailer); !ok || !logMailer.LogBodies {
+		t.Errorf("ConciergeMailConfig mailer = %+v ; want a LogMailer logging bodies", mailConfig.Mailer)
+	}
+
+	// The default mailer keeps the tokens in bodies out of the logs
+	core, logs := observer.New(zap.DebugLevel)
+	previousLogger := server.Logger
+	server.SetLogger(zap.New(core))
+	defer server.SetLogger(previousLogger)
+	(&server.LogMailer{}).Send("mail@test.com", "Verify your email address", "secrettoken")
+	for _, entry := range logs.All() {
+		if strings.Contains(fmt.Sprint(entry.ContextMap()), "secrettoken") {
+			t.Errorf("Default LogMailer logged the body: %v", entry.ContextMap())
+		}
+	}
+	if logs.Len() != 1 || logs.All()[0].ContextMap()["to"] != "mail@test.com" {
+		t.Errorf("Default LogMailer logs = %v ; want one entry for mail@test.com", logs.All())
+	}
+}
+
+func TestOidcConfig(t *testing.T) {
+	logger.Info("===Testing OIDC config===")
+
+	if _, ok := ConciergeOidcConfig(map[interface{}]interface{}{}); ok {
+		t.Errorf("ConciergeOidcConfig without an Oidc section ok = true ; want false")
+	}
+
+	config := map[interface{}]interface{}{
+		"Oidc": map[interface{}]interface{}{
+			"Issuer":          "https://idp.test",
+			"ClientId":        "netrun",
+			"ClientSecret":    "secret",
+			"RedirectUrl":     "https://netrun.test/access/oidc/callback",
+			"Scopes":          []interface{}{"email", "groups"},
+			"MatchBy":         "email",
+			"JitProvisioning": true,
+			"RoleMappings": []interface{}{
+				map[interface{}]interface{}{
+					"Claim": "groups",
+					"Value": "netrun-admins",
+					"Group": "site",
+					"Role":  "admin",
+				},
+			},
+		},
+	}
+	oidcConfig, ok := ConciergeOidcConfig(config)
+	if !ok {
+		t.Fatalf("ConciergeOidcConfig ok = false ; want true")
+	}
+	want := server.OidcConfig{
+		Issuer:          "https://idp.test",
+		ClientId:        "netrun",
+		ClientSecret:    "secret",
+		RedirectUrl:     "https://netrun.test/access/oidc/callback",
+		Scopes:          []string{"email", "groups"},
+		MatchBy:         server.OidcMatchEmail,
+		JitProvisioning: true,
+		RoleMappings: []server.OidcRoleMapping{{
+			Claim: "groups",
+			Value: "netrun-admins",
+			Group: "site",
+			Role:  "admin",
+		}},
+	}
+	if !reflect.DeepEqual(oidcConfig, want) {
+		t.Errorf("ConciergeOidcConfig = %+v ; want %+v", oidcConfig, want)
+	}
+}
+
+func TestTwoFactorConfig(t *testing.T) {
+	logger.Info("===Testing two-factor config===")
+
+	if _, ok := ConciergeTwoFactorConfig(map[interface{}]interface{}{}); ok {
+		t.Errorf("ConciergeTwoFactorConfig without a TwoFactor section ok = true ; want false")
+	}
+
+	config := map[interface{}]interface{}{
+		"TwoFactor": map[interface{}]interface{}{
+			"Issuer":           "netrun.test",
+			"RequireForAdmins": true,
+		},
+	}
+	twoFactorConfig, ok := ConciergeTwoFactorConfig(config)
+	if !ok {
+		t.Fatalf("ConciergeTwoFactorConfig ok = false ; want true")
+	}
+	want := TwoFactorConfig{Issuer: "netrun.test", RequireForAdmins: true}
+	if twoFactorConfig != want {
+		t.Errorf("ConciergeTwoFactorConfig = %+v ; want %+v", twoFactorConfig, want)
+	}
+}
+
+func TestDispatchConfig(t *testing.T) {
+	logger.Info("===Testing dispatch config===")
+
+	if _, ok := ConciergeDispatchConfig(map[interface{}]interface{}{}); ok {
+		t.Errorf("ConciergeDispatchConfig without a Dispatch section ok = true ; want false")
+	}
+
+	config := map[interface{}]interface{}{
+		"Dispatch": map[interface{}]interface{}{
+			"NodeName":      "node1",
+			"NodeRunLimit":  4,
+			"GroupRunLimit": 1,
+		},
+	}
+	dispatchConfig, ok := ConciergeDispatchConfig(config)
+	if !ok {
+		t.Fatalf("ConciergeDispatchConfig ok = false ; want true")
+	}
+	want := DispatchConfig{NodeName: "node1", NodeRunLimit: 4, GroupRunLimit: 1}
+	if dispatchConfig != want {
+		t.Errorf("ConciergeDispatchConfig = %+v ; want %+v", dispatchConfig, want)
+	}
+}
+
+func TestMiddlewareAborts(t *testing.T) {
+	logger.Info("===Testing rejected requests stop at the middleware===")
+	adminUser := configSiteAdmin["User"].(string)
+	password := "onetwothreefourfive"
+	tokens := map[string]string{}
+
+	post := func(path string, user string, body map[string]interface{}) *httptest.ResponseRecorder {
+		reqBody, err := json.Marshal(body)
+		if err != nil {
+			t.Errorf(err.Error())
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+		req.Header.Set("authorization", "Bearer "+tokens[user])
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	signin := func(user string, password string) {
+		var signinRes server.SigninRes
+		reqBody, _ := json.Marshal(map[string]string{"user": user, "password": password})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/access/signin", bytes.NewBuffer(reqBody))
+		srv.ServeHTTP(w, req)
+		if w.Code != 200 || json.Unmarshal(w.Body.Bytes(), &signinRes) != nil {
+			t.Fatalf("/access/signin as %s response = %d ; want 200", user, w.Code)
+		}
+		tokens[user] = signinRes.AccessToken
+	}
+	// A handler that ran after the middleware rejected the request would
+	// have written a second response after the rejection
+	rejected := func(path string, body map[string]interface{}) {
+		w := post(path, "mwuser1", body)
+		if w.Code == 200 {
+			t.Errorf("%s response = 200 ; want a rejection", path)
+			return
+		}
+		var rejection map[string]interface{}
+		decoder := json.NewDecoder(w.Body)
+		if err := decoder.Decode(&rejection); err != nil || decoder.More() {
+			t.Errorf("%s response = %q ; want a single rejection", path, w.Body.String())
+		}
+	}
+	count := func(queryStr string, args ...interface{}) int {
+		var n int
+		if err := db.QueryRow(queryStr, args...).Scan(&n); err != nil {
+			t.Fatalf(err.Error())
+		}
+		return n
+	}
+	commands := func(name string) int {
+		return count(`SELECT COUNT(*) FROM `+conciergedb.ConciergeTables.RegisteredProcesses+` WHERE name = $1`, name)
+	}
+
+	signup, _ := json.Marshal(map[string]string{"user": "mwuser1", "email": "mwuser1@test.com", "password": password})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/access/signup", bytes.NewBuffer(signup))
+	srv.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("/access/signup response = %d ; want 200", w.Code)
+	}
+	queryStr := `UPDATE ` + conciergedb.ConciergeTables.Users + ` SET email_verified = true WHERE username = $1`
+	if _, err := db.Exec(queryStr, "mwuser1"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	signin("mwuser1", password)
+	signin(adminUser, configSiteAdmin["Password"].(string))
+
+	if code := post("/groups/create", adminUser, map[string]interface{}{"group": "mwteam1"}).Code; code != 200 {
+		t.Fatalf("/groups/create response = %d ; want 200", code)
+	}
+	newCommand := map[string]interface{}{
+		"group":       "mwteam1",
+		"commandname": "mwcmd1",
+		"runcommand":  "echo mwcmd1",
+		"killcommand": "",
+	}
+
+	// CheckGroup
+	rejected("/command/newcommand", newCommand)
+	if n := commands("mwcmd1"); n != 0 {
+		t.Errorf("Command registered by a non-member")
+	}
+
+	member := map[string]interface{}{"group": "mwteam1", "target": "mwuser1"}
+	if code := post("/groups/adduser", adminUser, member).Code; code != 200 {
+		t.Fatalf("/groups/adduser response = %d ; want 200", code)
+	}
+
+	// CheckRole through IsAdmin
+	rejected("/command/newcommand", newCommand)
+	if n := commands("mwcmd1"); n != 0 {
+		t.Errorf("Command registered by a member who is not group admin")
+	}
+
+	// IsSiteAdmin
+	rejected("/groups/setquota", map[string]interface{}{"group": "mwteam1", "maxcontainers": 0})
+	quotas := `SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.GroupQuotas + ` gq
+		INNER JOIN ` + conciergedb.ConciergeTables.Groups + ` g ON g.gid = gq.gid
+		WHERE g.name = $1`
+	if n := count(quotas, "mwteam1"); n != 0 {
+		t.Errorf("Quota set by a user who is not site admin")
+	}
+
+	// CanWrite and CanExecute
+	if code := post("/command/newcommand", adminUser, newCommand).Code; code != 200 {
+		t.Fatalf("/command/newcommand response = %d ; want 200", code)
+	}
+	rejected("/command/deletecommand", map[string]interface{}{
+		"group":       "mwteam1",
+		"commandname": "mwcmd1",
+		"process":     "mwcmd1",
+	})
+	if n := commands("mwcmd1"); n != 1 {
+		t.Errorf("Command deleted by a member without write permission")
+	}
+	rejected("/command/runcommand", map[string]interface{}{
+		"group":   "mwteam1",
+		"process": "mwcmd1",
+		"runname": "mwrun1",
+	})
+	runs := `SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.RunQueue + ` WHERE name = $1`
+	if n := count(runs, "mwrun1"); n != 0 {
+		t.Errorf("Run queued by a member without execute permission")
+	}
+}
@@ -3,12 +3,13 @@ package server
 import (
 	"database/sql"
 	"fmt"
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	conciergedb "github.com/ingenierias-lentas/netrun/db"
 	"github.com/lib/pq"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
+	"io"
 	"net/http"
 	"time"
 )
@@ -22,12 +23,45 @@ type SignupBody struct {
 type SigninBody struct {
 	User     string `json:user`
 	Password string `json:group`
+	Code     string `json:"code"`
 }
 
 type SigninRes struct {
-	User        string
-	Auth        bool
-	AccessToken string
+	User         string
+	Auth         bool
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int64
+	// Set when the password was right but a TOTP or recovery code is still
+	// needed, to be sent to /access/signin-totp with ChallengeToken
+	TwoFactorRequired bool   `json:",omitempty"`
+	ChallengeToken    string `json:",omitempty"`
+	// Set when policy requires 2FA the user has not enrolled in. AccessToken
+	// then only works for the /access/totp enrollment routes.
+	TwoFactorEnrollment bool `json:",omitempty"`
+}
+
+type VerifyEmailBody struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordBody struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordBody struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type UnlockBody struct {
+	Target string `json:"target"`
+	Ip     string `json:"ip"`
+}
+
+type RefreshBody struct {
+	User         string `json:"user"`
+	RefreshToken string `json:"refreshtoken"`
 }
 
 func Signup(c *gin.Context) {
@@ -36,7 +70,7 @@ func Signup(c *gin.Context) {
 	var queryStr string
 	db = GetDb()
 
-	if err = c.ShouldBindJSON(&signupBody); err != nil {
+	if err = c.ShouldBindBodyWith(&signupBody, binding.JSON); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -146,6 +180,17 @@ func Signup(c *gin.Context) {
 		return
 	}
 
+	// Signing up does not depend on the mail going out, it can be resent
+	if err = sendVerificationEmail(signupBody.User, signupBody.Email); err != nil {
+		Logger.Error("Error sending verification email", zap.String("error", err.Error()))
+	}
+
+	auditRequest(c, AuditEntry{
+		Actor:   signupBody.User,
+		Action:  AuditSignup,
+		Target:  signupBody.User,
+		Outcome: AuditSuccess,
+	})
 	c.String(200, "Signed up successfully")
 }
 
@@ -158,11 +203,15 @@ func Signin(c *gin.Context) {
 	var uid int
 	db = GetDb()
 
-	if err = c.ShouldBindJSON(&signinBody); err != nil {
+	if err = c.ShouldBindBodyWith(&signinBody, binding.JSON); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	if loginThrottled(c, signinBody.User) {
+		return
+	}
+
 	queryStr = `
         SELECT u.uid, u.password
         FROM ` +
@@ -188,6 +237,9 @@ func Signin(c *gin.Context) {
 			return
 		}
 	} else {
+		if err = recordLoginFailure(c, signinBody.User); err != nil {
+			Logger.Error("Error recording failed sign in", zap.String("error", err.Error()))
+		}
 		errString := fmt.Sprintf("User %s not found", signinBody.User)
 		c.JSON(http.StatusNotFound, gin.H{"status": errString})
 		return
@@ -195,23 +247,100 @@ func Signin(c *gin.Context) {
 
 	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(signinBody.Password))
 	if err != nil {
+		if err = recordLoginFailure(c, signinBody.User); err != nil {
+			Logger.Error("Error recording failed sign in", zap.String("error", err.Error()))
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"status": "Password invalid"})
 		return
 	}
 
-	claims := &ConciergeTokenClaims{
-		signinBody.User,
-		jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + 86400,
-			IssuedAt:  time.Now().Unix(),
-		},
+	signinSecondFactor(c, signinBody.User, uid, signinBody.Code)
+}
+
+// Continues a sign in whose first factor, a password or an OIDC identity,
+// checked out. Users with TOTP and no code get a challenge token for
+// SigninTotp, admins who must enroll get an enrollment token, and everyone
+// else a session.
+func signinSecondFactor(c *gin.Context, username string, uid int, code string) {
+	totpEnabled, err := isTotpEnabled(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+		return
+	}
+	if totpEnabled && code == "" {
+		challengeToken, err := issueUserToken(
+			username,
+			signinChallengeAudience,
+			signinChallengeLifetime,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+			return
+		}
+		c.SecureJSON(http.StatusOK, SigninRes{
+			User:              username,
+			Auth:              false,
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		})
+		return
+	} else if totpEnabled {
+		ok, err := verifySecondFactor(uid, code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+			return
+		} else if !ok {
+			if err = recordLoginFailure(c, username); err != nil {
+				Logger.Error("Error recording failed sign in", zap.String("error", err.Error()))
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"status": "Two-factor code invalid"})
+			return
+		}
+	} else if mustEnroll, err := mustEnrollTotp(username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+		return
+	} else if mustEnroll {
+		// Only good for enrolling, after which the user signs in again
+		enrollmentToken, err := issueUserToken(
+			username,
+			totpEnrollmentAudience,
+			accessTokenLifetime,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+			return
+		}
+		c.SecureJSON(http.StatusOK, SigninRes{
+			User:                username,
+			Auth:                false,
+			TwoFactorEnrollment: true,
+			AccessToken:         enrollmentToken,
+		})
+		return
+	}
+
+	completeSignin(c, username, uid)
+}
+
+// Issues the tokens of a new session once every factor has been checked
+func completeSignin(c *gin.Context, username string, uid int) {
+	var err error
+	var queryStr string
+	db = GetDb()
+
+	if err = recordLoginSuccess(username); err != nil {
+		Logger.Error("Error clearing failed sign ins", zap.String("error", err.Error()))
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	var signedString string
-	signedString, err = token.SignedString(GetJwtSecret())
+	accessToken, err := issueAccessToken(username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+		return
+	}
+	refreshToken, err := issueRefreshToken(db, uid, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+		return
 	}
 
 	lastLogin := pq.FormatTimestamp(time.Now())
@@ -222,20 +351,265 @@ func Signin(c *gin.Context) {
         SET last_login = $1
         WHERE username = $2
         `
-	_, err = db.Query(queryStr, lastLogin, signinBody.User)
+	_, err = db.Query(queryStr, lastLogin, username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error updating user info"})
 		return
 	}
 
+	auditRequest(c, AuditEntry{
+		Actor:   username,
+		Action:  AuditSignin,
+		Target:  username,
+		Outcome: AuditSuccess,
+	})
 	signinRes := SigninRes{
-		User:        signinBody.User,
-		Auth:        true,
-		AccessToken: signedString,
+		User:         username,
+		Auth:         true,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenLifetime / time.Second),
 	}
 	c.SecureJSON(http.StatusOK, signinRes)
 }
 
+type SignoutBody struct {
+	RefreshToken string `json:"refreshtoken"`
+	AllSessions  bool   `json:"allsessions"`
+}
+
+// Revokes the token the request was made with and the refresh token of its
+// session, or with allsessions every token issued to the user so far. The
+// body is optional.
 func Signout(c *gin.Context) {
+	var signoutBody SignoutBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&signoutBody, binding.JSON); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	claims := c.MustGet(tokenClaimsKey).(*ConciergeTokenClaims)
+
+	if signoutBody.AllSessions {
+		err = revokeAllSessions(claims.User)
+	} else {
+		err = revokeToken(claims)
+		if err == nil && signoutBody.RefreshToken != "" {
+			err = revokeRefreshToken(claims.User, signoutBody.RefreshToken)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error signing out"})
+		return
+	}
+
+	target := claims.User
+	if signoutBody.AllSessions {
+		target += ":all"
+	}
+	auditRequest(c, AuditEntry{
+		Action:  AuditSignout,
+		Target:  target,
+		Outcome: AuditSuccess,
+	})
+
+	if signoutBody.AllSessions {
+		c.String(http.StatusOK, "Signed out of all sessions successfully")
+		return
+	}
 	c.String(http.StatusOK, "Signed out successfully")
 }
+
+// Trades a refresh token for a new access token and refresh token
+func Refresh(c *gin.Context) {
+	var refreshBody RefreshBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&refreshBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refreshToken, err := rotateRefreshToken(refreshBody.User, refreshBody.RefreshToken)
+	if err == ErrRefreshTokenReused {
+		Logger.Warn("Refresh token reused, revoked its family", zap.String("user", refreshBody.User))
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Refresh token invalid"})
+		return
+	} else if err == ErrRefreshTokenInvalid {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Refresh token invalid"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error refreshing token"})
+		return
+	}
+
+	accessToken, err := issueAccessToken(refreshBody.User)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error refreshing token"})
+		return
+	}
+
+	refreshRes := SigninRes{
+		User:         refreshBody.User,
+		Auth:         true,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenLifetime / time.Second),
+	}
+	c.SecureJSON(http.StatusOK, refreshRes)
+}
+
+func VerifyEmail(c *gin.Context) {
+	var verifyEmailBody VerifyEmailBody
+	var err error
+	db = GetDb()
+
+	if err = c.ShouldBindBodyWith(&verifyEmailBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := parseEmailVerificationToken(verifyEmailBody.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Verification token invalid"})
+		return
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Users + `
+        SET email_verified = true
+        WHERE username = $1 AND email = $2
+        `
+	res, err := db.Exec(queryStr, claims.User, claims.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error verifying email"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Verification token invalid"})
+		return
+	}
+
+	c.String(http.StatusOK, "Email verified successfully")
+}
+
+func ResendVerification(c *gin.Context) {
+	var email string
+	var emailVerified bool
+	var err error
+	errorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetUserEmail(requestUser(c), db, errorChan, &email, &emailVerified)
+	if err = <-errorChan; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+	if emailVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Email already verified"})
+		return
+	}
+
+	if err = sendVerificationEmail(requestUser(c), email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error sending verification email"})
+		return
+	}
+
+	c.String(http.StatusOK, "Verification email sent successfully")
+}
+
+// Always answers the same, whether or not the email belongs to an account
+func ForgotPassword(c *gin.Context) {
+	var forgotBody ForgotPasswordBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&forgotBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go sendPasswordReset(forgotBody.Email)
+
+	c.String(http.StatusOK, "If the email belongs to an account, a reset link was sent to it")
+}
+
+func ResetPassword(c *gin.Context) {
+	var resetBody ResetPasswordBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&resetBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if resetBody.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Password must not be empty"})
+		return
+	}
+
+	username, err := resetPassword(resetBody.Token, resetBody.Password)
+	if err == ErrResetTokenInvalid {
+		auditRequest(c, AuditEntry{
+			Action:  AuditPasswordReset,
+			Outcome: AuditDenied,
+		})
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Reset token invalid"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error resetting password"})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Actor:   username,
+		Action:  AuditPasswordReset,
+		Target:  username,
+		Outcome: AuditSuccess,
+	})
+
+	c.String(http.StatusOK, "Password reset successfully")
+}
+
+// Lifts the sign in lockout of a username, an IP, or both
+func Unlock(c *gin.Context) {
+	var unlockBody UnlockBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&unlockBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if unlockBody.Target == "" && unlockBody.Ip == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Need a target user or ip to unlock"})
+		return
+	}
+
+	unlocked, err := unlockLogin(unlockBody.Target, unlockBody.Ip)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error unlocking"})
+		return
+	}
+
+	target := loginFailureUser + ":" + unlockBody.Target
+	if unlockBody.Target == "" {
+		target = loginFailureIp + ":" + unlockBody.Ip
+	} else if unlockBody.Ip != "" {
+		target += "," + loginFailureIp + ":" + unlockBody.Ip
+	}
+	auditRequest(c, AuditEntry{
+		Action:  AuditUnlock,
+		Target:  target,
+		Outcome: AuditSuccess,
+	})
+
+	if !unlocked {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Nothing to unlock"})
+		return
+	}
+	c.String(http.StatusOK, "Unlocked successfully")
+}
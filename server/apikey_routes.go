@@ -0,0 +1,137 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"net/http"
+	"time"
+)
+
+type CreateApiKeyBody struct {
+	Name          string   `json:"name"`
+	Groups        []string `json:"groups"`
+	Commands      []string `json:"commands"`
+	Permissions   string   `json:"permissions"`
+	ExpiresInDays int      `json:"expiresindays"`
+}
+
+type RevokeApiKeyBody struct {
+	Prefix string `json:"prefix"`
+}
+
+type CreateApiKeyRes struct {
+	ApiKey string
+	Prefix string
+}
+
+// Creates a scoped key. API keys never grant more than their user has; the
+// scope only narrows it.
+func CreateApiKey(c *gin.Context) {
+	var body CreateApiKeyBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "API keys need a name"})
+		return
+	}
+	if !validApiKeyPermissions(body.Permissions) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Permissions must be some of r, w and x"})
+		return
+	}
+
+	lifetime := defaultApiKeyLifetime
+	if body.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid expiry"})
+		return
+	} else if body.ExpiresInDays > 0 {
+		lifetime = time.Duration(body.ExpiresInDays) * 24 * time.Hour
+	}
+	if lifetime > maxApiKeyLifetime {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "API keys expire after a year at most"})
+		return
+	}
+
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	scope := ApiKeyScope{
+		Groups:      append([]string{}, body.Groups...),
+		Commands:    append([]string{}, body.Commands...),
+		Permissions: body.Permissions,
+	}
+	apiKey, prefix, err := createApiKey(uid, body.Name, scope, lifetime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error creating API key"})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditApiKeyCreate,
+		Target:  prefix,
+		Outcome: AuditSuccess,
+	})
+	c.SecureJSON(http.StatusOK, CreateApiKeyRes{ApiKey: apiKey, Prefix: prefix})
+}
+
+func ListApiKeys(c *gin.Context) {
+	apiKeys := []conciergedb.DbApiKey{}
+	errorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	go conciergedb.GetUserApiKeys(uid, db, errorChan, &apiKeys)
+	if err = <-errorChan; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error listing API keys"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, apiKeys)
+}
+
+func RevokeApiKey(c *gin.Context) {
+	var body RevokeApiKeyBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	err = revokeApiKey(uid, body.Prefix)
+	if err == ErrApiKeyInvalid {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Cannot find API key"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error revoking API key"})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditApiKeyRevoke,
+		Target:  body.Prefix,
+		Outcome: AuditSuccess,
+	})
+	c.String(http.StatusOK, "API key revoked successfully")
+}
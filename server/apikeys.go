@@ -0,0 +1,179 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/lib/pq"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API keys look like nrk_<prefix>_<secret>. The prefix identifies the key in
+// listings and is not secret.
+const apiKeyPrefix = "nrk_"
+
+// Context key VerifyToken stores the scope of an API key under
+const apiKeyScopeKey = "apiKeyScope"
+
+var defaultApiKeyLifetime = 90 * 24 * time.Hour
+var maxApiKeyLifetime = 365 * 24 * time.Hour
+
+var ErrApiKeyInvalid = errors.New("API key invalid")
+
+// Limits an API key to groups, commands and permission bits. Empty groups or
+// commands allow any.
+type ApiKeyScope struct {
+	Groups      []string
+	Commands    []string
+	Permissions string
+}
+
+func scopeAllows(allowed []string, name string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ApiKeyScope) AllowsGroup(group string) bool {
+	return scopeAllows(s.Groups, group)
+}
+
+func (s *ApiKeyScope) AllowsCommand(command string) bool {
+	return scopeAllows(s.Commands, command)
+}
+
+func (s *ApiKeyScope) AllowsPermission(permission string) bool {
+	return permission != "" && strings.Contains(s.Permissions, permission)
+}
+
+// Permission bits are some of r, w and x, each at most once
+func validApiKeyPermissions(permissions string) bool {
+	if permissions == "" {
+		return false
+	}
+	for i, bit := range permissions {
+		if !strings.ContainsRune("rwx", bit) || strings.ContainsRune(permissions[i+1:], bit) {
+			return false
+		}
+	}
+	return true
+}
+
+// The scope of the API key a request was authenticated with, if it was
+func requestApiKeyScope(c *gin.Context) (*ApiKeyScope, bool) {
+	scope, ok := c.Get(apiKeyScopeKey)
+	if !ok {
+		return nil, false
+	}
+	return scope.(*ApiKeyScope), true
+}
+
+// Stores a new key for a user and returns it. The key itself is only ever
+// returned here.
+func createApiKey(uid int, name string, scope ApiKeyScope, lifetime time.Duration) (string, string, error) {
+	db = GetDb()
+
+	prefix, err := randomId()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = prefix[:12]
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	apiKey := apiKeyPrefix + prefix + "_" + secret
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.ApiKeys + `
+          (uid, name, prefix, key_hash, groups, commands, permissions,
+           date_created, date_expires)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, now(), now() + $8 * interval '1 second')
+        `
+	_, err = db.Exec(
+		queryStr,
+		uid,
+		name,
+		prefix,
+		hashOpaqueToken(apiKey),
+		pq.Array(scope.Groups),
+		pq.Array(scope.Commands),
+		scope.Permissions,
+		int64(lifetime/time.Second),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKey, prefix, nil
+}
+
+// The user and scope of a key that is not revoked or expired
+func authenticateApiKey(apiKey string) (string, *ApiKeyScope, error) {
+	var username string
+	var dbApiKey conciergedb.DbApiKey
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.UseApiKey(hashOpaqueToken(apiKey), db, errorChan, &username, &dbApiKey)
+	err := <-errorChan
+	if err == sql.ErrNoRows {
+		return "", nil, ErrApiKeyInvalid
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	return username, &ApiKeyScope{
+		Groups:      dbApiKey.Groups,
+		Commands:    dbApiKey.Commands,
+		Permissions: dbApiKey.Permissions,
+	}, nil
+}
+
+func revokeApiKey(uid int, prefix string) error {
+	db = GetDb()
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.ApiKeys + `
+        SET revoked = true
+        WHERE uid = $1 AND prefix = $2
+        `
+	res, err := db.Exec(queryStr, uid, prefix)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrApiKeyInvalid
+	}
+	return nil
+}
+
+// Aborts requests made with an API key whose scope does not cover the group,
+// command or permission. Empty arguments are not checked.
+func checkApiKeyScope(c *gin.Context, group string, command string, permission string) bool {
+	scope, ok := requestApiKeyScope(c)
+	if !ok {
+		return true
+	}
+	if (group != "" && !scope.AllowsGroup(group)) ||
+		(command != "" && !scope.AllowsCommand(command)) ||
+		(permission != "" && !scope.AllowsPermission(permission)) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Outside the scope of the API key"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditSigninFailed  = "signin.failed"
+	AuditSigninBlocked = "signin.blocked"
+	AuditLockout       = "signin.lockout"
+	AuditUnlock        = "signin.unlock"
+	AuditSignin        = "signin"
+	AuditSignup        = "signup"
+	AuditSignout       = "signout"
+	AuditPasswordReset = "password.reset"
+	AuditTotpEnable    = "totp.enable"
+	AuditTotpDisable   = "totp.disable"
+	AuditApiKeyCreate  = "apikey.create"
+	AuditApiKeyRevoke  = "apikey.revoke"
+	AuditKeyRotate     = "signingkey.rotate"
+	AuditKeyRetire     = "signingkey.retire"
+
+	AuditCommandRegister = "command.register"
+	AuditCommandDelete   = "command.delete"
+	AuditCommandRun      = "command.run"
+	AuditCommandKill     = "command.kill"
+
+	AuditPermissionGrant  = "permission.grant"
+	AuditPermissionChange = "permission.change"
+	AuditPermissionRevoke = "permission.revoke"
+	AuditPermissionDenied = "permission.denied"
+
+	AuditGroupCreate        = "group.create"
+	AuditGroupRename        = "group.rename"
+	AuditGroupDelete        = "group.delete"
+	AuditGroupAddUser       = "group.adduser"
+	AuditGroupRemoveUser    = "group.removeuser"
+	AuditGroupTransferOwner = "group.transferowner"
+	AuditGroupSetParent     = "group.setparent"
+	AuditGroupSetQuota      = "group.setquota"
+
+	AuditRoleCreate   = "role.create"
+	AuditRoleRename   = "role.rename"
+	AuditRoleDelete   = "role.delete"
+	AuditRoleAssign   = "role.assign"
+	AuditRoleUnassign = "role.unassign"
+	// Roles role mappings give or take away at an OIDC sign in
+	AuditOidcRoleAssign   = "role.oidc.assign"
+	AuditOidcRoleUnassign = "role.oidc.unassign"
+
+	AuditSecretPut    = "secret.put"
+	AuditSecretDelete = "secret.delete"
+
+	AuditScheduleCreate = "schedule.create"
+	AuditSchedulePause  = "schedule.pause"
+	AuditScheduleResume = "schedule.resume"
+	AuditScheduleDelete = "schedule.delete"
+
+	AuditRecoveryCodesRegenerate = "totp.recoverycodes"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+type AuditEntry struct {
+	Actor     string
+	Action    string
+	Target    string
+	Group     string
+	Ip        string
+	RequestId string
+	Outcome   string
+}
+
+const requestIdKey = "requestId"
+const RequestIdHeader = "X-Request-Id"
+
+// Request ids clients send are kept when they look like ids, so a request can
+// be followed from the client into the audit log
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Gives every request an id, the client's X-Request-Id when usable or a new
+// one, and echoes it back in the response
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(RequestIdHeader)
+		if !requestIdPattern.MatchString(requestId) {
+			var err error
+			if requestId, err = randomId(); err != nil {
+				requestId = ""
+			}
+		}
+		c.Set(requestIdKey, requestId)
+		c.Header(RequestIdHeader, requestId)
+		c.Next()
+	}
+}
+
+// An entry for something done in a request. The actor defaults to the
+// authenticated user, if any.
+func requestAudit(c *gin.Context, entry AuditEntry) AuditEntry {
+	if entry.Actor == "" {
+		if claims, ok := c.Get(tokenClaimsKey); ok {
+			entry.Actor = claims.(*ConciergeTokenClaims).User
+		}
+	}
+	entry.Ip = c.ClientIP()
+	entry.RequestId = c.GetString(requestIdKey)
+	return entry
+}
+
+// Writes an entry for something done in a request
+func auditRequest(c *gin.Context, entry AuditEntry) {
+	writeAudit(requestAudit(c, entry))
+}
+
+// Writes an entry for a request once its handler has answered, a failure when
+// the response is an error and a success otherwise. Handlers defer it after
+// binding their body, so failed attempts are recorded as well.
+func auditResponse(c *gin.Context, entry AuditEntry) {
+	entry.Outcome = AuditSuccess
+	if c.Writer.Status() >= http.StatusBadRequest {
+		entry.Outcome = AuditFailure
+	}
+	auditRequest(c, entry)
+}
+
+// The hash of an entry chained onto the hash of the one before it. Covers
+// everything but the aid, so rows cannot be edited, reordered or removed
+// without the hashes after them going wrong. Removing entries from the end
+// is only caught by comparing against a hash kept elsewhere.
+func auditEntryHash(entry conciergedb.DbAuditEntry) string {
+	hashed, _ := json.Marshal(struct {
+		PrevHash    string
+		Actor       string
+		Action      string
+		Target      string
+		Group       string
+		Ip          string
+		RequestId   string
+		Outcome     string
+		DateCreated string
+	}{
+		entry.PrevHash,
+		entry.Actor,
+		entry.Action,
+		entry.Target,
+		entry.Group,
+		entry.Ip,
+		entry.RequestId,
+		entry.Outcome,
+		entry.DateCreated.UTC().Format(time.RFC3339Nano),
+	})
+	hash := sha256.Sum256(hashed)
+	return hex.EncodeToString(hash[:])
+}
+
+func appendAudit(entry AuditEntry) error {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Writers take turns, so each entry chains onto the last one
+	_, err = tx.Exec(`LOCK TABLE ` + conciergedb.ConciergeTables.AuditLog + ` IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+
+	dbEntry := conciergedb.DbAuditEntry{
+		Actor:     entry.Actor,
+		Action:    entry.Action,
+		Target:    entry.Target,
+		Group:     entry.Group,
+		Ip:        entry.Ip,
+		RequestId: entry.RequestId,
+		Outcome:   entry.Outcome,
+		// Postgres keeps microseconds, and the hash has to match what is read
+		// back
+		DateCreated: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	queryStr := `
+        SELECT COALESCE((
+          SELECT hash FROM ` + conciergedb.ConciergeTables.AuditLog + `
+          ORDER BY aid DESC
+          LIMIT 1
+        ), '')
+        `
+	if err = tx.QueryRow(queryStr).Scan(&dbEntry.PrevHash); err != nil {
+		return err
+	}
+	dbEntry.Hash = auditEntryHash(dbEntry)
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.AuditLog + `
+          (actor, action, target, groupname, ip, request_id, outcome,
+           date_created, prev_hash, hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        `
+	_, err = tx.Exec(
+		queryStr,
+		dbEntry.Actor,
+		dbEntry.Action,
+		dbEntry.Target,
+		dbEntry.Group,
+		dbEntry.Ip,
+		dbEntry.RequestId,
+		dbEntry.Outcome,
+		dbEntry.DateCreated,
+		dbEntry.PrevHash,
+		dbEntry.Hash,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Appends an entry to the audit log. Failing to write one is logged rather
+// than failing the request it records.
+func writeAudit(entry AuditEntry) {
+	if err := appendAudit(entry); err != nil {
+		Logger.Error(
+			"Error writing audit entry",
+			zap.String("action", entry.Action),
+			zap.String("error", err.Error()),
+		)
+	}
+}
+
+const auditVerifyBatch = 1000
+
+// Walks the whole hash chain. Returns the number of entries checked and the
+// aid of the first one that does not match, or 0 when they all do.
+func verifyAuditChain() (int64, int64, error) {
+	var checked, afterAid int64
+	var prevHash string
+	db = GetDb()
+
+	errorChan := make(chan error, 1)
+	defer func() {
+		close(errorChan)
+	}()
+
+	for {
+		var entries []conciergedb.DbAuditEntry
+		go conciergedb.GetAuditChain(afterAid, auditVerifyBatch, db, errorChan, &entries)
+		if err := <-errorChan; err != nil {
+			return checked, 0, err
+		}
+
+		for _, entry := range entries {
+			if entry.PrevHash != prevHash || auditEntryHash(entry) != entry.Hash {
+				return checked, entry.Aid, nil
+			}
+			prevHash = entry.Hash
+			afterAid = entry.Aid
+			checked++
+		}
+		if len(entries) < auditVerifyBatch {
+			return checked, 0, nil
+		}
+	}
+}
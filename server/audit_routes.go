@@ -0,0 +1,108 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// Empty fields match anything. Pages go back in time: pass the next of one
+// response as the before of the request for the following page.
+type AuditQueryBody struct {
+	Actor     string     `json:"actor"`
+	Action    string     `json:"action"`
+	Target    string     `json:"target"`
+	Group     string     `json:"group"`
+	Outcome   string     `json:"outcome"`
+	RequestId string     `json:"requestid"`
+	Since     *time.Time `json:"since"`
+	Until     *time.Time `json:"until"`
+	Before    int64      `json:"before"`
+	Limit     int        `json:"limit"`
+}
+
+type AuditQueryRes struct {
+	Entries []conciergedb.DbAuditEntry `json:"entries"`
+	// The before of the next page, 0 on the last one
+	Next int64 `json:"next"`
+}
+
+type AuditVerifyRes struct {
+	Valid   bool  `json:"valid"`
+	Checked int64 `json:"checked"`
+	// The aid of the first entry that breaks the chain
+	BrokenAt int64 `json:"brokenAt,omitempty"`
+}
+
+func QueryAudit(c *gin.Context) {
+	var body AuditQueryBody
+	var entries []conciergedb.DbAuditEntry
+	errorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.Limit < 0 || body.Limit > maxAuditPageSize || body.Before < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid page"})
+		return
+	} else if body.Limit == 0 {
+		body.Limit = defaultAuditPageSize
+	}
+
+	filter := conciergedb.DbAuditFilter{
+		Actor:     body.Actor,
+		Action:    body.Action,
+		Target:    body.Target,
+		Group:     body.Group,
+		Outcome:   body.Outcome,
+		RequestId: body.RequestId,
+		Since:     body.Since,
+		Until:     body.Until,
+		Before:    body.Before,
+		// One more than asked for tells whether there is a next page
+		Limit: body.Limit + 1,
+	}
+	go conciergedb.GetAuditEntries(filter, db, errorChan, &entries)
+	if err := <-errorChan; err != nil {
+		Logger.Error("Error querying audit log", zap.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error querying audit log"})
+		return
+	}
+
+	auditRes := AuditQueryRes{Entries: entries}
+	if len(entries) > body.Limit {
+		auditRes.Entries = entries[:body.Limit]
+		auditRes.Next = auditRes.Entries[body.Limit-1].Aid
+	}
+	c.SecureJSON(http.StatusOK, auditRes)
+}
+
+// Checks the hash chain of the whole audit log
+func VerifyAudit(c *gin.Context) {
+	checked, brokenAt, err := verifyAuditChain()
+	if err != nil {
+		Logger.Error("Error verifying audit log", zap.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error verifying audit log"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, AuditVerifyRes{
+		Valid:    brokenAt == 0,
+		Checked:  checked,
+		BrokenAt: brokenAt,
+	})
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"sync"
+	"time"
+)
+
+// A request to use a process in a group, as CanExecute, CanWrite and CanRead
+// see it. CanReadProcess and CanWriteProcess ask once for each group the user
+// is in.
+type AuthzRequest struct {
+	User    string
+	Group   string
+	Process string
+	// One of "r", "w" or "x"
+	Permission string
+	Time       time.Time
+}
+
+// Decides whether requests to use processes are allowed. A denial with a nil
+// error is a normal denial; errors fail the request closed.
+type Authorizer interface {
+	Authorize(req AuthzRequest) (bool, error)
+}
+
+// The default authorizer, which allows what the rwx grants on a process allow
+// through the roles the user holds in the group and what it inherits
+type RbacAuthorizer struct{}
+
+func (RbacAuthorizer) Authorize(req AuthzRequest) (bool, error) {
+	var allowed bool
+	db = GetDb()
+
+	errorChan := make(chan error, 1)
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.HasPermission(
+		req.User,
+		req.Group,
+		req.Process,
+		req.Permission,
+		db,
+		errorChan,
+		&allowed,
+	)
+	if err := <-errorChan; err != nil {
+		return false, err
+	}
+	return allowed, nil
+}
+
+var authorizerState = struct {
+	sync.RWMutex
+	authorizer Authorizer
+}{authorizer: RbacAuthorizer{}}
+
+// Replaces the authorizer behind CanExecute, CanWrite, CanRead and their
+// process-wide forms
+func SetAuthorizer(authorizer Authorizer) {
+	authorizerState.Lock()
+	defer authorizerState.Unlock()
+	authorizerState.authorizer = authorizer
+}
+
+func GetAuthorizer() Authorizer {
+	authorizerState.RLock()
+	defer authorizerState.RUnlock()
+	return authorizerState.authorizer
+}
@@ -1,23 +1,82 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	conciergedb "github.com/ingenierias-lentas/netrun/db"
 	"github.com/lib/pq"
+	"go.uber.org/zap"
 	"net/http"
+	"strings"
 	"time"
 )
 
 type NewCommandBody struct {
-	User        string `json:user`
-	Group       string `json:group`
-	CommandName string `json:commandname`
-	RunCommand  string `json:runcommand`
-	KillCommand string `json:killcommand`
+	Group        string `json:group`
+	CommandName  string `json:commandname`
+	RunCommand   string `json:runcommand`
+	KillCommand  string `json:killcommand`
+	MemoryLimit  int    `json:"memorylimit"`
+	CpuLimit     int    `json:"cpulimit"`
+	StorageLimit int    `json:"storagelimit"`
+
+	// Take precedence over RunCommand and KillCommand, which are split on
+	// whitespace
+	RunArgv    []string        `json:"runargv"`
+	RunEnv     []string        `json:"runenv"`
+	KillArgv   []string        `json:"killargv"`
+	Parameters []ParameterBody `json:"parameters"`
+	Secrets    []SecretRefBody `json:"secrets"`
+}
+
+// Exposes the secret named Secret of the running group as either the env
+// var Env or the file File under SecretsMountPath
+type SecretRefBody struct {
+	Secret string `json:"secret"`
+	Env    string `json:"env"`
+	File   string `json:"file"`
+}
+
+type ParameterBody struct {
+	Name    string  `json:"name"`
+	Type    string  `json:"type"`
+	Default *string `json:"default"`
+	Pattern string  `json:"pattern"`
 }
 
 type DeleteCommandBody struct {
+	Group       string `json:"group"`
 	CommandName string `json:commandname`
+	// The process CanWrite checked, which must be the command deleted
+	Process string `json:"process"`
+}
+
+type RunCommandBody struct {
+	Group    string                 `json:"group"`
+	Process  string                 `json:"process"`
+	RunName  string                 `json:"runname"`
+	Priority int                    `json:"priority"`
+	Args     map[string]interface{} `json:"args"`
+}
+
+type KillCommandBody struct {
+	Group   string `json:"group"`
+	Process string `json:"process"`
+	RunName string `json:"runname"`
+}
+
+type QueueStatusBody struct {
+	Group   string `json:"group"`
+	RunName string `json:"runname"`
+}
+
+type QueueStatusRes struct {
+	RunName  string
+	Status   string
+	Priority int
+	Position int
 }
 
 func NewCommand(c *gin.Context) {
@@ -38,12 +97,53 @@ func NewCommand(c *gin.Context) {
 		close(rpidErrorChan)
 	}()
 
-	if err = c.ShouldBindJSON(&cmd); err != nil {
+	if err = c.ShouldBindBodyWith(&cmd, binding.JSON); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditCommandRegister,
+		Target: cmd.CommandName,
+		Group:  cmd.Group,
+	})
+	if cmd.MemoryLimit < 0 || cmd.CpuLimit < 0 || cmd.StorageLimit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Resource limits cannot be negative"})
+		return
+	}
+
+	if len(cmd.RunArgv) == 0 {
+		cmd.RunArgv = strings.Fields(cmd.RunCommand)
+	}
+	if len(cmd.KillArgv) == 0 {
+		cmd.KillArgv = strings.Fields(cmd.KillCommand)
+	}
+	parameters := make([]conciergedb.DbProcessParameter, len(cmd.Parameters))
+	for i, parameter := range cmd.Parameters {
+		parameters[i] = conciergedb.DbProcessParameter{
+			Name:    parameter.Name,
+			Type:    parameter.Type,
+			Default: parameter.Default,
+			Pattern: parameter.Pattern,
+		}
+	}
+	if err = ValidateCommandTemplate(cmd.RunArgv, cmd.RunEnv, parameters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	}
+	secretRefs := make([]conciergedb.DbSecretRef, len(cmd.Secrets))
+	for i, secretRef := range cmd.Secrets {
+		secretRefs[i] = conciergedb.DbSecretRef{
+			Secret: secretRef.Secret,
+			Env:    secretRef.Env,
+			File:   secretRef.File,
+		}
+	}
+	if err = validateSecretRefs(secretRefs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	}
 
-	go conciergedb.GetUid(cmd.User, db, uidErrorChan, &uid)
+	go conciergedb.GetUid(requestUser(c), db, uidErrorChan, &uid)
 	go conciergedb.GetGid(cmd.Group, db, gidErrorChan, &gid)
 	go conciergedb.GetRid(conciergedb.InitConciergeRoles.Admin, db, ridErrorChan, &rid)
 	uidErr, gidErr, ridErr := <-uidErrorChan, <-gidErrorChan, <-ridErrorChan
@@ -65,16 +165,21 @@ func NewCommand(c *gin.Context) {
 	queryStr = `
 		INSERT INTO ` +
 		conciergedb.ConciergeTables.RegisteredProcesses + `
-		  (creator_uid, name, run_command, kill_command, date_created)
-		VALUES ($1, $2, $3, $4, $5)
+		  (creator_uid, name, run_argv, run_env, kill_argv,
+		   memory_limit_mb, cpu_limit_millicores, storage_limit_mb, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		`
 
 	_, err = db.Query(
 		queryStr,
 		uid,
 		cmd.CommandName,
-		cmd.RunCommand,
-		cmd.KillCommand,
+		pq.Array(cmd.RunArgv),
+		pq.Array(cmd.RunEnv),
+		pq.Array(cmd.KillArgv),
+		cmd.MemoryLimit,
+		cmd.CpuLimit,
+		cmd.StorageLimit,
 		dateCreated,
 	)
 	if err != nil {
@@ -86,6 +191,42 @@ func NewCommand(c *gin.Context) {
 	rpidErr := <-rpidErrorChan
 	if rpidErr != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error checking registered command"})
+		return
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RegisteredProcessParameters + `
+          (rpid, name, type, default_value, pattern)
+        VALUES ($1, $2, $3, $4, $5)
+        `
+	for _, parameter := range parameters {
+		_, err = db.Exec(
+			queryStr,
+			rpid,
+			parameter.Name,
+			parameter.Type,
+			parameter.Default,
+			parameter.Pattern,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Error registering command parameters"})
+			return
+		}
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RegisteredProcessSecrets + `
+          (rpid, secret, env, file)
+        VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''))
+        `
+	for _, secretRef := range secretRefs {
+		_, err = db.Exec(queryStr, rpid, secretRef.Secret, secretRef.Env, secretRef.File)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "Error registering command secrets"})
+			return
+		}
 	}
 	permissionLevel := "B111"
 
@@ -122,10 +263,21 @@ func DeleteCommand(c *gin.Context) {
 		close(rpidErrorChan)
 	}()
 
-	if err = c.ShouldBindJSON(&cmd); err != nil {
+	if err = c.ShouldBindBodyWith(&cmd, binding.JSON); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if cmd.CommandName == "" {
+		cmd.CommandName = cmd.Process
+	} else if cmd.CommandName != cmd.Process {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Command name and process differ"})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditCommandDelete,
+		Target: cmd.CommandName,
+		Group:  cmd.Group,
+	})
 
 	go conciergedb.GetRpid(cmd.CommandName, db, rpidErrorChan, &rpid)
 	rpidErr := <-rpidErrorChan
@@ -134,12 +286,99 @@ func DeleteCommand(c *gin.Context) {
 		return
 	}
 
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Deleting the queued runs first locks them, so a dispatcher cannot
+	// claim one while the command goes away
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RunQueue + `
+        WHERE ` + conciergedb.ConciergeTables.RunQueue + `.rpid = $1
+          AND ` + conciergedb.ConciergeTables.RunQueue + `.status = $2
+        `
+	_, err = tx.Exec(queryStr, rpid, conciergedb.ConciergeRunStatuses.Queued)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting queued runs"})
+		return
+	}
+
+	// Running runs would lose their row and could no longer be killed or
+	// finished
+	var running int
+	queryStr = `
+        SELECT
+          (SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.RunQueue + `
+           WHERE rpid = $1 AND status = $2) +
+          (SELECT COUNT(*) FROM ` + conciergedb.ConciergeTables.RunningProcesses + `
+           WHERE rpid = $1)
+        `
+	err = tx.QueryRow(queryStr, rpid, conciergedb.ConciergeRunStatuses.Running).Scan(&running)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error checking running runs"})
+		return
+	}
+	if running > 0 {
+		c.JSON(http.StatusConflict, gin.H{"status": "Command has running runs"})
+		return
+	}
+
+	// Ended runs go with the command, their rpid would block the delete
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RunQueue + `
+        WHERE ` + conciergedb.ConciergeTables.RunQueue + `.rpid = $1
+          AND ` + conciergedb.ConciergeTables.RunQueue + `.status <> $2
+        `
+	_, err = tx.Exec(queryStr, rpid, conciergedb.ConciergeRunStatuses.Running)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting ended runs"})
+		return
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.Schedules + `
+        WHERE ` + conciergedb.ConciergeTables.Schedules + `.rpid = $1
+        `
+	_, err = tx.Exec(queryStr, rpid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command schedules"})
+		return
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RegisteredProcessParameters + `
+        WHERE ` + conciergedb.ConciergeTables.RegisteredProcessParameters + `.rpid = $1
+        `
+	_, err = tx.Exec(queryStr, rpid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command parameters"})
+		return
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RegisteredProcessSecrets + `
+        WHERE ` + conciergedb.ConciergeTables.RegisteredProcessSecrets + `.rpid = $1
+        `
+	_, err = tx.Exec(queryStr, rpid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command secrets"})
+		return
+	}
+
 	queryStr = `
         DELETE FROM	` +
 		conciergedb.ConciergeTables.RegisteredProcessPermissions + `
         WHERE ` + conciergedb.ConciergeTables.RegisteredProcessPermissions + `.rpid = $1
         `
-	_, err = db.Query(queryStr, rpid)
+	_, err = tx.Exec(queryStr, rpid)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command permissions"})
 		return
@@ -150,22 +389,218 @@ func DeleteCommand(c *gin.Context) {
 		conciergedb.ConciergeTables.RegisteredProcesses + `
         WHERE ` + conciergedb.ConciergeTables.RegisteredProcesses + `.rpid = $1
         `
-	_, err = db.Query(queryStr, rpid)
+	_, err = tx.Exec(queryStr, rpid)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command"})
 		return
 	}
 
+	if err = tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting command"})
+		return
+	}
+
 	c.String(http.StatusOK, "Command deleted successfully")
 }
 
 func RunCommand(c *gin.Context) {
-	//TODO container stuff
-	c.String(http.StatusOK, "Command run successfully")
+	var err error = nil
+	var cmd RunCommandBody
+	var uid, gid, rpid, position int
+	var queuedRun conciergedb.DbQueuedRun
+	uidErrorChan := make(chan error)
+	gidErrorChan := make(chan error)
+	rpidErrorChan := make(chan error)
+	positionErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(uidErrorChan)
+		close(gidErrorChan)
+		close(rpidErrorChan)
+		close(positionErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&cmd, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if cmd.Priority < 0 || cmd.Priority > MaxRunPriority {
+		errStr := fmt.Sprintf("Priority must be between 0 and %d", MaxRunPriority)
+		c.JSON(http.StatusBadRequest, gin.H{"status": errStr})
+		return
+	}
+	if cmd.RunName == "" {
+		cmd.RunName = fmt.Sprintf("%s-%d", cmd.Process, time.Now().UnixNano())
+	}
+	args, err := NormalizeArgs(cmd.Args)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	}
+
+	go conciergedb.GetUid(requestUser(c), db, uidErrorChan, &uid)
+	go conciergedb.GetGid(cmd.Group, db, gidErrorChan, &gid)
+	go conciergedb.GetRpid(cmd.Process, db, rpidErrorChan, &rpid)
+	uidErr, gidErr, rpidErr := <-uidErrorChan, <-gidErrorChan, <-rpidErrorChan
+	if uidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+	if gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+	if rpidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+		return
+	}
+
+	runAudit := AuditEntry{
+		Action: AuditCommandRun,
+		Target: cmd.Process + "/" + cmd.RunName,
+		Group:  cmd.Group,
+	}
+	if _, err = enqueueRun(cmd.RunName, rpid, uid, gid, cmd.Priority, args); err != nil {
+		var quotaErr *QuotaError
+		var parameterErr *ParameterError
+		runAudit.Outcome = AuditFailure
+		auditRequest(c, runAudit)
+		if errors.As(err, &quotaErr) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"status": quotaErr.Error()})
+			return
+		}
+		if errors.As(err, &parameterErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"status": parameterErr.Error()})
+			return
+		}
+		if errors.Is(err, ErrRunExists) {
+			c.JSON(http.StatusConflict, gin.H{"status": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error queueing command"})
+		return
+	}
+	runAudit.Outcome = AuditSuccess
+	auditRequest(c, runAudit)
+
+	go conciergedb.GetRunQueuePosition(cmd.RunName, db, positionErrorChan, &queuedRun, &position)
+	if err = <-positionErrorChan; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error checking queued command"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, QueueStatusRes{
+		RunName:  queuedRun.Name,
+		Status:   queuedRun.Status,
+		Priority: queuedRun.Priority,
+		Position: position,
+	})
+}
+
+func QueueStatus(c *gin.Context) {
+	var err error = nil
+	var body QueueStatusBody
+	var gid, position int
+	var queuedRun conciergedb.DbQueuedRun
+	gidErrorChan := make(chan error)
+	positionErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(positionErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go conciergedb.GetGid(body.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	go conciergedb.GetRunQueuePosition(body.RunName, db, positionErrorChan, &queuedRun, &position)
+	err = <-positionErrorChan
+	if err != nil || queuedRun.Gid != gid {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Cannot find queued command"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, QueueStatusRes{
+		RunName:  queuedRun.Name,
+		Status:   queuedRun.Status,
+		Priority: queuedRun.Priority,
+		Position: position,
+	})
 }
 
+func killErrorStatus(err error) int {
+	switch err {
+	case ErrRunNotFound:
+		return http.StatusNotFound
+	case ErrRunNotActive, ErrRunElsewhere, ErrRunStarting:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Takes a queued run off the queue or stops a running one. Runs are stopped
+// by the member running them.
 func KillCommand(c *gin.Context) {
-	//TODO container stuff
+	var err error = nil
+	var cmd KillCommandBody
+	var gid, rpid int
+	gidErrorChan := make(chan error)
+	rpidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(rpidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&cmd, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditCommandKill,
+		Target: cmd.Process + "/" + cmd.RunName,
+		Group:  cmd.Group,
+	})
+
+	go conciergedb.GetGid(cmd.Group, db, gidErrorChan, &gid)
+	go conciergedb.GetRpid(cmd.Process, db, rpidErrorChan, &rpid)
+	gidErr, rpidErr := <-gidErrorChan, <-rpidErrorChan
+	if gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+	if rpidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+		return
+	}
+
+	if err = killRun(cmd.RunName, gid, rpid); err != nil {
+		status := killErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			Logger.Error(
+				"Error killing run",
+				zap.String("name", cmd.RunName),
+				zap.String("error", err.Error()),
+			)
+			c.JSON(status, gin.H{"status": "Error killing command"})
+			return
+		}
+		c.JSON(status, gin.H{"status": err.Error()})
+		return
+	}
+
 	c.String(http.StatusOK, "Command killed successfully")
 }
 
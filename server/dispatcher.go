@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"os"
+	"time"
+)
+
+const MaxRunPriority = 9
+
+// Name this member records on the runs it queues and dispatches
+var nodeName string
+
+// Maximum number of runs executing on this member at once
+var nodeRunLimit = 8
+
+// Maximum number of runs a group may execute at once across all members,
+// unless the group's quota sets max_containers
+var groupRunLimit = 2
+
+// A claim passed over because the run's group is at its cap
+var errGroupAtCap = errors.New("Group at its run cap")
+
+// Wakes the dispatcher early when a run is queued or finishes
+var dispatchWake = make(chan struct{}, 1)
+
+func SetNodeName(name string) {
+	nodeName = name
+}
+
+func GetNodeName() string {
+	if nodeName == "" {
+		nodeName, _ = os.Hostname()
+	}
+	return nodeName
+}
+
+func SetNodeRunLimit(limit int) {
+	nodeRunLimit = limit
+}
+
+func SetGroupRunLimit(limit int) {
+	groupRunLimit = limit
+}
+
+func wakeDispatcher() {
+	select {
+	case dispatchWake <- struct{}{}:
+	default:
+	}
+}
+
+// Adds a run to this member's queue and returns its qid. Fails with a
+// *ParameterError when args do not fit the process's parameters, with a
+// *QuotaError when the run does not fit in its group's quota, and with
+// ErrRunExists when the name is taken.
+func enqueueRun(
+	runName string,
+	rpid int,
+	runnerUid int,
+	gid int,
+	priority int,
+	args map[string]string,
+) (int, error) {
+	var qid int
+	db = GetDb()
+
+	if args == nil {
+		args = map[string]string{}
+	}
+	if _, _, err := renderRun(rpid, args); err != nil {
+		return 0, err
+	}
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err = checkGroupQuota(tx, gid, rpid); err != nil {
+		return 0, err
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RunQueue + `
+          (name, rpid, runner_uid, gid, priority, status, node, args, date_created)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now())
+        RETURNING qid
+        `
+	err = tx.QueryRow(
+		queryStr,
+		runName,
+		rpid,
+		runnerUid,
+		gid,
+		priority,
+		conciergedb.ConciergeRunStatuses.Queued,
+		GetNodeName(),
+		argsJson,
+	).Scan(&qid)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return 0, ErrRunExists
+	} else if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	wakeDispatcher()
+	return qid, nil
+}
+
+// Records how a run ended, freeing its slot. Runs started by startRun are
+// finished when they exit.
+func FinishRun(runName string, runErr error) error {
+	db = GetDb()
+	status := conciergedb.ConciergeRunStatuses.Finished
+	var errString *string
+	if runErr != nil {
+		status = conciergedb.ConciergeRunStatuses.Failed
+		if errors.Is(runErr, ErrRunKilled) {
+			status = conciergedb.ConciergeRunStatuses.Killed
+		}
+		errMessage := runErr.Error()
+		errString = &errMessage
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.RunQueue + `
+        SET status = $1, error = $2
+        WHERE name = $3
+        `
+	if _, err := db.Exec(queryStr, status, errString, runName); err != nil {
+		return err
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RunningProcesses + `
+        WHERE name = $1
+        `
+	if _, err := db.Exec(queryStr, runName); err != nil {
+		return err
+	}
+
+	wakeDispatcher()
+	return nil
+}
+
+// Fails the runs this member recorded as running but holds no handle for.
+// Their handles went with the process that started them, so after a restart
+// nothing would finish them and they would hold their slots forever. Call it
+// once at startup, before the dispatcher runs.
+func ReconcileRuns() error {
+	var failed []string
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	live := []string{}
+	localRuns.Lock()
+	for runName := range localRuns.handles {
+		live = append(live, runName)
+	}
+	localRuns.Unlock()
+
+	go conciergedb.FailRunningRuns(GetNodeName(), live, ErrRunLost.Error(), db, errorChan, &failed)
+	if err := <-errorChan; err != nil {
+		return err
+	}
+	for _, runName := range failed {
+		Logger.Warn("Failed run lost in a restart", zap.String("run", runName))
+	}
+
+	wakeDispatcher()
+	return nil
+}
+
+// Starts queued runs every interval, or sooner when woken, until quit is
+// closed
+func RunDispatcher(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		DispatchQueuedRuns()
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		case <-dispatchWake:
+		}
+	}
+}
+
+// Claims a queued run if its group is below its cap. The count covers the
+// runs of the group on every member, and is taken under the same group lock
+// checkGroupQuota holds, so two members cannot both claim the last slot.
+func claimQueuedRun(queuedRun conciergedb.DbQueuedRun) (bool, error) {
+	var quota conciergedb.DbGroupQuota
+	var usage conciergedb.DbResources
+	var claimed bool
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	go conciergedb.GetGroupQuota(queuedRun.Gid, true, tx, errorChan, &quota)
+	if err = <-errorChan; err != nil {
+		return false, err
+	}
+	go conciergedb.GetGroupUsage(queuedRun.Gid, tx, errorChan, &usage)
+	if err = <-errorChan; err != nil {
+		return false, err
+	}
+	limit := groupRunLimit
+	if quota.MaxContainers != nil {
+		limit = *quota.MaxContainers
+	}
+	if usage.Containers >= limit {
+		return false, errGroupAtCap
+	}
+
+	go conciergedb.ClaimQueuedRun(queuedRun.Qid, tx, errorChan, &claimed)
+	if err = <-errorChan; err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return claimed, nil
+}
+
+// Starts as many queued runs of this member as its cap and the caps of their
+// groups allow
+func DispatchQueuedRuns() {
+	var queuedRuns []conciergedb.DbQueuedRun
+	var nodeRunning int
+	queuedErrorChan := make(chan error, 1)
+	runningErrorChan := make(chan error, 1)
+	node := GetNodeName()
+	db = GetDb()
+
+	defer func() {
+		close(queuedErrorChan)
+		close(runningErrorChan)
+	}()
+
+	go conciergedb.GetQueuedRuns(node, db, queuedErrorChan, &queuedRuns)
+	go conciergedb.GetRunningCount(node, db, runningErrorChan, &nodeRunning)
+	queuedErr, runningErr := <-queuedErrorChan, <-runningErrorChan
+	if queuedErr != nil {
+		Logger.Error("Error finding queued runs", zap.String("error", queuedErr.Error()))
+		return
+	}
+	if runningErr != nil {
+		Logger.Error("Error counting running runs", zap.String("error", runningErr.Error()))
+		return
+	}
+
+	// Runs of a group at its cap are passed over, so lower priority runs of
+	// other groups still get the free slots
+	groupsAtCap := map[int]bool{}
+	for _, queuedRun := range queuedRuns {
+		if nodeRunning >= nodeRunLimit {
+			return
+		}
+		if groupsAtCap[queuedRun.Gid] {
+			continue
+		}
+
+		claimed, err := claimQueuedRun(queuedRun)
+		if err == errGroupAtCap {
+			groupsAtCap[queuedRun.Gid] = true
+			continue
+		} else if err != nil {
+			Logger.Error(
+				"Error claiming queued run",
+				zap.String("run", queuedRun.Name),
+				zap.String("error", err.Error()),
+			)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		nodeRunning++
+
+		err = startRun(
+			queuedRun.Name,
+			queuedRun.Rpid,
+			queuedRun.RunnerUid,
+			queuedRun.Gid,
+			queuedRun.Args,
+		)
+		if err != nil {
+			Logger.Error(
+				"Error starting queued run",
+				zap.String("run", queuedRun.Name),
+				zap.String("error", err.Error()),
+			)
+			FinishRun(queuedRun.Name, err)
+			nodeRunning--
+		}
+	}
+}
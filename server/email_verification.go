@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	jwt "github.com/dgrijalva/jwt-go"
+	"net/url"
+	"time"
+)
+
+// Audience of email verification tokens, which VerifyToken never accepts
+const emailVerificationAudience = "verify-email"
+
+var emailVerificationLifetime = 48 * time.Hour
+
+// Link verification tokens are appended to as ?token=. Without one the mail
+// holds the bare token.
+var emailVerificationUrl string
+
+// When set, users must verify their email before using command and schedule
+// routes
+var requireVerifiedEmail bool
+
+func SetEmailVerificationUrl(verificationUrl string) {
+	emailVerificationUrl = verificationUrl
+}
+
+func SetRequireVerifiedEmail(require bool) {
+	requireVerifiedEmail = require
+}
+
+func GetRequireVerifiedEmail() bool {
+	return requireVerifiedEmail
+}
+
+type EmailVerificationClaims struct {
+	User  string `json:"user"`
+	Email string `json:"email"`
+	jwt.StandardClaims
+}
+
+// Signs a token binding a user to the email it was sent to, so changing the
+// email invalidates tokens sent to the old one
+func issueEmailVerificationToken(username string, email string) (string, error) {
+	signingKey, err := GetSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	claims := &EmailVerificationClaims{
+		username,
+		email,
+		jwt.StandardClaims{
+			Audience:  emailVerificationAudience,
+			ExpiresAt: time.Now().Add(emailVerificationLifetime).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(signingKey.Method, claims)
+	token.Header["kid"] = signingKey.Kid
+	return token.SignedString(signingKey.Key)
+}
+
+func parseEmailVerificationToken(token string) (*EmailVerificationClaims, error) {
+	parsedToken, err := parseToken(token, &EmailVerificationClaims{})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := parsedToken.Claims.(*EmailVerificationClaims)
+	if !ok || !parsedToken.Valid || !claims.VerifyAudience(emailVerificationAudience, true) {
+		return nil, errors.New("Verification token invalid")
+	}
+	return claims, nil
+}
+
+func sendVerificationEmail(username string, email string) error {
+	token, err := issueEmailVerificationToken(username, email)
+	if err != nil {
+		return err
+	}
+
+	link := token
+	if emailVerificationUrl != "" {
+		link = emailVerificationUrl + "?token=" + url.QueryEscape(token)
+	}
+	body := "Hello " + username + ",\n\n" +
+		"Confirm your email address with:\n\n" +
+		link + "\n\n" +
+		"This link expires in " + emailVerificationLifetime.String() + ".\n"
+
+	return GetMailer().Send(email, "Verify your email address", body)
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+type GroupUsageBody struct {
+	Group string `json:"group"`
+}
+
+type SetGroupQuotaBody struct {
+	Group string `json:"group"`
+	// Runs of the group executing at once across all members
+	MaxContainers    *int `json:"maxcontainers"`
+	MaxMemoryMb      *int `json:"maxmemory"`
+	MaxCpuMillicores *int `json:"maxcpu"`
+	MaxStorageMb     *int `json:"maxstorage"`
+}
+
+type CreateGroupBody struct {
+	Group string `json:"group"`
+	// Who owns and administers the new group, by default the user creating it
+	Owner string `json:"owner"`
+	// The group the new group goes under, none by default
+	Parent string `json:"parent"`
+}
+
+type SetGroupParentBody struct {
+	Group string `json:"group"`
+	// Empty moves the group to the top
+	Parent string `json:"parent"`
+}
+
+type RenameGroupBody struct {
+	Group string `json:"group"`
+	Name  string `json:"name"`
+}
+
+type GroupBody struct {
+	Group string `json:"group"`
+}
+
+// For the routes that act on one member of a group
+type GroupUserBody struct {
+	Group  string `json:"group"`
+	Target string `json:"target"`
+}
+
+type GroupMembersRes struct {
+	Group   string                      `json:"group"`
+	Members []conciergedb.DbGroupMember `json:"members"`
+}
+
+type GroupUsageRes struct {
+	Group string
+	Usage conciergedb.DbResources
+	Quota conciergedb.DbGroupQuota
+	// Always false: storage is reserved against the quota when runs are
+	// queued, but containers share one rootfs and are not stopped from
+	// writing past their storage limit
+	StorageEnforced bool
+}
+
+func GroupUsage(c *gin.Context) {
+	var err error = nil
+	var body GroupUsageBody
+	var gid int
+	var usage conciergedb.DbResources
+	var quota conciergedb.DbGroupQuota
+	gidErrorChan := make(chan error)
+	usageErrorChan := make(chan error)
+	quotaErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(usageErrorChan)
+		close(quotaErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go conciergedb.GetGid(body.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	go conciergedb.GetGroupUsage(gid, db, usageErrorChan, &usage)
+	go conciergedb.GetGroupQuota(gid, false, db, quotaErrorChan, &quota)
+	usageErr, quotaErr := <-usageErrorChan, <-quotaErrorChan
+	if usageErr != nil || quotaErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error checking group usage"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, GroupUsageRes{
+		Group:           body.Group,
+		Usage:           usage,
+		Quota:           quota,
+		StorageEnforced: false,
+	})
+}
+
+// Replaces the quota of a group. Omitted fields become unlimited.
+func SetGroupQuota(c *gin.Context) {
+	var err error = nil
+	var body SetGroupQuotaBody
+	var gid int
+	gidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupSetQuota,
+		Target: body.Group,
+		Group:  body.Group,
+	})
+	for _, limit := range []*int{
+		body.MaxContainers,
+		body.MaxMemoryMb,
+		body.MaxCpuMillicores,
+		body.MaxStorageMb,
+	} {
+		if limit != nil && *limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "Quotas cannot be negative"})
+			return
+		}
+	}
+
+	go conciergedb.GetGid(body.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupQuotas + `
+          (gid, max_containers, max_memory_mb, max_cpu_millicores, max_storage_mb)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (gid) DO UPDATE
+        SET max_containers = EXCLUDED.max_containers,
+            max_memory_mb = EXCLUDED.max_memory_mb,
+            max_cpu_millicores = EXCLUDED.max_cpu_millicores,
+            max_storage_mb = EXCLUDED.max_storage_mb
+        `
+	_, err = db.Exec(
+		queryStr,
+		gid,
+		body.MaxContainers,
+		body.MaxMemoryMb,
+		body.MaxCpuMillicores,
+		body.MaxStorageMb,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error setting group quota"})
+		return
+	}
+
+	c.String(http.StatusOK, "Group quota set successfully")
+}
+
+// The status code and message for errors from the group functions
+func groupErrorStatus(err error) (int, string) {
+	switch err {
+	case ErrGroupNameInvalid:
+		return http.StatusBadRequest, err.Error()
+	case ErrGroupNotFound, ErrUserNotFound:
+		return http.StatusNotFound, err.Error()
+	case ErrGroupExists, ErrGroupInUse, ErrAlreadyMember, ErrNotMember, ErrRemoveOwner, ErrGroupCycle, ErrGroupTooDeep:
+		return http.StatusConflict, err.Error()
+	case ErrGroupProtected:
+		return http.StatusForbidden, err.Error()
+	}
+	Logger.Error("Error managing group", zap.String("error", err.Error()))
+	return http.StatusInternalServerError, "Error managing group"
+}
+
+func CreateGroup(c *gin.Context) {
+	var body CreateGroupBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupCreate,
+		Target: body.Group,
+		Group:  body.Group,
+	})
+	owner := body.Owner
+	if owner == "" {
+		owner = requestUser(c)
+	}
+
+	if err := createGroup(body.Group, owner, body.Parent); err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Group created successfully")
+}
+
+func RenameGroup(c *gin.Context) {
+	var body RenameGroupBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupRename,
+		Target: body.Name,
+		Group:  body.Group,
+	})
+
+	if err := renameGroup(body.Group, body.Name); err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Group renamed successfully")
+}
+
+// Deletes a group. Groups still in use get a 409 listing what uses them.
+func DeleteGroup(c *gin.Context) {
+	var body GroupBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupDelete,
+		Target: body.Group,
+		Group:  body.Group,
+	})
+
+	deps, err := deleteGroup(body.Group)
+	if err == ErrGroupInUse {
+		c.JSON(http.StatusConflict, gin.H{"status": err.Error(), "dependencies": deps})
+		return
+	} else if err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Group deleted successfully")
+}
+
+func ListGroupMembers(c *gin.Context) {
+	var body GroupBody
+	var gid int
+	var members []conciergedb.DbGroupMember
+	gidErrorChan := make(chan error)
+	membersErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(membersErrorChan)
+	}()
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go conciergedb.GetGid(body.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	go conciergedb.GetGroupMembers(gid, db, membersErrorChan, &members)
+	if membersErr := <-membersErrorChan; membersErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error listing group members"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, GroupMembersRes{Group: body.Group, Members: members})
+}
+
+func AddGroupUser(c *gin.Context) {
+	var body GroupUserBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupAddUser,
+		Target: body.Target,
+		Group:  body.Group,
+	})
+
+	if err := addGroupUser(body.Group, body.Target); err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "User added to group successfully")
+}
+
+func RemoveGroupUser(c *gin.Context) {
+	var body GroupUserBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupRemoveUser,
+		Target: body.Target,
+		Group:  body.Group,
+	})
+
+	if err := removeGroupUser(body.Group, body.Target); err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "User removed from group successfully")
+}
+
+func TransferGroupOwnership(c *gin.Context) {
+	var body GroupUserBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupTransferOwner,
+		Target: body.Target,
+		Group:  body.Group,
+	})
+
+	if err := transferGroupOwnership(body.Group, body.Target); err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Group ownership transferred successfully")
+}
+
+func SetGroupParent(c *gin.Context) {
+	var body SetGroupParentBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditGroupSetParent,
+		Target: body.Parent,
+		Group:  body.Group,
+	})
+
+	if err := setGroupParent(body.Group, body.Parent); err != nil {
+		status, msg := groupErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Group parent set successfully")
+}
@@ -0,0 +1,504 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/lib/pq"
+	"strings"
+)
+
+var ErrGroupNameInvalid = errors.New("Group names must be 1 to 255 characters without surrounding spaces")
+var ErrGroupExists = errors.New("Group already exists")
+var ErrGroupNotFound = errors.New("Cannot find group")
+var ErrGroupProtected = errors.New("The site group cannot be renamed or deleted")
+var ErrGroupInUse = errors.New("Group is still in use")
+var ErrUserNotFound = errors.New("Cannot find user")
+var ErrAlreadyMember = errors.New("User is already in the group")
+var ErrNotMember = errors.New("User is not in the group")
+var ErrRemoveOwner = errors.New("The group owner cannot be removed, transfer ownership first")
+var ErrGroupCycle = errors.New("A group cannot be placed under itself or one of its descendants")
+var ErrGroupTooDeep = fmt.Errorf("Group hierarchies are at most %d groups deep", conciergedb.MaxGroupDepth)
+
+// Group and role names are 1 to 255 characters without surrounding spaces
+func validName(name string) bool {
+	return name != "" && len(name) <= 255 && strings.TrimSpace(name) == name
+}
+
+func lookupGid(tx *sql.Tx, group string) (int, error) {
+	var gid int
+	queryStr := `
+        SELECT g.gid
+        FROM ` +
+		conciergedb.ConciergeTables.Groups + ` g
+        WHERE g.name = $1
+        FOR UPDATE
+        `
+	err := tx.QueryRow(queryStr, group).Scan(&gid)
+	if err == sql.ErrNoRows {
+		return 0, ErrGroupNotFound
+	}
+	return gid, err
+}
+
+func lookupUid(tx *sql.Tx, username string) (int, error) {
+	var uid int
+	queryStr := `
+        SELECT u.uid
+        FROM ` +
+		conciergedb.ConciergeTables.Users + ` u
+        WHERE u.username = $1
+        `
+	err := tx.QueryRow(queryStr, username).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound
+	}
+	return uid, err
+}
+
+func isGroupMember(tx *sql.Tx, uid int, gid int) (bool, error) {
+	var isMember bool
+	queryStr := `
+        SELECT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.GroupUsers + `
+          WHERE uid = $1 AND gid = $2
+        )
+        `
+	err := tx.QueryRow(queryStr, uid, gid).Scan(&isMember)
+	return isMember, err
+}
+
+// Gives a user a role in a group unless they already hold it
+func grantGroupRole(tx *sql.Tx, uid int, gid int, role string) error {
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUserRoles + ` (uid, gid, rid)
+        SELECT $1, $2, r.rid
+        FROM ` + conciergedb.ConciergeTables.Roles + ` r
+        WHERE r.name = $3 AND NOT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.GroupUserRoles + ` gur
+          WHERE gur.uid = $1 AND gur.gid = $2 AND gur.rid = r.rid
+        )
+        `
+	_, err := tx.Exec(queryStr, uid, gid, role)
+	return err
+}
+
+// Creates a group owned and administered by owner, under parent unless it is
+// empty
+func createGroup(group string, owner string, parent string) error {
+	if !validName(group) {
+		return ErrGroupNameInvalid
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	uid, err := lookupUid(tx, owner)
+	if err != nil {
+		return err
+	}
+	var parentGid sql.NullInt64
+	if parent != "" {
+		gid, err := lookupGid(tx, parent)
+		if err != nil {
+			return err
+		}
+		depth, err := groupDepth(tx, gid)
+		if err != nil {
+			return err
+		} else if depth+1 > conciergedb.MaxGroupDepth {
+			return ErrGroupTooDeep
+		}
+		parentGid = sql.NullInt64{Int64: int64(gid), Valid: true}
+	}
+
+	var gid int
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.Groups + ` (name, owner_uid, parent_gid)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (name) DO NOTHING
+        RETURNING gid
+        `
+	err = tx.QueryRow(queryStr, group, uid, parentGid).Scan(&gid)
+	if err == sql.ErrNoRows {
+		return ErrGroupExists
+	} else if err != nil {
+		return err
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUsers + ` (uid, gid)
+        VALUES ($1, $2)
+        `
+	if _, err = tx.Exec(queryStr, uid, gid); err != nil {
+		return err
+	}
+	if err = grantGroupRole(tx, uid, gid, conciergedb.InitConciergeRoles.Admin); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Renames a group, carrying API key scopes that name it over to the new name
+func renameGroup(group string, name string) error {
+	if group == conciergedb.InitConciergeGroups.Site {
+		return ErrGroupProtected
+	}
+	if !validName(name) {
+		return ErrGroupNameInvalid
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Groups + `
+        SET name = $1
+        WHERE gid = $2 AND NOT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.Groups + ` WHERE name = $1
+        )
+        `
+	res, err := tx.Exec(queryStr, name, gid)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrGroupExists
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.ApiKeys + `
+        SET groups = array_replace(groups, $1, $2)
+        WHERE $1 = ANY(groups)
+        `
+	if _, err = tx.Exec(queryStr, group, name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a group along with its members, roles, quota and run history.
+// Groups that processes, schedules, active runs or secrets still refer to are
+// left alone, and what refers to them is returned with ErrGroupInUse.
+func deleteGroup(group string) (conciergedb.DbGroupDependencies, error) {
+	var deps conciergedb.DbGroupDependencies
+	var gid int
+	if group == conciergedb.InitConciergeGroups.Site {
+		return deps, ErrGroupProtected
+	}
+	db = GetDb()
+
+	errorChan := make(chan error, 1)
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetGid(group, db, errorChan, &gid)
+	if err := <-errorChan; err != nil {
+		return deps, ErrGroupNotFound
+	}
+	go conciergedb.GetGroupDependencies(gid, db, errorChan, &deps)
+	if err := <-errorChan; err != nil {
+		return deps, err
+	}
+	if deps != (conciergedb.DbGroupDependencies{}) {
+		return deps, ErrGroupInUse
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return deps, err
+	}
+	defer tx.Rollback()
+
+	if _, err = lookupGid(tx, group); err != nil {
+		return deps, err
+	}
+
+	// Anything added since the check above still has its foreign key, and
+	// fails the delete of the group itself
+	for _, table := range []string{
+		conciergedb.ConciergeTables.OidcRoleGrants,
+		conciergedb.ConciergeTables.GroupUserRoles,
+		conciergedb.ConciergeTables.GroupUsers,
+		conciergedb.ConciergeTables.GroupQuotas,
+	} {
+		if _, err = tx.Exec("DELETE FROM "+table+" WHERE gid = $1", gid); err != nil {
+			return deps, err
+		}
+	}
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RunQueue + `
+        WHERE gid = $1 AND status IN ($2, $3)
+        `
+	_, err = tx.Exec(
+		queryStr,
+		gid,
+		conciergedb.ConciergeRunStatuses.Finished,
+		conciergedb.ConciergeRunStatuses.Failed,
+	)
+	if err != nil {
+		return deps, err
+	}
+
+	// Keys scoped to the group would otherwise pick up a new group that
+	// reuses the name
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.ApiKeys + `
+        SET revoked = true
+        WHERE $1 = ANY(groups)
+        `
+	if _, err = tx.Exec(queryStr, group); err != nil {
+		return deps, err
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.Groups + `
+        WHERE gid = $1
+        `
+	if _, err = tx.Exec(queryStr, gid); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return deps, ErrGroupInUse
+		}
+		return deps, err
+	}
+
+	return deps, tx.Commit()
+}
+
+// Adds a user to a group with the user role
+func addGroupUser(group string, username string) error {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+	uid, err := lookupUid(tx, username)
+	if err != nil {
+		return err
+	}
+	isMember, err := isGroupMember(tx, uid, gid)
+	if err != nil {
+		return err
+	} else if isMember {
+		return ErrAlreadyMember
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUsers + ` (uid, gid)
+        VALUES ($1, $2)
+        `
+	if _, err = tx.Exec(queryStr, uid, gid); err != nil {
+		return err
+	}
+	if err = grantGroupRole(tx, uid, gid, conciergedb.InitConciergeRoles.User); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Removes a user and all their roles from a group
+func removeGroupUser(group string, username string) error {
+	var ownerUid sql.NullInt64
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+	uid, err := lookupUid(tx, username)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+        SELECT g.owner_uid
+        FROM ` +
+		conciergedb.ConciergeTables.Groups + ` g
+        WHERE g.gid = $1
+        `
+	if err = tx.QueryRow(queryStr, gid).Scan(&ownerUid); err != nil {
+		return err
+	}
+	if ownerUid.Valid && int(ownerUid.Int64) == uid {
+		return ErrRemoveOwner
+	}
+
+	for _, table := range []string{
+		conciergedb.ConciergeTables.OidcRoleGrants,
+		conciergedb.ConciergeTables.GroupUserRoles,
+	} {
+		if _, err = tx.Exec("DELETE FROM "+table+" WHERE uid = $1 AND gid = $2", uid, gid); err != nil {
+			return err
+		}
+	}
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.GroupUsers + `
+        WHERE uid = $1 AND gid = $2
+        `
+	res, err := tx.Exec(queryStr, uid, gid)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrNotMember
+	}
+
+	return tx.Commit()
+}
+
+// Makes a member the owner of a group, and an admin of it if they are not
+// already. The previous owner keeps their roles.
+func transferGroupOwnership(group string, username string) error {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+	uid, err := lookupUid(tx, username)
+	if err != nil {
+		return err
+	}
+	isMember, err := isGroupMember(tx, uid, gid)
+	if err != nil {
+		return err
+	} else if !isMember {
+		return ErrNotMember
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Groups + `
+        SET owner_uid = $1
+        WHERE gid = $2
+        `
+	if _, err = tx.Exec(queryStr, uid, gid); err != nil {
+		return err
+	}
+	if err = grantGroupRole(tx, uid, gid, conciergedb.InitConciergeRoles.Admin); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// How many groups deep a group is, counting itself
+func groupDepth(tx *sql.Tx, gid int) (int, error) {
+	var depth int
+	queryStr := `
+        WITH RECURSIVE ` + conciergedb.GroupAncestorsCte("g.gid = $1") + `
+        SELECT COUNT(*) FROM ancestors
+        `
+	err := tx.QueryRow(queryStr, gid).Scan(&depth)
+	return depth, err
+}
+
+// Moves a group under parent, or to the top when parent is empty. The group
+// takes its descendants along, so they inherit from parent too.
+func setGroupParent(group string, parent string) error {
+	if group == conciergedb.InitConciergeGroups.Site {
+		return ErrGroupProtected
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+	var parentGid sql.NullInt64
+	if parent != "" {
+		pgid, err := lookupGid(tx, parent)
+		if err != nil {
+			return err
+		}
+
+		// Parents move under their own descendants only by making a cycle.
+		// The height of the subtree moved plus the depth of its new parent
+		// is the depth of its deepest group.
+		var isDescendant bool
+		var height int
+		queryStr := `
+            WITH RECURSIVE ` + conciergedb.GroupDescendantsCte("g.gid = $1") + `
+            SELECT COALESCE(bool_or(gid = $2), false), COALESCE(MAX(depth), 0) + 1
+            FROM descendants
+            `
+		if err = tx.QueryRow(queryStr, gid, pgid).Scan(&isDescendant, &height); err != nil {
+			return err
+		}
+		if isDescendant {
+			return ErrGroupCycle
+		}
+		depth, err := groupDepth(tx, pgid)
+		if err != nil {
+			return err
+		} else if depth+height > conciergedb.MaxGroupDepth {
+			return ErrGroupTooDeep
+		}
+		parentGid = sql.NullInt64{Int64: int64(pgid), Valid: true}
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Groups + `
+        SET parent_gid = $1
+        WHERE gid = $2
+        `
+	if _, err = tx.Exec(queryStr, parentGid, gid); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
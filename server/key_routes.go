@@ -0,0 +1,94 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"net/http"
+	"time"
+)
+
+type RotateKeysBody struct {
+	RetireAfter int64 `json:"retireafter"`
+}
+
+type RetireKeyBody struct {
+	Kid string `json:"kid"`
+}
+
+type RotateKeysRes struct {
+	Kid string `json:"kid"`
+}
+
+type JwksRes struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// Signs new tokens with a fresh key. Tokens signed with the old key stay valid
+// for retireafter seconds, by default the access token lifetime.
+func RotateKeys(c *gin.Context) {
+	var err error = nil
+	var body RotateKeysBody
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if body.RetireAfter < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid retire after"})
+		return
+	}
+
+	retireAfter := accessTokenLifetime
+	if body.RetireAfter > 0 {
+		retireAfter = time.Duration(body.RetireAfter) * time.Second
+	}
+
+	kid, err := RotateSigningKeys(retireAfter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error rotating signing keys"})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditKeyRotate,
+		Target:  kid,
+		Outcome: AuditSuccess,
+	})
+	c.SecureJSON(http.StatusOK, RotateKeysRes{Kid: kid})
+}
+
+// Immediately invalidates every token signed with a rotated out key
+func RetireKey(c *gin.Context) {
+	var err error = nil
+	var body RetireKeyBody
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = RetireSigningKey(body.Kid); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditKeyRetire,
+		Target:  body.Kid,
+		Outcome: AuditSuccess,
+	})
+	c.String(http.StatusOK, "Signing key retired successfully")
+}
+
+// Publishes the public signing keys, so other services can verify tokens
+func Jwks(c *gin.Context) {
+	jwks, err := GetPublicSigningKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error reading signing keys"})
+		return
+	}
+
+	// Verifiers refetch on unknown kids, so a short cache is enough
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, JwksRes{Keys: jwks})
+}
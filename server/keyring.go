@@ -0,0 +1,520 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	jwt "github.com/dgrijalva/jwt-go"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A decrypted JWT signing key. Key signs tokens and VerifyKey checks them,
+// which for HS256 is the same secret.
+type SigningKey struct {
+	Kid       string
+	Status    string
+	Method    jwt.SigningMethod
+	Key       interface{}
+	VerifyKey interface{}
+}
+
+// Decrypted signing keys by kid, cached from the signing keys table
+var keyRing = struct {
+	sync.RWMutex
+	keys   map[string]*SigningKey
+	active *SigningKey
+	loaded time.Time
+}{}
+
+// Lower bound between key ring reloads triggered by unknown kids
+const keyRingReloadInterval = time.Second
+
+// How long the key ring is used before it is read again, which bounds how
+// long a key retired by another member keeps verifying here
+var keyRingMaxAge = 30 * time.Second
+
+// Held while reloading, so a stale key ring is read once rather than by every
+// request that finds it stale
+var keyRingReload sync.Mutex
+
+// Advisory lock rotations take, so members rotate one at a time and there is
+// only ever one active key
+const SigningKeyRotationLock = 7310582
+
+func SetKeyRingMaxAge(maxAge time.Duration) {
+	keyRingMaxAge = maxAge
+}
+
+// The algorithm new signing keys are made for
+var signingAlg = jwt.SigningMethodHS256.Alg()
+
+// Tokens naming any other algorithm are rejected before their key is looked
+// up, so "none" and the like never reach a key func
+var tokenParser = &jwt.Parser{
+	ValidMethods: []string{
+		jwt.SigningMethodHS256.Alg(),
+		jwt.SigningMethodRS256.Alg(),
+		SigningMethodEdDSA.Alg(),
+	},
+}
+
+// Sets the algorithm keys made by later rotations use: HS256, RS256 or EdDSA.
+// Only RS256 and EdDSA keys are published at /.well-known/jwks.json, so other
+// services can verify tokens without holding a secret.
+func SetSigningAlgorithm(alg string) error {
+	if _, err := signingMethod(alg); err != nil {
+		return err
+	}
+	signingAlg = alg
+	return nil
+}
+
+func GetSigningAlgorithm() string {
+	return signingAlg
+}
+
+func signingKeyAdditionalData(kid string) []byte {
+	return []byte("signing-key/" + kid)
+}
+
+// A random 128 bit hex id, used for kids and jtis
+func randomId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func signingMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		return jwt.SigningMethodHS256, nil
+	case jwt.SigningMethodRS256.Alg():
+		return jwt.SigningMethodRS256, nil
+	case SigningMethodEdDSA.Alg():
+		return SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("Unsupported signing algorithm %s", alg)
+}
+
+// Key material for a new key: the secret for HS256, a PKCS #8 private key
+// otherwise. The first HS256 key reuses the secret given to SetJwtSecret when
+// there is one.
+func generateKeyMaterial(alg string, first bool) ([]byte, error) {
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(privateKey)
+	case SigningMethodEdDSA.Alg():
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return x509.MarshalPKCS8PrivateKey(privateKey)
+	}
+
+	if first && len(GetJwtSecret()) > 0 {
+		return GetJwtSecret(), nil
+	}
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		return nil, err
+	}
+	return material, nil
+}
+
+// The signing and verification keys in material made by generateKeyMaterial
+func parseKeyMaterial(alg string, material []byte) (interface{}, interface{}, error) {
+	if alg == jwt.SigningMethodHS256.Alg() {
+		return material, material, nil
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(material)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if alg == jwt.SigningMethodRS256.Alg() {
+			return key, &key.PublicKey, nil
+		}
+	case ed25519.PrivateKey:
+		if alg == SigningMethodEdDSA.Alg() {
+			return key, key.Public(), nil
+		}
+	}
+	return nil, nil, fmt.Errorf("Key material does not match algorithm %s", alg)
+}
+
+// Reads and decrypts all keys that are not retired. Creates the first active
+// key when there is none.
+func loadKeyRing() error {
+	var signingKeys []conciergedb.DbSigningKey
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetSigningKeys(db, errorChan, &signingKeys)
+	if err := <-errorChan; err != nil {
+		return err
+	}
+
+	keys := map[string]*SigningKey{}
+	var active *SigningKey
+	for _, signingKey := range signingKeys {
+		method, err := signingMethod(signingKey.Alg)
+		if err != nil {
+			return err
+		}
+		material, err := openWithMasterKey(
+			signingKey.Ciphertext,
+			signingKeyAdditionalData(signingKey.Kid),
+		)
+		if err != nil {
+			return fmt.Errorf("Could not decrypt signing key %s", signingKey.Kid)
+		}
+		key, verifyKey, err := parseKeyMaterial(signingKey.Alg, material)
+		if err != nil {
+			return fmt.Errorf("Could not read signing key %s", signingKey.Kid)
+		}
+		keys[signingKey.Kid] = &SigningKey{
+			Kid:       signingKey.Kid,
+			Status:    signingKey.Status,
+			Method:    method,
+			Key:       key,
+			VerifyKey: verifyKey,
+		}
+		if signingKey.Status == conciergedb.ConciergeKeyStatuses.Active {
+			active = keys[signingKey.Kid]
+		}
+	}
+
+	if active == nil {
+		_, err := rotateSigningKeys(accessTokenLifetime, true)
+		return err
+	}
+
+	keyRing.Lock()
+	keyRing.keys = keys
+	keyRing.active = active
+	keyRing.loaded = time.Now()
+	keyRing.Unlock()
+	return nil
+}
+
+// Reads the key ring again unless it was loaded within maxAge
+func reloadKeyRing(maxAge time.Duration) error {
+	keyRingReload.Lock()
+	defer keyRingReload.Unlock()
+
+	keyRing.RLock()
+	loaded := keyRing.loaded
+	keyRing.RUnlock()
+	if !loaded.IsZero() && time.Since(loaded) <= maxAge {
+		return nil
+	}
+	return loadKeyRing()
+}
+
+// The key new tokens are signed with
+func GetSigningKey() (*SigningKey, error) {
+	if err := reloadKeyRing(keyRingMaxAge); err != nil {
+		return nil, err
+	}
+	keyRing.RLock()
+	defer keyRing.RUnlock()
+	return keyRing.active, nil
+}
+
+// Any key that is not retired. The key ring is read again once it is older
+// than keyRingMaxAge, and for unknown kids, since keys are rotated and
+// retired by other members too.
+func getVerificationKey(kid string) (*SigningKey, error) {
+	if err := reloadKeyRing(keyRingMaxAge); err != nil {
+		return nil, err
+	}
+	keyRing.RLock()
+	signingKey, ok := keyRing.keys[kid]
+	keyRing.RUnlock()
+	if ok {
+		return signingKey, nil
+	}
+
+	if err := reloadKeyRing(keyRingReloadInterval); err != nil {
+		return nil, err
+	}
+	keyRing.RLock()
+	signingKey, ok = keyRing.keys[kid]
+	keyRing.RUnlock()
+	if ok {
+		return signingKey, nil
+	}
+
+	return nil, fmt.Errorf("Unknown signing key %s", kid)
+}
+
+// A public key in the JSON Web Key format of RFC 7517
+type Jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 curve and public key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// The public halves of the keys that are not retired. HS256 keys are secret
+// and left out.
+func GetPublicSigningKeys() ([]Jwk, error) {
+	if _, err := GetSigningKey(); err != nil {
+		return nil, err
+	}
+	keyRing.RLock()
+	defer keyRing.RUnlock()
+
+	jwks := []Jwk{}
+	for _, signingKey := range keyRing.keys {
+		jwk := Jwk{Use: "sig", Alg: signingKey.Method.Alg(), Kid: signingKey.Kid}
+		switch key := signingKey.VerifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(key)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks, nil
+}
+
+// Parses and verifies a token signed by a key in the key ring
+func parseToken(token string, claims jwt.Claims) (*jwt.Token, error) {
+	return tokenParser.ParseWithClaims(token, claims, signingKeyFunc)
+}
+
+// Key lookup for jwt.Parse. Tokens must name a known kid and use its
+// algorithm, so a token cannot pass an RSA public key off as an HMAC secret.
+func signingKeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errors.New("Token has no kid")
+	}
+	signingKey, err := getVerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != signingKey.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing algorithm %s", token.Method.Alg())
+	}
+	return signingKey.VerifyKey, nil
+}
+
+// Makes a new active signing key for the configured algorithm. The previous
+// active key keeps verifying tokens for retireAfter, then is retired. Returns
+// the new kid.
+func RotateSigningKeys(retireAfter time.Duration) (string, error) {
+	return rotateSigningKeys(retireAfter, false)
+}
+
+// Rotates the signing keys. With first, only when there is no active key yet,
+// so members starting together make a single first key between them. Returns
+// an empty kid when another member made it.
+func rotateSigningKeys(retireAfter time.Duration, first bool) (string, error) {
+	db = GetDb()
+
+	kid, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	alg := GetSigningAlgorithm()
+	material, err := generateKeyMaterial(alg, first)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealWithMasterKey(material, signingKeyAdditionalData(kid))
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, SigningKeyRotationLock); err != nil {
+		return "", err
+	}
+	if first {
+		var activeKeys int
+		queryStr := `
+            SELECT COUNT(*)
+            FROM ` +
+			conciergedb.ConciergeTables.SigningKeys + ` sk
+            WHERE sk.status = $1
+            `
+		err = tx.QueryRow(queryStr, conciergedb.ConciergeKeyStatuses.Active).Scan(&activeKeys)
+		if err != nil {
+			return "", err
+		}
+		if activeKeys > 0 {
+			tx.Rollback()
+			return "", loadKeyRing()
+		}
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.SigningKeys + `
+        SET status = $1, date_retire = now() + $2 * interval '1 second'
+        WHERE status = $3
+        `
+	_, err = tx.Exec(
+		queryStr,
+		conciergedb.ConciergeKeyStatuses.Verify,
+		int64(retireAfter/time.Second),
+		conciergedb.ConciergeKeyStatuses.Active,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.SigningKeys + `
+          (kid, alg, ciphertext, status, date_created)
+        VALUES ($1, $2, $3, $4, now())
+        `
+	_, err = tx.Exec(
+		queryStr,
+		kid,
+		alg,
+		ciphertext,
+		conciergedb.ConciergeKeyStatuses.Active,
+	)
+	if err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	Logger.Info("Rotated signing keys", zap.String("kid", kid))
+	return kid, loadKeyRing()
+}
+
+// Stops a key from verifying tokens. The active key cannot be retired, rotate
+// it out first.
+func RetireSigningKey(kid string) error {
+	db = GetDb()
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.SigningKeys + `
+        SET status = $1, date_retired = now()
+        WHERE kid = $2 AND status = $3
+        `
+	res, err := db.Exec(
+		queryStr,
+		conciergedb.ConciergeKeyStatuses.Retired,
+		kid,
+		conciergedb.ConciergeKeyStatuses.Verify,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return errors.New("No rotated out signing key found with that kid")
+	}
+
+	Logger.Info("Retired signing key", zap.String("kid", kid))
+	return loadKeyRing()
+}
+
+func retireExpiredSigningKeys() error {
+	db = GetDb()
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.SigningKeys + `
+        SET status = $1, date_retired = now()
+        WHERE status = $2 AND date_retire <= now()
+        `
+	res, err := db.Exec(
+		queryStr,
+		conciergedb.ConciergeKeyStatuses.Retired,
+		conciergedb.ConciergeKeyStatuses.Verify,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows > 0 {
+		return loadKeyRing()
+	}
+	return nil
+}
+
+// Every interval retires rotated out keys whose time is up, and rotates the
+// active key once it is older than rotateEvery. A zero rotateEvery leaves
+// rotation to the admin API.
+func RunKeyRotation(interval time.Duration, rotateEvery time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := retireExpiredSigningKeys(); err != nil {
+			Logger.Error("Error retiring signing keys", zap.String("error", err.Error()))
+		}
+		if rotateEvery <= 0 {
+			continue
+		}
+
+		var dateCreated time.Time
+		queryStr := `
+            SELECT sk.date_created
+            FROM ` +
+			conciergedb.ConciergeTables.SigningKeys + ` sk
+            WHERE sk.status = $1
+            `
+		err := GetDb().QueryRow(queryStr, conciergedb.ConciergeKeyStatuses.Active).Scan(&dateCreated)
+		if err == nil && time.Since(dateCreated) < rotateEvery {
+			continue
+		}
+		if _, err = RotateSigningKeys(accessTokenLifetime); err != nil {
+			Logger.Error("Error rotating signing keys", zap.String("error", err.Error()))
+		}
+	}
+}
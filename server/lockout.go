@@ -0,0 +1,233 @@
+package server
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Failed sign ins are counted per username and per client IP
+const (
+	loginFailureUser = "user"
+	loginFailureIp   = "ip"
+)
+
+// How failed sign ins slow down and lock out further attempts. After each
+// failure the next attempt must wait BaseDelay, doubling per failure up to
+// MaxDelay. Reaching MaxUserFailures for a username or MaxIpFailures for an
+// IP locks it out for Lockout. Failures older than Lockout are forgotten.
+type LoginThrottlePolicy struct {
+	MaxUserFailures int
+	MaxIpFailures   int
+	Lockout         time.Duration
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+}
+
+var loginThrottlePolicy = LoginThrottlePolicy{
+	MaxUserFailures: 5,
+	MaxIpFailures:   50,
+	Lockout:         15 * time.Minute,
+	BaseDelay:       500 * time.Millisecond,
+	MaxDelay:        16 * time.Second,
+}
+
+func SetLoginThrottlePolicy(policy LoginThrottlePolicy) {
+	loginThrottlePolicy = policy
+}
+
+func GetLoginThrottlePolicy() LoginThrottlePolicy {
+	return loginThrottlePolicy
+}
+
+func loginFailureDelay(failures int) time.Duration {
+	policy := GetLoginThrottlePolicy()
+	delay := policy.BaseDelay
+	for i := 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	return delay
+}
+
+// How long a client must wait before trying to sign in as a user, zero when
+// it may try now
+func loginWait(username string, ip string) (time.Duration, error) {
+	var wait time.Duration
+	db = GetDb()
+	policy := GetLoginThrottlePolicy()
+
+	queryStr := `
+        SELECT lf.failures, lf.last_failure, lf.locked_until
+        FROM ` +
+		conciergedb.ConciergeTables.LoginFailures + ` lf
+        WHERE (lf.kind = $1 AND lf.key = $2) OR (lf.kind = $3 AND lf.key = $4)
+        `
+	res, err := db.Query(queryStr, loginFailureUser, username, loginFailureIp, ip)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	now := time.Now()
+	for res.Next() {
+		var failures int
+		var lastFailure time.Time
+		var lockedUntil sql.NullTime
+		if err = res.Scan(&failures, &lastFailure, &lockedUntil); err != nil {
+			return 0, err
+		}
+
+		until := lastFailure.Add(loginFailureDelay(failures))
+		if lastFailure.Before(now.Add(-policy.Lockout)) {
+			until = now
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(until) {
+			until = lockedUntil.Time
+		}
+		if until.Sub(now) > wait {
+			wait = until.Sub(now)
+		}
+	}
+	return wait, res.Err()
+}
+
+// Responds 429 with a Retry-After when the client has to wait before trying
+// to sign in as the user again. Returns whether it did.
+func loginThrottled(c *gin.Context, username string) bool {
+	ip := c.ClientIP()
+	wait, err := loginWait(username, ip)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+		return true
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	auditRequest(c, AuditEntry{
+		Actor:   username,
+		Action:  AuditSigninBlocked,
+		Target:  username,
+		Outcome: AuditDenied,
+	})
+	c.Header("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{"status": "Too many failed sign in attempts, try again later"})
+	return true
+}
+
+// Counts a failure against a username or IP, locking it out once it reaches
+// max. Returns whether this failure caused a lockout.
+func countLoginFailure(kind string, key string, max int) (bool, error) {
+	var lockedUntil sql.NullTime
+	db = GetDb()
+	policy := GetLoginThrottlePolicy()
+
+	failuresExpr := `
+        CASE WHEN lf.last_failure < now() - $3 * interval '1 second'
+          THEN 1 ELSE lf.failures + 1 END`
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.LoginFailures + ` AS lf
+          (kind, key, failures, last_failure, locked_until)
+        VALUES ($1, $2, 1, now(),
+          CASE WHEN $4 <= 1 THEN now() + $5 * interval '1 second' END)
+        ON CONFLICT (kind, key) DO UPDATE
+        SET failures = ` + failuresExpr + `,
+          last_failure = now(),
+          locked_until = CASE WHEN ` + failuresExpr + ` >= $4
+            THEN now() + $5 * interval '1 second'
+            ELSE lf.locked_until END
+        RETURNING CASE WHEN failures = $4 THEN locked_until END
+        `
+	err := db.QueryRow(
+		queryStr,
+		kind,
+		key,
+		int64(policy.Lockout/time.Second),
+		max,
+		int64(policy.Lockout/time.Second),
+	).Scan(&lockedUntil)
+	if err != nil {
+		return false, err
+	}
+	return lockedUntil.Valid, nil
+}
+
+// Records a failed sign in against both the username and the client IP, and
+// audits it along with any lockout it causes
+func recordLoginFailure(c *gin.Context, username string) error {
+	policy := GetLoginThrottlePolicy()
+	ip := c.ClientIP()
+
+	auditRequest(c, AuditEntry{
+		Actor:   username,
+		Action:  AuditSigninFailed,
+		Target:  username,
+		Outcome: AuditFailure,
+	})
+
+	userLocked, err := countLoginFailure(loginFailureUser, username, policy.MaxUserFailures)
+	if err != nil {
+		return err
+	}
+	ipLocked, err := countLoginFailure(loginFailureIp, ip, policy.MaxIpFailures)
+	if err != nil {
+		return err
+	}
+
+	if userLocked {
+		auditRequest(c, AuditEntry{
+			Actor:   username,
+			Action:  AuditLockout,
+			Target:  loginFailureUser + ":" + username,
+			Outcome: AuditDenied,
+		})
+	}
+	if ipLocked {
+		auditRequest(c, AuditEntry{
+			Actor:   username,
+			Action:  AuditLockout,
+			Target:  loginFailureIp + ":" + ip,
+			Outcome: AuditDenied,
+		})
+	}
+	return nil
+}
+
+// Forgets the failures of a username after it signs in. IP counters only
+// expire, so one good account cannot clear the way for guessing others.
+func recordLoginSuccess(username string) error {
+	db = GetDb()
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.LoginFailures + `
+        WHERE kind = $1 AND key = $2
+        `
+	_, err := db.Exec(queryStr, loginFailureUser, username)
+	return err
+}
+
+// Clears the failures and lockout of a username, an IP, or both. Returns
+// whether there was anything to clear.
+func unlockLogin(username string, ip string) (bool, error) {
+	db = GetDb()
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.LoginFailures + `
+        WHERE (kind = $1 AND key = $2) OR (kind = $3 AND key = $4)
+        `
+	res, err := db.Exec(queryStr, loginFailureUser, username, loginFailureIp, ip)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := res.RowsAffected()
+	return rows > 0, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sends mail to users. Set with SetMailer; the default sends nothing and
+// logs only who the mail was for.
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+var mailer Mailer = &LogMailer{}
+
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+func GetMailer() Mailer {
+	return mailer
+}
+
+// Sends through an SMTP relay. Auth may be nil for relays that do not need it.
+type SmtpMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m *SmtpMailer) Send(to string, subject string, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("Invalid mail header")
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		body
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// Writes mail to the log instead of sending it. Bodies hold verification and
+// reset tokens, so they are only logged with LogBodies, for development.
+type LogMailer struct {
+	LogBodies bool
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+	if !m.LogBodies {
+		Logger.Warn(
+			"Mail not sent, no mailer configured",
+			zap.String("to", to),
+			zap.String("subject", subject),
+		)
+		return nil
+	}
+	Logger.Info(
+		"Mail",
+		zap.String("to", to),
+		zap.String("subject", subject),
+		zap.String("body", body),
+	)
+	return nil
+}
+
+// Appends mail to a file instead of sending it, for tests and development
+type FileMailer struct {
+	Filename string
+	mu       sync.Mutex
+}
+
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "To: %s\nSubject: %s\n\n%s\n\n", to, subject, body)
+	return err
+}
@@ -0,0 +1,549 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	oidc "github.com/coreos/go-oidc"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How OIDC users are matched to local users when they sign in for the first
+// time. Later sign ins always go by the linked subject.
+const (
+	OidcMatchSubject = "subject"
+	OidcMatchEmail   = "email"
+)
+
+// Grants Role in Group to users whose ID token has Claim equal to, or for
+// list claims containing, Value
+type OidcRoleMapping struct {
+	Claim string
+	Value string
+	Group string
+	Role  string
+}
+
+type OidcConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	// Scopes besides openid, by default email and profile
+	Scopes []string
+	// OidcMatchSubject only links users by a subject they signed in with
+	// before. OidcMatchEmail also links a first sign in to the local user with
+	// the same email, when the provider says it is verified.
+	MatchBy string
+	// Creates unknown users in the site group on their first sign in
+	JitProvisioning bool
+	RoleMappings    []OidcRoleMapping
+}
+
+type oidcClient struct {
+	config   OidcConfig
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+}
+
+var oidcState = struct {
+	sync.RWMutex
+	client *oidcClient
+}{}
+
+var oidcLoginLifetime = 10 * time.Minute
+
+var oidcUsernameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var ErrOidcNotConfigured = errors.New("OIDC sign in is not configured")
+var ErrOidcLoginInvalid = errors.New("OIDC sign in invalid or expired")
+var ErrOidcUnknownUser = errors.New("No local user for this identity")
+
+// Discovers the provider at config.Issuer and enables OIDC sign in
+func SetOidcConfig(config OidcConfig) error {
+	provider, err := oidc.NewProvider(context.Background(), config.Issuer)
+	if err != nil {
+		return err
+	}
+	switch config.MatchBy {
+	case "":
+		config.MatchBy = OidcMatchSubject
+	case OidcMatchSubject, OidcMatchEmail:
+	default:
+		return fmt.Errorf("Unknown OIDC match %s", config.MatchBy)
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	oidcState.Lock()
+	defer oidcState.Unlock()
+	oidcState.client = &oidcClient{
+		config:   config,
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientId}),
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientId,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectUrl,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+	}
+	return nil
+}
+
+func getOidcClient() (*oidcClient, error) {
+	oidcState.RLock()
+	defer oidcState.RUnlock()
+	if oidcState.client == nil {
+		return nil, ErrOidcNotConfigured
+	}
+	return oidcState.client, nil
+}
+
+func randomUrlToken(size int) (string, error) {
+	raw := make([]byte, size)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Starts a sign in, returning the provider URL to send the user to. The
+// state, nonce and PKCE verifier are kept until the callback uses them.
+func beginOidcLogin() (string, error) {
+	client, err := getOidcClient()
+	if err != nil {
+		return "", err
+	}
+	db = GetDb()
+
+	state, err := randomUrlToken(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomUrlToken(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomUrlToken(48)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.OidcStates + `
+          (state, verifier, nonce, date_expires)
+        VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+        `
+	_, err = db.Exec(queryStr, state, verifier, nonce, int64(oidcLoginLifetime/time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	return client.oauth2.AuthCodeURL(
+		state,
+		oidc.Nonce(nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+// Finishes a sign in with the code the provider redirected back with, and
+// returns the local user it maps to and the roles its mappings changed
+func finishOidcLogin(ctx context.Context, state string, code string) (string, int, []oidcRoleChange, error) {
+	var verifier, nonce string
+	client, err := getOidcClient()
+	if err != nil {
+		return "", 0, nil, err
+	}
+	db = GetDb()
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.OidcStates + `
+        WHERE state = $1 AND date_expires > now()
+        RETURNING verifier, nonce
+        `
+	err = db.QueryRow(queryStr, state).Scan(&verifier, &nonce)
+	if err == sql.ErrNoRows {
+		return "", 0, nil, ErrOidcLoginInvalid
+	} else if err != nil {
+		return "", 0, nil, err
+	}
+
+	token, err := client.oauth2.Exchange(
+		ctx,
+		code,
+		oauth2.SetAuthURLParam("code_verifier", verifier),
+	)
+	if err != nil {
+		return "", 0, nil, ErrOidcLoginInvalid
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", 0, nil, ErrOidcLoginInvalid
+	}
+	idToken, err := client.verifier.Verify(ctx, rawIdToken)
+	if err != nil || idToken.Nonce != nonce {
+		return "", 0, nil, ErrOidcLoginInvalid
+	}
+
+	claims := map[string]interface{}{}
+	if err = idToken.Claims(&claims); err != nil {
+		return "", 0, nil, err
+	}
+
+	username, uid, err := oidcUser(client.config, idToken.Issuer, idToken.Subject, claims)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	roleChanges, err := syncOidcRoles(client.config, uid, claims)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return username, uid, roleChanges, nil
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+func claimMatches(claims map[string]interface{}, name string, value string) bool {
+	switch claim := claims[name].(type) {
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, item := range claim {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The local user linked to an OIDC subject, linking or provisioning one on
+// first sign in as the config allows
+func oidcUser(
+	config OidcConfig,
+	issuer string,
+	subject string,
+	claims map[string]interface{},
+) (string, int, error) {
+	var username string
+	var uid int
+	db = GetDb()
+
+	queryStr := `
+        SELECT u.username, u.uid
+        FROM ` +
+		conciergedb.ConciergeTables.UserIdentities + ` ui
+        JOIN ` + conciergedb.ConciergeTables.Users + ` u ON u.uid = ui.uid
+        WHERE ui.issuer = $1 AND ui.subject = $2
+        `
+	err := db.QueryRow(queryStr, issuer, subject).Scan(&username, &uid)
+	if err == nil {
+		return username, uid, nil
+	} else if err != sql.ErrNoRows {
+		return "", 0, err
+	}
+
+	email := claimString(claims, "email")
+	emailVerified, _ := claims["email_verified"].(bool)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	err = sql.ErrNoRows
+	if config.MatchBy == OidcMatchEmail && email != "" && emailVerified {
+		queryStr = `
+            SELECT u.username, u.uid
+            FROM ` +
+			conciergedb.ConciergeTables.Users + ` u
+            WHERE u.email = $1
+            `
+		err = tx.QueryRow(queryStr, email).Scan(&username, &uid)
+	}
+	if err == sql.ErrNoRows {
+		if !config.JitProvisioning {
+			return "", 0, ErrOidcUnknownUser
+		}
+		username, uid, err = provisionOidcUser(tx, subject, email, emailVerified, claims)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.UserIdentities + `
+          (issuer, subject, uid, date_created)
+        VALUES ($1, $2, $3, now())
+        `
+	if _, err = tx.Exec(queryStr, issuer, subject, uid); err != nil {
+		return "", 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", 0, err
+	}
+	return username, uid, nil
+}
+
+// Creates a user for an OIDC identity, as a user in the site group like
+// Signup does. The password is random, so the account can only be used through
+// the provider until a password is reset.
+func provisionOidcUser(
+	tx *sql.Tx,
+	subject string,
+	email string,
+	emailVerified bool,
+	claims map[string]interface{},
+) (string, int, error) {
+	var uid int
+
+	base := claimString(claims, "preferred_username")
+	if base == "" && email != "" {
+		base = strings.SplitN(email, "@", 2)[0]
+	}
+	if base == "" {
+		base = subject
+	}
+	base = oidcUsernameChars.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 64 {
+		base = base[:64]
+	}
+
+	password, err := randomUrlToken(32)
+	if err != nil {
+		return "", 0, err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	if err != nil {
+		return "", 0, err
+	}
+	var emailValue interface{}
+	if email != "" {
+		emailValue = email
+	}
+
+	// Usernames taken locally get a numeric suffix
+	username := base
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.Users + `
+          (username, email, email_verified, date_created, last_login, password)
+        SELECT $1, $2, $3, now(), now(), $4
+        WHERE NOT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.Users + ` WHERE username = $1
+        )
+        RETURNING uid
+        `
+	for i := 2; ; i++ {
+		err = tx.QueryRow(queryStr, username, emailValue, emailVerified, passwordHash).Scan(&uid)
+		if err != sql.ErrNoRows {
+			break
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUsers + ` (uid, gid)
+        SELECT $1, g.gid FROM ` + conciergedb.ConciergeTables.Groups + ` g
+        WHERE g.name = $2
+        `
+	if _, err = tx.Exec(queryStr, uid, conciergedb.InitConciergeGroups.Site); err != nil {
+		return "", 0, err
+	}
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUserRoles + ` (uid, gid, rid)
+        SELECT $1, g.gid, r.rid
+        FROM ` + conciergedb.ConciergeTables.Groups + ` g, ` +
+		conciergedb.ConciergeTables.Roles + ` r
+        WHERE g.name = $2 AND r.name = $3
+        `
+	_, err = tx.Exec(
+		queryStr,
+		uid,
+		conciergedb.InitConciergeGroups.Site,
+		conciergedb.InitConciergeRoles.User,
+	)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return username, uid, nil
+}
+
+// A role an OIDC sign in gave or took away
+type oidcRoleChange struct {
+	Group    string
+	Role     string
+	Assigned bool
+}
+
+// Reads the group and role names a role change query returns
+func scanOidcRoleChanges(rows *sql.Rows, assigned bool, changes *[]oidcRoleChange) error {
+	defer rows.Close()
+	for rows.Next() {
+		change := oidcRoleChange{Assigned: assigned}
+		if err := rows.Scan(&change.Group, &change.Role); err != nil {
+			return err
+		}
+		*changes = append(*changes, change)
+	}
+	return rows.Err()
+}
+
+// Makes the roles granted by mappings match the claims of the latest sign in,
+// and returns what changed. Roles granted any other way are left alone.
+func syncOidcRoles(config OidcConfig, uid int, claims map[string]interface{}) ([]oidcRoleChange, error) {
+	var changes []oidcRoleChange
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	queryStr := `
+        CREATE TEMPORARY TABLE oidc_wanted_roles (gid INT, rid INT) ON COMMIT DROP
+        `
+	if _, err = tx.Exec(queryStr); err != nil {
+		return nil, err
+	}
+	queryStr = `
+        INSERT INTO oidc_wanted_roles (gid, rid)
+        SELECT g.gid, r.rid
+        FROM ` + conciergedb.ConciergeTables.Groups + ` g, ` +
+		conciergedb.ConciergeTables.Roles + ` r
+        WHERE g.name = $1 AND r.name = $2
+        `
+	for _, mapping := range config.RoleMappings {
+		if !claimMatches(claims, mapping.Claim, mapping.Value) {
+			continue
+		}
+		if _, err = tx.Exec(queryStr, mapping.Group, mapping.Role); err != nil {
+			return nil, err
+		}
+	}
+
+	// Drop mapped roles the claims no longer give
+	queryStr = `
+        WITH removed AS (
+          DELETE FROM ` +
+		conciergedb.ConciergeTables.GroupUserRoles + ` gur
+          USING ` + conciergedb.ConciergeTables.OidcRoleGrants + ` org
+          WHERE org.uid = $1 AND gur.uid = org.uid AND gur.gid = org.gid AND gur.rid = org.rid
+            AND NOT EXISTS (
+              SELECT 1 FROM oidc_wanted_roles w WHERE w.gid = org.gid AND w.rid = org.rid
+            )
+          RETURNING gur.gid, gur.rid
+        )
+        SELECT g.name, r.name
+        FROM removed
+        INNER JOIN ` + conciergedb.ConciergeTables.Groups + ` g ON g.gid = removed.gid
+        INNER JOIN ` + conciergedb.ConciergeTables.Roles + ` r ON r.rid = removed.rid
+        `
+	rows, err := tx.Query(queryStr, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err = scanOidcRoleChanges(rows, false, &changes); err != nil {
+		return nil, err
+	}
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.OidcRoleGrants + ` org
+        WHERE org.uid = $1 AND NOT EXISTS (
+          SELECT 1 FROM oidc_wanted_roles w WHERE w.gid = org.gid AND w.rid = org.rid
+        )
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return nil, err
+	}
+
+	// Add the ones it newly gives, joining their groups as needed. Roles the
+	// user already held some other way are not recorded as mapped, so they
+	// outlive the mapping.
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUsers + ` (uid, gid)
+        SELECT DISTINCT $1::INT, w.gid FROM oidc_wanted_roles w
+        WHERE NOT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.GroupUsers + ` gu
+          WHERE gu.uid = $1 AND gu.gid = w.gid
+        )
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return nil, err
+	}
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.OidcRoleGrants + ` (uid, gid, rid)
+        SELECT DISTINCT $1::INT, w.gid, w.rid FROM oidc_wanted_roles w
+        WHERE NOT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.GroupUserRoles + ` gur
+          WHERE gur.uid = $1 AND gur.gid = w.gid AND gur.rid = w.rid
+        )
+        ON CONFLICT DO NOTHING
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return nil, err
+	}
+	queryStr = `
+        WITH added AS (
+          INSERT INTO ` +
+		conciergedb.ConciergeTables.GroupUserRoles + ` (uid, gid, rid)
+          SELECT DISTINCT $1::INT, w.gid, w.rid FROM oidc_wanted_roles w
+          WHERE NOT EXISTS (
+            SELECT 1 FROM ` + conciergedb.ConciergeTables.GroupUserRoles + ` gur
+            WHERE gur.uid = $1 AND gur.gid = w.gid AND gur.rid = w.rid
+          )
+          RETURNING gid, rid
+        )
+        SELECT g.name, r.name
+        FROM added
+        INNER JOIN ` + conciergedb.ConciergeTables.Groups + ` g ON g.gid = added.gid
+        INNER JOIN ` + conciergedb.ConciergeTables.Roles + ` r ON r.rid = added.rid
+        `
+	rows, err = tx.Query(queryStr, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err = scanOidcRoleChanges(rows, true, &changes); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
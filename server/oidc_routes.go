@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// Sends the user to the OIDC provider to sign in
+func OidcLogin(c *gin.Context) {
+	authUrl, err := beginOidcLogin()
+	if err == ErrOidcNotConfigured {
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		return
+	} else if err != nil {
+		Logger.Error("Error starting OIDC sign in", zap.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error starting OIDC sign in"})
+		return
+	}
+
+	c.Redirect(http.StatusFound, authUrl)
+}
+
+// Where the OIDC provider sends the user back to. Signs in the user the
+// identity maps to, the same as Signin: locked out users are refused, users
+// with TOTP get a challenge and admins who must enroll an enrollment token.
+func OidcCallback(c *gin.Context) {
+	if errMsg := c.Query("error"); errMsg != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "OIDC sign in failed: " + errMsg})
+		return
+	}
+
+	username, uid, roleChanges, err := finishOidcLogin(c.Request.Context(), c.Query("state"), c.Query("code"))
+	switch err {
+	case nil:
+	case ErrOidcNotConfigured:
+		c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		return
+	case ErrOidcLoginInvalid, ErrOidcUnknownUser:
+		c.JSON(http.StatusUnauthorized, gin.H{"status": err.Error()})
+		return
+	default:
+		Logger.Error("Error finishing OIDC sign in", zap.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error finishing OIDC sign in"})
+		return
+	}
+
+	for _, change := range roleChanges {
+		action := AuditOidcRoleUnassign
+		if change.Assigned {
+			action = AuditOidcRoleAssign
+		}
+		auditRequest(c, AuditEntry{
+			Actor:   username,
+			Action:  action,
+			Target:  username + "=" + change.Role,
+			Group:   change.Group,
+			Outcome: AuditSuccess,
+		})
+	}
+
+	if loginThrottled(c, username) {
+		return
+	}
+	signinSecondFactor(c, username, uid, "")
+}
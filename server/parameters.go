@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Returned when a command template or the arguments of a run are invalid
+type ParameterError struct {
+	Parameter string
+	Reason    string
+}
+
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("Invalid parameter %s: %s", e.Parameter, e.Reason)
+}
+
+var parameterPlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func isParameterType(parameterType string) bool {
+	types := conciergedb.ConciergeParameterTypes
+	switch parameterType {
+	case types.String, types.Int, types.Float, types.Bool:
+		return true
+	}
+	return false
+}
+
+func checkParameterValue(parameter conciergedb.DbProcessParameter, value string) error {
+	var err error
+	types := conciergedb.ConciergeParameterTypes
+
+	switch parameter.Type {
+	case types.String:
+	case types.Int:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case types.Float:
+		_, err = strconv.ParseFloat(value, 64)
+	case types.Bool:
+		_, err = strconv.ParseBool(value)
+	default:
+		return &ParameterError{parameter.Name, "unknown type " + parameter.Type}
+	}
+	if err != nil {
+		return &ParameterError{parameter.Name, "not a valid " + parameter.Type}
+	}
+
+	if parameter.Pattern != "" {
+		matched, err := regexp.MatchString("^(?:"+parameter.Pattern+")$", value)
+		if err != nil {
+			return &ParameterError{parameter.Name, "invalid pattern"}
+		}
+		if !matched {
+			return &ParameterError{parameter.Name, "does not match " + parameter.Pattern}
+		}
+	}
+
+	return nil
+}
+
+// Checks parameter declarations, their defaults, and that argv and env only
+// reference declared parameters. Env entries must look like NAME=value.
+func ValidateCommandTemplate(
+	argv []string,
+	env []string,
+	parameters []conciergedb.DbProcessParameter,
+) error {
+	declared := map[string]bool{}
+
+	if len(argv) == 0 {
+		return &ParameterError{"argv", "must not be empty"}
+	}
+
+	for _, parameter := range parameters {
+		if !identifierPattern.MatchString(parameter.Name) {
+			return &ParameterError{parameter.Name, "names must be identifiers"}
+		}
+		if declared[parameter.Name] {
+			return &ParameterError{parameter.Name, "declared more than once"}
+		}
+		declared[parameter.Name] = true
+
+		if !isParameterType(parameter.Type) {
+			return &ParameterError{parameter.Name, "unknown type " + parameter.Type}
+		}
+		if _, err := regexp.Compile(parameter.Pattern); err != nil {
+			return &ParameterError{parameter.Name, "invalid pattern"}
+		}
+		if parameter.Default != nil {
+			if err := checkParameterValue(parameter, *parameter.Default); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range env {
+		name := strings.SplitN(entry, "=", 2)[0]
+		if !strings.Contains(entry, "=") || !identifierPattern.MatchString(name) {
+			return &ParameterError{entry, "env entries must look like NAME=value"}
+		}
+	}
+
+	for _, template := range append(append([]string{}, argv...), env...) {
+		for _, match := range parameterPlaceholder.FindAllStringSubmatch(template, -1) {
+			if !declared[match[1]] {
+				return &ParameterError{match[1], "used but not declared"}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Converts decoded JSON argument values to the strings they are rendered as
+func NormalizeArgs(args map[string]interface{}) (map[string]string, error) {
+	normalized := map[string]string{}
+	for name, value := range args {
+		switch v := value.(type) {
+		case string:
+			normalized[name] = v
+		case float64:
+			normalized[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			normalized[name] = strconv.FormatBool(v)
+		default:
+			return nil, &ParameterError{name, "values must be strings, numbers or booleans"}
+		}
+	}
+	return normalized, nil
+}
+
+// Renders the argv and env templates of a registered process. Each value is
+// substituted into a single argv element or env value and is never split or
+// passed through a shell, so arguments cannot inject extra words or commands.
+func RenderCommand(
+	argv []string,
+	env []string,
+	parameters []conciergedb.DbProcessParameter,
+	args map[string]string,
+) ([]string, []string, error) {
+	values := map[string]string{}
+
+	for _, parameter := range parameters {
+		value, ok := args[parameter.Name]
+		if !ok {
+			if parameter.Default == nil {
+				return nil, nil, &ParameterError{parameter.Name, "required"}
+			}
+			value = *parameter.Default
+		}
+		if err := checkParameterValue(parameter, value); err != nil {
+			return nil, nil, err
+		}
+		values[parameter.Name] = value
+	}
+	for name := range args {
+		if _, ok := values[name]; !ok {
+			return nil, nil, &ParameterError{name, "not a parameter of this command"}
+		}
+	}
+
+	render := func(templates []string) []string {
+		rendered := make([]string, len(templates))
+		for i, template := range templates {
+			rendered[i] = parameterPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+				return values[parameterPlaceholder.FindStringSubmatch(placeholder)[1]]
+			})
+		}
+		return rendered
+	}
+
+	return render(argv), render(env), nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"time"
+)
+
+var passwordResetLifetime = time.Hour
+
+// Link reset tokens are appended to as ?token=. Without one the mail holds
+// the bare token.
+var passwordResetUrl string
+
+var ErrResetTokenInvalid = errors.New("Reset token invalid")
+
+func SetPasswordResetUrl(resetUrl string) {
+	passwordResetUrl = resetUrl
+}
+
+// Mails a reset token to the owner of an email address, if there is one.
+// Callers respond before this finishes, so neither the response nor its
+// timing tells whether the account exists.
+func sendPasswordReset(email string) {
+	var uid int
+	var username string
+	db = GetDb()
+
+	queryStr := `
+        SELECT u.uid, u.username
+        FROM ` +
+		conciergedb.ConciergeTables.Users + ` u
+        WHERE u.email = $1
+        `
+	err := db.QueryRow(queryStr, email).Scan(&uid, &username)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		Logger.Error("Error finding user for password reset", zap.String("error", err.Error()))
+		return
+	}
+
+	resetToken, err := newOpaqueToken()
+	if err != nil {
+		Logger.Error("Error creating password reset", zap.String("error", err.Error()))
+		return
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.PasswordResets + `
+          (token_hash, uid, date_created, date_expires)
+        VALUES ($1, $2, now(), now() + $3 * interval '1 second')
+        `
+	_, err = db.Exec(
+		queryStr,
+		hashOpaqueToken(resetToken),
+		uid,
+		int64(passwordResetLifetime/time.Second),
+	)
+	if err != nil {
+		Logger.Error("Error creating password reset", zap.String("error", err.Error()))
+		return
+	}
+
+	link := resetToken
+	if passwordResetUrl != "" {
+		link = passwordResetUrl + "?token=" + url.QueryEscape(resetToken)
+	}
+	body := "Hello " + username + ",\n\n" +
+		"Reset your password with:\n\n" +
+		link + "\n\n" +
+		"This link expires in " + passwordResetLifetime.String() + ". " +
+		"If you did not ask for a reset, ignore this mail.\n"
+
+	if err = GetMailer().Send(email, "Reset your password", body); err != nil {
+		Logger.Error("Error sending password reset", zap.String("error", err.Error()))
+	}
+}
+
+// Sets a new password with a reset token, uses up every outstanding reset
+// token of the user, and signs them out of all sessions. Returns the user.
+func resetPassword(resetToken string, password string) (string, error) {
+	var uid int
+	var username string
+	db = GetDb()
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	queryStr := `
+        SELECT pr.uid, u.username
+        FROM ` +
+		conciergedb.ConciergeTables.PasswordResets + ` pr
+        JOIN ` + conciergedb.ConciergeTables.Users + ` u ON u.uid = pr.uid
+        WHERE pr.token_hash = $1 AND NOT pr.used AND pr.date_expires > now()
+        FOR UPDATE OF pr
+        `
+	err = tx.QueryRow(queryStr, hashOpaqueToken(resetToken)).Scan(&uid, &username)
+	if err == sql.ErrNoRows {
+		return "", ErrResetTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.PasswordResets + `
+        SET used = true
+        WHERE uid = $1
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return "", err
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Users + `
+        SET password = $1
+        WHERE uid = $2
+        `
+	if _, err = tx.Exec(queryStr, passwordHash, uid); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return username, revokeAllSessions(username)
+}
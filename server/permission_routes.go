@@ -0,0 +1,244 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+type PermissionBody struct {
+	Process string `json:"process"`
+	Group   string `json:"group"`
+	Role    string `json:"role"`
+	// rwx flags like "r-x", or bits like "101"
+	Permissions string `json:"permissions"`
+	// Takes the permissions away from the role here and in groups below
+	Deny bool `json:"deny"`
+}
+
+type ListPermissionsBody struct {
+	Process string `json:"process"`
+}
+
+type PermissionGrantRes struct {
+	Group       string   `json:"group"`
+	Role        string   `json:"role"`
+	Permissions string   `json:"permissions"`
+	Deny        bool     `json:"deny"`
+	Users       []string `json:"users"`
+}
+
+type ListPermissionsRes struct {
+	Process string               `json:"process"`
+	Grants  []PermissionGrantRes `json:"grants"`
+}
+
+type ExplainPermissionBody struct {
+	// The user whose access is explained, the caller when empty
+	Target  string `json:"target"`
+	Group   string `json:"group"`
+	Process string `json:"process"`
+	// The permission checked for, as in "x" or "rw"
+	Permission string `json:"permission"`
+}
+
+type PermissionCheckRes struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ExplainGrantRes struct {
+	// The group the grant is on, the group asked about or one above it
+	Group       string `json:"group"`
+	Role        string `json:"role"`
+	Permissions string `json:"permissions"`
+	Deny        bool   `json:"deny"`
+	// Whether the user holds the role in the group
+	Held bool `json:"held"`
+}
+
+type ExplainPermissionRes struct {
+	User       string `json:"user"`
+	Group      string `json:"group"`
+	Process    string `json:"process"`
+	Permission string `json:"permission"`
+	Allowed    bool   `json:"allowed"`
+	// The first check that failed, empty when allowed
+	FailedCheck string               `json:"failedCheck,omitempty"`
+	Checks      []PermissionCheckRes `json:"checks"`
+	// Roles the user holds in the group
+	Roles []string `json:"roles"`
+	// Grants on the process to roles in the group and the groups above it,
+	// nearest first
+	Grants []ExplainGrantRes `json:"grants"`
+	// The bits the user ends up with, merged across the roles they hold
+	Permissions string `json:"permissions"`
+	// The bits deny grants take away
+	Denied string `json:"denied"`
+}
+
+// The status code and message for errors from the permission functions
+func permissionErrorStatus(err error) (int, string) {
+	switch err {
+	case ErrPermissionInvalid, ErrPermissionNameInvalid:
+		return http.StatusBadRequest, err.Error()
+	case ErrProcessNotFound, ErrGroupNotFound, ErrRoleNotFound, ErrPermissionNotFound:
+		return http.StatusNotFound, err.Error()
+	case ErrPermissionExists:
+		return http.StatusConflict, err.Error()
+	}
+	Logger.Error("Error managing permissions", zap.String("error", err.Error()))
+	return http.StatusInternalServerError, "Error managing permissions"
+}
+
+// What a permission change is audited as changing, like "backup/operator=r-x"
+func permissionAuditTarget(body PermissionBody) string {
+	target := body.Process + "/" + body.Role
+	if body.Permissions != "" {
+		target += "=" + body.Permissions
+	}
+	if body.Deny {
+		target += " deny"
+	}
+	return target
+}
+
+func GrantPermission(c *gin.Context) {
+	var body PermissionBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := grantPermission(body.Process, body.Group, body.Role, body.Permissions, body.Deny); err != nil {
+		status, msg := permissionErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditPermissionGrant,
+		Target:  permissionAuditTarget(body),
+		Group:   body.Group,
+		Outcome: AuditSuccess,
+	})
+	c.String(http.StatusOK, "Permission granted successfully")
+}
+
+func ChangePermission(c *gin.Context) {
+	var body PermissionBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := changePermission(body.Process, body.Group, body.Role, body.Permissions, body.Deny); err != nil {
+		status, msg := permissionErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditPermissionChange,
+		Target:  permissionAuditTarget(body),
+		Group:   body.Group,
+		Outcome: AuditSuccess,
+	})
+	c.String(http.StatusOK, "Permission changed successfully")
+}
+
+func RevokePermission(c *gin.Context) {
+	var body PermissionBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := revokePermission(body.Process, body.Group, body.Role); err != nil {
+		status, msg := permissionErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditPermissionRevoke,
+		Target:  permissionAuditTarget(body),
+		Group:   body.Group,
+		Outcome: AuditSuccess,
+	})
+	c.String(http.StatusOK, "Permission revoked successfully")
+}
+
+// Lists who can do what with a process: every group and role granted
+// permissions on it, with the members holding that role
+func ListPermissions(c *gin.Context) {
+	var body ListPermissionsBody
+	var rpid int
+	var acl []conciergedb.DbPermissionGrant
+	rpidErrorChan := make(chan error)
+	aclErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(rpidErrorChan)
+		close(aclErrorChan)
+	}()
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go conciergedb.GetRpid(body.Process, db, rpidErrorChan, &rpid)
+	if rpidErr := <-rpidErrorChan; rpidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+		return
+	}
+
+	go conciergedb.GetProcessAcl(rpid, db, aclErrorChan, &acl)
+	if aclErr := <-aclErrorChan; aclErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error listing permissions"})
+		return
+	}
+
+	listPermissionsRes := ListPermissionsRes{Process: body.Process, Grants: []PermissionGrantRes{}}
+	for _, grant := range acl {
+		listPermissionsRes.Grants = append(listPermissionsRes.Grants, PermissionGrantRes{
+			Group:       grant.Group,
+			Role:        grant.Role,
+			Permissions: formatRwx(grant.Rwx),
+			Deny:        grant.Deny,
+			Users:       grant.Users,
+		})
+	}
+	c.SecureJSON(http.StatusOK, listPermissionsRes)
+}
+
+// Explains why a user can or cannot do something with a process in a group
+func ExplainPermission(c *gin.Context) {
+	var body ExplainPermissionBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	target := body.Target
+	if target == "" {
+		target = requestUser(c)
+	}
+
+	trace, err := explainPermission(target, body.Group, body.Process, body.Permission)
+	if err != nil {
+		status, msg := permissionErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, trace)
+}
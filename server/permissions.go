@@ -0,0 +1,307 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"regexp"
+	"strings"
+)
+
+var ErrPermissionInvalid = errors.New(`Permissions are three rwx flags, as in "rwx", "r-x" or "101"`)
+var ErrProcessNotFound = errors.New("Cannot find command")
+var ErrPermissionExists = errors.New("Permission already granted, change it instead")
+var ErrPermissionNotFound = errors.New("No permission granted to that group and role")
+var ErrPermissionNameInvalid = errors.New(`Permission must be one of "r", "w", "x", "rw", "rx" or "wx"`)
+
+var rwxFlags = regexp.MustCompile(`^[r-][w-][x-]$`)
+var rwxBits = regexp.MustCompile(`^[01]{3}$`)
+
+// The bit string for permissions given as rwx flags or bits. Granting nothing
+// is revoking, so "---" is invalid.
+func parseRwx(permissions string) (string, error) {
+	bits := permissions
+	if rwxFlags.MatchString(permissions) {
+		bits = ""
+		for _, flag := range permissions {
+			if flag == '-' {
+				bits += "0"
+			} else {
+				bits += "1"
+			}
+		}
+	}
+	if !rwxBits.MatchString(bits) || bits == "000" {
+		return "", ErrPermissionInvalid
+	}
+	return bits, nil
+}
+
+// The rwx flags for a bit string, as in "r-x" for "101"
+func formatRwx(bits string) string {
+	flags := []byte("---")
+	for i, flag := range []byte("rwx") {
+		if i < len(bits) && bits[i] == '1' {
+			flags[i] = flag
+		}
+	}
+	return string(flags)
+}
+
+// The rpid, gid and rid a grant is keyed by
+func lookupGrant(tx *sql.Tx, process string, group string, role string) (int, int, int, error) {
+	var rpid, gid, rid int
+	queryStr := `
+        SELECT rp.rpid FROM ` + conciergedb.ConciergeTables.RegisteredProcesses + ` rp
+        WHERE rp.name = $1
+        `
+	err := tx.QueryRow(queryStr, process).Scan(&rpid)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrProcessNotFound
+	} else if err != nil {
+		return 0, 0, 0, err
+	}
+	if gid, err = lookupGid(tx, group); err != nil {
+		return 0, 0, 0, err
+	}
+	queryStr = `
+        SELECT r.rid FROM ` + conciergedb.ConciergeTables.Roles + ` r
+        WHERE r.name = $1
+        `
+	err = tx.QueryRow(queryStr, role).Scan(&rid)
+	if err == sql.ErrNoRows {
+		return 0, 0, 0, ErrRoleNotFound
+	} else if err != nil {
+		return 0, 0, 0, err
+	}
+	return rpid, gid, rid, nil
+}
+
+// Grants a role in a group permissions on a process it has none on yet. The
+// grant reaches members holding the role in the group and in every group below
+// it. A deny grant takes the permissions away instead, whatever other grants
+// give.
+func grantPermission(process string, group string, role string, permissions string, deny bool) error {
+	bits, err := parseRwx(permissions)
+	if err != nil {
+		return err
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rpid, gid, rid, err := lookupGrant(tx, process, group, role)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RegisteredProcessPermissions + `
+          (rpid, gid, rid, rwx, deny)
+        VALUES ($1, $2, $3, $4::BIT(3), $5)
+        ON CONFLICT (rpid, gid, rid) DO NOTHING
+        `
+	res, err := tx.Exec(queryStr, rpid, gid, rid, bits, deny)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrPermissionExists
+	}
+
+	return tx.Commit()
+}
+
+// Replaces the permissions a role in a group has on a process, and whether
+// they are allowed or denied
+func changePermission(process string, group string, role string, permissions string, deny bool) error {
+	bits, err := parseRwx(permissions)
+	if err != nil {
+		return err
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rpid, gid, rid, err := lookupGrant(tx, process, group, role)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.RegisteredProcessPermissions + `
+        SET rwx = $4::BIT(3), deny = $5
+        WHERE rpid = $1 AND gid = $2 AND rid = $3
+        `
+	res, err := tx.Exec(queryStr, rpid, gid, rid, bits, deny)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrPermissionNotFound
+	}
+
+	return tx.Commit()
+}
+
+// Takes all permissions on a process from a role in a group
+func revokePermission(process string, group string, role string) error {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rpid, gid, rid, err := lookupGrant(tx, process, group, role)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RegisteredProcessPermissions + `
+        WHERE rpid = $1 AND gid = $2 AND rid = $3
+        `
+	res, err := tx.Exec(queryStr, rpid, gid, rid)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrPermissionNotFound
+	}
+
+	return tx.Commit()
+}
+
+// The checks HasPermission makes, in the order it makes them
+const (
+	CheckUserExists    = "user exists"
+	CheckGroupExists   = "group exists"
+	CheckProcessExists = "command exists"
+	CheckMembership    = "group membership"
+	CheckGrants        = "role grants"
+	CheckBits          = "permission bits"
+)
+
+func unlessPassed(passed bool, detail string) string {
+	if passed {
+		return ""
+	}
+	return detail
+}
+
+// Traces the permission check CanExecute, CanWrite and CanRead make for a user
+// on a process in a group. Checks stop at the first that fails, which is
+// named in FailedCheck. Only the rwx grants are traced; a PolicyAuthorizer
+// sees them as rbac.
+func explainPermission(user string, group string, process string, permission string) (ExplainPermissionRes, error) {
+	var explanation conciergedb.DbPermissionExplanation
+	trace := ExplainPermissionRes{
+		User:       user,
+		Group:      group,
+		Process:    process,
+		Permission: permission,
+		Checks:     []PermissionCheckRes{},
+		Roles:      []string{},
+		Grants:     []ExplainGrantRes{},
+	}
+
+	permissionRegexp, ok := conciergedb.ConciergePermissions[permission]
+	if !ok {
+		return trace, ErrPermissionNameInvalid
+	}
+	db = GetDb()
+
+	errorChan := make(chan error, 1)
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.ExplainPermission(user, group, process, db, errorChan, &explanation)
+	if err := <-errorChan; err != nil {
+		return trace, err
+	}
+
+	trace.Roles = explanation.Roles
+	allowed := []byte("000")
+	denied := []byte("000")
+	var heldGrants []string
+	for _, grant := range explanation.Grants {
+		trace.Grants = append(trace.Grants, ExplainGrantRes{
+			Group:       grant.Group,
+			Role:        grant.Role,
+			Permissions: formatRwx(grant.Rwx),
+			Deny:        grant.Deny,
+			Held:        grant.Held,
+		})
+		if !grant.Held {
+			continue
+		}
+		bits := allowed
+		if grant.Deny {
+			bits = denied
+		} else {
+			heldGrants = append(heldGrants, grant.Group+"/"+grant.Role)
+		}
+		for i := 0; i < len(bits) && i < len(grant.Rwx); i++ {
+			if grant.Rwx[i] == '1' {
+				bits[i] = '1'
+			}
+		}
+	}
+	// HasPermission only counts roles held by members, and denials win
+	bits := []byte("000")
+	if explanation.Member {
+		for i := range bits {
+			if allowed[i] == '1' && denied[i] == '0' {
+				bits[i] = '1'
+			}
+		}
+	}
+	trace.Permissions = formatRwx(string(bits))
+	trace.Denied = formatRwx(string(denied))
+	trace.Allowed = explanation.Member && conciergedb.MatchPermission(permissionRegexp, string(bits))
+
+	grantsDetail := fmt.Sprintf("No role %s holds in %s is granted permissions on %s there or above", user, group, process)
+	if len(heldGrants) > 0 {
+		grantsDetail = "Granted through " + strings.Join(heldGrants, ", ")
+	}
+	checks := []PermissionCheckRes{
+		{CheckUserExists, explanation.UserFound, unlessPassed(explanation.UserFound, "Cannot find user "+user)},
+		{CheckGroupExists, explanation.GroupFound, unlessPassed(explanation.GroupFound, "Cannot find group "+group)},
+		{CheckProcessExists, explanation.ProcessFound, unlessPassed(explanation.ProcessFound, "Cannot find command "+process)},
+		{
+			CheckMembership,
+			explanation.Member,
+			unlessPassed(explanation.Member, fmt.Sprintf("User %s is not in group %s", user, group)),
+		},
+		{CheckGrants, len(heldGrants) > 0, grantsDetail},
+		{
+			CheckBits,
+			trace.Allowed,
+			fmt.Sprintf("Granted %s, denied %s, need %s", trace.Permissions, trace.Denied, permission),
+		},
+	}
+	for _, check := range checks {
+		trace.Checks = append(trace.Checks, check)
+		if !check.Passed {
+			trace.FailedCheck = check.Check
+			break
+		}
+	}
+
+	return trace, nil
+}
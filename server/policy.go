@@ -0,0 +1,347 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/cel-go/cel"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// A rule in a policy file. Conditions are CEL expressions over
+//
+//	user, group, process, permission  strings, permission one of r, w or x
+//	roles                             the user's roles in the group
+//	rbac                              whether the rwx grants allow the request
+//	now                               the time of the request
+//
+// as in
+//
+//	rules:
+//	  - name: backups-in-business-hours
+//	    effect: deny
+//	    condition: >
+//	      process.startsWith("backup-") && permission == "x" &&
+//	      (now.getHours("Europe/Madrid") < 9 || now.getHours("Europe/Madrid") >= 18)
+//	  - name: operators-run-backups
+//	    effect: allow
+//	    condition: '"operator" in roles && process.startsWith("backup-") && permission == "x"'
+//	  - name: grants
+//	    effect: allow
+//	    condition: rbac
+type PolicyRule struct {
+	Name      string `yaml:"name"`
+	Effect    string `yaml:"effect"`
+	Condition string `yaml:"condition"`
+}
+
+type policyFile struct {
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+type compiledRule struct {
+	PolicyRule
+	file    string
+	program cel.Program
+}
+
+// What a policy decides on
+type PolicyInput struct {
+	User       string
+	Group      string
+	Process    string
+	Permission string
+	Roles      []string
+	Rbac       bool
+	Time       time.Time
+}
+
+type PolicyDecision struct {
+	Allowed bool
+	// The rule that decided, empty when no rule matched
+	Rule string
+}
+
+// An authorizer that evaluates rules loaded from policy files. Any matching
+// deny rule denies, otherwise any matching allow rule allows, and requests no
+// rule matches are denied. Policies that should keep the rwx grants working
+// need an allow rule on rbac.
+type PolicyAuthorizer struct {
+	sync.RWMutex
+	// Policy files, or directories whose .yaml and .yml files are policies
+	paths    []string
+	rules    []compiledRule
+	modTimes map[string]time.Time
+}
+
+var ErrPolicyInvalid = errors.New("Invalid policy")
+
+var policyEnv = struct {
+	once sync.Once
+	env  *cel.Env
+	err  error
+}{}
+
+func getPolicyEnv() (*cel.Env, error) {
+	policyEnv.once.Do(func() {
+		policyEnv.env, policyEnv.err = cel.NewEnv(
+			cel.Variable("user", cel.StringType),
+			cel.Variable("group", cel.StringType),
+			cel.Variable("process", cel.StringType),
+			cel.Variable("permission", cel.StringType),
+			cel.Variable("roles", cel.ListType(cel.StringType)),
+			cel.Variable("rbac", cel.BoolType),
+			cel.Variable("now", cel.TimestampType),
+		)
+	})
+	return policyEnv.env, policyEnv.err
+}
+
+// Checks and compiles a rule, so policies are rejected when loaded rather
+// than when a request runs into them
+func compilePolicyRule(rule PolicyRule, file string) (compiledRule, error) {
+	compiled := compiledRule{PolicyRule: rule, file: file}
+	if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+		return compiled, fmt.Errorf("%w: rule %q in %s has effect %q, want allow or deny",
+			ErrPolicyInvalid, rule.Name, file, rule.Effect)
+	}
+
+	env, err := getPolicyEnv()
+	if err != nil {
+		return compiled, err
+	}
+	ast, issues := env.Compile(rule.Condition)
+	if issues != nil && issues.Err() != nil {
+		return compiled, fmt.Errorf("%w: rule %q in %s: %s", ErrPolicyInvalid, rule.Name, file, issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return compiled, fmt.Errorf("%w: rule %q in %s is not a bool condition", ErrPolicyInvalid, rule.Name, file)
+	}
+	if compiled.program, err = env.Program(ast); err != nil {
+		return compiled, fmt.Errorf("%w: rule %q in %s: %s", ErrPolicyInvalid, rule.Name, file, err)
+	}
+	return compiled, nil
+}
+
+// The policy files under paths, in a stable order, with the modification
+// times of everything whose change means reloading
+func policyFiles(paths []string) ([]string, map[string]time.Time, error) {
+	var files []string
+	modTimes := map[string]time.Time{}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		modTimes[path] = info.ModTime()
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		var dirFiles []string
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, nil, err
+			}
+			dirFiles = append(dirFiles, matches...)
+		}
+		sort.Strings(dirFiles)
+		for _, file := range dirFiles {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			modTimes[file] = info.ModTime()
+		}
+		files = append(files, dirFiles...)
+	}
+	return files, modTimes, nil
+}
+
+func loadPolicyRules(paths []string) ([]compiledRule, map[string]time.Time, error) {
+	files, modTimes, err := policyFiles(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules := []compiledRule{}
+	for _, file := range files {
+		var policy policyFile
+		fileData, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = yaml.UnmarshalStrict(fileData, &policy); err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %s", ErrPolicyInvalid, file, err)
+		}
+		for _, rule := range policy.Rules {
+			compiled, err := compilePolicyRule(rule, file)
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, compiled)
+		}
+	}
+	return rules, modTimes, nil
+}
+
+// Loads the policies in paths, which are policy files or directories of them
+func NewPolicyAuthorizer(paths []string) (*PolicyAuthorizer, error) {
+	rules, modTimes, err := loadPolicyRules(paths)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyAuthorizer{paths: paths, rules: rules, modTimes: modTimes}, nil
+}
+
+// Reads the policies again. Requests made after it returns see the new rules;
+// a failed reload keeps the old ones.
+func (p *PolicyAuthorizer) Reload() error {
+	rules, modTimes, err := loadPolicyRules(p.paths)
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.rules = rules
+	p.modTimes = modTimes
+	return nil
+}
+
+func (p *PolicyAuthorizer) policiesChanged() bool {
+	_, modTimes, err := policyFiles(p.paths)
+	if err != nil {
+		return true
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+	if len(modTimes) != len(p.modTimes) {
+		return true
+	}
+	for file, modTime := range modTimes {
+		if current, ok := p.modTimes[file]; !ok || !current.Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every interval reloads the policies if any of their files changed
+func (p *PolicyAuthorizer) RunReload(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if !p.policiesChanged() {
+			continue
+		}
+		if err := p.Reload(); err != nil {
+			Logger.Error("Error reloading policies", zap.String("error", err.Error()))
+		} else {
+			Logger.Info("Reloaded policies")
+		}
+	}
+}
+
+// Evaluates the policies against an input. Needs no database, so policies
+// can be tested on their own.
+func (p *PolicyAuthorizer) Decide(input PolicyInput) (PolicyDecision, error) {
+	p.RLock()
+	rules := p.rules
+	p.RUnlock()
+
+	roles := input.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	activation := map[string]interface{}{
+		"user":       input.User,
+		"group":      input.Group,
+		"process":    input.Process,
+		"permission": input.Permission,
+		"roles":      roles,
+		"rbac":       input.Rbac,
+		"now":        input.Time,
+	}
+
+	decision := PolicyDecision{}
+	for _, rule := range rules {
+		out, _, err := rule.program.Eval(activation)
+		if err != nil {
+			return PolicyDecision{}, fmt.Errorf("Evaluating rule %q in %s: %s", rule.Name, rule.file, err)
+		}
+		matched, ok := out.Value().(bool)
+		if !ok {
+			return PolicyDecision{}, fmt.Errorf("Rule %q in %s did not evaluate to a bool", rule.Name, rule.file)
+		}
+		if !matched {
+			continue
+		}
+
+		if rule.Effect == PolicyDeny {
+			return PolicyDecision{Allowed: false, Rule: rule.Name}, nil
+		}
+		if !decision.Allowed {
+			decision = PolicyDecision{Allowed: true, Rule: rule.Name}
+		}
+	}
+	return decision, nil
+}
+
+// Looks up the user's roles and what the rwx grants decide, then decides with
+// the policies
+func (p *PolicyAuthorizer) Authorize(req AuthzRequest) (bool, error) {
+	var roles []string
+	db = GetDb()
+
+	errorChan := make(chan error, 1)
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetUserRoles(req.User, req.Group, db, errorChan, &roles)
+	if err := <-errorChan; err != nil {
+		return false, err
+	}
+	rbac, err := RbacAuthorizer{}.Authorize(req)
+	if err != nil {
+		return false, err
+	}
+
+	decision, err := p.Decide(PolicyInput{
+		User:       req.User,
+		Group:      req.Group,
+		Process:    req.Process,
+		Permission: req.Permission,
+		Roles:      roles,
+		Rbac:       rbac,
+		Time:       req.Time,
+	})
+	if err != nil {
+		return false, err
+	}
+	return decision.Allowed, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+)
+
+// Returned when a run would take a group past one of its quotas
+type QuotaError struct {
+	Resource  string
+	Used      int
+	Requested int
+	Quota     int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf(
+		"Group quota exceeded for %s: %d in use, %d requested, quota is %d",
+		e.Resource, e.Used, e.Requested, e.Quota,
+	)
+}
+
+// Checks that one more run of rpid fits in the quota of group gid. The group
+// stays locked until tx ends, so concurrent requests for the same group are
+// checked one at a time. The containers quota is not checked here: it caps
+// how many runs execute at once across all members, and runs past it wait in
+// the queue until claimQueuedRun finds a free slot.
+func checkGroupQuota(tx *sql.Tx, gid int, rpid int) error {
+	var quota conciergedb.DbGroupQuota
+	var usage, requested conciergedb.DbResources
+	errorChan := make(chan error, 1)
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetGroupQuota(gid, true, tx, errorChan, &quota)
+	if err := <-errorChan; err != nil {
+		return err
+	}
+	if quota == (conciergedb.DbGroupQuota{}) {
+		return nil
+	}
+
+	go conciergedb.GetGroupUsage(gid, tx, errorChan, &usage)
+	if err := <-errorChan; err != nil {
+		return err
+	}
+	go conciergedb.GetProcessResources(rpid, tx, errorChan, &requested)
+	if err := <-errorChan; err != nil {
+		return err
+	}
+
+	checks := []struct {
+		resource  string
+		used      int
+		requested int
+		quota     *int
+	}{
+		{"memory (MB)", usage.MemoryMb, requested.MemoryMb, quota.MaxMemoryMb},
+		{"cpu (millicores)", usage.CpuMillicores, requested.CpuMillicores, quota.MaxCpuMillicores},
+		{"storage (MB)", usage.StorageMb, requested.StorageMb, quota.MaxStorageMb},
+	}
+	for _, check := range checks {
+		if check.quota != nil && check.used+check.requested > *check.quota {
+			return &QuotaError{
+				Resource:  check.resource,
+				Used:      check.used,
+				Requested: check.requested,
+				Quota:     *check.quota,
+			}
+		}
+	}
+
+	return nil
+}
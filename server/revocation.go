@@ -0,0 +1,144 @@
+package server
+
+import (
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Adds a token to the revocation list until it would have expired anyway
+func revokeToken(claims *ConciergeTokenClaims) error {
+	db = GetDb()
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RevokedTokens + `
+          (jti, uid, date_revoked, date_expires)
+        SELECT $1, u.uid, now(), to_timestamp($3)
+        FROM ` +
+		conciergedb.ConciergeTables.Users + ` u
+        WHERE u.username = $2
+        ON CONFLICT (jti) DO NOTHING
+        `
+	_, err := db.Exec(queryStr, claims.Id, claims.User, claims.ExpiresAt)
+	return err
+}
+
+// Revokes every token issued to a user so far, and all their refresh tokens
+// and API keys. Tokens are compared by their microsecond issue time, so ones
+// issued right after, like the session of a sign in following a password
+// reset, stay valid.
+func revokeAllSessions(username string) error {
+	db = GetDb()
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.RefreshTokens + ` rt
+        SET revoked = true
+        FROM ` + conciergedb.ConciergeTables.Users + ` u
+        WHERE u.uid = rt.uid AND u.username = $1
+        `
+	if _, err := db.Exec(queryStr, username); err != nil {
+		return err
+	}
+
+	// A leaked key would otherwise outlive the password it was made with
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.ApiKeys + ` ak
+        SET revoked = true
+        FROM ` + conciergedb.ConciergeTables.Users + ` u
+        WHERE u.uid = ak.uid AND u.username = $1
+        `
+	if _, err := db.Exec(queryStr, username); err != nil {
+		return err
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Users + `
+        SET sessions_revoked_at = $2
+        WHERE username = $1
+        `
+	// Tokens get their issue time from this clock too
+	_, err := db.Exec(queryStr, username, time.Now().Truncate(time.Microsecond))
+	return err
+}
+
+func isTokenRevoked(claims *ConciergeTokenClaims) (bool, error) {
+	var revoked bool
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	issuedAtUs := claims.IssuedAtUs
+	if issuedAtUs == 0 {
+		issuedAtUs = claims.IssuedAt * int64(time.Second/time.Microsecond)
+	}
+	go conciergedb.IsTokenRevoked(claims.Id, claims.User, issuedAtUs, db, errorChan, &revoked)
+	if err := <-errorChan; err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
+
+func collectRevokedTokens() error {
+	db = GetDb()
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RevokedTokens + `
+        WHERE date_expires < now()
+        `
+	if _, err := db.Exec(queryStr); err != nil {
+		return err
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.RefreshTokens + `
+        WHERE date_expires < now()
+        `
+	if _, err := db.Exec(queryStr); err != nil {
+		return err
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.PasswordResets + `
+        WHERE date_expires < now()
+        `
+	if _, err := db.Exec(queryStr); err != nil {
+		return err
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.OidcStates + `
+        WHERE date_expires < now()
+        `
+	_, err := db.Exec(queryStr)
+	return err
+}
+
+// Every interval drops revoked, refresh and reset tokens and OIDC sign ins
+// that have expired, since those are rejected on their expiry alone
+func RunRevocationGc(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := collectRevokedTokens(); err != nil {
+			Logger.Error("Error collecting revoked tokens", zap.String("error", err.Error()))
+		}
+	}
+}
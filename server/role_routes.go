@@ -0,0 +1,175 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+type RoleBody struct {
+	Role string `json:"role"`
+}
+
+type RenameRoleBody struct {
+	Role string `json:"role"`
+	Name string `json:"name"`
+}
+
+type AssignRolesBody struct {
+	Group  string   `json:"group"`
+	Target string   `json:"target"`
+	Roles  []string `json:"roles"`
+}
+
+type ListRolesRes struct {
+	Roles []conciergedb.DbRole `json:"roles"`
+}
+
+// The status code and message for errors from the role functions
+func roleErrorStatus(err error) (int, string) {
+	switch err {
+	case ErrRoleNameInvalid:
+		return http.StatusBadRequest, err.Error()
+	case ErrRoleNotFound, ErrGroupNotFound, ErrUserNotFound:
+		return http.StatusNotFound, err.Error()
+	case ErrRoleExists, ErrRoleInUse, ErrNotMember, ErrUnassignOwnerAdmin:
+		return http.StatusConflict, err.Error()
+	case ErrRoleBuiltin:
+		return http.StatusForbidden, err.Error()
+	}
+	Logger.Error("Error managing role", zap.String("error", err.Error()))
+	return http.StatusInternalServerError, "Error managing role"
+}
+
+// What a role assignment is audited as changing, like "alice=operator,viewer"
+func roleAuditTarget(body AssignRolesBody) string {
+	return body.Target + "=" + strings.Join(body.Roles, ",")
+}
+
+func ListRoles(c *gin.Context) {
+	var roles []conciergedb.DbRole
+	errorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetRoles(db, errorChan, &roles)
+	if err := <-errorChan; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error listing roles"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, ListRolesRes{Roles: roles})
+}
+
+func CreateRole(c *gin.Context) {
+	var body RoleBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditRoleCreate,
+		Target: body.Role,
+	})
+
+	if err := createRole(body.Role); err != nil {
+		status, msg := roleErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Role created successfully")
+}
+
+func RenameRole(c *gin.Context) {
+	var body RenameRoleBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditRoleRename,
+		Target: body.Role + "/" + body.Name,
+	})
+
+	if err := renameRole(body.Role, body.Name); err != nil {
+		status, msg := roleErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Role renamed successfully")
+}
+
+func DeleteRole(c *gin.Context) {
+	var body RoleBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditRoleDelete,
+		Target: body.Role,
+	})
+
+	if err := deleteRole(body.Role); err != nil {
+		status, msg := roleErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Role deleted successfully")
+}
+
+func AssignRoles(c *gin.Context) {
+	var body AssignRolesBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditRoleAssign,
+		Target: roleAuditTarget(body),
+		Group:  body.Group,
+	})
+
+	if err := assignRoles(body.Group, body.Target, body.Roles); err != nil {
+		status, msg := roleErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Roles assigned successfully")
+}
+
+func UnassignRoles(c *gin.Context) {
+	var body AssignRolesBody
+
+	if err := c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditRoleUnassign,
+		Target: roleAuditTarget(body),
+		Group:  body.Group,
+	})
+
+	if err := unassignRoles(body.Group, body.Target, body.Roles); err != nil {
+		status, msg := roleErrorStatus(err)
+		c.JSON(status, gin.H{"status": msg})
+		return
+	}
+
+	c.String(http.StatusOK, "Roles unassigned successfully")
+}
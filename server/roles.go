@@ -0,0 +1,220 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/lib/pq"
+)
+
+var ErrRoleNameInvalid = errors.New("Role names must be 1 to 255 characters without surrounding spaces")
+var ErrRoleExists = errors.New("Role already exists")
+var ErrRoleNotFound = errors.New("Cannot find role")
+var ErrRoleBuiltin = errors.New("Built in roles cannot be renamed or deleted")
+var ErrRoleInUse = errors.New("Role is still assigned or granted permissions")
+var ErrUnassignOwnerAdmin = errors.New("The group owner must stay an admin, transfer ownership first")
+
+func createRole(role string) error {
+	if !validName(role) {
+		return ErrRoleNameInvalid
+	}
+	db = GetDb()
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.Roles + ` (name)
+        VALUES ($1)
+        ON CONFLICT (name) DO NOTHING
+        `
+	res, err := db.Exec(queryStr, role)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrRoleExists
+	}
+	return nil
+}
+
+func renameRole(role string, name string) error {
+	if conciergedb.IsBuiltinRole(role) {
+		return ErrRoleBuiltin
+	}
+	if !validName(name) {
+		return ErrRoleNameInvalid
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queryStr := `
+        SELECT EXISTS (
+          SELECT 1 FROM ` + conciergedb.ConciergeTables.Roles + ` WHERE name = $1
+        )
+        `
+	var exists bool
+	if err = tx.QueryRow(queryStr, name).Scan(&exists); err != nil {
+		return err
+	} else if exists {
+		return ErrRoleExists
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Roles + `
+        SET name = $1
+        WHERE name = $2
+        `
+	res, err := tx.Exec(queryStr, name, role)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return ErrRoleNotFound
+	}
+
+	return tx.Commit()
+}
+
+// Deletes a role nobody holds and no permission is granted to
+func deleteRole(role string) error {
+	if conciergedb.IsBuiltinRole(role) {
+		return ErrRoleBuiltin
+	}
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rid int
+	var inUse bool
+	queryStr := `
+        SELECT r.rid,
+               EXISTS (
+                 SELECT 1 FROM ` + conciergedb.ConciergeTables.GroupUserRoles + ` WHERE rid = r.rid
+               ) OR EXISTS (
+                 SELECT 1 FROM ` + conciergedb.ConciergeTables.RegisteredProcessPermissions + ` WHERE rid = r.rid
+               )
+        FROM ` +
+		conciergedb.ConciergeTables.Roles + ` r
+        WHERE r.name = $1
+        FOR UPDATE
+        `
+	err = tx.QueryRow(queryStr, role).Scan(&rid, &inUse)
+	if err == sql.ErrNoRows {
+		return ErrRoleNotFound
+	} else if err != nil {
+		return err
+	} else if inUse {
+		return ErrRoleInUse
+	}
+
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.Roles + `
+        WHERE rid = $1
+        `
+	if _, err = tx.Exec(queryStr, rid); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return ErrRoleInUse
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Gives a member of a group roles in it. Roles they already hold are skipped.
+func assignRoles(group string, username string, roles []string) error {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+	uid, err := lookupUid(tx, username)
+	if err != nil {
+		return err
+	}
+	isMember, err := isGroupMember(tx, uid, gid)
+	if err != nil {
+		return err
+	} else if !isMember {
+		return ErrNotMember
+	}
+
+	for _, role := range roles {
+		if err = grantGroupRole(tx, uid, gid, role); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Takes roles in a group from a member. The owner keeps the admin role.
+func unassignRoles(group string, username string, roles []string) error {
+	var ownerUid sql.NullInt64
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	gid, err := lookupGid(tx, group)
+	if err != nil {
+		return err
+	}
+	uid, err := lookupUid(tx, username)
+	if err != nil {
+		return err
+	}
+
+	queryStr := `
+        SELECT g.owner_uid
+        FROM ` +
+		conciergedb.ConciergeTables.Groups + ` g
+        WHERE g.gid = $1
+        `
+	if err = tx.QueryRow(queryStr, gid).Scan(&ownerUid); err != nil {
+		return err
+	}
+	if ownerUid.Valid && int(ownerUid.Int64) == uid {
+		for _, role := range roles {
+			if role == conciergedb.InitConciergeRoles.Admin {
+				return ErrUnassignOwnerAdmin
+			}
+		}
+	}
+
+	for _, table := range []string{
+		conciergedb.ConciergeTables.OidcRoleGrants,
+		conciergedb.ConciergeTables.GroupUserRoles,
+	} {
+		queryStr = `
+            DELETE FROM ` + table + ` t
+            USING ` + conciergedb.ConciergeTables.Roles + ` r
+            WHERE t.uid = $1 AND t.gid = $2 AND t.rid = r.rid AND r.name = ANY($3)
+            `
+		if _, err = tx.Exec(queryStr, uid, gid, pq.Array(roles)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
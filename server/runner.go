@@ -0,0 +1,242 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"sync"
+)
+
+// A single run of a registered process on this member
+type RunRequest struct {
+	Name      string
+	Rpid      int
+	RunnerUid int
+	Gid       int
+	Argv      []string
+	Env       []string
+
+	// Mounted on a tmpfs at SecretsMountPath. Like secret values in Env, they
+	// must never be logged or written to disk.
+	SecretFiles []SecretFile
+
+	// Zero means no limit
+	MemoryLimitMb      int
+	CpuLimitMillicores int
+	// Only reserved against the group's quota, runners need not enforce it
+	StorageLimitMb int
+}
+
+// A run a ProcessRunner started
+type RunHandle interface {
+	// The pid of the run's init process
+	Pid() int
+	// Blocks until the run exits, returning why it failed if it did
+	Wait() error
+	// Stops the run. Wait returns once it is gone.
+	Kill() error
+}
+
+// Starts the run. The container runtime lives outside this package, so it is
+// handed in with SetProcessRunner.
+type ProcessRunner func(runRequest RunRequest) (RunHandle, error)
+
+var processRunner ProcessRunner
+
+func SetProcessRunner(runner ProcessRunner) {
+	processRunner = runner
+}
+
+func GetProcessRunner() ProcessRunner {
+	return processRunner
+}
+
+var (
+	ErrRunNotFound  = errors.New("Cannot find run")
+	ErrRunExists    = errors.New("A run with that name already exists")
+	ErrRunNotActive = errors.New("Run already finished")
+	ErrRunElsewhere = errors.New("Run is on another member")
+	ErrRunStarting  = errors.New("Run is starting, try again")
+	ErrRunKilled    = errors.New("Run killed")
+	ErrRunLost      = errors.New("Member restarted while the run was running")
+)
+
+// Runs started on this member, by name, until they exit
+var localRuns = struct {
+	sync.Mutex
+	handles map[string]RunHandle
+	killed  map[string]bool
+}{handles: map[string]RunHandle{}, killed: map[string]bool{}}
+
+// Waits for a run to exit and frees its slot
+func waitRun(runName string, handle RunHandle) {
+	runErr := handle.Wait()
+
+	localRuns.Lock()
+	if localRuns.killed[runName] {
+		runErr = ErrRunKilled
+	}
+	delete(localRuns.handles, runName)
+	delete(localRuns.killed, runName)
+	localRuns.Unlock()
+
+	if err := FinishRun(runName, runErr); err != nil {
+		Logger.Error(
+			"Error finishing run",
+			zap.String("name", runName),
+			zap.String("error", err.Error()),
+		)
+	}
+}
+
+// Kills a run of a process in a group. Queued runs are taken off the queue,
+// running ones are stopped if they run on this member.
+func killRun(runName string, gid int, rpid int) error {
+	var queuedRun conciergedb.DbQueuedRun
+	var position int
+	var cancelled bool
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetRunQueuePosition(runName, db, errorChan, &queuedRun, &position)
+	if err := <-errorChan; err != nil || queuedRun.Gid != gid || queuedRun.Rpid != rpid {
+		return ErrRunNotFound
+	}
+
+	if queuedRun.Status == conciergedb.ConciergeRunStatuses.Queued {
+		go conciergedb.CancelQueuedRun(queuedRun.Qid, ErrRunKilled.Error(), db, errorChan, &cancelled)
+		if err := <-errorChan; err != nil {
+			return err
+		}
+		if cancelled {
+			return nil
+		}
+		// A dispatcher claimed it in the meantime
+		queuedRun.Status = conciergedb.ConciergeRunStatuses.Running
+	}
+	if queuedRun.Status != conciergedb.ConciergeRunStatuses.Running {
+		return ErrRunNotActive
+	}
+	if queuedRun.Node != GetNodeName() {
+		return ErrRunElsewhere
+	}
+
+	localRuns.Lock()
+	handle, ok := localRuns.handles[runName]
+	if ok {
+		localRuns.killed[runName] = true
+	}
+	localRuns.Unlock()
+	if !ok {
+		return ErrRunStarting
+	}
+	return handle.Kill()
+}
+
+// Renders the argv and env of a registered process for the given arguments
+func renderRun(rpid int, args map[string]string) ([]string, []string, error) {
+	var argv, env []string
+	var parameters []conciergedb.DbProcessParameter
+	commandErrorChan := make(chan error)
+	parametersErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(commandErrorChan)
+		close(parametersErrorChan)
+	}()
+
+	go conciergedb.GetProcessCommand(rpid, db, commandErrorChan, &argv, &env)
+	go conciergedb.GetProcessParameters(rpid, db, parametersErrorChan, &parameters)
+	commandErr, parametersErr := <-commandErrorChan, <-parametersErrorChan
+	if commandErr != nil {
+		return nil, nil, commandErr
+	}
+	if parametersErr != nil {
+		return nil, nil, parametersErr
+	}
+
+	return RenderCommand(argv, env, parameters, args)
+}
+
+// Renders the command of a registered process, starts it with the configured
+// process runner and records it in the running processes table. The run is
+// finished with FinishRun once it exits.
+func startRun(runName string, rpid int, runnerUid int, gid int, args map[string]string) error {
+	var runRequest RunRequest
+	var err error
+	db = GetDb()
+
+	runner := GetProcessRunner()
+	if runner == nil {
+		return errors.New("No process runner configured")
+	}
+
+	runRequest.Argv, runRequest.Env, err = renderRun(rpid, args)
+	if err != nil {
+		return err
+	}
+
+	secretEnv, secretFiles, err := resolveRunSecrets(rpid, gid)
+	if err != nil {
+		return err
+	}
+	runRequest.Env = append(runRequest.Env, secretEnv...)
+	runRequest.SecretFiles = secretFiles
+
+	queryStr := `
+        SELECT rp.memory_limit_mb, rp.cpu_limit_millicores, rp.storage_limit_mb
+        FROM ` +
+		conciergedb.ConciergeTables.RegisteredProcesses + ` rp
+        WHERE rp.rpid = $1
+        `
+	err = db.QueryRow(queryStr, rpid).Scan(
+		&runRequest.MemoryLimitMb,
+		&runRequest.CpuLimitMillicores,
+		&runRequest.StorageLimitMb,
+	)
+	if err != nil {
+		return fmt.Errorf("No registered process found for rpid %d: %v", rpid, err)
+	}
+	runRequest.Name = runName
+	runRequest.Rpid = rpid
+	runRequest.RunnerUid = runnerUid
+	runRequest.Gid = gid
+
+	handle, err := runner(runRequest)
+	if err != nil {
+		return err
+	}
+
+	Logger.Info(
+		"Started run",
+		zap.String("name", runName),
+		zap.Int("rpid", rpid),
+		zap.Int("pid", handle.Pid()),
+	)
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RunningProcesses + `
+          (name, pid, runner_uid, gid, rpid)
+        VALUES ($1, $2, $3, $4, $5)
+        `
+	_, err = db.Exec(queryStr, runName, handle.Pid(), runnerUid, gid, rpid)
+	if err != nil {
+		// A run nothing tracks would never free its slot
+		handle.Kill()
+		handle.Wait()
+		return err
+	}
+
+	localRuns.Lock()
+	localRuns.handles[runName] = handle
+	localRuns.Unlock()
+	go waitRun(runName, handle)
+	return nil
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/lib/pq"
+	"net/http"
+	"time"
+)
+
+type NewScheduleBody struct {
+	Group         string                 `json:"group"`
+	Process       string                 `json:"process"`
+	ScheduleName  string                 `json:"schedulename"`
+	Cron          string                 `json:"cron"`
+	Timezone      string                 `json:"timezone"`
+	MisfirePolicy string                 `json:"misfirepolicy"`
+	Args          map[string]interface{} `json:"args"`
+}
+
+type ScheduleBody struct {
+	Group        string `json:"group"`
+	Process      string `json:"process"`
+	ScheduleName string `json:"schedulename"`
+}
+
+type ListSchedulesBody struct {
+	Group string `json:"group"`
+}
+
+func NewSchedule(c *gin.Context) {
+	var err error = nil
+	var schedule NewScheduleBody
+	var uid, gid, rpid int
+	var queryStr string
+	uidErrorChan := make(chan error)
+	gidErrorChan := make(chan error)
+	rpidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(uidErrorChan)
+		close(gidErrorChan)
+		close(rpidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&schedule, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditScheduleCreate,
+		Target: schedule.Process + "/" + schedule.ScheduleName,
+		Group:  schedule.Group,
+	})
+
+	if schedule.Timezone == "" {
+		schedule.Timezone = "UTC"
+	}
+	switch schedule.MisfirePolicy {
+	case "":
+		schedule.MisfirePolicy = conciergedb.ConciergeMisfirePolicies.FireOnce
+	case conciergedb.ConciergeMisfirePolicies.FireOnce, conciergedb.ConciergeMisfirePolicies.Skip:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid misfire policy"})
+		return
+	}
+
+	nextRun, err := nextScheduleRun(schedule.Cron, schedule.Timezone, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid cron expression or timezone"})
+		return
+	}
+	args, err := NormalizeArgs(schedule.Args)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	}
+
+	go conciergedb.GetUid(requestUser(c), db, uidErrorChan, &uid)
+	go conciergedb.GetGid(schedule.Group, db, gidErrorChan, &gid)
+	go conciergedb.GetRpid(schedule.Process, db, rpidErrorChan, &rpid)
+	uidErr, gidErr, rpidErr := <-uidErrorChan, <-gidErrorChan, <-rpidErrorChan
+	if uidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+	if gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+	if rpidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+		return
+	}
+
+	if _, _, err = renderRun(rpid, args); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	}
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid arguments"})
+		return
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.Schedules + `
+          (name, cron_expr, timezone, rpid, runner_uid, gid, enabled,
+           misfire_policy, args, next_run, date_created)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        `
+	_, err = db.Exec(
+		queryStr,
+		schedule.ScheduleName,
+		schedule.Cron,
+		schedule.Timezone,
+		rpid,
+		uid,
+		gid,
+		true,
+		schedule.MisfirePolicy,
+		argsJson,
+		nextRun,
+		pq.FormatTimestamp(time.Now()),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error creating schedule"})
+		return
+	}
+
+	c.String(http.StatusOK, "Schedule created successfully")
+}
+
+func ListSchedules(c *gin.Context) {
+	var err error = nil
+	var body ListSchedulesBody
+	var gid int
+	schedules := []conciergedb.DbSchedule{}
+	gidErrorChan := make(chan error)
+	schedulesErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(schedulesErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go conciergedb.GetGid(body.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	go conciergedb.GetGroupSchedules(gid, db, schedulesErrorChan, &schedules)
+	if err = <-schedulesErrorChan; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error listing schedules"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, schedules)
+}
+
+// Sets the enabled flag of a schedule. Resuming moves the next run to the
+// first one after now, so a resumed schedule does not misfire for the time it
+// was paused.
+func setScheduleEnabled(c *gin.Context, enabled bool) {
+	var err error = nil
+	var schedule ScheduleBody
+	var gid, rpid int
+	var cronExpr, timezone string
+	gidErrorChan := make(chan error)
+	rpidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(rpidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&schedule, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	action := AuditSchedulePause
+	if enabled {
+		action = AuditScheduleResume
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: action,
+		Target: schedule.Process + "/" + schedule.ScheduleName,
+		Group:  schedule.Group,
+	})
+
+	go conciergedb.GetGid(schedule.Group, db, gidErrorChan, &gid)
+	go conciergedb.GetRpid(schedule.Process, db, rpidErrorChan, &rpid)
+	gidErr, rpidErr := <-gidErrorChan, <-rpidErrorChan
+	if gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+	if rpidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+		return
+	}
+
+	queryStr := `
+        SELECT s.cron_expr, s.timezone
+        FROM ` +
+		conciergedb.ConciergeTables.Schedules + ` s
+        WHERE s.name = $1 AND s.gid = $2 AND s.rpid = $3
+        `
+	err = db.QueryRow(queryStr, schedule.ScheduleName, gid, rpid).Scan(&cronExpr, &timezone)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Cannot find schedule"})
+		return
+	}
+
+	nextRun, err := nextScheduleRun(cronExpr, timezone, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Invalid stored schedule"})
+		return
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.Schedules + `
+        SET enabled = $1,
+            next_run = CASE WHEN $1 AND NOT enabled THEN $2 ELSE next_run END
+        WHERE name = $3 AND gid = $4 AND rpid = $5
+        `
+	_, err = db.Exec(queryStr, enabled, nextRun, schedule.ScheduleName, gid, rpid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error updating schedule"})
+		return
+	}
+
+	if enabled {
+		c.String(http.StatusOK, "Schedule resumed successfully")
+	} else {
+		c.String(http.StatusOK, "Schedule paused successfully")
+	}
+}
+
+func PauseSchedule(c *gin.Context) {
+	setScheduleEnabled(c, false)
+}
+
+func ResumeSchedule(c *gin.Context) {
+	setScheduleEnabled(c, true)
+}
+
+func DeleteSchedule(c *gin.Context) {
+	var err error = nil
+	var schedule ScheduleBody
+	var gid, rpid int
+	gidErrorChan := make(chan error)
+	rpidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(rpidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&schedule, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditScheduleDelete,
+		Target: schedule.Process + "/" + schedule.ScheduleName,
+		Group:  schedule.Group,
+	})
+
+	go conciergedb.GetGid(schedule.Group, db, gidErrorChan, &gid)
+	go conciergedb.GetRpid(schedule.Process, db, rpidErrorChan, &rpid)
+	gidErr, rpidErr := <-gidErrorChan, <-rpidErrorChan
+	if gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+	if rpidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+		return
+	}
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.Schedules + `
+        WHERE name = $1 AND gid = $2 AND rpid = $3
+        `
+	res, err := db.Exec(queryStr, schedule.ScheduleName, gid, rpid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting schedule"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Cannot find schedule"})
+		return
+	}
+
+	c.String(http.StatusOK, "Schedule deleted successfully")
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Standard five field cron expressions plus descriptors such as @daily
+var cronParser = cron.NewParser(
+	cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// Runs found later than this after their due time are misfires, and are
+// handled by the misfire policy of their schedule
+var misfireGrace = time.Minute
+
+func SetMisfireGrace(grace time.Duration) {
+	misfireGrace = grace
+}
+
+func nextScheduleRun(cronExpr string, timezone string, after time.Time) (time.Time, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	schedule, err := cronParser.Parse(cronExpr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(after.In(location)), nil
+}
+
+// Fires due schedules every interval until quit is closed. Schedules missed
+// while the member was down are picked up on the first pass.
+func RunScheduler(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	FireDueSchedules(time.Now())
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			FireDueSchedules(now)
+		}
+	}
+}
+
+// Whether the runner of a schedule may still execute its process. Schedules
+// outlive the grants they were created under, so this is checked each time
+// one fires.
+func scheduleRunnerAllowed(schedule conciergedb.DbSchedule, now time.Time) (bool, error) {
+	var runner, group, process string
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetScheduleNames(schedule.Sid, db, errorChan, &runner, &group, &process)
+	if err := <-errorChan; err != nil {
+		return false, err
+	}
+	return GetAuthorizer().Authorize(AuthzRequest{
+		User:       runner,
+		Group:      group,
+		Process:    process,
+		Permission: "x",
+		Time:       now,
+	})
+}
+
+// Queues a run for every schedule due at now
+func FireDueSchedules(now time.Time) {
+	var schedules []conciergedb.DbSchedule
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetDueSchedules(now, db, errorChan, &schedules)
+	if err := <-errorChan; err != nil {
+		Logger.Error("Error finding due schedules", zap.String("error", err.Error()))
+		return
+	}
+
+	for _, schedule := range schedules {
+		var claimed bool
+
+		nextRun, err := nextScheduleRun(schedule.CronExpr, schedule.Timezone, now)
+		if err != nil {
+			Logger.Error(
+				"Invalid schedule",
+				zap.String("schedule", schedule.Name),
+				zap.String("error", err.Error()),
+			)
+			continue
+		}
+
+		// Any number of missed runs collapse into at most one
+		misfired := now.Sub(schedule.NextRun) > misfireGrace
+		fire := !misfired || schedule.MisfirePolicy == conciergedb.ConciergeMisfirePolicies.FireOnce
+
+		go conciergedb.ClaimScheduleRun(
+			schedule.Sid,
+			schedule.NextRun,
+			nextRun,
+			fire,
+			db,
+			errorChan,
+			&claimed,
+		)
+		if err = <-errorChan; err != nil {
+			Logger.Error(
+				"Error claiming schedule run",
+				zap.String("schedule", schedule.Name),
+				zap.String("error", err.Error()),
+			)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		if misfired {
+			Logger.Warn(
+				"Schedule misfired",
+				zap.String("schedule", schedule.Name),
+				zap.Time("due", schedule.NextRun),
+				zap.String("policy", schedule.MisfirePolicy),
+			)
+		}
+		if !fire {
+			continue
+		}
+
+		allowed, err := scheduleRunnerAllowed(schedule, now)
+		if err != nil {
+			Logger.Error(
+				"Error checking schedule permissions",
+				zap.String("schedule", schedule.Name),
+				zap.String("error", err.Error()),
+			)
+			continue
+		}
+		if !allowed {
+			Logger.Warn(
+				"Schedule runner may no longer execute its process",
+				zap.String("schedule", schedule.Name),
+				zap.Int("runner", schedule.RunnerUid),
+			)
+			continue
+		}
+
+		runName := fmt.Sprintf("%s-%d", schedule.Name, now.Unix())
+		_, err = enqueueRun(
+			runName,
+			schedule.Rpid,
+			schedule.RunnerUid,
+			schedule.Gid,
+			0,
+			schedule.Args,
+		)
+		if err != nil {
+			Logger.Error(
+				"Error queueing schedule run",
+				zap.String("schedule", schedule.Name),
+				zap.String("error", err.Error()),
+			)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"net/http"
+)
+
+type PutSecretBody struct {
+	Group      string `json:"group"`
+	SecretName string `json:"secretname"`
+	Value      string `json:"value"`
+}
+
+type ListSecretsBody struct {
+	Group string `json:"group"`
+}
+
+type SecretBody struct {
+	Group      string `json:"group"`
+	SecretName string `json:"secretname"`
+}
+
+// Creates or replaces a secret. The value is only ever returned to the runs
+// that reference it.
+func PutSecret(c *gin.Context) {
+	var err error = nil
+	var secret PutSecretBody
+	var gid int
+	gidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&secret, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditSecretPut,
+		Target: secret.SecretName,
+		Group:  secret.Group,
+	})
+	if !secretFileName.MatchString(secret.SecretName) {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Invalid secret name"})
+		return
+	}
+
+	go conciergedb.GetGid(secret.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	ciphertext, err := encryptSecret(gid, secret.SecretName, []byte(secret.Value))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error encrypting secret"})
+		return
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.Secrets + `
+          (gid, name, ciphertext, date_created, date_updated)
+        VALUES ($1, $2, $3, now(), now())
+        ON CONFLICT (gid, name) DO UPDATE
+        SET ciphertext = EXCLUDED.ciphertext, date_updated = EXCLUDED.date_updated
+        `
+	_, err = db.Exec(queryStr, gid, secret.SecretName, ciphertext)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error storing secret"})
+		return
+	}
+
+	c.String(http.StatusOK, "Secret stored successfully")
+}
+
+func ListSecrets(c *gin.Context) {
+	var err error = nil
+	var body ListSecretsBody
+	var gid int
+	secrets := []conciergedb.DbSecretInfo{}
+	gidErrorChan := make(chan error)
+	secretsErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+		close(secretsErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&body, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	go conciergedb.GetGid(body.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	go conciergedb.GetGroupSecrets(gid, db, secretsErrorChan, &secrets)
+	if err = <-secretsErrorChan; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error listing secrets"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, secrets)
+}
+
+func DeleteSecret(c *gin.Context) {
+	var err error = nil
+	var secret SecretBody
+	var gid int
+	gidErrorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(gidErrorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&secret, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditSecretDelete,
+		Target: secret.SecretName,
+		Group:  secret.Group,
+	})
+
+	go conciergedb.GetGid(secret.Group, db, gidErrorChan, &gid)
+	if gidErr := <-gidErrorChan; gidErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find group"})
+		return
+	}
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.Secrets + `
+        WHERE gid = $1 AND name = $2
+        `
+	res, err := db.Exec(queryStr, gid, secret.SecretName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error deleting secret"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"status": "Cannot find secret"})
+		return
+	}
+
+	c.String(http.StatusOK, "Secret deleted successfully")
+}
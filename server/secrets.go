@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"io"
+	"io/ioutil"
+	"regexp"
+)
+
+// Where the runtime mounts the tmpfs holding file secrets inside a container
+const SecretsMountPath = "/run/secrets"
+
+// A secret file the runtime writes to the tmpfs at SecretsMountPath
+type SecretFile struct {
+	Name string
+	Data []byte
+}
+
+var secretsAead cipher.AEAD
+
+var secretFileName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// Sets the master key secrets are encrypted with at rest. The key is 32 bytes
+// for AES-256-GCM, raw or base64 encoded.
+func SetSecretsKey(key []byte) error {
+	if len(key) != 32 {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(key)))
+		if err != nil || len(decoded) != 32 {
+			return errors.New("Secrets key must be 32 bytes, raw or base64 encoded")
+		}
+		key = decoded
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	secretsAead = aead
+	return nil
+}
+
+func LoadSecretsKeyFile(filename string) error {
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return SetSecretsKey(key)
+}
+
+// Binds a ciphertext to its group and name, so rows cannot be swapped
+func secretAdditionalData(gid int, secretname string) []byte {
+	return []byte(fmt.Sprintf("%d/%s", gid, secretname))
+}
+
+// Encrypts with the master key. The additional data is authenticated but not
+// stored, and must be given again to open the ciphertext.
+func sealWithMasterKey(plaintext []byte, additionalData []byte) ([]byte, error) {
+	if secretsAead == nil {
+		return nil, errors.New("No secrets key configured")
+	}
+	nonce := make([]byte, secretsAead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return secretsAead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openWithMasterKey(ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if secretsAead == nil {
+		return nil, errors.New("No secrets key configured")
+	}
+	nonceSize := secretsAead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("Ciphertext too short")
+	}
+	return secretsAead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], additionalData)
+}
+
+func encryptSecret(gid int, secretname string, plaintext []byte) ([]byte, error) {
+	return sealWithMasterKey(plaintext, secretAdditionalData(gid, secretname))
+}
+
+func decryptSecret(gid int, secretname string, ciphertext []byte) ([]byte, error) {
+	return openWithMasterKey(ciphertext, secretAdditionalData(gid, secretname))
+}
+
+func validateSecretRefs(secretRefs []conciergedb.DbSecretRef) error {
+	for _, secretRef := range secretRefs {
+		if (secretRef.Env == "") == (secretRef.File == "") {
+			return &ParameterError{secretRef.Secret, "secrets need exactly one of env or file"}
+		}
+		if secretRef.Env != "" && !identifierPattern.MatchString(secretRef.Env) {
+			return &ParameterError{secretRef.Secret, "env must be a variable name"}
+		}
+		if secretRef.File != "" && !secretFileName.MatchString(secretRef.File) {
+			return &ParameterError{secretRef.Secret, "file must be a plain file name"}
+		}
+	}
+	return nil
+}
+
+// Decrypts the secrets a registered process references, from the group the
+// run belongs to
+func resolveRunSecrets(rpid int, gid int) ([]string, []SecretFile, error) {
+	var secretRefs []conciergedb.DbSecretRef
+	var env []string
+	var files []SecretFile
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetProcessSecretRefs(rpid, db, errorChan, &secretRefs)
+	if err := <-errorChan; err != nil {
+		return nil, nil, err
+	}
+
+	for _, secretRef := range secretRefs {
+		var ciphertext []byte
+		go conciergedb.GetSecretCiphertext(gid, secretRef.Secret, db, errorChan, &ciphertext)
+		if err := <-errorChan; err != nil {
+			return nil, nil, err
+		}
+		plaintext, err := decryptSecret(gid, secretRef.Secret, ciphertext)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not decrypt secret %s", secretRef.Secret)
+		}
+
+		if secretRef.Env != "" {
+			env = append(env, secretRef.Env+"="+string(plaintext))
+		} else {
+			files = append(files, SecretFile{Name: secretRef.File, Data: plaintext})
+		}
+	}
+
+	return env, files, nil
+}
@@ -75,6 +75,7 @@ func InitServer() *gin.Engine {
 
 	router.Use(ginzap.Ginzap(Logger, time.RFC3339, true))
 	router.Use(ginzap.RecoveryWithZap(Logger, true))
+	router.Use(RequestId())
 
 	errcsoolCors := cors.New(cors.Config{
 		AllowOrigins: []string{
@@ -93,21 +94,97 @@ func InitServer() *gin.Engine {
 	accessRouter.Use(errcsoolCors)
 	accessRouter.POST("/signin", Signin)
 	accessRouter.POST("/signup", Signup)
-	accessRouter.POST("/signout", Signout)
+	accessRouter.POST("/signout", VerifySessionToken(), Signout)
+	accessRouter.POST("/refresh", Refresh)
+	accessRouter.POST("/verify-email", VerifyEmail)
+	accessRouter.POST("/resend-verification", VerifySessionToken(), ResendVerification)
+	accessRouter.POST("/forgot-password", ForgotPassword)
+	accessRouter.POST("/reset-password", ResetPassword)
+	accessRouter.POST("/signin-totp", SigninTotp)
+	accessRouter.GET("/oidc/login", OidcLogin)
+	accessRouter.GET("/oidc/callback", OidcCallback)
+	accessRouter.POST("/totp/enroll", VerifyEnrollmentToken(), EnrollTotp)
+	accessRouter.POST("/totp/confirm", VerifyEnrollmentToken(), ConfirmTotp)
+	accessRouter.POST("/totp/disable", VerifySessionToken(), DisableTotp)
+	accessRouter.POST("/totp/recoverycodes", VerifySessionToken(), RegenerateRecoveryCodes)
+	accessRouter.POST("/apikeys/create", VerifySessionToken(), CreateApiKey)
+	accessRouter.POST("/apikeys/list", VerifySessionToken(), ListApiKeys)
+	accessRouter.POST("/apikeys/revoke", VerifySessionToken(), RevokeApiKey)
+	accessRouter.POST("/explain", VerifySessionToken(), IsSelfOrGroupAdmin(), ExplainPermission)
+	accessRouter.POST("/unlock", VerifySessionToken(), IsSiteAdmin(), Unlock)
+	accessRouter.POST("/rotatekeys", VerifySessionToken(), IsSiteAdmin(), RotateKeys)
+	accessRouter.POST("/retirekey", VerifySessionToken(), IsSiteAdmin(), RetireKey)
 
 	commandRouter := router.Group("/command")
 	commandRouter.Use(errcsoolCors)
-	commandRouter.POST("/newcommand", VerifyToken(), CheckGroup(), IsAdmin(), NewCommand)
-	commandRouter.POST("/deletecommand", VerifyToken(), CheckGroup(), CanWrite(), DeleteCommand)
-	commandRouter.POST("/runcommand", VerifyToken(), CheckGroup(), CanExecute(), RunCommand)
-	commandRouter.POST("/killcommand", VerifyToken(), CheckGroup(), CanExecute(), KillCommand)
+	commandRouter.POST("/newcommand", VerifyToken(), RequireVerifiedEmail(), CheckGroup("w"), IsAdmin(), NewCommand)
+	commandRouter.POST("/deletecommand", VerifyToken(), RequireVerifiedEmail(), CheckGroup("w"), CanWrite(), DeleteCommand)
+	commandRouter.POST("/runcommand", VerifyToken(), RequireVerifiedEmail(), CheckGroup("x"), CanExecute(), RunCommand)
+	commandRouter.POST("/killcommand", VerifyToken(), RequireVerifiedEmail(), CheckGroup("x"), CanExecute(), KillCommand)
+	commandRouter.POST("/queuestatus", VerifyToken(), RequireVerifiedEmail(), CheckGroup("r"), QueueStatus)
+	commandRouter.POST("/grantpermission", VerifySessionToken(), RequireVerifiedEmail(), CanWriteProcess(), CanManageGrants(), GrantPermission)
+	commandRouter.POST("/changepermission", VerifySessionToken(), RequireVerifiedEmail(), CanWriteProcess(), CanManageGrants(), ChangePermission)
+	commandRouter.POST("/revokepermission", VerifySessionToken(), RequireVerifiedEmail(), CanWriteProcess(), CanManageGrants(), RevokePermission)
+	commandRouter.POST("/listpermissions", VerifyToken(), RequireVerifiedEmail(), CanReadProcess(), ListPermissions)
+
+	scheduleRouter := router.Group("/schedule")
+	scheduleRouter.Use(errcsoolCors)
+	scheduleRouter.POST("/newschedule", VerifyToken(), RequireVerifiedEmail(), CheckGroup("x"), CanExecute(), NewSchedule)
+	scheduleRouter.POST("/listschedules", VerifyToken(), RequireVerifiedEmail(), CheckGroup("r"), ListSchedules)
+	scheduleRouter.POST("/pauseschedule", VerifyToken(), RequireVerifiedEmail(), CheckGroup("x"), CanExecute(), PauseSchedule)
+	scheduleRouter.POST("/resumeschedule", VerifyToken(), RequireVerifiedEmail(), CheckGroup("x"), CanExecute(), ResumeSchedule)
+	scheduleRouter.POST("/deleteschedule", VerifyToken(), RequireVerifiedEmail(), CheckGroup("w"), CanWrite(), DeleteSchedule)
+
+	groupRouter := router.Group("/groups")
+	groupRouter.Use(errcsoolCors)
+	groupRouter.POST("/usage", VerifyToken(), CheckGroup("r"), GroupUsage)
+	groupRouter.POST("/setquota", VerifyToken(), IsSiteAdmin(), SetGroupQuota)
+	groupRouter.POST("/create", VerifySessionToken(), IsParentGroupAdmin(), CreateGroup)
+	groupRouter.POST("/rename", VerifySessionToken(), IsGroupAdmin(), RenameGroup)
+	groupRouter.POST("/delete", VerifySessionToken(), IsGroupAdmin(), DeleteGroup)
+	groupRouter.POST("/members", VerifySessionToken(), IsGroupAdmin(), ListGroupMembers)
+	groupRouter.POST("/adduser", VerifySessionToken(), IsGroupAdmin(), AddGroupUser)
+	groupRouter.POST("/removeuser", VerifySessionToken(), IsGroupAdmin(), RemoveGroupUser)
+	groupRouter.POST("/transferowner", VerifySessionToken(), IsGroupAdmin(), TransferGroupOwnership)
+	groupRouter.POST("/setparent", VerifySessionToken(), IsGroupAdmin(), IsParentGroupAdmin(), SetGroupParent)
+
+	roleRouter := router.Group("/roles")
+	roleRouter.Use(errcsoolCors)
+	roleRouter.POST("/list", VerifyToken(), ListRoles)
+	roleRouter.POST("/create", VerifySessionToken(), IsSiteAdmin(), CreateRole)
+	roleRouter.POST("/rename", VerifySessionToken(), IsSiteAdmin(), RenameRole)
+	roleRouter.POST("/delete", VerifySessionToken(), IsSiteAdmin(), DeleteRole)
+	roleRouter.POST("/assign", VerifySessionToken(), IsGroupAdmin(), CheckRolesExist(), AssignRoles)
+	roleRouter.POST("/unassign", VerifySessionToken(), IsGroupAdmin(), CheckRolesExist(), UnassignRoles)
+
+	secretRouter := router.Group("/secrets")
+	secretRouter.Use(errcsoolCors)
+	secretRouter.POST("/putsecret", VerifyToken(), CheckGroup("w"), IsAdmin(), PutSecret)
+	secretRouter.POST("/listsecrets", VerifyToken(), CheckGroup("r"), ListSecrets)
+	secretRouter.POST("/deletesecret", VerifyToken(), CheckGroup("w"), IsAdmin(), DeleteSecret)
+
+	auditRouter := router.Group("/audit")
+	auditRouter.Use(errcsoolCors)
+	auditRouter.POST("", VerifySessionToken(), IsSiteAdmin(), QueryAudit)
+	auditRouter.POST("/verify", VerifySessionToken(), IsSiteAdmin(), VerifyAudit)
 
 	router.GET("/ping", handler)
+	router.GET("/.well-known/jwks.json", Jwks)
 
 	return router
 }
 
+// Serves over TLS when SetTlsConfig was called, plain HTTP otherwise
 func RunServer(portString string, router *gin.Engine) {
 	throttler := rateLimiter()
-	http.ListenAndServe(portString, throttler.RateLimit(router))
+	httpServer := &http.Server{
+		Addr:      portString,
+		Handler:   throttler.RateLimit(router),
+		TLSConfig: ServerTlsConfig(),
+	}
+	if httpServer.TLSConfig != nil {
+		httpServer.ListenAndServeTLS("", "")
+		return
+	}
+	httpServer.ListenAndServe()
 }
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type TlsConfig struct {
+	CertFile string
+	KeyFile  string
+	// PEM bundle of the CAs client certificates are verified against. Without
+	// one, client certificates are neither requested nor used.
+	ClientCaFile string
+	// Refuses connections without a valid client certificate, instead of
+	// leaving them to authenticate with tokens
+	RequireClientCert bool
+	// Usernames by certificate subject, as in "CN=node1,O=netrun"
+	ClientCertUsers map[string]string
+	// Maps subjects missing from ClientCertUsers to the user named by their
+	// common name
+	MapCommonName bool
+}
+
+// The certificates in use, swapped as a whole on reload so handshakes never
+// see a cert from one load and a CA pool from another
+type tlsMaterial struct {
+	cert     *tls.Certificate
+	clientCa *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+var tlsState = struct {
+	sync.RWMutex
+	config   TlsConfig
+	material *tlsMaterial
+}{}
+
+var ErrTlsNotConfigured = errors.New("TLS is not configured")
+
+func loadTlsMaterial(config TlsConfig) (*tlsMaterial, error) {
+	material := &tlsMaterial{modTimes: map[string]time.Time{}}
+
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	material.cert = &cert
+
+	if config.ClientCaFile != "" {
+		caPem, err := ioutil.ReadFile(config.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		material.clientCa = x509.NewCertPool()
+		if !material.clientCa.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("No certificates found in " + config.ClientCaFile)
+		}
+	}
+
+	for _, file := range []string{config.CertFile, config.KeyFile, config.ClientCaFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		material.modTimes[file] = info.ModTime()
+	}
+	return material, nil
+}
+
+// Loads the certificates in config and serves TLS with them from RunServer
+func SetTlsConfig(config TlsConfig) error {
+	material, err := loadTlsMaterial(config)
+	if err != nil {
+		return err
+	}
+
+	tlsState.Lock()
+	defer tlsState.Unlock()
+	tlsState.config = config
+	tlsState.material = material
+	return nil
+}
+
+func getTlsState() (TlsConfig, *tlsMaterial) {
+	tlsState.RLock()
+	defer tlsState.RUnlock()
+	return tlsState.config, tlsState.material
+}
+
+// Reads the certificate files again. Connections made after it returns use
+// the new certificates; a failed reload keeps the old ones.
+func ReloadCertificates() error {
+	config, current := getTlsState()
+	if current == nil {
+		return ErrTlsNotConfigured
+	}
+	material, err := loadTlsMaterial(config)
+	if err != nil {
+		return err
+	}
+
+	tlsState.Lock()
+	defer tlsState.Unlock()
+	tlsState.material = material
+	return nil
+}
+
+func certificatesChanged() bool {
+	_, current := getTlsState()
+	if current == nil {
+		return false
+	}
+	for file, modTime := range current.modTimes {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Every interval reloads the certificates if any of their files changed
+func RunCertReload(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if !certificatesChanged() {
+			continue
+		}
+		if err := ReloadCertificates(); err != nil {
+			Logger.Error("Error reloading certificates", zap.String("error", err.Error()))
+		} else {
+			Logger.Info("Reloaded certificates")
+		}
+	}
+}
+
+// The server side TLS config, or nil when TLS is not configured. Certificates
+// are looked up per handshake, so reloads apply without a restart.
+func ServerTlsConfig() *tls.Config {
+	if _, material := getTlsState(); material == nil {
+		return nil
+	}
+
+	serverConfig := func() *tls.Config {
+		config, material := getTlsState()
+		tlsConfig := &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{*material.cert},
+		}
+		if material.clientCa != nil {
+			tlsConfig.ClientCAs = material.clientCa
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if config.RequireClientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return tlsConfig
+	}
+
+	tlsConfig := serverConfig()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return serverConfig(), nil
+	}
+	return tlsConfig
+}
+
+// The TLS config for calls to other nodes. It presents this node's certificate
+// and trusts the client CA, so nodes sharing a CA authenticate each other.
+func ClientTlsConfig() *tls.Config {
+	_, material := getTlsState()
+	if material == nil {
+		return nil
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    material.clientCa,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, material := getTlsState()
+			return material.cert, nil
+		},
+	}
+}
+
+// Set on requests authenticated with a client certificate
+const clientCertKey = "clientCert"
+
+// Whether a request was authenticated with a client certificate
+func requestUsedClientCert(c *gin.Context) bool {
+	_, ok := c.Get(clientCertKey)
+	return ok
+}
+
+// The user a verified client certificate maps to, if any
+func clientCertUser(c *gin.Context) (string, bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	config, _ := getTlsState()
+	cert := c.Request.TLS.VerifiedChains[0][0]
+
+	if username, ok := config.ClientCertUsers[cert.Subject.String()]; ok {
+		return username, true
+	}
+	if config.MapCommonName && cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, true
+	}
+	return "", false
+}
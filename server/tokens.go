@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	jwt "github.com/dgrijalva/jwt-go"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"time"
+)
+
+var accessTokenLifetime = 15 * time.Minute
+var refreshTokenLifetime = 30 * 24 * time.Hour
+
+var ErrRefreshTokenInvalid = errors.New("Refresh token invalid")
+var ErrRefreshTokenReused = errors.New("Refresh token reused")
+
+func SetTokenLifetimes(access time.Duration, refresh time.Duration) {
+	accessTokenLifetime = access
+	refreshTokenLifetime = refresh
+}
+
+// Signs a short-lived access token for a user with the active signing key
+func issueAccessToken(username string) (string, error) {
+	return issueUserToken(username, "", accessTokenLifetime)
+}
+
+// Signs a token for a user. Tokens with an audience are only accepted by the
+// steps that ask for it, never as access tokens.
+func issueUserToken(username string, audience string, lifetime time.Duration) (string, error) {
+	signingKey, err := GetSigningKey()
+	if err != nil {
+		return "", err
+	}
+	jti, err := randomId()
+	if err != nil {
+		return "", err
+	}
+
+	issuedAt := time.Now()
+	claims := &ConciergeTokenClaims{
+		username,
+		issuedAt.UnixNano() / int64(time.Microsecond),
+		jwt.StandardClaims{
+			Id:        jti,
+			Audience:  audience,
+			ExpiresAt: issuedAt.Add(lifetime).Unix(),
+			IssuedAt:  issuedAt.Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(signingKey.Method, claims)
+	token.Header["kid"] = signingKey.Kid
+	return token.SignedString(signingKey.Key)
+}
+
+// A random token that is only ever stored hashed, for refresh and reset tokens
+func newOpaqueToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Opaque tokens carry 256 random bits, so a plain SHA-256 is enough to keep
+// the stored hashes useless to anyone reading the table
+func hashOpaqueToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Stores and returns a new refresh token. An empty family starts a new one.
+func issueRefreshToken(ex conciergedb.Querier, uid int, family string) (string, error) {
+	var err error
+
+	if family == "" {
+		if family, err = randomId(); err != nil {
+			return "", err
+		}
+	}
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.RefreshTokens + `
+          (token_hash, family, uid, date_created, date_expires)
+        VALUES ($1, $2, $3, now(), now() + $4 * interval '1 second')
+        `
+	_, err = ex.Exec(
+		queryStr,
+		hashOpaqueToken(refreshToken),
+		family,
+		uid,
+		int64(refreshTokenLifetime/time.Second),
+	)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// Trades a refresh token for a new one in the same family. Each refresh token
+// is single use; presenting a used one means it was stolen or replayed, and
+// revokes every token in its family.
+func rotateRefreshToken(username string, refreshToken string) (string, error) {
+	var rtid, uid int
+	var family string
+	var used, revoked, expired bool
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	queryStr := `
+        SELECT rt.rtid, rt.uid, rt.family, rt.used, rt.revoked, rt.date_expires < now()
+        FROM ` +
+		conciergedb.ConciergeTables.RefreshTokens + ` rt
+        JOIN ` + conciergedb.ConciergeTables.Users + ` u ON u.uid = rt.uid
+        WHERE rt.token_hash = $1 AND u.username = $2
+        FOR UPDATE OF rt
+        `
+	err = tx.QueryRow(queryStr, hashOpaqueToken(refreshToken), username).Scan(
+		&rtid, &uid, &family, &used, &revoked, &expired,
+	)
+	if err == sql.ErrNoRows {
+		return "", ErrRefreshTokenInvalid
+	} else if err != nil {
+		return "", err
+	}
+
+	if used && !revoked {
+		if err = revokeRefreshFamily(tx, family); err != nil {
+			return "", err
+		}
+		if err = tx.Commit(); err != nil {
+			return "", err
+		}
+		return "", ErrRefreshTokenReused
+	}
+	if revoked || expired {
+		return "", ErrRefreshTokenInvalid
+	}
+
+	queryStr = `
+        UPDATE ` +
+		conciergedb.ConciergeTables.RefreshTokens + `
+        SET used = true
+        WHERE rtid = $1
+        `
+	if _, err = tx.Exec(queryStr, rtid); err != nil {
+		return "", err
+	}
+	newRefreshToken, err := issueRefreshToken(tx, uid, family)
+	if err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	return newRefreshToken, nil
+}
+
+func revokeRefreshFamily(ex conciergedb.Querier, family string) error {
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.RefreshTokens + `
+        SET revoked = true
+        WHERE family = $1
+        `
+	_, err := ex.Exec(queryStr, family)
+	return err
+}
+
+// Revokes the family of a refresh token, if it belongs to the user
+func revokeRefreshToken(username string, refreshToken string) error {
+	db = GetDb()
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.RefreshTokens + ` rt
+        SET revoked = true
+        FROM ` + conciergedb.ConciergeTables.Users + ` u
+        WHERE u.uid = rt.uid AND u.username = $2 AND rt.family = (
+          SELECT family FROM ` + conciergedb.ConciergeTables.RefreshTokens + `
+          WHERE token_hash = $1
+        )
+        `
+	_, err := db.Exec(queryStr, hashOpaqueToken(refreshToken), username)
+	return err
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"strings"
+	"time"
+)
+
+// Audience of the token Signin gives users who still owe a second factor
+const signinChallengeAudience = "signin-totp"
+
+// Audience of the token Signin gives users who must enroll before signing in
+const totpEnrollmentAudience = "totp-enroll"
+
+const totpPeriod = 30
+
+// Codes from one period either side of now are accepted, for clock drift
+const totpSkew = 1
+
+const recoveryCodeCount = 10
+
+var signinChallengeLifetime = 5 * time.Minute
+
+var totpIssuer = "netrun"
+
+// When set, users holding the admin role in any group must use 2FA
+var requireAdminTwoFactor bool
+
+var ErrTotpEnrolled = errors.New("Two-factor authentication already enabled")
+var ErrTotpNotEnrolled = errors.New("Two-factor authentication not enabled")
+
+var totpOpts = totp.ValidateOpts{
+	Period:    totpPeriod,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+func SetTotpIssuer(issuer string) {
+	totpIssuer = issuer
+}
+
+func SetRequireAdminTwoFactor(require bool) {
+	requireAdminTwoFactor = require
+}
+
+func GetRequireAdminTwoFactor() bool {
+	return requireAdminTwoFactor
+}
+
+func totpAdditionalData(uid int) []byte {
+	return []byte(fmt.Sprintf("totp/%d", uid))
+}
+
+// Whether the user has confirmed a TOTP enrollment
+func isTotpEnabled(uid int) (bool, error) {
+	var enabled bool
+	db = GetDb()
+
+	queryStr := `
+        SELECT ut.enabled
+        FROM ` +
+		conciergedb.ConciergeTables.UserTotp + ` ut
+        WHERE ut.uid = $1
+        `
+	err := db.QueryRow(queryStr, uid).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Whether policy makes the user enroll before they may sign in
+func mustEnrollTotp(username string) (bool, error) {
+	var isAdmin bool
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	if !GetRequireAdminTwoFactor() {
+		return false, nil
+	}
+	go conciergedb.IsAdminInAnyGroup(username, db, errorChan, &isAdmin)
+	if err := <-errorChan; err != nil {
+		return false, err
+	}
+	return isAdmin, nil
+}
+
+// Stores a new pending TOTP secret, replacing any earlier pending one. It
+// only takes effect once confirmed with a code from the authenticator.
+func beginTotpEnrollment(uid int, username string) (*otp.Key, error) {
+	db = GetDb()
+
+	enabled, err := isTotpEnabled(uid)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTotpEnrolled
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: username,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := sealWithMasterKey([]byte(key.Secret()), totpAdditionalData(uid))
+	if err != nil {
+		return nil, err
+	}
+
+	queryStr := `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.UserTotp + `
+          (uid, ciphertext, enabled, last_counter, date_created)
+        VALUES ($1, $2, false, 0, now())
+        ON CONFLICT (uid) DO UPDATE
+        SET ciphertext = EXCLUDED.ciphertext, last_counter = 0, date_created = now()
+        WHERE NOT ` + conciergedb.ConciergeTables.UserTotp + `.enabled
+        `
+	if _, err = db.Exec(queryStr, uid, ciphertext); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Checks a TOTP code against the pending or the enabled secret of a user.
+// Each time step is only accepted once, so an observed code cannot be
+// replayed.
+func checkTotpCode(uid int, code string, enabled bool) (bool, error) {
+	var ciphertext []byte
+	var lastCounter int64
+	db = GetDb()
+
+	queryStr := `
+        SELECT ut.ciphertext, ut.last_counter
+        FROM ` +
+		conciergedb.ConciergeTables.UserTotp + ` ut
+        WHERE ut.uid = $1 AND ut.enabled = $2
+        `
+	err := db.QueryRow(queryStr, uid, enabled).Scan(&ciphertext, &lastCounter)
+	if err == sql.ErrNoRows {
+		if enabled {
+			return false, ErrTotpNotEnrolled
+		}
+		return false, errors.New("No pending two-factor enrollment")
+	} else if err != nil {
+		return false, err
+	}
+	secret, err := openWithMasterKey(ciphertext, totpAdditionalData(uid))
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		at := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		counter := at.Unix() / totpPeriod
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(string(secret), at, totpOpts)
+		if err != nil {
+			return false, err
+		}
+		if expected != strings.TrimSpace(code) {
+			continue
+		}
+
+		queryStr = `
+            UPDATE ` +
+			conciergedb.ConciergeTables.UserTotp + `
+            SET last_counter = $1
+            WHERE uid = $2 AND last_counter < $1
+            `
+		res, err := db.Exec(queryStr, counter, uid)
+		if err != nil {
+			return false, err
+		}
+		rows, _ := res.RowsAffected()
+		return rows == 1, nil
+	}
+	return false, nil
+}
+
+// Enables a pending enrollment once the user proves their authenticator has
+// the secret, and returns fresh recovery codes
+func confirmTotpEnrollment(uid int, code string) ([]string, error) {
+	db = GetDb()
+
+	ok, err := checkTotpCode(uid, code, false)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.UserTotp + `
+        SET enabled = true
+        WHERE uid = $1
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return nil, err
+	}
+	recoveryCodes, err := replaceRecoveryCodes(tx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// Replaces all recovery codes of a user. Codes are 80 random bits, shown once
+// as four dash separated groups and stored hashed.
+func replaceRecoveryCodes(ex conciergedb.Querier, uid int) ([]string, error) {
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.TotpRecoveryCodes + `
+        WHERE uid = $1
+        `
+	if _, err := ex.Exec(queryStr, uid); err != nil {
+		return nil, err
+	}
+
+	queryStr = `
+        INSERT INTO ` +
+		conciergedb.ConciergeTables.TotpRecoveryCodes + `
+          (uid, code_hash)
+        VALUES ($1, $2)
+        `
+	recoveryCodes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(raw)
+		recoveryCodes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		if _, err := ex.Exec(queryStr, uid, hashOpaqueToken(code)); err != nil {
+			return nil, err
+		}
+	}
+	return recoveryCodes, nil
+}
+
+// Accepts a TOTP code or an unused recovery code, which is then used up
+func verifySecondFactor(uid int, code string) (bool, error) {
+	db = GetDb()
+
+	ok, err := checkTotpCode(uid, code, true)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	queryStr := `
+        UPDATE ` +
+		conciergedb.ConciergeTables.TotpRecoveryCodes + `
+        SET used = true
+        WHERE uid = $1 AND code_hash = $2 AND NOT used
+        `
+	res, err := db.Exec(queryStr, uid, hashOpaqueToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	rows, _ := res.RowsAffected()
+	return rows == 1, nil
+}
+
+func regenerateRecoveryCodes(uid int) ([]string, error) {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	recoveryCodes, err := replaceRecoveryCodes(tx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+func disableTotp(uid int) error {
+	db = GetDb()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queryStr := `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.UserTotp + `
+        WHERE uid = $1
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return err
+	}
+	queryStr = `
+        DELETE FROM ` +
+		conciergedb.ConciergeTables.TotpRecoveryCodes + `
+        WHERE uid = $1
+        `
+	if _, err = tx.Exec(queryStr, uid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
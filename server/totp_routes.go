@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
+	"image/png"
+	"net/http"
+)
+
+type TotpBody struct {
+	Code string `json:"code"`
+}
+
+type SigninTotpBody struct {
+	User           string `json:"user"`
+	ChallengeToken string `json:"challengetoken"`
+	Code           string `json:"code"`
+}
+
+type TotpEnrollmentRes struct {
+	Secret string `json:"secret"`
+	// otpauth:// provisioning URI, and the same as a base64 PNG QR code
+	Uri    string `json:"uri"`
+	QrCode string `json:"qrcode"`
+}
+
+type TotpRecoveryCodesRes struct {
+	RecoveryCodes []string `json:"recoverycodes"`
+}
+
+// The uid of the user VerifyToken authenticated
+func tokenUid(c *gin.Context) (int, error) {
+	var uid int
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetUid(requestUser(c), db, errorChan, &uid)
+	err := <-errorChan
+	return uid, err
+}
+
+func EnrollTotp(c *gin.Context) {
+	var totpBody TotpBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&totpBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	key, err := beginTotpEnrollment(uid, requestUser(c))
+	if err == ErrTotpEnrolled {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error enrolling in two-factor authentication"})
+		return
+	}
+
+	var qrCode bytes.Buffer
+	image, err := key.Image(256, 256)
+	if err == nil {
+		err = png.Encode(&qrCode, image)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error enrolling in two-factor authentication"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, TotpEnrollmentRes{
+		Secret: key.Secret(),
+		Uri:    key.URL(),
+		QrCode: base64.StdEncoding.EncodeToString(qrCode.Bytes()),
+	})
+}
+
+// Enables 2FA with a code from the newly enrolled authenticator. The recovery
+// codes are only ever shown here and on regeneration.
+func ConfirmTotp(c *gin.Context) {
+	var totpBody TotpBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&totpBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	recoveryCodes, err := confirmTotpEnrollment(uid, totpBody.Code)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	} else if recoveryCodes == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Two-factor code invalid"})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditTotpEnable,
+		Target:  requestUser(c),
+		Outcome: AuditSuccess,
+	})
+	c.SecureJSON(http.StatusOK, TotpRecoveryCodesRes{RecoveryCodes: recoveryCodes})
+}
+
+func DisableTotp(c *gin.Context) {
+	var totpBody TotpBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&totpBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	if mustEnroll, err := mustEnrollTotp(requestUser(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error disabling two-factor authentication"})
+		return
+	} else if mustEnroll {
+		c.JSON(http.StatusForbidden, gin.H{"status": "Two-factor authentication is required for admins"})
+		return
+	}
+
+	ok, err := verifySecondFactor(uid, totpBody.Code)
+	if err == ErrTotpNotEnrolled {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error disabling two-factor authentication"})
+		return
+	} else if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Two-factor code invalid"})
+		return
+	}
+
+	if err = disableTotp(uid); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error disabling two-factor authentication"})
+		return
+	}
+
+	auditRequest(c, AuditEntry{
+		Action:  AuditTotpDisable,
+		Target:  requestUser(c),
+		Outcome: AuditSuccess,
+	})
+	c.String(http.StatusOK, "Two-factor authentication disabled successfully")
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var totpBody TotpBody
+	var err error
+
+	if err = c.ShouldBindBodyWith(&totpBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer auditResponse(c, AuditEntry{
+		Action: AuditRecoveryCodesRegenerate,
+		Target: requestUser(c),
+	})
+	uid, err := tokenUid(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	ok, err := verifySecondFactor(uid, totpBody.Code)
+	if err == ErrTotpNotEnrolled {
+		c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error regenerating recovery codes"})
+		return
+	} else if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Two-factor code invalid"})
+		return
+	}
+
+	recoveryCodes, err := regenerateRecoveryCodes(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error regenerating recovery codes"})
+		return
+	}
+
+	c.SecureJSON(http.StatusOK, TotpRecoveryCodesRes{RecoveryCodes: recoveryCodes})
+}
+
+// Second step of Signin for users with 2FA, taking the challenge token the
+// password step returned and a TOTP or recovery code
+func SigninTotp(c *gin.Context) {
+	var signinTotpBody SigninTotpBody
+	var uid int
+	var err error
+	errorChan := make(chan error)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	if err = c.ShouldBindBodyWith(&signinTotpBody, binding.JSON); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if loginThrottled(c, signinTotpBody.User) {
+		return
+	}
+
+	parsedToken, err := parseToken(signinTotpBody.ChallengeToken, &ConciergeTokenClaims{})
+	if err != nil || !parsedToken.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Challenge token invalid"})
+		return
+	}
+	claims, ok := parsedToken.Claims.(*ConciergeTokenClaims)
+	if !ok ||
+		claims.Audience != signinChallengeAudience ||
+		claims.User != signinTotpBody.User {
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Challenge token invalid"})
+		return
+	}
+
+	go conciergedb.GetUid(claims.User, db, errorChan, &uid)
+	if err = <-errorChan; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
+		return
+	}
+
+	ok, err = verifySecondFactor(uid, signinTotpBody.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "Error authenticating user"})
+		return
+	} else if !ok {
+		if err = recordLoginFailure(c, claims.User); err != nil {
+			Logger.Error("Error recording failed sign in", zap.String("error", err.Error()))
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"status": "Two-factor code invalid"})
+		return
+	}
+
+	completeSignin(c, claims.User, uid)
+}
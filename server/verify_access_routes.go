@@ -5,15 +5,27 @@ import (
 	"fmt"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"io"
 	//"github.com/lib/pq"
 	"net/http"
 	"strings"
 	//"time"
 )
 
+// Context key VerifyToken stores the verified *ConciergeTokenClaims under
+const tokenClaimsKey = "tokenClaims"
+
+// Context key the roles of the user in a group are cached under
+const groupRolesKey = "groupRoles"
+
 type ConciergeTokenClaims struct {
 	User string `json:"user"`
+	// When the token was issued, in microseconds since the epoch. iat only
+	// has seconds, too coarse to tell tokens issued just before revoking all
+	// sessions from those issued just after.
+	IssuedAtUs int64 `json:"iatus,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -21,31 +33,94 @@ type AuthCheck struct {
 	Token string `header:"authorization"`
 }
 
+// Bodies may still name the user, but only the user the token is for
 type UserCheck struct {
-	User string `json:user`
+	User string `json:"user"`
 }
 
 type RolesCheck struct {
-	Roles []string `json:roles`
+	Roles []string `json:"roles"`
 }
 
 type GroupCheck struct {
-	User  string `json:user`
-	Group string `json:group`
+	Group string `json:"group"`
+}
+
+type ParentCheck struct {
+	Parent string `json:"parent"`
+}
+
+type TargetCheck struct {
+	Target string `json:"target"`
+}
+
+// The user VerifyToken authenticated
+func requestUser(c *gin.Context) string {
+	return c.MustGet(tokenClaimsKey).(*ConciergeTokenClaims).User
+}
+
+type groupRoles struct {
+	group string
+	roles []string
 }
 
-type RoleCheck struct {
-	User  string `json:user`
-	Group string `json:group`
-	Role  string `json:group`
+// The roles the authenticated user holds in a group, looked up once per
+// request. Non-members hold none.
+func requestGroupRoles(c *gin.Context, group string) ([]string, error) {
+	if cached, ok := c.Get(groupRolesKey); ok && cached.(*groupRoles).group == group {
+		return cached.(*groupRoles).roles, nil
+	}
+
+	var roles []string
+	errorChan := make(chan error, 1)
+	db = GetDb()
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	go conciergedb.GetUserRoles(requestUser(c), group, db, errorChan, &roles)
+	if err := <-errorChan; err != nil {
+		return nil, err
+	}
+	c.Set(groupRolesKey, &groupRoles{group: group, roles: roles})
+	return roles, nil
 }
 
-type AdminCheck struct {
-	User  string `json:user`
-	Group string `json:group`
+// Whether the authenticated user holds the role in the group
+func requestHasRole(c *gin.Context, group string, role string) (bool, error) {
+	roles, err := requestGroupRoles(c, group)
+	if err != nil {
+		return false, err
+	}
+	for _, held := range roles {
+		if held == role {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
+// Accepts access tokens and API keys
 func VerifyToken() gin.HandlerFunc {
+	return verifyTokenFor(true, "")
+}
+
+// Accepts access tokens only, for routes that manage the account itself, so a
+// leaked API key cannot be used to mint more keys or change credentials
+func VerifySessionToken() gin.HandlerFunc {
+	return verifyTokenFor(false, "")
+}
+
+// Like VerifySessionToken, but also accepts the restricted token users who
+// must enroll in two-factor authentication get from Signin
+func VerifyEnrollmentToken() gin.HandlerFunc {
+	return verifyTokenFor(false, "", totpEnrollmentAudience)
+}
+
+// Verifies the bearer token of a request, accepting only the given audiences.
+// An empty audience is a regular access token.
+func verifyTokenFor(allowApiKeys bool, audiences ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var authCheck AuthCheck
 		var userCheck UserCheck
@@ -53,57 +128,114 @@ func VerifyToken() gin.HandlerFunc {
 		var parsedToken *jwt.Token
 
 		if err = c.ShouldBindHeader(&authCheck); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if err = c.ShouldBindJSON(&userCheck); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		// The identity comes from the token, so bodies need not name the user
+		if err = c.ShouldBindBodyWith(&userCheck, binding.JSON); err != nil && err != io.EOF {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
+		// Machine clients may authenticate with a client certificate instead of
+		// a token. Like API keys, certificates do not manage accounts.
+		if authCheck.Token == "" && allowApiKeys {
+			if username, ok := clientCertUser(c); ok {
+				if userCheck.User != "" && userCheck.User != username {
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Client certificate invalid for provided user"})
+					return
+				}
+				c.Set(tokenClaimsKey, &ConciergeTokenClaims{User: username})
+				c.Set(clientCertKey, true)
+				c.Next()
+				return
+			}
+		}
+
 		token := authCheck.Token
 		bearerPrefix := "Bearer "
 		if strings.HasPrefix(token, bearerPrefix) {
 			token = strings.TrimPrefix(token, bearerPrefix)
 		}
-		parsedToken, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-			secret := GetJwtSecret()
-			return secret, nil
-		})
-
-		if ve, ok := err.(*jwt.ValidationError); ok {
-			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-				c.JSON(http.StatusBadRequest, gin.H{"status": "Authentication token malformed"})
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			if !allowApiKeys {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "API keys cannot be used here"})
 				return
-			} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-				c.JSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
+			}
+			username, scope, err := authenticateApiKey(token)
+			if err == ErrApiKeyInvalid {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
 				return
-			} else {
-				c.JSON(
+			} else if err != nil {
+				c.AbortWithStatusJSON(
 					http.StatusInternalServerError,
 					gin.H{"status": "Could not handle authentication token"},
 				)
 				return
+			} else if userCheck.User != "" && userCheck.User != username {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid for provided user"})
+				return
 			}
-		} else if !parsedToken.Valid {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "Could not handle authentication token"})
+
+			c.Set(tokenClaimsKey, &ConciergeTokenClaims{User: username})
+			c.Set(apiKeyScopeKey, scope)
+			c.Next()
+			return
+		}
+
+		parsedToken, err = parseToken(token, &ConciergeTokenClaims{})
+
+		if ve, ok := err.(*jwt.ValidationError); ok {
+			if ve.Errors&jwt.ValidationErrorMalformed != 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "Authentication token malformed"})
+				return
+			} else {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
+				return
+			}
+		} else if err != nil || !parsedToken.Valid {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
 			return
 		}
 
 		parsedTokenClaims, ok := parsedToken.Claims.(*ConciergeTokenClaims)
 
 		if !(ok && parsedToken.Valid) {
-			c.JSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
+			return
+		} else if userCheck.User != "" && userCheck.User != parsedTokenClaims.User {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid for provided user"})
+			return
+		}
+
+		// Tokens for other purposes, like email verification, carry an audience
+		audienceOk := false
+		for _, audience := range audiences {
+			audienceOk = audienceOk || parsedTokenClaims.Audience == audience
+		}
+		if parsedTokenClaims.Id == "" || !audienceOk {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid"})
+			return
+		}
+		revoked, err := isTokenRevoked(parsedTokenClaims)
+		if err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				gin.H{"status": "Could not handle authentication token"},
+			)
 			return
-		} else if userCheck.User != parsedTokenClaims.User {
-			c.JSON(http.StatusUnauthorized, gin.H{"status": "Authentication token invalid for provided user"})
+		} else if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "Authentication token revoked"})
 			return
 		}
 
+		c.Set(tokenClaimsKey, parsedTokenClaims)
+
 		c.Next()
 	}
 }
 
+// Rejects requests naming roles that do not exist, or no roles at all
 func CheckRolesExist() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var res *sql.Rows
@@ -111,34 +243,37 @@ func CheckRolesExist() gin.HandlerFunc {
 		var queryStr string
 		var rolesList RolesCheck
 		var currRole string
-		var foundRole bool
 		db = GetDb()
 
-		if err = c.ShouldBindJSON(&rolesList); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if err = c.ShouldBindBodyWith(&rolesList, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rolesList.Roles) == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "No roles given"})
 			return
 		}
 
 		queryStr = `SELECT name FROM ` + conciergedb.ConciergeTables.Roles
 		res, err = db.Query(queryStr)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"status": "Error finding roles"})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error finding roles"})
 			return
 		}
+		defer res.Close()
+
+		existingRoles := map[string]bool{}
 		for res.Next() {
 			if err = res.Scan(&currRole); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"status": "Error checking roles"})
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking roles"})
 				return
 			}
-			foundRole = false
-			for _, n := range rolesList.Roles {
-				if currRole == n {
-					foundRole = true
-				}
-			}
-			if !foundRole {
-				errStr := fmt.Sprintf("Role %s not found", currRole)
-				c.JSON(http.StatusBadRequest, gin.H{"status": errStr})
+			existingRoles[currRole] = true
+		}
+		for _, n := range rolesList.Roles {
+			if !existingRoles[n] {
+				errStr := fmt.Sprintf("Role %s not found", n)
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": errStr})
 				return
 			}
 		}
@@ -147,29 +282,57 @@ func CheckRolesExist() gin.HandlerFunc {
 	}
 }
 
-func CheckGroup() gin.HandlerFunc {
+// Requires the authenticated user to be in the body group, and an API key
+// scoped to it that holds permission, one of r, w or x
+func CheckGroup(permission string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var groupCheck GroupCheck
 		var isInGroup bool
-		var err error
 		db = GetDb()
 
-		if err = c.ShouldBindJSON(&groupCheck); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
 		errorChan := make(chan error, 1)
 
 		defer func() {
 			close(errorChan)
 		}()
 
-		go conciergedb.IsInGroup(groupCheck.User, groupCheck.Group, db, errorChan, &isInGroup)
-		err = <-errorChan
+		if err := c.ShouldBindBodyWith(&groupCheck, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkApiKeyScope(c, groupCheck.Group, "", permission) {
+			return
+		}
+
+		user := requestUser(c)
+		go conciergedb.IsInGroup(user, groupCheck.Group, db, errorChan, &isInGroup)
+		if err := <-errorChan; err != nil || !isInGroup {
+			errStr := fmt.Sprintf("User %s not in group %s", user, groupCheck.Group)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": errStr})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Requires the authenticated user to hold the role in the body group
+func CheckRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var groupCheck GroupCheck
+
+		if err := c.ShouldBindBodyWith(&groupCheck, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		hasRole, err := requestHasRole(c, groupCheck.Group, role)
 		if err != nil {
-			errStr := fmt.Sprintf("User %s not in group %s", groupCheck.User, groupCheck.Group)
-			c.JSON(http.StatusBadRequest, gin.H{"status": errStr})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking roles"})
+			return
+		} else if !hasRole {
+			errStr := fmt.Sprintf("User %s not role %s in group %s", requestUser(c), role, groupCheck.Group)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": errStr})
 			return
 		}
 
@@ -177,39 +340,119 @@ func CheckGroup() gin.HandlerFunc {
 	}
 }
 
-func CheckRole() gin.HandlerFunc {
+// Aborts requests authenticated with an API key or a client certificate,
+// which do not manage accounts or groups
+func refuseMachineCredentials(c *gin.Context) bool {
+	if _, ok := requestApiKeyScope(c); ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "API keys cannot be used for admin routes"})
+		return false
+	}
+	if requestUsedClientCert(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Client certificates cannot be used for admin routes"})
+		return false
+	}
+	return true
+}
+
+// Like CheckRole for the admin role, but refusing API keys and client
+// certificates
+func IsAdmin() gin.HandlerFunc {
+	checkAdmin := CheckRole(conciergedb.InitConciergeRoles.Admin)
 	return func(c *gin.Context) {
-		var roleCheck RoleCheck
-		var validRole bool
-		var err error
-		db = GetDb()
+		if !refuseMachineCredentials(c) {
+			return
+		}
 
-		errorChan := make(chan error, 1)
+		checkAdmin(c)
+	}
+}
 
-		defer func() {
-			close(errorChan)
-		}()
+// Like IsAdmin, but for the site group regardless of the group in the request
+func IsSiteAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !refuseMachineCredentials(c) {
+			return
+		}
 
-		if err = c.ShouldBindJSON(&roleCheck); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		isAdmin, err := requestHasRole(c, conciergedb.InitConciergeGroups.Site, conciergedb.InitConciergeRoles.Admin)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking roles"})
+			return
+		} else if !isAdmin {
+			errStr := fmt.Sprintf(
+				"User %s not %s in group %s",
+				requestUser(c),
+				conciergedb.InitConciergeRoles.Admin,
+				conciergedb.InitConciergeGroups.Site,
+			)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": errStr})
 			return
 		}
 
-		go conciergedb.IsRole(
-			roleCheck.User,
-			roleCheck.Group,
-			roleCheck.Role,
+		c.Next()
+	}
+}
+
+// Aborts the request unless the authenticated user is an admin of the group,
+// of a group above it, or of site
+func requireGroupAdmin(c *gin.Context, group string) bool {
+	var isGroupAdmin bool
+	user := requestUser(c)
+	db = GetDb()
+
+	errorChan := make(chan error, 1)
+
+	defer func() {
+		close(errorChan)
+	}()
+
+	if !refuseMachineCredentials(c) {
+		return false
+	}
+
+	isSiteAdmin, err := requestHasRole(c, conciergedb.InitConciergeGroups.Site, conciergedb.InitConciergeRoles.Admin)
+	if err == nil && !isSiteAdmin {
+		go conciergedb.IsInheritedRole(
+			user,
+			group,
+			conciergedb.InitConciergeRoles.Admin,
 			db,
 			errorChan,
-			&validRole,
+			&isGroupAdmin,
 		)
 		err = <-errorChan
-		if err != nil {
-			errStr := fmt.Sprintf(
-				"User %s not role %s in group %s",
-				roleCheck.User, roleCheck.Role, roleCheck.Group,
-			)
-			c.JSON(http.StatusBadRequest, gin.H{"status": errStr})
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking roles"})
+		return false
+	}
+	if !isGroupAdmin && !isSiteAdmin {
+		errStr := fmt.Sprintf(
+			"User %s not %s in group %s, its parents or %s",
+			user,
+			conciergedb.InitConciergeRoles.Admin,
+			group,
+			conciergedb.InitConciergeGroups.Site,
+		)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": errStr})
+		return false
+	}
+
+	return true
+}
+
+// Like IsAdmin, but admins of groups above the group pass too, as do site
+// admins for any group, so they can manage groups that have no admin of their
+// own yet
+func IsGroupAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var groupCheck GroupCheck
+
+		if err := c.ShouldBindBodyWith(&groupCheck, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !requireGroupAdmin(c, groupCheck.Group) {
 			return
 		}
 
@@ -217,39 +460,74 @@ func CheckRole() gin.HandlerFunc {
 	}
 }
 
-func IsAdmin() gin.HandlerFunc {
+// Like IsGroupAdmin, for the parent group a route puts a group under. With no
+// parent the group goes to the top, which only site admins may do.
+func IsParentGroupAdmin() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var adminCheck AdminCheck
-		var isAdmin bool
-		var err error
+		var parentCheck ParentCheck
+
+		if err := c.ShouldBindBodyWith(&parentCheck, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		parent := parentCheck.Parent
+		if parent == "" {
+			parent = conciergedb.InitConciergeGroups.Site
+		}
+		if !requireGroupAdmin(c, parent) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Lets users act on themselves, and otherwise requires IsGroupAdmin. The
+// target is the body's target, or the authenticated user when it is empty.
+func IsSelfOrGroupAdmin() gin.HandlerFunc {
+	isGroupAdmin := IsGroupAdmin()
+	return func(c *gin.Context) {
+		var targetCheck TargetCheck
+
+		if err := c.ShouldBindBodyWith(&targetCheck, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if targetCheck.Target == "" || targetCheck.Target == requestUser(c) {
+			c.Next()
+			return
+		}
+
+		isGroupAdmin(c)
+	}
+}
+
+// Blocks users who have not verified their email, when SetRequireVerifiedEmail
+// is on
+func RequireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var email string
+		var emailVerified bool
 		db = GetDb()
 
+		if !GetRequireVerifiedEmail() {
+			c.Next()
+			return
+		}
+
 		errorChan := make(chan error, 1)
 
 		defer func() {
 			close(errorChan)
 		}()
 
-		if err = c.ShouldBindJSON(&adminCheck); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		go conciergedb.GetUserEmail(requestUser(c), db, errorChan, &email, &emailVerified)
+		if err := <-errorChan; err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "Cannot find user"})
 			return
 		}
-
-		go conciergedb.IsRole(
-			adminCheck.User,
-			adminCheck.Group,
-			conciergedb.InitConciergeRoles.Admin,
-			db,
-			errorChan,
-			&isAdmin,
-		)
-		err = <-errorChan
-		if err != nil {
-			errStr := fmt.Sprintf(
-				"User %s not %s in group %s",
-				adminCheck.User, conciergedb.InitConciergeRoles.Admin, adminCheck.Group,
-			)
-			c.JSON(http.StatusBadRequest, gin.H{"status": errStr})
+		if !emailVerified {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "Email not verified"})
 			return
 		}
 
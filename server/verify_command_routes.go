@@ -2,57 +2,70 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	conciergedb "github.com/ingenierias-lentas/netrun/db"
+	"go.uber.org/zap"
 	"net/http"
+	"time"
 )
 
 type CommandVerification struct {
-	User    string `json:user`
-	Group   string `json:group`
-	Role    string `json:role`
-	Process string `json:process`
+	Group   string `json:"group"`
+	Process string `json:"process"`
 }
 
-func evalPermission(c *gin.Context, permissionStr string, errorStr string) error {
-	errorChan := make(chan error, 1)
-	db = GetDb()
-	defer func() {
-		close(errorChan)
-	}()
-
-	var canDo bool
-
-	var err error = nil
+// Aborts the request unless the authorizer allows the authenticated user the
+// permission on the process in the group
+func evalPermission(c *gin.Context, permissionStr string, errorStr string) bool {
 	var cmdver CommandVerification
 
-	if err = c.ShouldBindJSON(&cmdver); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return err
+	if err := c.ShouldBindBodyWith(&cmdver, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
 	}
-	go conciergedb.HasPermission(
-		cmdver.User,
-		cmdver.Group,
-		cmdver.Role,
-		cmdver.Process,
-		permissionStr,
-		db,
-		errorChan,
-		&canDo,
-	)
-	err = <-errorChan
-	if err != nil || canDo == false {
-		c.JSON(http.StatusUnauthorized, gin.H{"status": errorStr})
-		return err
+	allowed, err := GetAuthorizer().Authorize(AuthzRequest{
+		User:       requestUser(c),
+		Group:      cmdver.Group,
+		Process:    cmdver.Process,
+		Permission: permissionStr,
+		Time:       time.Now(),
+	})
+	if err != nil {
+		Logger.Error("Error checking permissions", zap.String("error", err.Error()))
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking permissions"})
+		return false
 	}
+	if !allowed {
+		auditRequest(c, AuditEntry{
+			Action:  AuditPermissionDenied,
+			Target:  cmdver.Process + ":" + permissionStr,
+			Group:   cmdver.Group,
+			Outcome: AuditDenied,
+		})
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": errorStr})
+		return false
+	}
+
+	return true
+}
+
+// Checks the command and permission against the scope of an API key
+func checkCommandScope(c *gin.Context, permissionStr string) bool {
+	var cmdver CommandVerification
 
-	return nil
+	if err := c.ShouldBindBodyWith(&cmdver, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return checkApiKeyScope(c, cmdver.Group, cmdver.Process, permissionStr)
 }
 
 func CanExecute() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// create copy of context for usage in goroutines
-		cCopy := c.Copy()
-		if err := evalPermission(cCopy, "x", "Need execute permission"); err != nil {
+		if !checkCommandScope(c, "x") {
+			return
+		}
+		if !evalPermission(c, "x", "Need execute permission") {
 			return
 		}
 		c.Next()
@@ -61,8 +74,10 @@ func CanExecute() gin.HandlerFunc {
 
 func CanWrite() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		cCopy := c.Copy()
-		if err := evalPermission(cCopy, "w", "Need write permission"); err != nil {
+		if !checkCommandScope(c, "w") {
+			return
+		}
+		if !evalPermission(c, "w", "Need write permission") {
 			return
 		}
 		c.Next()
@@ -71,10 +86,140 @@ func CanWrite() gin.HandlerFunc {
 
 func CanRead() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		cCopy := c.Copy()
-		if err := evalPermission(cCopy, "r", "Need read permission"); err != nil {
+		if !checkCommandScope(c, "r") {
+			return
+		}
+		if !evalPermission(c, "r", "Need read permission") {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Requires write permission on the process in the group a grant is made in,
+// or being an admin of that group. Write permission in one group does not let
+// a user hand out permissions in another.
+func CanManageGrants() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var cmdver CommandVerification
+
+		if err := c.ShouldBindBodyWith(&cmdver, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkApiKeyScope(c, cmdver.Group, cmdver.Process, "w") {
+			return
+		}
+		allowed, err := GetAuthorizer().Authorize(AuthzRequest{
+			User:       requestUser(c),
+			Group:      cmdver.Group,
+			Process:    cmdver.Process,
+			Permission: "w",
+			Time:       time.Now(),
+		})
+		if err != nil {
+			Logger.Error("Error checking permissions", zap.String("error", err.Error()))
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking permissions"})
+			return
+		}
+		if !allowed && !requireGroupAdmin(c, cmdver.Group) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+type ProcessCheck struct {
+	Process string `json:"process"`
+}
+
+// Requires the authorizer to allow the permission on the process in at least
+// one of the groups the user is in. Site admins always pass, so a process
+// nobody can write to can still be recovered.
+func processPermission(permissionStr string, errorStr string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var processCheck ProcessCheck
+		var rpid int
+		var groups []string
+		user := requestUser(c)
+		db = GetDb()
+
+		rpidErrorChan := make(chan error, 1)
+		groupsErrorChan := make(chan error, 1)
+
+		defer func() {
+			close(rpidErrorChan)
+			close(groupsErrorChan)
+		}()
+
+		if err := c.ShouldBindBodyWith(&processCheck, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if !checkApiKeyScope(c, "", processCheck.Process, permissionStr) {
+			return
+		}
+
+		go conciergedb.GetRpid(processCheck.Process, db, rpidErrorChan, &rpid)
+		if err := <-rpidErrorChan; err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "Cannot find command"})
+			return
+		}
+
+		go conciergedb.GetUserGroups(user, db, groupsErrorChan, &groups)
+		if err := <-groupsErrorChan; err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking permissions"})
+			return
+		}
+		authorizer := GetAuthorizer()
+		now := time.Now()
+		for _, group := range groups {
+			allowed, err := authorizer.Authorize(AuthzRequest{
+				User:       user,
+				Group:      group,
+				Process:    processCheck.Process,
+				Permission: permissionStr,
+				Time:       now,
+			})
+			if err != nil {
+				Logger.Error("Error checking permissions", zap.String("error", err.Error()))
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "Error checking permissions"})
+				return
+			}
+			if allowed {
+				c.Next()
+				return
+			}
+		}
+
+		isSiteAdmin, err := requestHasRole(
+			c,
+			conciergedb.InitConciergeGroups.Site,
+			conciergedb.InitConciergeRoles.Admin,
+		)
+		if err != nil || !isSiteAdmin {
+			auditRequest(c, AuditEntry{
+				Action:  AuditPermissionDenied,
+				Target:  processCheck.Process + ":" + permissionStr,
+				Outcome: AuditDenied,
+			})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": errorStr})
+			return
+		}
+
 		c.Next()
 	}
 }
+
+// Like CanRead, but for routes about the process as a whole rather than one
+// group's use of it
+func CanReadProcess() gin.HandlerFunc {
+	return processPermission("r", "Need read permission")
+}
+
+// Like CanWrite, but for routes about the process as a whole rather than one
+// group's use of it
+func CanWriteProcess() gin.HandlerFunc {
+	return processPermission("w", "Need write permission")
+}